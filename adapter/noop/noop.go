@@ -62,6 +62,10 @@ func (*handler) HandleMetric(context.Context, []*metric.Instance) error {
 }
 
 func (*handler) HandleQuota(ctx context.Context, _ *quota.Instance, args adapter.QuotaArgs) (adapter.QuotaResult, error) {
+	if args.QuotaAmount < 0 {
+		// releases always succeed in full.
+		return adapter.QuotaResult{Amount: -args.QuotaAmount}, nil
+	}
 	return adapter.QuotaResult{
 			ValidDuration: 1000000000 * time.Second,
 			Amount:        args.QuotaAmount,
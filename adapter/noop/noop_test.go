@@ -116,6 +116,11 @@ func TestBasic(t *testing.T) {
 			t.Errorf("Got %d quota, expecting 100", result.Amount)
 		}
 	}
+	if result, err := quotaHandler.HandleQuota(context.TODO(), nil, adapter.QuotaArgs{QuotaAmount: -100}); err != nil {
+		t.Errorf("Got error %v, expecting success", err)
+	} else if result.Amount != 100 {
+		t.Errorf("Got %d released quota, expecting 100", result.Amount)
+	}
 
 	if err := handler.Close(); err != nil {
 		t.Errorf("Got error %v, expecting success", err)
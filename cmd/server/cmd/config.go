@@ -0,0 +1,84 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"istio.io/mixer/cmd/shared"
+	"istio.io/mixer/pkg/config"
+	"istio.io/mixer/pkg/config/migrate"
+	"istio.io/mixer/pkg/config/store"
+	mixerRuntime "istio.io/mixer/pkg/runtime"
+)
+
+func configCmd(printf, fatalf shared.FormatFn) *cobra.Command {
+	cfgCmd := cobra.Command{
+		Use:   "config",
+		Short: "Tools for Mixer configuration",
+	}
+
+	var configStoreURL string
+	opts := migrate.Options{}
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Translate the legacy config of a store into v1alpha2 resources",
+		Long: "Reads the scopes, subjects, adapters and descriptors of the legacy config store, and prints\n" +
+			"the equivalent v1alpha2 resources as yaml. The legacy constructs which can not be translated\n" +
+			"are reported as comments at the beginning of the output.",
+		Run: func(cmd *cobra.Command, args []string) {
+			migrateConfig(configStoreURL, opts, printf, fatalf)
+		},
+	}
+	migrateCmd.PersistentFlags().StringVarP(&configStoreURL, "configStoreURL", "", "",
+		"URL of the legacy config store. May be fs:// for file system, or redis:// for redis url")
+	migrateCmd.PersistentFlags().StringVarP(&opts.Namespace, "namespace", "", mixerRuntime.DefaultConfigNamespace,
+		"Namespace of the translated resources.")
+	migrateCmd.PersistentFlags().StringVarP(&opts.IdentityAttribute, "configIdentityAttribute", "", mixerRuntime.DefaultIdentityAttribute,
+		"Attribute that was used to identify applicable scopes. The subjects of the legacy rules are matched against it.")
+	cfgCmd.AddCommand(migrateCmd)
+
+	return &cfgCmd
+}
+
+func migrateConfig(configStoreURL string, opts migrate.Options, printf, fatalf shared.FormatFn) {
+	if configStoreURL == "" {
+		fatalf("Missing configStoreURL")
+		return
+	}
+	kv, err := store.NewRegistry(config.StoreInventory()...).NewStore(configStoreURL)
+	if err != nil {
+		fatalf("Failed to get config store: %v", err)
+		return
+	}
+	defer kv.Close()
+
+	res, err := migrate.Migrate(kv, opts)
+	if err != nil {
+		fatalf("Failed to migrate config: %v", err)
+		return
+	}
+	data, err := res.YAML()
+	if err != nil {
+		fatalf("Failed to write resources: %v", err)
+		return
+	}
+	for _, issue := range res.Issues {
+		printf("# not translated: %s", issue)
+	}
+	printf("%s", strings.TrimSuffix(string(data), "\n"))
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"istio.io/mixer/pkg/config/migrate"
+)
+
+const legacyRules = `
+rules:
+- selector: source.name == "a"
+  aspects:
+  - kind: quotas
+    params:
+      quotas:
+      - descriptor_name: RequestCount
+  - kind: attributes
+`
+
+const legacyAdapters = `
+adapters:
+- name: default
+  kind: quotas
+  impl: memquota
+`
+
+const migratedConfig = `# not translated: /scopes/global/subjects/global/rules: aspect 1 (attributes) of rule global-0 is not translated: no template replaces the aspect kind
+---
+apiVersion: config.istio.io/v1alpha2
+kind: memquota
+metadata:
+  name: default
+  namespace: istio-system
+spec: {}
+---
+apiVersion: config.istio.io/v1alpha2
+kind: quota
+metadata:
+  name: requestcount
+  namespace: istio-system
+spec: {}
+---
+apiVersion: config.istio.io/v1alpha2
+kind: rule
+metadata:
+  name: global-0
+  namespace: istio-system
+spec:
+  actions:
+  - handler: default.memquota
+    instances:
+    - requestcount.quota
+  match: source.name == "a"`
+
+func TestMigrateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "migrateConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	for path, data := range map[string]string{
+		"scopes/global/adapters.yml":              legacyAdapters,
+		"scopes/global/subjects/global/rules.yml": legacyRules,
+	} {
+		path = filepath.Join(dir, path)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		url       string
+		wantOut   string
+		wantFatal string
+	}{
+		{"migrate", "fs://" + dir, migratedConfig, ""},
+		{"missing url", "", "", "Missing configStoreURL"},
+		{"unknown url", "foo://bar", "", "Failed to get config store"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, fatal bytes.Buffer
+			printf := func(format string, args ...interface{}) {
+				out.WriteString(fmt.Sprintf(format, args...) + "\n")
+			}
+			fatalf := func(format string, args ...interface{}) {
+				fatal.WriteString(fmt.Sprintf(format, args...))
+			}
+			migrateConfig(tt.url, migrate.Options{Namespace: "istio-system", IdentityAttribute: "destination.service"}, printf, fatalf)
+
+			if strings.TrimSpace(out.String()) != strings.TrimSpace(tt.wantOut) {
+				t.Errorf("migrateConfig() = %s, want %s", out.String(), tt.wantOut)
+			}
+			if !strings.Contains(fatal.String(), tt.wantFatal) || tt.wantFatal == "" && fatal.Len() > 0 {
+				t.Errorf("migrateConfig() failed with %s, want %s", fatal.String(), tt.wantFatal)
+			}
+		})
+	}
+}
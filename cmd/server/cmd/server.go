@@ -43,8 +43,10 @@ import (
 	adptr "istio.io/mixer/pkg/adapter"
 	"istio.io/mixer/pkg/adapterManager"
 	"istio.io/mixer/pkg/api"
+	streampb "istio.io/mixer/pkg/api/stream"
 	"istio.io/mixer/pkg/aspect"
 	"istio.io/mixer/pkg/config"
+	"istio.io/mixer/pkg/config/crd"
 	"istio.io/mixer/pkg/config/store"
 	"istio.io/mixer/pkg/expr"
 	"istio.io/mixer/pkg/il/evaluator"
@@ -81,7 +83,16 @@ type serverArgs struct {
 	configFetchIntervalSec        uint
 	configIdentityAttribute       string
 	configIdentityAttributeDomain string
+	configNamespaceExpression     string
+	handlerDrainTimeout           time.Duration
+	maxTargetLabelValues          int
+	configSnapshotHistory         int
+	breakers                      mixerRuntime.BreakerConfig
 	useAst                        bool
+	admissionPort                 uint16
+	admissionCertFile             string
+	admissionKeyFile              string
+	adminPort                     uint16
 
 	// @deprecated
 	serviceConfigFile string
@@ -112,7 +123,20 @@ func (sa *serverArgs) String() string {
 	b.WriteString(fmt.Sprint("configFetchIntervalSec: ", s.configFetchIntervalSec, "\n"))
 	b.WriteString(fmt.Sprint("configIdentityAttribute: ", s.configIdentityAttribute, "\n"))
 	b.WriteString(fmt.Sprint("configIdentityAttributeDomain: ", s.configIdentityAttributeDomain, "\n"))
+	b.WriteString(fmt.Sprint("configNamespaceExpression: ", s.configNamespaceExpression, "\n"))
+	b.WriteString(fmt.Sprint("handlerDrainTimeout: ", s.handlerDrainTimeout, "\n"))
+	b.WriteString(fmt.Sprint("maxTargetLabelValues: ", s.maxTargetLabelValues, "\n"))
+	b.WriteString(fmt.Sprint("configSnapshotHistory: ", s.configSnapshotHistory, "\n"))
+	b.WriteString(fmt.Sprint("breakersDisabled: ", s.breakers.Disabled, "\n"))
+	b.WriteString(fmt.Sprint("breakerWindow: ", s.breakers.Window, "\n"))
+	b.WriteString(fmt.Sprint("breakerMinRequests: ", s.breakers.MinRequests, "\n"))
+	b.WriteString(fmt.Sprint("breakerErrorRatio: ", s.breakers.ErrorRatio, "\n"))
+	b.WriteString(fmt.Sprint("breakerCoolDown: ", s.breakers.CoolDown, "\n"))
 	b.WriteString(fmt.Sprint("useAst: ", s.useAst, "\n"))
+	b.WriteString(fmt.Sprint("admissionPort: ", s.admissionPort, "\n"))
+	b.WriteString(fmt.Sprint("admissionCertFile: ", s.admissionCertFile, "\n"))
+	b.WriteString(fmt.Sprint("admissionKeyFile: ", s.admissionKeyFile, "\n"))
+	b.WriteString(fmt.Sprint("adminPort: ", s.adminPort, "\n"))
 	return b.String()
 }
 
@@ -137,6 +161,10 @@ func serverCmd(info map[string]template.Info, adapters []adptr.InfoFn, legacyAda
 				return fmt.Errorf("adapter worker pool size must be >= 0 and <= 2^31-1, got pool size %d", sa.adapterWorkerPoolSize)
 			}
 
+			if sa.admissionPort != 0 && (sa.admissionCertFile == "" || sa.admissionKeyFile == "") {
+				return fmt.Errorf("admission webhook on port %d requires admissionCertFile and admissionKeyFile", sa.admissionPort)
+			}
+
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
@@ -168,6 +196,15 @@ func serverCmd(info map[string]template.Info, adapters []adptr.InfoFn, legacyAda
 
 	serverCmd.PersistentFlags().StringVarP(&sa.clientCertFiles, "clientCertFiles", "", "", "A set of comma-separated client X509 cert files")
 
+	serverCmd.PersistentFlags().Uint16VarP(&sa.admissionPort, "admissionPort", "", 0,
+		"HTTPS port to use for the admission webhook which validates config changes. 0 disables the webhook.")
+	serverCmd.PersistentFlags().StringVarP(&sa.admissionCertFile, "admissionCertFile", "", "", "The TLS cert file of the admission webhook")
+	_ = serverCmd.MarkPersistentFlagFilename("admissionCertFile")
+	serverCmd.PersistentFlags().StringVarP(&sa.admissionKeyFile, "admissionKeyFile", "", "", "The TLS key file of the admission webhook")
+	_ = serverCmd.MarkPersistentFlagFilename("admissionKeyFile")
+	serverCmd.PersistentFlags().Uint16VarP(&sa.adminPort, "adminPort", "", 0,
+		"HTTP port on localhost to use for admin actions such as config snapshot diffs and rollbacks. 0 disables the actions.")
+
 	// TODO: implement a better option to specify how traces are reported
 	serverCmd.PersistentFlags().StringVarP(&sa.traceOutput, "traceOutput", "t", "",
 		"If the literal string 'STDOUT' or 'STDERR', traces will be produced and written to stdout or stderr respectively. "+
@@ -178,19 +215,37 @@ func serverCmd(info map[string]template.Info, adapters []adptr.InfoFn, legacyAda
 		"URL of the config store. May be fs:// for file system, or redis:// for redis url")
 
 	serverCmd.PersistentFlags().StringVarP(&sa.configStore2URL, "configStore2URL", "", "",
-		"URL of the config store. Use k8s://path_to_kubeconfig or fs:// for file system. If path_to_kubeconfig is empty, in-cluster kubeconfig is used.")
+		"URL of the config store. Use k8s://path_to_kubeconfig (optionally with ?ns=ns1,ns2&label-selector=selector), fs:// for file system, etcd://host:port/prefix for etcd, or layered://?layer=url1&layer=url2 to overlay stores in increasing precedence. If path_to_kubeconfig is empty, in-cluster kubeconfig is used.")
 
 	serverCmd.PersistentFlags().StringVarP(&sa.configDefaultNamespace, "configDefaultNamespace", "", mixerRuntime.DefaultConfigNamespace,
 		"Namespace used to store mesh wide configuration.")
 
-	// Hide configIdentityAttribute and configIdentityAttributeDomain until we have a need to expose it.
 	// These parameters ensure that rest of Mixer makes no assumptions about specific identity attribute.
 	// Rules selection is based on scopes.
-	serverCmd.PersistentFlags().StringVarP(&sa.configIdentityAttribute, "configIdentityAttribute", "", "destination.service",
+	serverCmd.PersistentFlags().StringVarP(&sa.configIdentityAttribute, "configIdentityAttribute", "", mixerRuntime.DefaultIdentityAttribute,
 		"Attribute that is used to identify applicable scopes.")
-	if err := serverCmd.PersistentFlags().MarkHidden("configIdentityAttribute"); err != nil {
-		fatalf("unable to hide: %v", err)
-	}
+	serverCmd.PersistentFlags().StringVarP(&sa.configNamespaceExpression, "configNamespaceExpression", "", "",
+		"Expression evaluated against request attributes to derive the configuration namespace, "+
+			"for example 'destination.namespace | \"default\"'. "+
+			"If empty, the namespace is the second segment of the configIdentityAttribute value.")
+	serverCmd.PersistentFlags().DurationVarP(&sa.handlerDrainTimeout, "handlerDrainTimeout", "", mixerRuntime.DefaultHandlerDrainTimeout,
+		"Time given to handlers removed by a config change to complete in-flight calls before they are closed.")
+	serverCmd.PersistentFlags().IntVarP(&sa.maxTargetLabelValues, "maxTargetLabelValues", "", 0,
+		"Maximum number of distinct target label values in config metrics. Other targets are reported as 'other'. 0 for no limit.")
+	serverCmd.PersistentFlags().IntVarP(&sa.configSnapshotHistory, "configSnapshotHistory", "", mixerRuntime.DefaultSnapshotHistory,
+		"Number of published config snapshots retained for diffs and rollbacks. 0 retains none.")
+	breakers := mixerRuntime.DefaultBreakerConfig()
+	serverCmd.PersistentFlags().BoolVarP(&sa.breakers.Disabled, "breakersDisabled", "", false,
+		"Disable the circuit breakers of handlers. Calls are always dispatched to handlers.")
+	serverCmd.PersistentFlags().DurationVarP(&sa.breakers.Window, "breakerWindow", "", breakers.Window,
+		"Period over which the error rate of a handler is computed by its circuit breaker.")
+	serverCmd.PersistentFlags().IntVarP(&sa.breakers.MinRequests, "breakerMinRequests", "", breakers.MinRequests,
+		"Minimum number of calls to a handler in a breakerWindow before its circuit can open.")
+	serverCmd.PersistentFlags().Float64VarP(&sa.breakers.ErrorRatio, "breakerErrorRatio", "", breakers.ErrorRatio,
+		"Ratio of failed calls to a handler in a breakerWindow that opens its circuit.")
+	serverCmd.PersistentFlags().DurationVarP(&sa.breakers.CoolDown, "breakerCoolDown", "", breakers.CoolDown,
+		"Time the circuit of a handler stays open before a probe call is let through.")
+	// Hide configIdentityAttributeDomain until we have a need to expose it.
 	serverCmd.PersistentFlags().StringVarP(&sa.configIdentityAttributeDomain, "configIdentityAttributeDomain", "", "svc.cluster.local",
 		"The domain to which all values of the configIdentityAttribute belong. For kubernetes services it is svc.cluster.local")
 	if err := serverCmd.PersistentFlags().MarkHidden("configIdentityAttributeDomain"); err != nil {
@@ -284,13 +339,19 @@ func setupServer(sa *serverArgs, info map[string]template.Info, adapters []adptr
 		fatalf("Failed to connect to the configuration server. %v", err)
 	}
 	dispatcher, err = mixerRuntime.New(eval, gp, adapterGP,
-		sa.configIdentityAttribute, sa.configDefaultNamespace,
-		store2, adapterMap, info,
+		sa.configIdentityAttribute, sa.configNamespaceExpression, sa.configDefaultNamespace,
+		sa.handlerDrainTimeout, sa.maxTargetLabelValues, sa.configSnapshotHistory, sa.breakers, store2, adapterMap, info,
 	)
 	if err != nil {
 		fatalf("Failed to create runtime dispatcher. %v", err)
 	}
 
+	if sa.admissionPort != 0 {
+		// config changes are validated against the state of the store, as seen by the dispatcher.
+		v := mixerRuntime.NewValidator(store2, eval, adapterMap, info)
+		startAdmissionServer(sa, crd.AdmissionHandler(v.Kinds(), v), printf)
+	}
+
 	// Legacy Runtime
 	repo := template.NewRepository(info)
 	store := configStore(sa.configStoreURL, sa.serviceConfigFile, sa.globalConfigFile, printf, fatalf)
@@ -354,6 +415,7 @@ func setupServer(sa *serverArgs, info map[string]template.Info, adapters []adptr
 	}
 
 	var interceptors []grpc.UnaryServerInterceptor
+	var streamInterceptors []grpc.StreamServerInterceptor
 
 	if sa.traceOutput != "" {
 		var recorder zt.SpanRecorder
@@ -385,12 +447,15 @@ func setupServer(sa *serverArgs, info map[string]template.Info, adapters []adptr
 		printf("Zipkin traces being sent to %s", sa.traceOutput)
 		ot.InitGlobalTracer(tracer)
 		interceptors = append(interceptors, otgrpc.OpenTracingServerInterceptor(tracer))
+		streamInterceptors = append(streamInterceptors, otgrpc.OpenTracingStreamServerInterceptor(tracer))
 	}
 
 	// setup server prometheus monitoring (as final interceptor in chain)
 	interceptors = append(interceptors, grpc_prometheus.UnaryServerInterceptor)
+	streamInterceptors = append(streamInterceptors, grpc_prometheus.StreamServerInterceptor)
 	grpc_prometheus.EnableHandlingTimeHistogram()
 	grpcOptions = append(grpcOptions, grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(interceptors...)))
+	grpcOptions = append(grpcOptions, grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)))
 
 	configManager.Register(adapterMgr)
 	if !sa.useAst {
@@ -413,6 +478,12 @@ func setupServer(sa *serverArgs, info map[string]template.Info, adapters []adptr
 	// is coming. that design will include proper coverage of statusz/healthz type
 	// functionality, in addition to how mixer reports its own metrics.
 	http.Handle(metricsPath, promhttp.Handler())
+	if dh := mixerRuntime.DebugHandler(dispatcher); dh != nil {
+		http.Handle(mixerRuntime.DebugPath, dh)
+	}
+	if ah := mixerRuntime.AdminHandler(dispatcher); ah != nil && sa.adminPort != 0 {
+		startAdminServer(sa, ah, printf)
+	}
 	http.HandleFunc(versionPath, func(out http.ResponseWriter, req *http.Request) {
 		if _, verErr := out.Write([]byte(version.Info.String())); verErr != nil {
 			printf("error printing version info: %v", verErr)
@@ -431,9 +502,39 @@ func setupServer(sa *serverArgs, info map[string]template.Info, adapters []adptr
 
 	s := api.NewGRPCServer(adapterMgr, dispatcher, gp)
 	mixerpb.RegisterMixerServer(gs, s)
+	if ss, ok := s.(streampb.MixerStreamServer); ok {
+		streampb.RegisterMixerStreamServer(gs, ss)
+	}
 	return &ServerContext{GP: gp, AdapterGP: adapterGP, Server: gs}
 }
 
+// startAdmissionServer serves the admission webhook over HTTPS.
+func startAdmissionServer(sa *serverArgs, h http.Handler, printf shared.FormatFn) {
+	mux := http.NewServeMux()
+	mux.Handle(crd.AdmissionPath, h)
+	admission := &http.Server{Addr: fmt.Sprintf(":%d", sa.admissionPort), Handler: mux}
+	printf("Starting admission webhook on port %d", sa.admissionPort)
+	go func() {
+		if err := admission.ListenAndServeTLS(sa.admissionCertFile, sa.admissionKeyFile); err != nil {
+			printf("admission webhook server error: %v", err)
+		}
+	}()
+}
+
+// startAdminServer serves the admin actions on the loopback interface, apart from
+// the monitoring port which is reachable by everyone that can scrape metrics.
+func startAdminServer(sa *serverArgs, h http.Handler, printf shared.FormatFn) {
+	mux := http.NewServeMux()
+	mux.Handle(mixerRuntime.AdminPath, h)
+	admin := &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", sa.adminPort), Handler: mux}
+	printf("Starting admin server on localhost port %d", sa.adminPort)
+	go func() {
+		if err := admin.ListenAndServe(); err != nil {
+			printf("admin server error: %v", err)
+		}
+	}()
+}
+
 func runServer(sa *serverArgs, info map[string]template.Info, adapters []adptr.InfoFn, legacyAdapters []adptr.RegisterFn, printf, fatalf shared.FormatFn) {
 	printf("Mixer started with\n%s", sa)
 	context := setupServer(sa, info, adapters, legacyAdapters, printf, fatalf)
@@ -18,6 +18,7 @@ import (
 	"istio.io/mixer/cmd/shared"
 	"istio.io/mixer/pkg/adapter"
 	"istio.io/mixer/pkg/expr"
+	mixerRuntime "istio.io/mixer/pkg/runtime"
 	"istio.io/mixer/pkg/template"
 )
 
@@ -41,6 +42,7 @@ var defaultSeverArgs = serverArgs{
 	configFetchIntervalSec:        3,
 	configIdentityAttribute:       "target.service",
 	configIdentityAttributeDomain: "",
+	breakers:                      mixerRuntime.DefaultBreakerConfig(),
 	useAst: false,
 }
 
@@ -64,6 +64,16 @@ gogoslick_proto_library(
     ],
 )
 
+filegroup(
+    name = "mixer/v1_protos",
+    srcs = [
+        "mixer/v1/attributes.proto",
+        "mixer/v1/check.proto",
+        "mixer/v1/report.proto",
+    ],
+    visibility = ["//visibility:public"],
+)
+
 DESCRIPTOR_FILE_GROUP = [
     "mixer/v1/config/descriptor/log_entry_descriptor.proto",
     "mixer/v1/config/descriptor/metric_descriptor.proto",
@@ -90,7 +90,12 @@ type (
 		// UUID is used for retries of the same quota allocation or release call.
 		DeduplicationID string
 
-		// The amount of quota being allocated or released.
+		// The amount of quota being allocated or released. A positive amount
+		// allocates quota. A negative amount releases the absolute amount of
+		// previously allocated quota; handlers release at most the amount in use
+		// and return the amount actually released as a positive QuotaResult.Amount.
+		// Releases are always best effort. Handlers that do not support releases
+		// must treat a negative amount as a no-op rather than an allocation.
 		QuotaAmount int64
 
 		// If true, allows a response to return less quota than requested. When
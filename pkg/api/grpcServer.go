@@ -20,12 +20,16 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/any"
 	rpc "github.com/googleapis/googleapis/google/rpc"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
 	legacyContext "golang.org/x/net/context"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	grpcStatus "google.golang.org/grpc/status"
 
 	mixerpb "istio.io/api/mixer/v1"
 	"istio.io/mixer/pkg/adapter"
@@ -184,12 +188,13 @@ func (s *grpcServer) Check(legacyCtx legacyContext.Context, req *mixerpb.CheckRe
 
 	if status.IsOK(resp.Precondition.Status) && len(req.Quotas) > 0 {
 		resp.Quotas = make(map[string]mixerpb.CheckResponse_QuotaResult, len(req.Quotas))
-		var qr *mixerpb.CheckResponse_QuotaResult
+		results := make(chan *quotaResult, len(req.Quotas))
 
-		// TODO: should dispatch this loop in parallel
-		// WARNING: if this is dispatched in parallel, then we need to do
-		//          use a different protoBag for each individual goroutine
-		//          such that we can get valid usage info for individual attributes.
+		// Each quota is dispatched in parallel on its own protoBag so that
+		// referenced attributes are tracked independently for every quota.
+		// The quotas run on their own goroutines rather than on the worker pool,
+		// since the dispatcher schedules the adapter calls on the same pool and
+		// waits for them.
 		for name, param := range req.Quotas {
 			qma := &aspect.QuotaMethodArgs{
 				Quota:           name,
@@ -197,34 +202,39 @@ func (s *grpcServer) Check(legacyCtx legacyContext.Context, req *mixerpb.CheckRe
 				DeduplicationID: req.DeduplicationId + name,
 				BestEffort:      param.BestEffort,
 			}
-			var err error
-
-			qr, err = quota(legacyCtx, s.dispatcher, compatRespBag, qma)
-			// if quota check fails, set status for the entire request and stop processing.
-			if err != nil {
-				resp.Precondition.Status = status.WithError(err)
-				requestBag.ClearReferencedAttributes()
-				break
+
+			quotaBag := attribute.NewProtoBag(&req.Attributes, s.globalDict, s.globalWordList)
+			quotaRespBag := attribute.GetMutableBag(quotaBag)
+			// carry over attributes produced by the preprocessors.
+			if err := quotaRespBag.Merge(preprocResponseBag); err != nil {
+				glog.Warningf("Unable to carry over preprocessed attributes for quota %s: %v", name, err)
 			}
 
-			// If qma.Quota does not apply to this request give the client what it asked for.
-			// Effectively the quota is unlimited.
-			if qr == nil {
-				qr = &mixerpb.CheckResponse_QuotaResult{
-					ValidDuration: defaultValidDuration,
-					GrantedAmount: qma.Amount,
+			go func() {
+				results <- s.quota(legacyCtx, quotaBag, quotaRespBag, qma, globalWordCount)
+			}()
+		}
+
+		for i := 0; i < len(req.Quotas); i++ {
+			qr := <-results
+			// if quota check fails, set status for the entire request.
+			// The first failure is reported.
+			if qr.err != nil {
+				if status.IsOK(resp.Precondition.Status) {
+					resp.Precondition.Status = status.WithError(qr.err)
 				}
+				continue
 			}
 
 			msg := ""
-			if qr.GrantedAmount == 0 {
+			if qr.amount < 0 {
+				msg = "released"
+			} else if qr.res.GrantedAmount == 0 {
 				msg = "exhausted"
 			}
-			glog.V(1).Infof("AccessLog Quota %s %d/%d %s", dest, qr.GrantedAmount, qma.Amount, msg)
+			glog.V(1).Infof("AccessLog Quota %s %s %d/%d %s", dest, qr.name, qr.res.GrantedAmount, qr.amount, msg)
 
-			qr.ReferencedAttributes = requestBag.GetReferencedAttributes(s.globalDict, globalWordCount)
-			resp.Quotas[name] = *qr
-			requestBag.ClearReferencedAttributes()
+			resp.Quotas[qr.name] = *qr.res
 		}
 	}
 
@@ -234,6 +244,53 @@ func (s *grpcServer) Check(legacyCtx legacyContext.Context, req *mixerpb.CheckRe
 	return resp, nil
 }
 
+// quotaResult is the outcome of a single quota dispatched by Check.
+type quotaResult struct {
+	name   string
+	amount int64
+	res    *mixerpb.CheckResponse_QuotaResult
+	err    error
+}
+
+// quota dispatches a single quota request using the given bags.
+// quotaBag is used exclusively by this quota, which allows references to be tracked per quota.
+// quotaRespBag is released before returning.
+func (s *grpcServer) quota(legacyCtx legacyContext.Context, quotaBag *attribute.ProtoBag, quotaRespBag *attribute.MutableBag,
+	qma *aspect.QuotaMethodArgs, globalWordCount int) *quotaResult {
+	defer quotaRespBag.Done()
+
+	out := &quotaResult{
+		name:   qma.Quota,
+		amount: qma.Amount,
+	}
+
+	var qr *mixerpb.CheckResponse_QuotaResult
+	var err error
+	// compatBag ensures that quota input handles deprecated attributes gracefully.
+	if qma.Amount < 0 {
+		qr, err = release(legacyCtx, s.dispatcher, &compatBag{quotaRespBag}, qma)
+	} else {
+		qr, err = quota(legacyCtx, s.dispatcher, &compatBag{quotaRespBag}, qma)
+	}
+	if err != nil {
+		out.err = err
+		return out
+	}
+
+	// If qma.Quota does not apply to this request give the client what it asked for.
+	// Effectively the quota is unlimited.
+	if qr == nil {
+		qr = &mixerpb.CheckResponse_QuotaResult{
+			ValidDuration: defaultValidDuration,
+			GrantedAmount: qma.Amount,
+		}
+	}
+
+	qr.ReferencedAttributes = quotaBag.GetReferencedAttributes(s.globalDict, globalWordCount)
+	out.res = qr
+	return out
+}
+
 func quota(legacyCtx legacyContext.Context, d runtime.Dispatcher, bag attribute.Bag,
 	qma *aspect.QuotaMethodArgs) (*mixerpb.CheckResponse_QuotaResult, error) {
 	if d == nil {
@@ -260,9 +317,41 @@ func quota(legacyCtx legacyContext.Context, d runtime.Dispatcher, bag attribute.
 	}, nil
 }
 
+// release returns unused quota to the adapters.
+// A quota request with a negative amount is a release of the absolute amount.
+// The amount actually released is reported as a negative GrantedAmount.
+func release(legacyCtx legacyContext.Context, d runtime.Dispatcher, bag attribute.Bag,
+	qma *aspect.QuotaMethodArgs) (*mixerpb.CheckResponse_QuotaResult, error) {
+	if d == nil {
+		return nil, nil
+	}
+	rqma := *qma
+	rqma.Amount = -qma.Amount
+
+	glog.V(1).Infof("Dispatching ReleaseQuota: %s", qma.Quota)
+	qmr, err := d.ReleaseQuota(legacyCtx, bag, &rqma)
+	if err != nil {
+		glog.Warningf("ReleaseQuota %s returned error: %v", qma.Quota, err)
+		return nil, err
+	}
+
+	if qmr == nil { // no quota applied for the given request
+		return nil, nil
+	}
+
+	if glog.V(2) {
+		glog.Infof("ReleaseQuota %s returned: %v", qma.Quota, qmr)
+	}
+	return &mixerpb.CheckResponse_QuotaResult{
+		GrantedAmount: -qmr.Amount,
+	}, nil
+}
+
 var reportResp = &mixerpb.ReportResponse{}
 
-// Report is the entry point for the external Report method
+// Report is the entry point for the external Report method.
+// Every attribute block is processed even if some of them fail.
+// If any block fails, the returned error identifies the failed blocks.
 func (s *grpcServer) Report(legacyCtx legacyContext.Context, req *mixerpb.ReportRequest) (*mixerpb.ReportResponse, error) {
 	if len(req.Attributes) == 0 {
 		// early out
@@ -270,85 +359,171 @@ func (s *grpcServer) Report(legacyCtx legacyContext.Context, req *mixerpb.Report
 	}
 
 	// apply the request-level word list to each attribute message if needed
+	applyDefaultWords(req)
+
+	protoBag := attribute.NewProtoBag(&req.Attributes[0], s.globalDict, s.globalWordList)
+	requestBag := attribute.GetMutableBag(protoBag)
+
+	// the first attribute block is handled by the protoBag as a foundation,
+	// deltas are applied to the child bag (i.e. requestBag)
+	out := s.processReport(legacyCtx, req, requestBag, 1)
+
+	requestBag.Done()
+	protoBag.Done()
+
+	if !status.IsOK(out) {
+		return nil, makeGRPCError(out)
+	}
+
+	return reportResp, nil
+}
+
+// applyDefaultWords applies the request-level word list to each attribute message if needed.
+func applyDefaultWords(req *mixerpb.ReportRequest) {
 	for i := 0; i < len(req.Attributes); i++ {
 		if len(req.Attributes[i].Words) == 0 {
 			req.Attributes[i].Words = req.DefaultWords
 		}
 	}
+}
 
-	protoBag := attribute.NewProtoBag(&req.Attributes[0], s.globalDict, s.globalWordList)
-	requestBag := attribute.GetMutableBag(protoBag)
+// processReport dispatches every attribute block of the request.
+// Attribute blocks starting at index firstDelta are applied as deltas to requestBag.
+// Processing continues past failing blocks; the returned status identifies all failed blocks.
+func (s *grpcServer) processReport(legacyCtx legacyContext.Context, req *mixerpb.ReportRequest,
+	requestBag *attribute.MutableBag, firstDelta int) rpc.Status {
 	// compatReqBag ensures that preprocessor input handles deprecated attributes gracefully.
 	compatReqBag := &compatBag{requestBag}
 	preprocResponseBag := attribute.GetMutableBag(requestBag)
 	// compatRespBag ensures that report input handles deprecated attributes gracefully.
 	compatRespBag := &compatBag{preprocResponseBag}
 
-	var err error
+	// failed records the attribute blocks that could not be processed.
+	var failed *rpc.BadRequest
+	code := rpc.OK
+
 	for i := 0; i < len(req.Attributes); i++ {
 		span, newctx := opentracing.StartSpanFromContext(legacyCtx, fmt.Sprintf("Attributes %d", i))
 
-		// the first attribute block is handled by the protoBag as a foundation,
-		// deltas are applied to the child bag (i.e. requestBag)
-		if i > 0 {
-			err = requestBag.UpdateBagFromProto(&req.Attributes[i], s.globalWordList)
-			if err != nil {
-				msg := "Request could not be processed due to invalid attributes."
-				glog.Error(msg, "\n", err)
-				details := status.NewBadRequest("attributes", err)
-				err = makeGRPCError(status.InvalidWithDetails(msg, details))
-				break
-			}
+		var delta *mixerpb.CompressedAttributes
+		if i >= firstDelta {
+			delta = &req.Attributes[i]
 		}
 
-		glog.V(1).Info("Dispatching Preprocess")
-		out := s.aspectDispatcher.Preprocess(newctx, compatReqBag, preprocResponseBag)
+		out := s.reportBlock(newctx, i, len(req.Attributes), delta, requestBag, compatReqBag, preprocResponseBag, compatRespBag)
+		preprocResponseBag.Reset()
+
 		if !status.IsOK(out) {
-			glog.Error("Preprocess returned with: ", status.String(out))
-			err = makeGRPCError(out)
-			span.LogFields(log.String("error", err.Error()))
+			span.LogFields(log.String("error", status.String(out)))
 			span.Finish()
-			break
-		}
-		glog.V(1).Info("Preprocess returned with: ", status.String(out))
+			reportBlocks.With(prometheus.Labels{outcomeStr: outcomeDropped}).Inc()
 
-		if glog.V(2) {
-			glog.Info("Dispatching to main adapters after running processors")
-			glog.Infof("Attribute Bag: \n%s", preprocResponseBag.DebugString())
+			if failed == nil {
+				failed = &rpc.BadRequest{}
+				// the first failure's code becomes the code of the response.
+				code = rpc.Code(out.Code)
+			}
+			failed.FieldViolations = append(failed.FieldViolations, &rpc.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("attributes[%d]", i),
+				Description: out.Message,
+			})
+			continue
 		}
 
-		glog.V(1).Infof("Dispatching Report %d out of %d", i, len(req.Attributes))
-		err = s.dispatcher.Report(legacyCtx, compatRespBag)
+		reportBlocks.With(prometheus.Labels{outcomeStr: outcomeDelivered}).Inc()
+		span.LogFields(log.String("success", fmt.Sprintf("finished Report for attribute bag %d", i)))
+		span.Finish()
+	}
+
+	preprocResponseBag.Done()
+
+	if failed == nil {
+		return status.OK
+	}
+
+	msg := reportFailureMessage(failed, len(req.Attributes))
+	glog.Error(msg)
+	return status.WithDetails(code, msg, failed)
+}
+
+// reportBlock processes the attribute block at index i out of n.
+// If delta is not nil it is applied to requestBag before dispatching.
+func (s *grpcServer) reportBlock(ctx legacyContext.Context, i int, n int, delta *mixerpb.CompressedAttributes,
+	requestBag *attribute.MutableBag, compatReqBag attribute.Bag,
+	preprocResponseBag *attribute.MutableBag, compatRespBag attribute.Bag) rpc.Status {
+	if delta != nil {
+		// The delta is decoded on its own, so that a block which fails to decode
+		// leaves requestBag unchanged for the deltas of the subsequent blocks.
+		deltaBag, err := attribute.GetBagFromProto(delta, s.globalWordList)
 		if err != nil {
-			out = status.WithError(err)
-			glog.Warningf("Report returned %v", err)
+			msg := "Request could not be processed due to invalid attributes."
+			glog.Error(msg, "\n", err)
+			return status.WithInvalidArgument(fmt.Sprintf("%s %v", msg, err))
 		}
-
-		if !status.IsOK(out) {
-			glog.Errorf("Report %d returned with: %s", i, status.String(out))
-			err = makeGRPCError(out)
-			span.LogFields(log.String("error", err.Error()))
-			span.Finish()
-			break
+		err = requestBag.Merge(deltaBag)
+		deltaBag.Done()
+		if err != nil {
+			return status.WithInternal(err.Error())
 		}
-		glog.V(1).Infof("Report %d returned with: %s", i, status.String(out))
+	}
 
-		span.LogFields(log.String("success", fmt.Sprintf("finished Report for attribute bag %d", i)))
-		span.Finish()
-		preprocResponseBag.Reset()
+	glog.V(1).Info("Dispatching Preprocess")
+	out := s.aspectDispatcher.Preprocess(ctx, compatReqBag, preprocResponseBag)
+	if !status.IsOK(out) {
+		glog.Error("Preprocess returned with: ", status.String(out))
+		return out
 	}
+	glog.V(1).Info("Preprocess returned with: ", status.String(out))
 
-	preprocResponseBag.Done()
-	requestBag.Done()
-	protoBag.Done()
+	if glog.V(2) {
+		glog.Info("Dispatching to main adapters after running processors")
+		glog.Infof("Attribute Bag: \n%s", preprocResponseBag.DebugString())
+	}
 
-	if err != nil {
-		return nil, err
+	glog.V(1).Infof("Dispatching Report %d out of %d", i, n)
+	if err := s.dispatcher.Report(ctx, compatRespBag); err != nil {
+		glog.Warningf("Report returned %v", err)
+		out = status.WithError(err)
 	}
 
-	return reportResp, nil
+	if !status.IsOK(out) {
+		glog.Errorf("Report %d returned with: %s", i, status.String(out))
+		return out
+	}
+	glog.V(1).Infof("Report %d returned with: %s", i, status.String(out))
+	return out
 }
 
+// reportFailureMessage summarizes failed attribute blocks.
+func reportFailureMessage(failed *rpc.BadRequest, total int) string {
+	buf := pool.GetBuffer()
+	fmt.Fprintf(buf, "%d of %d attribute blocks could not be processed: ", len(failed.FieldViolations), total)
+	for i, fv := range failed.FieldViolations {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(fv.Field + ": " + fv.Description)
+	}
+	msg := buf.String()
+	pool.PutBuffer(buf)
+	return msg
+}
+
+// makeGRPCError converts status into a gRPC error, the details of status are
+// carried along so that clients can inspect them.
 func makeGRPCError(status rpc.Status) error {
-	return grpc.Errorf(codes.Code(status.Code), status.Message)
+	if len(status.Details) == 0 {
+		return grpc.Errorf(codes.Code(status.Code), status.Message)
+	}
+
+	// the gRPC status is based on golang/protobuf types, while rpc.Status uses gogo types.
+	s := &spb.Status{
+		Code:    status.Code,
+		Message: status.Message,
+		Details: make([]*any.Any, 0, len(status.Details)),
+	}
+	for _, d := range status.Details {
+		s.Details = append(s.Details, &any.Any{TypeUrl: d.TypeUrl, Value: d.Value})
+	}
+	return grpcStatus.FromProto(s).Err()
 }
@@ -20,15 +20,19 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	rpc "github.com/googleapis/googleapis/google/rpc"
 	"google.golang.org/grpc"
+	grpcStatus "google.golang.org/grpc/status"
 
 	mixerpb "istio.io/api/mixer/v1"
 	"istio.io/mixer/pkg/adapter"
 	"istio.io/mixer/pkg/adapterManager"
+	streampb "istio.io/mixer/pkg/api/stream"
 	"istio.io/mixer/pkg/aspect"
 	"istio.io/mixer/pkg/attribute"
 	"istio.io/mixer/pkg/pool"
@@ -62,15 +66,17 @@ func (l *legacyDispatcher) Quota(_ context.Context, requestBag attribute.Bag,
 }
 
 type testState struct {
-	client     mixerpb.MixerClient
-	connection *grpc.ClientConn
-	gs         *grpc.Server
-	gp         *pool.GoroutinePool
-	s          *grpcServer
+	client       mixerpb.MixerClient
+	streamClient streampb.MixerStreamClient
+	connection   *grpc.ClientConn
+	gs           *grpc.Server
+	gp           *pool.GoroutinePool
+	s            *grpcServer
 
 	check   checkCallback
 	report  reportCallback
 	quota   quotaCallback
+	release quotaCallback
 	preproc preprocCallback
 
 	legacy *legacyDispatcher
@@ -96,6 +102,7 @@ func (ts *testState) createGRPCServer() (string, error) {
 	ms := NewGRPCServer(ts.legacy, ts, ts.gp)
 	ts.s = ms.(*grpcServer)
 	mixerpb.RegisterMixerServer(ts.gs, ts.s)
+	streampb.RegisterMixerStreamServer(ts.gs, ts.s)
 
 	go func() {
 		_ = ts.gs.Serve(listener)
@@ -119,12 +126,14 @@ func (ts *testState) createAPIClient(dial string) error {
 	}
 
 	ts.client = mixerpb.NewMixerClient(ts.connection)
+	ts.streamClient = streampb.NewMixerStreamClient(ts.connection)
 	return nil
 }
 
 func (ts *testState) deleteAPIClient() {
 	_ = ts.connection.Close()
 	ts.client = nil
+	ts.streamClient = nil
 	ts.connection = nil
 }
 
@@ -171,6 +180,12 @@ func (ts *testState) Quota(ctx context.Context, bag attribute.Bag,
 	return ts.quota(ctx, bag, qma)
 }
 
+func (ts *testState) ReleaseQuota(ctx context.Context, bag attribute.Bag,
+	qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
+
+	return ts.release(ctx, bag, qma)
+}
+
 func (ts *testState) Preprocess(ctx context.Context, req attribute.Bag, resp *attribute.MutableBag) error {
 	return ts.preproc(ctx, req, resp)
 }
@@ -288,6 +303,188 @@ func TestCheckQuota(t *testing.T) {
 	}
 }
 
+func TestCheckMultipleQuotas(t *testing.T) {
+	ts, err := prepTestState()
+	if err != nil {
+		t.Fatalf("Unable to prep test state: %v", err)
+	}
+	defer ts.cleanupTestState()
+
+	ts.check = func(ctx context.Context, requestBag attribute.Bag) (*adapter.CheckResult, error) {
+		return &adapter.CheckResult{
+			Status: status.OK,
+		}, nil
+	}
+
+	// each quota references a different attribute.
+	quotaAttrs := map[string]string{
+		"RequestCount": "A1",
+		"RequestBytes": "A2",
+		"Connections":  "A3",
+	}
+
+	ts.quota = func(ctx context.Context, requestBag attribute.Bag, qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
+		v, _ := requestBag.Get(quotaAttrs[qma.Quota])
+		return &adapter.QuotaResult{
+			Amount: v.(int64),
+		}, nil
+	}
+
+	attr0 := mixerpb.CompressedAttributes{
+		Words: []string{"A1", "A2", "A3"},
+		Int64S: map[int32]int64{
+			-1: 25,
+			-2: 26,
+			-3: 27,
+		},
+	}
+
+	request := mixerpb.CheckRequest{Attributes: attr0}
+	request.Quotas = make(map[string]mixerpb.CheckRequest_QuotaParams)
+	for name := range quotaAttrs {
+		request.Quotas[name] = mixerpb.CheckRequest_QuotaParams{Amount: 100}
+	}
+
+	response, err := ts.client.Check(context.Background(), &request)
+	if err != nil {
+		t.Fatalf("Got %v, expected success", err)
+	}
+	if !status.IsOK(response.Precondition.Status) {
+		t.Fatalf("Got unexpected failure %s", response.Precondition.Status)
+	}
+
+	want := map[string]int64{
+		"RequestCount": 25,
+		"RequestBytes": 26,
+		"Connections":  27,
+	}
+	for name, amount := range want {
+		qr, found := response.Quotas[name]
+		if !found {
+			t.Errorf("Quota %s not found in response", name)
+			continue
+		}
+		if qr.GrantedAmount != amount {
+			t.Errorf("%s: got %v granted amount, expecting %v", name, qr.GrantedAmount, amount)
+		}
+		// only the attribute referenced by the quota is reported.
+		if len(qr.ReferencedAttributes.AttributeMatches) != 1 {
+			t.Errorf("%s: got %d referenced attributes, expecting 1: %v", name,
+				len(qr.ReferencedAttributes.AttributeMatches), qr.ReferencedAttributes)
+		}
+	}
+
+	ts.quota = func(ctx context.Context, requestBag attribute.Bag, qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
+		if qma.Quota == "RequestBytes" {
+			return nil, errors.New("quota failure")
+		}
+		return &adapter.QuotaResult{
+			Amount: 42,
+		}, nil
+	}
+
+	response, err = ts.client.Check(context.Background(), &request)
+	if err != nil {
+		t.Fatalf("Got %v, expected success", err)
+	}
+	if status.IsOK(response.Precondition.Status) {
+		t.Error("Got precondition success, expected error")
+	}
+	if _, found := response.Quotas["RequestBytes"]; found {
+		t.Error("Failed quota RequestBytes unexpectedly found in response")
+	}
+}
+
+func TestCheckQuotasSmallPool(t *testing.T) {
+	ts, err := prepTestState()
+	if err != nil {
+		t.Fatalf("Unable to prep test state: %v", err)
+	}
+	defer ts.cleanupTestState()
+
+	// a single worker, which the dispatcher also schedules the adapter calls on.
+	gp := pool.NewGoroutinePool(1, false)
+	defer gp.Close()
+	ts.s.gp = gp
+
+	ts.check = func(ctx context.Context, requestBag attribute.Bag) (*adapter.CheckResult, error) {
+		return &adapter.CheckResult{
+			Status: status.OK,
+		}, nil
+	}
+	ts.quota = func(ctx context.Context, requestBag attribute.Bag, qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
+		done := make(chan struct{})
+		gp.ScheduleWork(func() { close(done) })
+		<-done
+		return &adapter.QuotaResult{
+			Amount: qma.Amount,
+		}, nil
+	}
+
+	request := mixerpb.CheckRequest{Quotas: make(map[string]mixerpb.CheckRequest_QuotaParams)}
+	for i := 0; i < 8; i++ {
+		request.Quotas[fmt.Sprintf("Quota%d", i)] = mixerpb.CheckRequest_QuotaParams{Amount: 10}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	response, err := ts.client.Check(ctx, &request)
+	if err != nil {
+		t.Fatalf("Got %v, expected success", err)
+	}
+	if len(response.Quotas) != len(request.Quotas) {
+		t.Errorf("Got %d quotas, expecting %d", len(response.Quotas), len(request.Quotas))
+	}
+}
+
+func TestCheckQuotaRelease(t *testing.T) {
+	ts, err := prepTestState()
+	if err != nil {
+		t.Fatalf("Unable to prep test state: %v", err)
+	}
+	defer ts.cleanupTestState()
+
+	ts.check = func(ctx context.Context, requestBag attribute.Bag) (*adapter.CheckResult, error) {
+		return &adapter.CheckResult{
+			Status: status.OK,
+		}, nil
+	}
+
+	ts.quota = func(ctx context.Context, requestBag attribute.Bag, qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
+		t.Errorf("Quota called for %s, expected ReleaseQuota", qma.Quota)
+		return nil, nil
+	}
+
+	var released *aspect.QuotaMethodArgs
+	ts.release = func(ctx context.Context, requestBag attribute.Bag, qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
+		released = qma
+		return &adapter.QuotaResult{
+			Amount: 3,
+		}, nil
+	}
+
+	request := mixerpb.CheckRequest{DeduplicationId: "dedup1"}
+	request.Quotas = make(map[string]mixerpb.CheckRequest_QuotaParams)
+	request.Quotas["InFlight"] = mixerpb.CheckRequest_QuotaParams{Amount: -5}
+
+	response, err := ts.client.Check(context.Background(), &request)
+	if err != nil {
+		t.Fatalf("Got %v, expected success", err)
+	}
+	if !status.IsOK(response.Precondition.Status) {
+		t.Fatalf("Got unexpected failure %s", response.Precondition.Status)
+	}
+	if released == nil {
+		t.Fatal("ReleaseQuota was not called")
+	}
+	if released.Amount != 5 || released.DeduplicationID != "dedup1InFlight" {
+		t.Errorf("Got release args %v, expecting amount 5 and deduplication id dedup1InFlight", *released)
+	}
+	if response.Quotas["InFlight"].GrantedAmount != -3 {
+		t.Errorf("Got %v granted amount, expecting -3", response.Quotas["InFlight"].GrantedAmount)
+	}
+}
+
 func TestReport(t *testing.T) {
 	ts, err := prepTestState()
 	if err != nil {
@@ -365,6 +562,153 @@ func TestReport(t *testing.T) {
 	}
 }
 
+func TestReportPartialFailure(t *testing.T) {
+	ts, err := prepTestState()
+	if err != nil {
+		t.Fatalf("Unable to prep test state: %v", err)
+	}
+	defer ts.cleanupTestState()
+
+	attr0 := mixerpb.CompressedAttributes{
+		Words: []string{"A1"},
+		Int64S: map[int32]int64{
+			-1: 0,
+		},
+	}
+	attr1 := mixerpb.CompressedAttributes{
+		Words: []string{"A1"},
+		Int64S: map[int32]int64{
+			-1: 1,
+		},
+	}
+	attr2 := mixerpb.CompressedAttributes{
+		Words: []string{"A1"},
+		Int64S: map[int32]int64{
+			-1: 2,
+		},
+	}
+	// refers to an undefined word.
+	badAttr := mixerpb.CompressedAttributes{
+		Words: []string{"A1"},
+		Int64S: map[int32]int64{
+			-42: 3,
+		},
+	}
+
+	var reported []int64
+	ts.report = func(ctx context.Context, requestBag attribute.Bag) error {
+		v, _ := requestBag.Get("A1")
+		reported = append(reported, v.(int64))
+		if v.(int64) == 1 {
+			return errors.New("report failure")
+		}
+		return nil
+	}
+
+	request := mixerpb.ReportRequest{Attributes: []mixerpb.CompressedAttributes{attr0, attr1, badAttr, attr2}}
+	_, err = ts.client.Report(context.Background(), &request)
+	if err == nil {
+		t.Fatal("Got success, expected failure")
+	}
+
+	// all valid blocks are delivered, even after a failure.
+	if len(reported) != 3 || reported[0] != 0 || reported[1] != 1 || reported[2] != 2 {
+		t.Errorf("Got reported values %v, expected [0 1 2]", reported)
+	}
+
+	for _, want := range []string{"2 of 4", "attributes[1]", "report failure", "attributes[2]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("'%s' doesn't contain '%s'", err.Error(), want)
+		}
+	}
+	for _, notWant := range []string{"attributes[0]", "attributes[3]"} {
+		if strings.Contains(err.Error(), notWant) {
+			t.Errorf("'%s' unexpectedly contains '%s'", err.Error(), notWant)
+		}
+	}
+
+	// the failed blocks are also reported as details of the status.
+	st, ok := grpcStatus.FromError(err)
+	if !ok {
+		t.Fatalf("Got %v, expected a gRPC status", err)
+	}
+	details := st.Proto().Details
+	if len(details) != 1 || !strings.HasSuffix(details[0].TypeUrl, "google.rpc.BadRequest") {
+		t.Fatalf("Got details %v, expected a single BadRequest", details)
+	}
+	failed := &rpc.BadRequest{}
+	if err = failed.Unmarshal(details[0].Value); err != nil {
+		t.Fatalf("Unable to unmarshal details: %v", err)
+	}
+	var fields []string
+	for _, fv := range failed.FieldViolations {
+		fields = append(fields, fv.Field)
+	}
+	if len(fields) != 2 || fields[0] != "attributes[1]" || fields[1] != "attributes[2]" {
+		t.Errorf("Got failed fields %v, expected [attributes[1] attributes[2]]", fields)
+	}
+}
+
+func TestReportFailedDelta(t *testing.T) {
+	ts, err := prepTestState()
+	if err != nil {
+		t.Fatalf("Unable to prep test state: %v", err)
+	}
+	defer ts.cleanupTestState()
+
+	attr0 := mixerpb.CompressedAttributes{
+		Words:   []string{"A1", "A2", "good"},
+		Int64S:  map[int32]int64{-1: 0},
+		Strings: map[int32]int32{-2: -3},
+	}
+	// string attributes are decoded before the undefined word is found.
+	badAttr := mixerpb.CompressedAttributes{
+		Words:   []string{"A1", "A2", "bad"},
+		Strings: map[int32]int32{-2: -3},
+		Int64S:  map[int32]int64{-42: 1},
+	}
+	attr2 := mixerpb.CompressedAttributes{
+		Words:  []string{"A1"},
+		Int64S: map[int32]int64{-1: 2},
+	}
+
+	reported := map[int64]string{}
+	ts.report = func(ctx context.Context, requestBag attribute.Bag) error {
+		v1, _ := requestBag.Get("A1")
+		v2, _ := requestBag.Get("A2")
+		reported[v1.(int64)] = v2.(string)
+		return nil
+	}
+
+	request := mixerpb.ReportRequest{Attributes: []mixerpb.CompressedAttributes{attr0, badAttr, attr2}}
+	if _, err = ts.client.Report(context.Background(), &request); err == nil {
+		t.Fatal("Got success, expected failure")
+	}
+	if !strings.Contains(err.Error(), "attributes[1]") {
+		t.Errorf("'%s' doesn't contain 'attributes[1]'", err.Error())
+	}
+
+	// the block after the failed one is applied on the last valid block.
+	want := map[int64]string{0: "good", 2: "good"}
+	if !reflect.DeepEqual(reported, want) {
+		t.Errorf("Got reported values %v, expected %v", reported, want)
+	}
+}
+
+func TestReportFailureMessage(t *testing.T) {
+	failed := &rpc.BadRequest{
+		FieldViolations: []*rpc.BadRequest_FieldViolation{
+			{Field: "attributes[1]", Description: "bad"},
+			{Field: "attributes[3]", Description: "worse"},
+		},
+	}
+
+	want := "2 of 5 attribute blocks could not be processed: attributes[1]: bad; attributes[3]: worse"
+	if got := reportFailureMessage(failed, 5); got != want {
+		t.Errorf("Got '%s', expected '%s'", got, want)
+	}
+}
+
 func TestUnknownStatus(t *testing.T) {
 	ts, err := prepTestState()
 	if err != nil {
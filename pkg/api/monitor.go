@@ -0,0 +1,40 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	outcomeStr = "outcome"
+
+	outcomeDelivered = "delivered"
+	outcomeDropped   = "dropped"
+)
+
+var (
+	reportBlocks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "api",
+			Name:      "report_attribute_blocks",
+			Help:      "Total number of Report attribute blocks processed by Mixer, by outcome.",
+		}, []string{outcomeStr})
+)
+
+func init() {
+	prometheus.MustRegister(reportBlocks)
+}
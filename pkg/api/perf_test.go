@@ -162,6 +162,16 @@ func (bs *benchState) Quota(ctx context.Context, requestBag attribute.Bag,
 	return qr, nil
 }
 
+func (bs *benchState) ReleaseQuota(ctx context.Context, requestBag attribute.Bag,
+	qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
+
+	qr := &adapter.QuotaResult{
+		Status: status.OK,
+		Amount: qma.Amount,
+	}
+	return qr, nil
+}
+
 func (bs *benchState) legacyQuota(_ attribute.Bag, _ *aspect.QuotaMethodArgs) (*aspect.QuotaMethodResp, rpc.Status) {
 	qmr := &aspect.QuotaMethodResp{Amount: 42}
 	return qmr, status.OK
@@ -0,0 +1,88 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"io"
+
+	"github.com/golang/glog"
+	rpc "github.com/googleapis/googleapis/google/rpc"
+	"google.golang.org/grpc"
+
+	mixerpb "istio.io/api/mixer/v1"
+	streampb "istio.io/mixer/pkg/api/stream"
+	"istio.io/mixer/pkg/attribute"
+	"istio.io/mixer/pkg/status"
+)
+
+// ReportStream is the entry point for the streaming Report method.
+// Attributes are retained for the lifetime of the stream: every attribute block
+// received on the stream is applied as a delta to all the attributes received before it.
+// Clients therefore only need to send attributes that changed since the previous block.
+// A failed request is reported in its acknowledgement and does not terminate the stream.
+func (s *grpcServer) ReportStream(stream streampb.MixerStream_ReportStreamServer) error {
+	requestBag := attribute.GetMutableBag(nil)
+	defer requestBag.Done()
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			glog.Warningf("Report stream receive failed: %v", err)
+			return err
+		}
+
+		applyDefaultWords(req)
+		out := s.processReport(stream.Context(), req, requestBag, 0)
+
+		if err = stream.Send(&out); err != nil {
+			glog.Warningf("Report stream send failed: %v", err)
+			return err
+		}
+	}
+}
+
+// CheckStream is the entry point for the streaming Check method.
+// Check requests are not delta encoded, since referenced attributes are tracked per request.
+// A failed request is reported in the precondition status of its response and
+// does not terminate the stream.
+func (s *grpcServer) CheckStream(stream streampb.MixerStream_CheckStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			glog.Warningf("Check stream receive failed: %v", err)
+			return err
+		}
+
+		resp, err := s.Check(stream.Context(), req)
+		if err != nil {
+			resp = &mixerpb.CheckResponse{
+				Precondition: mixerpb.CheckResponse_PreconditionResult{
+					Status: status.WithMessage(rpc.Code(grpc.Code(err)), grpc.ErrorDesc(err)),
+				},
+			}
+		}
+
+		if err = stream.Send(resp); err != nil {
+			glog.Warningf("Check stream send failed: %v", err)
+			return err
+		}
+	}
+}
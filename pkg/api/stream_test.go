@@ -0,0 +1,155 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	mixerpb "istio.io/api/mixer/v1"
+	"istio.io/mixer/pkg/adapter"
+	"istio.io/mixer/pkg/attribute"
+	"istio.io/mixer/pkg/status"
+)
+
+func TestReportStream(t *testing.T) {
+	ts, err := prepTestState()
+	if err != nil {
+		t.Fatalf("Unable to prep test state: %v", err)
+	}
+	defer ts.cleanupTestState()
+
+	type values struct {
+		a1, a2 int64
+	}
+	var reported []values
+	ts.report = func(ctx context.Context, requestBag attribute.Bag) error {
+		v1, _ := requestBag.Get("A1")
+		v2, _ := requestBag.Get("A2")
+		reported = append(reported, values{v1.(int64), v2.(int64)})
+		if v2.(int64) == 0 {
+			return errors.New("report failure")
+		}
+		return nil
+	}
+
+	stream, err := ts.streamClient.ReportStream(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to open report stream: %v", err)
+	}
+
+	// only the first message carries all attributes,
+	// subsequent messages carry changed attributes only.
+	requests := []mixerpb.ReportRequest{
+		{
+			DefaultWords: []string{"A1", "A2"},
+			Attributes: []mixerpb.CompressedAttributes{
+				{Int64S: map[int32]int64{-1: 1, -2: 10}},
+				{Int64S: map[int32]int64{-2: 11}},
+			},
+		},
+		{
+			Attributes: []mixerpb.CompressedAttributes{
+				{Words: []string{"A2"}, Int64S: map[int32]int64{-1: 0}},
+			},
+		},
+		{
+			Attributes: []mixerpb.CompressedAttributes{
+				{Words: []string{"A1"}, Int64S: map[int32]int64{-1: 2}},
+			},
+		},
+	}
+	wantOK := []bool{true, false, true}
+
+	for i := range requests {
+		if err = stream.Send(&requests[i]); err != nil {
+			t.Fatalf("Unable to send request %d: %v", i, err)
+		}
+		ack, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Unable to receive ack %d: %v", i, err)
+		}
+		if status.IsOK(*ack) != wantOK[i] {
+			t.Errorf("Got ack %d %v, want ok %v", i, ack, wantOK[i])
+		}
+		if !wantOK[i] && !strings.Contains(ack.Message, "report failure") {
+			t.Errorf("'%s' doesn't contain 'report failure'", ack.Message)
+		}
+	}
+
+	if err = stream.CloseSend(); err != nil {
+		t.Fatalf("Unable to close stream: %v", err)
+	}
+	if _, err = stream.Recv(); err != io.EOF {
+		t.Errorf("Got %v, expected EOF", err)
+	}
+
+	want := []values{{1, 10}, {1, 11}, {1, 0}, {2, 0}}
+	if len(reported) != len(want) {
+		t.Fatalf("Got %v, want %v", reported, want)
+	}
+	for i := range want {
+		if reported[i] != want[i] {
+			t.Errorf("Report %d: got %v, want %v", i, reported[i], want[i])
+		}
+	}
+}
+
+func TestCheckStream(t *testing.T) {
+	ts, err := prepTestState()
+	if err != nil {
+		t.Fatalf("Unable to prep test state: %v", err)
+	}
+	defer ts.cleanupTestState()
+
+	ts.check = func(ctx context.Context, requestBag attribute.Bag) (*adapter.CheckResult, error) {
+		v, _ := requestBag.Get("A1")
+		if v.(int64) != 1 {
+			return &adapter.CheckResult{Status: status.WithPermissionDenied("denied")}, nil
+		}
+		return &adapter.CheckResult{Status: status.OK}, nil
+	}
+
+	stream, err := ts.streamClient.CheckStream(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to open check stream: %v", err)
+	}
+
+	for i, want := range []bool{true, false} {
+		req := mixerpb.CheckRequest{
+			Attributes: mixerpb.CompressedAttributes{
+				Words:  []string{"A1"},
+				Int64S: map[int32]int64{-1: int64(i + 1)},
+			},
+		}
+		if err = stream.Send(&req); err != nil {
+			t.Fatalf("Unable to send request %d: %v", i, err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Unable to receive response %d: %v", i, err)
+		}
+		if status.IsOK(resp.Precondition.Status) != want {
+			t.Errorf("Got response %d %v, want ok %v", i, resp.Precondition.Status, want)
+		}
+	}
+
+	if err = stream.CloseSend(); err != nil {
+		t.Fatalf("Unable to close stream: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	"istio.io/mixer/pkg/config/store"
+)
+
+// AdmissionPath is the path of the validating admission webhook served by AdmissionHandler.
+const AdmissionPath = "/admitconfig"
+
+// Operations of admission requests.
+const (
+	admissionCreate = "CREATE"
+	admissionUpdate = "UPDATE"
+	admissionDelete = "DELETE"
+)
+
+// admissionReview is the subset of the admission.k8s.io/v1beta1 AdmissionReview used by the webhook.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       types.UID        `json:"uid"`
+	Kind      groupVersionKind `json:"kind"`
+	Namespace string           `json:"namespace,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Operation string           `json:"operation"`
+	Object    json.RawMessage  `json:"object,omitempty"`
+}
+
+type groupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+type admissionResponse struct {
+	UID     types.UID      `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"status,omitempty"`
+}
+
+// admissionHandler validates changes of config resources before they are persisted.
+type admissionHandler struct {
+	kinds     map[string]proto.Message
+	validator store.Validator
+}
+
+// AdmissionHandler returns the http.Handler of a kubernetes validating admission webhook.
+// Creates, updates and deletes of the kinds of the config API group are validated by v.
+// Other resources are admitted.
+func AdmissionHandler(kinds map[string]proto.Message, v store.Validator) http.Handler {
+	return &admissionHandler{kinds: kinds, validator: v}
+}
+
+// ServeHTTP implements http.Handler interface.
+func (h *admissionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "admission reviews must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	review := &admissionReview{}
+	if err := json.NewDecoder(req.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+	resp := h.admit(review.Request)
+	resp.UID = review.Request.UID
+	data, err := json.Marshal(&admissionReview{
+		APIVersion: review.APIVersion,
+		Kind:       review.Kind,
+		Response:   resp,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// admit validates the change of the request.
+func (h *admissionHandler) admit(req *admissionRequest) *admissionResponse {
+	if req.Kind.Group != apiGroup {
+		return &admissionResponse{Allowed: true}
+	}
+	target, ok := h.kinds[req.Kind.Kind]
+	if !ok {
+		// the API group is shared with other components.
+		return &admissionResponse{Allowed: true}
+	}
+	key := store.Key{Kind: req.Kind.Kind, Namespace: req.Namespace, Name: req.Name}
+	ev := &store.Event{Key: key}
+	switch req.Operation {
+	case admissionDelete:
+		ev.Type = store.Delete
+	case admissionCreate, admissionUpdate:
+		res, err := toResource(req.Object, target)
+		if err != nil {
+			return denied(key, err)
+		}
+		if ev.Name == "" {
+			ev.Name = res.Metadata.Name
+		}
+		if ev.Namespace == "" {
+			ev.Namespace = res.Metadata.Namespace
+		}
+		ev.Type = store.Update
+		ev.Value = res
+	default:
+		return &admissionResponse{Allowed: true}
+	}
+	if err := h.validator.Validate(ev); err != nil {
+		return denied(ev.Key, err)
+	}
+	return &admissionResponse{Allowed: true}
+}
+
+// toResource converts the object of an admission request to a resource with the spec of the target type.
+// Unlike the conversion of the store, unknown fields are errors.
+func toResource(data []byte, target proto.Message) (*store.Resource, error) {
+	uns := &unstructured.Unstructured{}
+	if err := uns.UnmarshalJSON(data); err != nil {
+		return nil, fmt.Errorf("invalid object: %v", err)
+	}
+	res := backEndResource(uns)
+	spec, err := json.Marshal(res.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec: %v", err)
+	}
+	pbSpec := proto.Clone(target)
+	if err = jsonpb.Unmarshal(bytes.NewReader(spec), pbSpec); err != nil {
+		return nil, fmt.Errorf("invalid spec: %v", err)
+	}
+	return &store.Resource{Metadata: res.Metadata, Spec: pbSpec}, nil
+}
+
+// denied returns the response which rejects the change of the key.
+func denied(key store.Key, err error) *admissionResponse {
+	glog.Infof("Rejected the change of %s: %v", key, err)
+	return &admissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Details: &metav1.StatusDetails{
+				Name: key.Name,
+				Kind: key.Kind,
+			},
+		},
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+
+	cpb "istio.io/mixer/pkg/config/proto"
+	"istio.io/mixer/pkg/config/store"
+)
+
+type fakeValidator struct {
+	ev  *store.Event
+	err error
+}
+
+func (v *fakeValidator) Validate(ev *store.Event) error {
+	v.ev = ev
+	return v.err
+}
+
+func admissionRequestBody(group string, kind string, operation string, object string) string {
+	req := `{"uid":"1","kind":{"group":"` + group + `","version":"v1alpha2","kind":"` + kind + `"},` +
+		`"namespace":"ns","operation":"` + operation + `"`
+	if object != "" {
+		req += `,"object":` + object
+	}
+	return `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":` + req + `}}`
+}
+
+func postReview(t *testing.T, h http.Handler, body string) *admissionResponse {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, AdmissionPath, bytes.NewBufferString(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got %d %s, Want 200", w.Code, w.Body.String())
+	}
+	review := &admissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil || review.Response.UID != "1" {
+		t.Fatalf("Got %+v, Want the response of the request", review.Response)
+	}
+	return review.Response
+}
+
+func TestAdmission(t *testing.T) {
+	v := &fakeValidator{}
+	h := AdmissionHandler(map[string]proto.Message{"rule": &cpb.Rule{}}, v)
+	rule := `{"apiVersion":"config.istio.io/v1alpha2","kind":"rule",` +
+		`"metadata":{"name":"r1","namespace":"ns","labels":{"istio-priority":"10"}},` +
+		`"spec":{"match":"true","actions":[{"handler":"h1.denier","instances":["i1.checknothing"]}]}}`
+
+	resp := postReview(t, h, admissionRequestBody(apiGroup, "rule", admissionCreate, rule))
+	if !resp.Allowed {
+		t.Errorf("Got %+v, Want allowed", resp)
+	}
+	want := store.Key{Kind: "rule", Namespace: "ns", Name: "r1"}
+	if v.ev == nil || v.ev.Type != store.Update || v.ev.Key != want {
+		t.Fatalf("Got %+v, Want the update of %s", v.ev, want)
+	}
+	if r, ok := v.ev.Value.Spec.(*cpb.Rule); !ok || r.Match != "true" || r.Actions[0].Handler != "h1.denier" {
+		t.Errorf("Got %+v, Want the rule spec", v.ev.Value.Spec)
+	}
+	if v.ev.Value.Metadata.Labels["istio-priority"] != "10" {
+		t.Errorf("Got %+v, Want the labels", v.ev.Value.Metadata)
+	}
+
+	v.err = errors.New("rule r1.ns Rejected: invalid match")
+	resp = postReview(t, h, admissionRequestBody(apiGroup, "rule", admissionUpdate, rule))
+	if resp.Allowed || resp.Result == nil || resp.Result.Message != v.err.Error() || resp.Result.Details.Name != "r1" {
+		t.Errorf("Got %+v, Want denied with %v", resp, v.err)
+	}
+
+	v.err = nil
+	v.ev = nil
+	body := admissionRequestBody(apiGroup, "rule", admissionDelete, "")
+	body = strings.Replace(body, `"namespace":"ns"`, `"namespace":"ns","name":"r1"`, 1)
+	if resp = postReview(t, h, body); !resp.Allowed || v.ev == nil || v.ev.Type != store.Delete || v.ev.Key != want {
+		t.Errorf("Got %+v %+v, Want the delete of %s", resp, v.ev, want)
+	}
+}
+
+func TestAdmissionInvalidSpec(t *testing.T) {
+	v := &fakeValidator{}
+	h := AdmissionHandler(map[string]proto.Message{"rule": &cpb.Rule{}}, v)
+	rule := `{"apiVersion":"config.istio.io/v1alpha2","kind":"rule","metadata":{"name":"r1"},"spec":{"unknown":1}}`
+	resp := postReview(t, h, admissionRequestBody(apiGroup, "rule", admissionCreate, rule))
+	if resp.Allowed || resp.Result == nil || !strings.Contains(resp.Result.Message, "invalid spec") {
+		t.Errorf("Got %+v, Want denied with invalid spec", resp)
+	}
+	if v.ev != nil {
+		t.Errorf("Got %+v, Want no validation", v.ev)
+	}
+}
+
+func TestAdmissionIgnored(t *testing.T) {
+	v := &fakeValidator{err: errors.New("not allowed")}
+	h := AdmissionHandler(map[string]proto.Message{"rule": &cpb.Rule{}}, v)
+	for _, body := range []string{
+		admissionRequestBody("", "Pod", admissionCreate, `{}`),
+		admissionRequestBody(apiGroup, "RouteRule", admissionCreate, `{}`),
+		admissionRequestBody(apiGroup, "rule", "CONNECT", ""),
+	} {
+		if resp := postReview(t, h, body); !resp.Allowed {
+			t.Errorf("%s: Got %+v, Want allowed", body, resp)
+		}
+	}
+	if v.ev != nil {
+		t.Errorf("Got %+v, Want no validation", v.ev)
+	}
+}
+
+func TestAdmissionBadRequest(t *testing.T) {
+	h := AdmissionHandler(nil, &fakeValidator{})
+	for _, c := range []struct {
+		method string
+		body   string
+		want   int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "{", http.StatusBadRequest},
+		{http.MethodPost, `{"kind":"AdmissionReview"}`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, AdmissionPath, bytes.NewBufferString(c.body)))
+		if w.Code != c.want {
+			t.Errorf("%s %s: Got %d, Want %d", c.method, c.body, w.Code, c.want)
+		}
+	}
+}
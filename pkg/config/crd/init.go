@@ -15,13 +15,17 @@
 package crd
 
 import (
+	"fmt"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
@@ -45,6 +49,9 @@ func defaultDiscoveryBuilder(conf *rest.Config) (discovery.DiscoveryInterface, e
 // k8s.io/client-go/dynamic.Client.
 type dynamicListerWatcherBuilder struct {
 	client *dynamic.Client
+
+	// rest is used to patch the status subresource, which the dynamic client does not support.
+	rest *rest.RESTClient
 }
 
 func newDynamicListenerWatcherBuilder(conf *rest.Config) (listerWatcherBuilderInterface, error) {
@@ -52,17 +59,58 @@ func newDynamicListenerWatcherBuilder(conf *rest.Config) (listerWatcherBuilderIn
 	if err != nil {
 		return nil, err
 	}
-	return &dynamicListerWatcherBuilder{client}, nil
+	rc := *conf
+	rc.ContentConfig = dynamic.ContentConfig()
+	rc.GroupVersion = conf.GroupVersion
+	restClient, err := rest.RESTClientFor(&rc)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamicListerWatcherBuilder{client: client, rest: restClient}, nil
+}
+
+func (b *dynamicListerWatcherBuilder) build(res metav1.APIResource, namespace string) cache.ListerWatcher {
+	return b.client.Resource(&res, namespace)
+}
+
+func (b *dynamicListerWatcherBuilder) patchStatus(res metav1.APIResource, namespace string, name string, data []byte) error {
+	return b.rest.Patch(types.MergePatchType).
+		Namespace(namespace).
+		Resource(res.Name).
+		Name(name).
+		SubResource("status").
+		Body(data).
+		Do().
+		Error()
+}
+
+func (b *dynamicListerWatcherBuilder) createResource(res metav1.APIResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	return b.client.Resource(&res, obj.GetNamespace()).Create(obj)
 }
 
-func (b *dynamicListerWatcherBuilder) build(res metav1.APIResource) cache.ListerWatcher {
-	return b.client.Resource(&res, "")
+func (b *dynamicListerWatcherBuilder) updateResource(res metav1.APIResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	return b.client.Resource(&res, obj.GetNamespace()).Update(obj)
 }
 
-// NewStore creates a new Store instance.
+func (b *dynamicListerWatcherBuilder) deleteResource(res metav1.APIResource, namespace string, name string) error {
+	return b.client.Resource(&res, namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+// NewStore creates a new Store instance. The config URL is like
+// k8s://path_to_kubeconfig?ns=ns1,ns2&label-selector=team%3Dfoo
+// where "ns" lists the namespaces to watch instead of all namespaces, and
+// "label-selector" restricts the watched resources to the ones with matching labels.
 func NewStore(u *url.URL) (store.Store2Backend, error) {
 	kubeconfig := u.Path
 	namespaces := u.Query().Get("ns")
+	var labelSelector string
+	if ls := u.Query().Get("label-selector"); ls != "" {
+		sel, err := labels.Parse(ls)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label-selector of the config URL %s: %v", u, err)
+		}
+		labelSelector = sel.String()
+	}
 	retryTimeout := crdRetryTimeout
 	retryTimeoutParam := u.Query().Get("retry-timeout")
 	if retryTimeoutParam != "" {
@@ -80,6 +128,7 @@ func NewStore(u *url.URL) (store.Store2Backend, error) {
 	conf.GroupVersion = &schema.GroupVersion{Group: apiGroup, Version: apiVersion}
 	s := &Store{
 		conf:                 conf,
+		labelSelector:        labelSelector,
 		retryTimeout:         retryTimeout,
 		discoveryBuilder:     defaultDiscoveryBuilder,
 		listerWatcherBuilder: newDynamicListenerWatcherBuilder,
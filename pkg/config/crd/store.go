@@ -18,12 +18,19 @@ package crd
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
@@ -55,7 +62,23 @@ const (
 var retryInterval = time.Second / 2
 
 type listerWatcherBuilderInterface interface {
-	build(res metav1.APIResource) cache.ListerWatcher
+	// build returns the cache.ListerWatcher of the resources in the namespace,
+	// or in all namespaces if namespace is empty.
+	build(res metav1.APIResource, namespace string) cache.ListerWatcher
+}
+
+// statusPatcher patches the status subresource of a custom resource.
+// listerWatcherBuilderInterface implementations may optionally implement it.
+type statusPatcher interface {
+	patchStatus(res metav1.APIResource, namespace string, name string, data []byte) error
+}
+
+// resourceWriter creates, updates and deletes custom resources.
+// listerWatcherBuilderInterface implementations may optionally implement it.
+type resourceWriter interface {
+	createResource(res metav1.APIResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error)
+	updateResource(res metav1.APIResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error)
+	deleteResource(res metav1.APIResource, namespace string, name string) error
 }
 
 func waitForSynced(ctx context.Context, informers map[string]cache.SharedInformer) <-chan struct{} {
@@ -83,12 +106,23 @@ func waitForSynced(ctx context.Context, informers map[string]cache.SharedInforme
 
 // Store offers store.Store2Backend interface through kubernetes custom resource definitions.
 type Store struct {
-	conf         *rest.Config
-	ns           map[string]bool
-	retryTimeout time.Duration
+	conf *rest.Config
+	// ns is the namespaces to watch, or nil for all namespaces.
+	ns map[string]bool
+	// labelSelector restricts the watched resources to the ones with matching labels.
+	labelSelector string
+	retryTimeout  time.Duration
 
 	cacheMutex sync.Mutex
-	caches     map[string]cache.Store
+	// caches are the caches of each kind by the watched namespace, which is empty
+	// when all namespaces are watched through a single cache.
+	caches    map[string]map[string]cache.Store
+	resources map[string]metav1.APIResource
+	// noStatus is the set of kinds whose custom resources have no status subresource.
+	noStatus map[string]bool
+
+	// lwBuilder is used to write resources and their status.
+	lwBuilder listerWatcherBuilderInterface
 
 	watchMutex sync.RWMutex
 	watchCtx   context.Context
@@ -103,6 +137,7 @@ var _ store.Store2Backend = &Store{}
 
 // checkAndCreateCaches checks the presence of custom resource definitions through the discovery API,
 // and then create caches through lwBUilder which is in kinds. It retries within the timeout duration.
+// When the store watches specific namespaces, a cache is created for each namespace.
 // If the timeout duration is 0, it waits forever (which should be done within a goroutine).
 // Returns the created shared informers, and the list of kinds which are not created yet.
 func (s *Store) checkAndCreateCaches(
@@ -142,13 +177,18 @@ func (s *Store) checkAndCreateCaches(
 				continue
 			}
 			if _, ok := kindsSet[res.Kind]; ok {
-				cl := lwBuilder.build(res)
-				informer := cache.NewSharedInformer(cl, &unstructured.Unstructured{}, 0)
-				s.caches[res.Kind] = informer.GetStore()
-				informers[res.Kind] = informer
+				caches := map[string]cache.Store{}
+				for _, ns := range s.namespaces(res) {
+					cl := &reportingListerWatcher{ListerWatcher: s.listerWatcher(lwBuilder, res, ns), kind: res.Kind, store: s}
+					informer := cache.NewSharedInformer(cl, &unstructured.Unstructured{}, 0)
+					caches[ns] = informer.GetStore()
+					informers[res.Kind+"/"+ns] = informer
+					informer.AddEventHandler(s)
+					go informer.Run(ctx.Done())
+				}
+				s.caches[res.Kind] = caches
+				s.resources[res.Kind] = res
 				delete(kindsSet, res.Kind)
-				informer.AddEventHandler(s)
-				go informer.Run(ctx.Done())
 				added++
 			}
 		}
@@ -162,6 +202,39 @@ func (s *Store) checkAndCreateCaches(
 	return informers, remaining
 }
 
+// namespaces returns the namespaces to create the caches of the resource for.
+// An empty namespace is all namespaces.
+func (s *Store) namespaces(res metav1.APIResource) []string {
+	if s.ns == nil || !res.Namespaced {
+		return []string{""}
+	}
+	namespaces := make([]string, 0, len(s.ns))
+	for ns := range s.ns {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// listerWatcher returns the cache.ListerWatcher of the resources in the namespace
+// which match the label selector.
+func (s *Store) listerWatcher(lwBuilder listerWatcherBuilderInterface, res metav1.APIResource, namespace string) cache.ListerWatcher {
+	lw := lwBuilder.build(res, namespace)
+	if s.labelSelector == "" {
+		return lw
+	}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = s.labelSelector
+			return lw.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = s.labelSelector
+			return lw.Watch(options)
+		},
+	}
+}
+
 // Init implements store.Store2Backend interface.
 func (s *Store) Init(ctx context.Context, kinds []string) error {
 	d, err := s.discoveryBuilder(s.conf)
@@ -172,7 +245,9 @@ func (s *Store) Init(ctx context.Context, kinds []string) error {
 	if err != nil {
 		return err
 	}
-	s.caches = make(map[string]cache.Store, len(kinds))
+	s.caches = make(map[string]map[string]cache.Store, len(kinds))
+	s.resources = make(map[string]metav1.APIResource, len(kinds))
+	s.lwBuilder = lwBuilder
 	informers, remainingKinds := s.checkAndCreateCaches(ctx, s.retryTimeout, d, lwBuilder, kinds)
 	if len(remainingKinds) > 0 {
 		// Wait asynchronously for other kinds.
@@ -198,7 +273,10 @@ func (s *Store) Get(key store.Key) (*store.BackEndResource, error) {
 		return nil, store.ErrNotFound
 	}
 	s.cacheMutex.Lock()
-	c, ok := s.caches[key.Kind]
+	c, ok := s.caches[key.Kind][key.Namespace]
+	if !ok {
+		c, ok = s.caches[key.Kind][""]
+	}
 	s.cacheMutex.Unlock()
 	if !ok {
 		return nil, store.ErrNotFound
@@ -235,20 +313,173 @@ func backEndResource(uns *unstructured.Unstructured) *store.BackEndResource {
 func (s *Store) List() map[store.Key]*store.BackEndResource {
 	result := make(map[store.Key]*store.BackEndResource)
 	s.cacheMutex.Lock()
-	for kind, c := range s.caches {
-		for _, obj := range c.List() {
-			uns := obj.(*unstructured.Unstructured)
-			key := store.Key{Kind: kind, Name: uns.GetName(), Namespace: uns.GetNamespace()}
-			if s.ns != nil && !s.ns[key.Namespace] {
-				continue
+	for kind, caches := range s.caches {
+		for _, c := range caches {
+			for _, obj := range c.List() {
+				uns := obj.(*unstructured.Unstructured)
+				key := store.Key{Kind: kind, Name: uns.GetName(), Namespace: uns.GetNamespace()}
+				if s.ns != nil && !s.ns[key.Namespace] {
+					continue
+				}
+				result[key] = backEndResource(uns)
 			}
-			result[key] = backEndResource(uns)
 		}
 	}
 	s.cacheMutex.Unlock()
 	return result
 }
 
+// Put implements store.Store2Backend interface. The resource is created if it does not exist,
+// otherwise it is updated against resource.Metadata.Revision, or the cached revision if not specified.
+func (s *Store) Put(key store.Key, resource *store.BackEndResource) (string, error) {
+	w, res, err := s.writer(key)
+	if err != nil {
+		return "", err
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": resource.Spec}}
+	obj.SetAPIVersion(apiGroupVersion)
+	obj.SetKind(key.Kind)
+	obj.SetNamespace(key.Namespace)
+	obj.SetName(key.Name)
+	obj.SetLabels(resource.Metadata.Labels)
+	obj.SetAnnotations(resource.Metadata.Annotations)
+
+	rev := resource.Metadata.Revision
+	if rev == "" {
+		if cur, gerr := s.Get(key); gerr == nil {
+			rev = cur.Metadata.Revision
+		}
+	}
+	var out *unstructured.Unstructured
+	if rev == "" {
+		out, err = w.createResource(res, obj)
+	} else {
+		obj.SetResourceVersion(rev)
+		out, err = w.updateResource(res, obj)
+		if apierrors.IsNotFound(err) {
+			// the revision can not match a resource that does not exist.
+			return "", store.ErrConflict
+		}
+	}
+	if err != nil {
+		return "", convertError(err)
+	}
+	return out.GetResourceVersion(), nil
+}
+
+// Delete implements store.Store2Backend interface.
+// The API server only supports UID preconditions on deletions, so a deletion
+// against a revision returns store.ErrRevisionNotSupported.
+func (s *Store) Delete(key store.Key, revision string) error {
+	if revision != "" {
+		return store.ErrRevisionNotSupported
+	}
+	w, res, err := s.writer(key)
+	if err != nil {
+		return err
+	}
+	return convertError(w.deleteResource(res, key.Namespace, key.Name))
+}
+
+// writer returns the resourceWriter and the API resource for the key.
+func (s *Store) writer(key store.Key) (resourceWriter, metav1.APIResource, error) {
+	w, ok := s.lwBuilder.(resourceWriter)
+	if !ok {
+		return nil, metav1.APIResource{}, fmt.Errorf("store does not support writing %s", key)
+	}
+	if s.ns != nil && !s.ns[key.Namespace] {
+		return nil, metav1.APIResource{}, fmt.Errorf("namespace %s is not watched", key.Namespace)
+	}
+	s.cacheMutex.Lock()
+	res, ok := s.resources[key.Kind]
+	s.cacheMutex.Unlock()
+	if !ok {
+		return nil, metav1.APIResource{}, fmt.Errorf("unrecognized kind %s", key.Kind)
+	}
+	return w, res, nil
+}
+
+// convertError converts the API errors into the store errors.
+func convertError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsConflict(err), apierrors.IsAlreadyExists(err):
+		return store.ErrConflict
+	case apierrors.IsNotFound(err):
+		return store.ErrNotFound
+	}
+	return err
+}
+
+// SetStatus implements store.StatusWriter interface.
+// The status is written to the status subresource of the custom resource.
+// It returns store.ErrStatusNotSupported if the kind has no status subresource,
+// after which the status of the kind is no longer written.
+func (s *Store) SetStatus(key store.Key, status map[string]interface{}) error {
+	sp, ok := s.lwBuilder.(statusPatcher)
+	if !ok {
+		return store.ErrStatusNotSupported
+	}
+	s.cacheMutex.Lock()
+	res, ok := s.resources[key.Kind]
+	noStatus := s.noStatus[key.Kind]
+	s.cacheMutex.Unlock()
+	if !ok {
+		return store.ErrNotFound
+	}
+	if noStatus {
+		return store.ErrStatusNotSupported
+	}
+	data, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	err = sp.patchStatus(res, key.Namespace, key.Name, data)
+	if !statusNotSupported(err) {
+		return err
+	}
+	if apierrors.IsNotFound(err) {
+		// the resource itself may be gone.
+		if _, gerr := s.Get(key); gerr == store.ErrNotFound {
+			return store.ErrNotFound
+		}
+	}
+	glog.Infof("Custom resources of kind %s have no status subresource: %v", key.Kind, err)
+	s.cacheMutex.Lock()
+	if s.noStatus == nil {
+		s.noStatus = map[string]bool{}
+	}
+	s.noStatus[key.Kind] = true
+	s.cacheMutex.Unlock()
+	return store.ErrStatusNotSupported
+}
+
+// statusNotSupported returns true if err may report that the status subresource does not exist.
+// A not found error is also reported if the custom resource does not exist.
+func statusNotSupported(err error) bool {
+	return apierrors.IsNotFound(err) || apierrors.IsMethodNotSupported(err)
+}
+
+// statusOnlyUpdate returns true if only the status of the resource has changed.
+// Such updates are caused by SetStatus and are not propagated.
+func statusOnlyUpdate(oldObj, newObj interface{}) bool {
+	o, ok := oldObj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	n, ok := newObj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	if reflect.DeepEqual(o.UnstructuredContent()["status"], n.UnstructuredContent()["status"]) {
+		return false
+	}
+	ob, nb := backEndResource(o), backEndResource(n)
+	ob.Metadata.Revision = nb.Metadata.Revision
+	return reflect.DeepEqual(ob, nb)
+}
+
 func toEvent(t store.ChangeType, obj interface{}) store.BackendEvent {
 	uns := obj.(*unstructured.Unstructured)
 	key := store.Key{Kind: uns.GetKind(), Namespace: uns.GetNamespace(), Name: uns.GetName()}
@@ -259,6 +490,61 @@ func toEvent(t store.ChangeType, obj interface{}) store.BackendEvent {
 	}
 }
 
+// reportingListerWatcher reports the recovery from failures to list or watch
+// the resources of a kind as a disconnect of the store, since events may have
+// been missed in the meantime.
+type reportingListerWatcher struct {
+	cache.ListerWatcher
+	kind  string
+	store *Store
+
+	// failed is set when listing or watching fails. The reflector of the
+	// informer calls List and Watch sequentially.
+	failed bool
+}
+
+// List implements cache.ListerWatcher interface.
+func (lw *reportingListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	obj, err := lw.ListerWatcher.List(options)
+	lw.report(err)
+	return obj, err
+}
+
+// Watch implements cache.ListerWatcher interface.
+func (lw *reportingListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	w, err := lw.ListerWatcher.Watch(options)
+	lw.report(err)
+	return w, err
+}
+
+func (lw *reportingListerWatcher) report(err error) {
+	if err != nil {
+		if !lw.failed {
+			glog.Warningf("Lost the connection to watch %s: %v", lw.kind, err)
+		}
+		lw.failed = true
+		return
+	}
+	if lw.failed {
+		lw.failed = false
+		glog.Infof("Recovered the connection to watch %s", lw.kind)
+		lw.store.disconnect()
+	}
+}
+
+// disconnect reports a disconnect by closing the watch channel. Events are
+// dropped until the next Watch, the changes are recovered by listing the caches.
+func (s *Store) disconnect() {
+	s.watchMutex.Lock()
+	defer s.watchMutex.Unlock()
+	if s.watchCh == nil {
+		return
+	}
+	close(s.watchCh)
+	s.watchCtx = nil
+	s.watchCh = nil
+}
+
 func (s *Store) dispatch(ev store.BackendEvent) {
 	s.watchMutex.RLock()
 	defer s.watchMutex.RUnlock()
@@ -281,6 +567,9 @@ func (s *Store) OnAdd(obj interface{}) {
 
 // OnUpdate implements cache.ResourceEventHandler interface.
 func (s *Store) OnUpdate(oldObj, newObj interface{}) {
+	if statusOnlyUpdate(oldObj, newObj) {
+		return
+	}
 	ev := toEvent(store.Update, newObj)
 	if s.ns == nil || s.ns[ev.Key.Namespace] {
 		s.dispatch(ev)
@@ -289,6 +578,14 @@ func (s *Store) OnUpdate(oldObj, newObj interface{}) {
 
 // OnDelete implements cache.ResourceEventHandler interface.
 func (s *Store) OnDelete(obj interface{}) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		// the deletion was missed, and is found by relisting the resources.
+		obj = d.Obj
+	}
+	if _, ok := obj.(*unstructured.Unstructured); !ok {
+		glog.Warningf("Unexpected deleted object %T", obj)
+		return
+	}
 	ev := toEvent(store.Delete, obj)
 	ev.Value = nil
 	if s.ns == nil || s.ns[ev.Key.Namespace] {
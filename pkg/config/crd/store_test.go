@@ -17,15 +17,20 @@ package crd
 import (
 	"context"
 	"errors"
+	"net/url"
 	"reflect"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/discovery/fake"
@@ -59,30 +64,139 @@ func createFakeDiscovery(*rest.Config) (discovery.DiscoveryInterface, error) {
 }
 
 type dummyListerWatcherBuilder struct {
-	mu       sync.RWMutex
-	data     map[store.Key]*unstructured.Unstructured
-	watchers map[string]*watch.RaceFreeFakeWatcher
+	mu   sync.RWMutex
+	data map[store.Key]*unstructured.Unstructured
+	// watchers are the watchers of each kind.
+	watchers map[string][]*dummyWatcher
+	patches  map[string]string
+	// statusErr is returned by patchStatus, if set.
+	statusErr error
+	revision  int
+	// built is the namespaces the resources are listed and watched in, by kind.
+	built map[string][]string
 }
 
-func (d *dummyListerWatcherBuilder) build(res metav1.APIResource) cache.ListerWatcher {
-	w := watch.NewRaceFreeFake()
+// dummyWatcher watches the resources in the namespace, or all namespaces if it is
+// empty, which match the selector.
+type dummyWatcher struct {
+	*watch.RaceFreeFakeWatcher
+	namespace string
+	selector  labels.Selector
+}
+
+func (w *dummyWatcher) matches(obj *unstructured.Unstructured) bool {
+	return (w.namespace == "" || w.namespace == obj.GetNamespace()) && w.selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// notifyLocked calls f on the watchers of the object.
+func (d *dummyListerWatcherBuilder) notifyLocked(obj *unstructured.Unstructured, f func(w *dummyWatcher)) {
+	for _, w := range d.watchers[obj.GetKind()] {
+		if w.matches(obj) {
+			f(w)
+		}
+	}
+}
+
+func (d *dummyListerWatcherBuilder) patchStatus(res metav1.APIResource, namespace string, name string, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.statusErr != nil {
+		return d.statusErr
+	}
+	if d.patches == nil {
+		d.patches = map[string]string{}
+	}
+	d.patches[res.Name+"/"+namespace+"/"+name] = string(data)
+	return nil
+}
+
+func (d *dummyListerWatcherBuilder) createResource(res metav1.APIResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	key := store.Key{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.data[key]; ok {
+		return nil, apierrors.NewAlreadyExists(schema.GroupResource{Group: apiGroup, Resource: res.Name}, key.Name)
+	}
+	return d.storeLocked(key, obj, false), nil
+}
+
+func (d *dummyListerWatcherBuilder) updateResource(res metav1.APIResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	key := store.Key{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
 	d.mu.Lock()
-	d.watchers[res.Kind] = w
+	defer d.mu.Unlock()
+	cur, ok := d.data[key]
+	gr := schema.GroupResource{Group: apiGroup, Resource: res.Name}
+	if !ok {
+		return nil, apierrors.NewNotFound(gr, key.Name)
+	}
+	if cur.GetResourceVersion() != obj.GetResourceVersion() {
+		return nil, apierrors.NewConflict(gr, key.Name, errors.New("resource version mismatch"))
+	}
+	return d.storeLocked(key, obj, true), nil
+}
+
+func (d *dummyListerWatcherBuilder) deleteResource(res metav1.APIResource, namespace string, name string) error {
+	key := store.Key{Kind: res.Kind, Namespace: namespace, Name: name}
+	d.mu.RLock()
+	_, ok := d.data[key]
+	d.mu.RUnlock()
+	if !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Group: apiGroup, Resource: res.Name}, name)
+	}
+	d.delete(key)
+	return nil
+}
+
+// storeLocked stores a copy of obj with a new resource version and notifies the watcher.
+func (d *dummyListerWatcherBuilder) storeLocked(key store.Key, obj *unstructured.Unstructured, existed bool) *unstructured.Unstructured {
+	d.revision++
+	res := &unstructured.Unstructured{Object: obj.UnstructuredContent()}
+	res.SetResourceVersion(strconv.Itoa(d.revision))
+	d.data[key] = res
+	d.notifyLocked(res, func(w *dummyWatcher) {
+		if existed {
+			w.Modify(res)
+		} else {
+			w.Add(res)
+		}
+	})
+	return res
+}
+
+func (d *dummyListerWatcherBuilder) build(res metav1.APIResource, namespace string) cache.ListerWatcher {
+	d.mu.Lock()
+	if d.built == nil {
+		d.built = map[string][]string{}
+	}
+	d.built[res.Kind] = append(d.built[res.Kind], namespace)
 	d.mu.Unlock()
 
 	return &cache.ListWatch{
-		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			w := &dummyWatcher{namespace: namespace}
+			var err error
+			if w.selector, err = labels.Parse(options.LabelSelector); err != nil {
+				return nil, err
+			}
 			list := &unstructured.UnstructuredList{}
 			d.mu.RLock()
 			for k, v := range d.data {
-				if k.Kind == res.Kind {
+				if k.Kind == res.Kind && w.matches(v) {
 					list.Items = append(list.Items, *v)
 				}
 			}
 			d.mu.RUnlock()
 			return list, nil
 		},
-		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			w := &dummyWatcher{RaceFreeFakeWatcher: watch.NewRaceFreeFake(), namespace: namespace}
+			var err error
+			if w.selector, err = labels.Parse(options.LabelSelector); err != nil {
+				return nil, err
+			}
+			d.mu.Lock()
+			d.watchers[res.Kind] = append(d.watchers[res.Kind], w)
+			d.mu.Unlock()
 			return w, nil
 		},
 	}
@@ -100,15 +214,13 @@ func (d *dummyListerWatcherBuilder) put(key store.Key, spec map[string]interface
 	defer d.mu.Unlock()
 	_, existed := d.data[key]
 	d.data[key] = res
-	w, ok := d.watchers[key.Kind]
-	if !ok {
-		return nil
-	}
-	if existed {
-		w.Modify(res)
-	} else {
-		w.Add(res)
-	}
+	d.notifyLocked(res, func(w *dummyWatcher) {
+		if existed {
+			w.Modify(res)
+		} else {
+			w.Add(res)
+		}
+	})
 	return nil
 }
 
@@ -120,11 +232,9 @@ func (d *dummyListerWatcherBuilder) delete(key store.Key) {
 		return
 	}
 	delete(d.data, key)
-	w, ok := d.watchers[key.Kind]
-	if !ok {
-		return
-	}
-	w.Delete(value)
+	d.notifyLocked(value, func(w *dummyWatcher) {
+		w.Delete(value)
+	})
 }
 
 func getTempClient() (*Store, string, *dummyListerWatcherBuilder) {
@@ -132,7 +242,7 @@ func getTempClient() (*Store, string, *dummyListerWatcherBuilder) {
 	ns := "istio-mixer-testing"
 	lw := &dummyListerWatcherBuilder{
 		data:     map[store.Key]*unstructured.Unstructured{},
-		watchers: map[string]*watch.RaceFreeFakeWatcher{},
+		watchers: map[string][]*dummyWatcher{},
 	}
 	client := &Store{
 		conf:             &rest.Config{},
@@ -274,6 +384,76 @@ func TestStoreNamespaces(t *testing.T) {
 			t.Errorf("For key %s, Got %v error, Want %v", c.key, err, c.ok)
 		}
 	}
+
+	// the resources are watched in each namespace instead of cluster-wide.
+	want := []string{ns, otherNS}
+	lw.mu.RLock()
+	defer lw.mu.RUnlock()
+	for _, kind := range []string{"Action", "Handler"} {
+		if got := lw.built[kind]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Got %v, Want %v", kind, got, want)
+		}
+	}
+}
+
+func TestStoreLabelSelector(t *testing.T) {
+	s, ns, lw := getTempClient()
+	s.labelSelector = "team=foo"
+	res := metav1.APIResource{Name: "handlers", SingularName: "handler", Kind: "Handler", Namespaced: true}
+	create := func(name string, team string) store.Key {
+		obj := &unstructured.Unstructured{}
+		obj.SetKind("Handler")
+		obj.SetNamespace(ns)
+		obj.SetName(name)
+		obj.SetLabels(map[string]string{"team": team})
+		if _, err := lw.createResource(res, obj); err != nil {
+			t.Fatal(err)
+		}
+		return store.Key{Kind: "Handler", Namespace: ns, Name: name}
+	}
+	k1 := create("listed", "foo")
+	k2 := create("ignored", "bar")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k3 := create("watched", "foo")
+	if err = waitFor(wch, store.Update, k3); err != nil {
+		t.Errorf("Got %v, Want the update of %s", err, k3)
+	}
+	k4 := create("unwatched", "bar")
+	if err = waitFor(wch, store.Update, k4); err == nil {
+		t.Errorf("Got the update of %s, Want nothing", k4)
+	}
+	list := s.List()
+	for _, c := range []struct {
+		key store.Key
+		ok  bool
+	}{
+		{k1, true},
+		{k2, false},
+		{k3, true},
+		{k4, false},
+	} {
+		if _, ok := list[c.key]; ok != c.ok {
+			t.Errorf("For key %s, Got %v, Want %v", c.key, ok, c.ok)
+		}
+	}
+}
+
+func TestNewStoreInvalidLabelSelector(t *testing.T) {
+	u, err := url.Parse("k8s://?label-selector=" + url.QueryEscape("team=="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewStore(u); err == nil {
+		t.Errorf("Got nil, Want error")
+	}
 }
 
 func TestStoreFailToInit(t *testing.T) {
@@ -434,3 +614,237 @@ loop:
 		t.Errorf("Got %v, Want nil", err)
 	}
 }
+
+func TestStoreSetStatus(t *testing.T) {
+	s, ns, lw := getTempClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	k := store.Key{Kind: "Handler", Namespace: ns, Name: "default"}
+	if err := s.SetStatus(k, map[string]interface{}{"state": "Rejected"}); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	want := map[string]string{"handlers/" + ns + "/default": `{"status":{"state":"Rejected"}}`}
+	if !reflect.DeepEqual(lw.patches, want) {
+		t.Errorf("Got %v, Want %v", lw.patches, want)
+	}
+	if err := s.SetStatus(store.Key{Kind: "Action", Namespace: ns, Name: "a"}, nil); err != store.ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+}
+
+func TestStoreSetStatusNoSubresource(t *testing.T) {
+	s, ns, lw := getTempClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler", "Action"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	k := store.Key{Kind: "Handler", Namespace: ns, Name: "default"}
+	if err = lw.put(k, map[string]interface{}{"adapter": "noop"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = waitFor(wch, store.Update, k); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	gr := schema.GroupResource{Group: apiGroup, Resource: "handlers"}
+	lw.statusErr = apierrors.NewNotFound(gr, "missing")
+	// a resource that does not exist is not found.
+	if err = s.SetStatus(store.Key{Kind: "Handler", Namespace: ns, Name: "missing"}, nil); err != store.ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+
+	// the API server does not find the status subresource of an existing resource.
+	lw.statusErr = apierrors.NewNotFound(gr, k.Name)
+	if err = s.SetStatus(k, map[string]interface{}{"state": "Rejected"}); err != store.ErrStatusNotSupported {
+		t.Errorf("Got %v, Want ErrStatusNotSupported", err)
+	}
+
+	// the kind is no longer written.
+	lw.statusErr = nil
+	if err = s.SetStatus(k, map[string]interface{}{"state": "Rejected"}); err != store.ErrStatusNotSupported {
+		t.Errorf("Got %v, Want ErrStatusNotSupported", err)
+	}
+	if len(lw.patches) != 0 {
+		t.Errorf("Got %v, Want no patches", lw.patches)
+	}
+
+	// other kinds are still written.
+	if err = s.SetStatus(store.Key{Kind: "Action", Namespace: ns, Name: "a"}, nil); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+
+	lw.statusErr = apierrors.NewMethodNotSupported(schema.GroupResource{Group: apiGroup, Resource: "actions"}, "patch")
+	if err = s.SetStatus(store.Key{Kind: "Action", Namespace: ns, Name: "a"}, nil); err != store.ErrStatusNotSupported {
+		t.Errorf("Got %v, Want ErrStatusNotSupported", err)
+	}
+}
+
+func TestStorePutDelete(t *testing.T) {
+	s, ns, _ := getTempClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	k := store.Key{Kind: "Handler", Namespace: ns, Name: "default"}
+	if _, err = s.Put(store.Key{Kind: "Unknown", Namespace: ns, Name: "default"}, &store.BackEndResource{}); err == nil {
+		t.Errorf("Got nil, Want error for unknown kind")
+	}
+	if _, err = s.Put(k, &store.BackEndResource{Metadata: store.ResourceMeta{Revision: "10"}}); err != store.ErrConflict {
+		t.Errorf("Got %v, Want ErrConflict", err)
+	}
+
+	h := map[string]interface{}{"name": "default", "adapter": "noop"}
+	rev, err := s.Put(k, &store.BackEndResource{
+		Metadata: store.ResourceMeta{Labels: map[string]string{"app": "mixer"}},
+		Spec:     h,
+	})
+	if err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	if err = waitFor(wch, store.Update, k); err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	got, err := s.Get(k)
+	if err != nil || got.Metadata.Revision != rev || got.Metadata.Labels["app"] != "mixer" || !reflect.DeepEqual(got.Spec, h) {
+		t.Errorf("Got %+v/%v, Want %v at revision %s", got, err, h, rev)
+	}
+
+	// without a revision, the cached revision is used.
+	h2 := map[string]interface{}{"name": "default", "adapter": "noop2"}
+	rev2, err := s.Put(k, &store.BackEndResource{Spec: h2})
+	if err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	if _, err = s.Put(k, &store.BackEndResource{Metadata: store.ResourceMeta{Revision: rev}, Spec: h}); err != store.ErrConflict {
+		t.Errorf("Got %v, Want ErrConflict", err)
+	}
+	if err = waitFor(wch, store.Update, k); err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	if got, err = s.Get(k); err != nil || got.Metadata.Revision != rev2 {
+		t.Errorf("Got %+v/%v, Want revision %s", got, err, rev2)
+	}
+
+	if err = s.Delete(k, rev2); err != store.ErrRevisionNotSupported {
+		t.Errorf("Got %v, Want ErrRevisionNotSupported", err)
+	}
+	if err = s.Delete(k, ""); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if err = waitFor(wch, store.Delete, k); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if err = s.Delete(k, ""); err != store.ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+}
+
+func TestStatusOnlyUpdate(t *testing.T) {
+	obj := func(rev string, spec string, status string) *unstructured.Unstructured {
+		res := &unstructured.Unstructured{}
+		res.SetKind("Handler")
+		res.SetName("default")
+		res.SetResourceVersion(rev)
+		res.Object["spec"] = map[string]interface{}{"adapter": spec}
+		if status != "" {
+			res.Object["status"] = map[string]interface{}{"state": status}
+		}
+		return res
+	}
+	for _, tc := range []struct {
+		desc     string
+		old, new *unstructured.Unstructured
+		want     bool
+	}{
+		{"status", obj("1", "noop", ""), obj("2", "noop", "Accepted"), true},
+		{"spec", obj("1", "noop", ""), obj("2", "noop2", ""), false},
+		{"spec and status", obj("1", "noop", ""), obj("2", "noop2", "Accepted"), false},
+		{"resync", obj("1", "noop", "Accepted"), obj("1", "noop", "Accepted"), false},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := statusOnlyUpdate(tc.old, tc.new); got != tc.want {
+				t.Errorf("Got %v, Want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReportingListerWatcher(t *testing.T) {
+	s := &Store{}
+	ch, err := s.Watch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listErr error
+	lw := &reportingListerWatcher{
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+				return &unstructured.UnstructuredList{}, listErr
+			},
+			WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+				return watch.NewFake(), nil
+			},
+		},
+		kind:  "Handler",
+		store: s,
+	}
+	closed := func() bool {
+		select {
+		case _, ok := <-ch:
+			return !ok
+		default:
+			return false
+		}
+	}
+
+	if _, err = lw.List(metav1.ListOptions{}); err != nil || closed() {
+		t.Fatalf("Got %v, Want the watch to continue", err)
+	}
+	listErr = errors.New("connection refused")
+	if _, err = lw.List(metav1.ListOptions{}); err != listErr || closed() {
+		t.Fatalf("Got %v, Want %v without disconnect", err, listErr)
+	}
+	listErr = nil
+	if _, err = lw.List(metav1.ListOptions{}); err != nil || !closed() {
+		t.Fatalf("Got %v, Want the disconnect reported on recovery", err)
+	}
+
+	// events are dropped until the store is watched again.
+	s.dispatch(store.BackendEvent{Type: store.Delete, Key: store.Key{Kind: "Handler", Namespace: "ns", Name: "h1"}})
+	if _, err = lw.Watch(metav1.ListOptions{}); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+}
+
+func TestStoreDeletedFinalStateUnknown(t *testing.T) {
+	s := &Store{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &unstructured.Unstructured{}
+	obj.SetKind("Handler")
+	obj.SetNamespace("ns")
+	obj.SetName("h1")
+	go s.OnDelete(cache.DeletedFinalStateUnknown{Key: "ns/h1", Obj: obj})
+	if err = waitFor(wch, store.Delete, store.Key{Kind: "Handler", Namespace: "ns", Name: "h1"}); err != nil {
+		t.Errorf("Got %v, Want the delete event", err)
+	}
+	// unknown objects are ignored.
+	s.OnDelete(cache.DeletedFinalStateUnknown{Key: "ns/h2"})
+}
@@ -0,0 +1,308 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// errCompacted is returned when a watch starts at a revision which is already compacted.
+var errCompacted = errors.New("required revision has been compacted")
+
+// revision is an int64 encoded as a JSON string, as the gateway encodes 64 bit integers.
+type revision int64
+
+// MarshalJSON implements json.Marshaler interface.
+func (r revision) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(r), 10))
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface. Both strings and numbers are accepted.
+func (r *revision) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err = json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*r = revision(n)
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*r = revision(n)
+	return nil
+}
+
+// The messages of the key-value API of the gateway. Keys and values are
+// base64 encoded by encoding/json since they are []byte.
+type (
+	responseHeader struct {
+		Revision revision `json:"revision,omitempty"`
+	}
+
+	keyValue struct {
+		Key         []byte   `json:"key,omitempty"`
+		Value       []byte   `json:"value,omitempty"`
+		ModRevision revision `json:"mod_revision,omitempty"`
+	}
+
+	rangeRequest struct {
+		Key      []byte `json:"key,omitempty"`
+		RangeEnd []byte `json:"range_end,omitempty"`
+	}
+
+	rangeResponse struct {
+		Header responseHeader `json:"header"`
+		Kvs    []*keyValue    `json:"kvs,omitempty"`
+	}
+
+	putRequest struct {
+		Key   []byte `json:"key,omitempty"`
+		Value []byte `json:"value,omitempty"`
+	}
+
+	deleteRangeRequest struct {
+		Key []byte `json:"key,omitempty"`
+	}
+
+	compare struct {
+		Key         []byte   `json:"key,omitempty"`
+		Result      string   `json:"result,omitempty"`
+		Target      string   `json:"target,omitempty"`
+		ModRevision revision `json:"mod_revision"`
+	}
+
+	requestOp struct {
+		RequestPut         *putRequest         `json:"request_put,omitempty"`
+		RequestDeleteRange *deleteRangeRequest `json:"request_delete_range,omitempty"`
+	}
+
+	responseOp struct {
+		ResponseDeleteRange *struct {
+			Deleted revision `json:"deleted,omitempty"`
+		} `json:"response_delete_range,omitempty"`
+	}
+
+	txnRequest struct {
+		Compare []*compare   `json:"compare,omitempty"`
+		Success []*requestOp `json:"success,omitempty"`
+	}
+
+	txnResponse struct {
+		Header    responseHeader `json:"header"`
+		Succeeded bool           `json:"succeeded,omitempty"`
+		Responses []*responseOp  `json:"responses,omitempty"`
+	}
+
+	watchCreateRequest struct {
+		Key           []byte   `json:"key,omitempty"`
+		RangeEnd      []byte   `json:"range_end,omitempty"`
+		StartRevision revision `json:"start_revision,omitempty"`
+	}
+
+	watchRequest struct {
+		CreateRequest *watchCreateRequest `json:"create_request"`
+	}
+
+	event struct {
+		// Type is empty for PUT, which is the default value.
+		Type string    `json:"type,omitempty"`
+		Kv   *keyValue `json:"kv"`
+	}
+
+	watchResponse struct {
+		Header          responseHeader `json:"header"`
+		Created         bool           `json:"created,omitempty"`
+		Canceled        bool           `json:"canceled,omitempty"`
+		CompactRevision revision       `json:"compact_revision,omitempty"`
+		Events          []*event       `json:"events,omitempty"`
+	}
+
+	// watchStreamResponse is a message of the watch stream.
+	watchStreamResponse struct {
+		Result *watchResponse `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+)
+
+// deleteEvent is the type of events of deleted keys.
+const deleteEvent = "DELETE"
+
+// client talks to the JSON gateway of the key-value service.
+type client struct {
+	// endpoints are the base URLs of the API of the members, like http://localhost:2379/v3alpha
+	endpoints []string
+	http      *http.Client
+
+	// current is the index of the endpoint in use.
+	current int32
+}
+
+// prefixEnd returns the end of the range of keys that begin with the prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// the prefix is all 0xff; the range is all keys after it.
+	return []byte{0}
+}
+
+func (c *client) call(ctx context.Context, path string, req interface{}, resp interface{}) error {
+	body, err := c.post(ctx, path, req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+	return json.NewDecoder(body).Decode(resp)
+}
+
+func (c *client) post(ctx context.Context, path string, req interface{}) (io.ReadCloser, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	// members are tried in turn, starting at the one that last succeeded.
+	var resp *http.Response
+	cur := int(atomic.LoadInt32(&c.current))
+	for i := range c.endpoints {
+		idx := (cur + i) % len(c.endpoints)
+		var hreq *http.Request
+		if hreq, err = http.NewRequest(http.MethodPost, c.endpoints[idx]+path, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		hreq.Header.Set("Content-Type", "application/json")
+		if resp, err = c.http.Do(hreq.WithContext(ctx)); err == nil {
+			atomic.StoreInt32(&c.current, int32(idx))
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s failed with %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp.Body, nil
+}
+
+// list returns the key-values whose keys begin with the prefix, and the revision of the store.
+func (c *client) list(ctx context.Context, prefix []byte) ([]*keyValue, int64, error) {
+	resp := &rangeResponse{}
+	if err := c.call(ctx, "/kv/range", &rangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)}, resp); err != nil {
+		return nil, 0, err
+	}
+	return resp.Kvs, int64(resp.Header.Revision), nil
+}
+
+// put writes the value if the key is at the modRevision, and returns the revision of the write.
+// A modRevision of 0 requires that the key does not exist, and -1 writes unconditionally.
+func (c *client) put(ctx context.Context, key []byte, value []byte, modRevision int64) (int64, bool, error) {
+	txn := &txnRequest{
+		Success: []*requestOp{{RequestPut: &putRequest{Key: key, Value: value}}},
+	}
+	if modRevision >= 0 {
+		txn.Compare = []*compare{{Key: key, Result: "EQUAL", Target: "MOD", ModRevision: revision(modRevision)}}
+	}
+	resp := &txnResponse{}
+	if err := c.call(ctx, "/kv/txn", txn, resp); err != nil {
+		return 0, false, err
+	}
+	return int64(resp.Header.Revision), resp.Succeeded, nil
+}
+
+// delete removes the key if it is at the modRevision, and returns false if it does not exist.
+// A modRevision of -1 removes the key unconditionally. The second result is false
+// if the key is not at the modRevision.
+func (c *client) delete(ctx context.Context, key []byte, modRevision int64) (bool, bool, error) {
+	txn := &txnRequest{
+		Success: []*requestOp{{RequestDeleteRange: &deleteRangeRequest{Key: key}}},
+	}
+	if modRevision >= 0 {
+		txn.Compare = []*compare{{Key: key, Result: "EQUAL", Target: "MOD", ModRevision: revision(modRevision)}}
+	}
+	resp := &txnResponse{}
+	if err := c.call(ctx, "/kv/txn", txn, resp); err != nil {
+		return false, false, err
+	}
+	if !resp.Succeeded {
+		return false, false, nil
+	}
+	deleted := len(resp.Responses) > 0 && resp.Responses[0].ResponseDeleteRange != nil &&
+		resp.Responses[0].ResponseDeleteRange.Deleted > 0
+	return deleted, true, nil
+}
+
+// watch streams the events of the keys which begin with the prefix, starting at startRevision,
+// to fn until the context is canceled or the stream fails. It returns errCompacted
+// if startRevision is compacted.
+func (c *client) watch(ctx context.Context, prefix []byte, startRevision int64, fn func(*watchResponse)) error {
+	body, err := c.post(ctx, "/watch", &watchRequest{CreateRequest: &watchCreateRequest{
+		Key:           prefix,
+		RangeEnd:      prefixEnd(prefix),
+		StartRevision: revision(startRevision),
+	}})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+	dec := json.NewDecoder(bufio.NewReader(body))
+	for {
+		msg := &watchStreamResponse{}
+		if err := dec.Decode(msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+		if msg.Result == nil {
+			continue
+		}
+		if msg.Result.CompactRevision > 0 {
+			return errCompacted
+		}
+		if msg.Result.Canceled {
+			return errors.New("watch canceled by the server")
+		}
+		fn(msg.Result)
+	}
+}
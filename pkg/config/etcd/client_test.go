@@ -0,0 +1,59 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	for _, c := range []struct {
+		prefix string
+		want   string
+	}{
+		{"/a/", "/a0"},
+		{"ab", "ac"},
+		{"a\xff", "b"},
+		{"\xff\xff", "\x00"},
+	} {
+		if got := string(prefixEnd([]byte(c.prefix))); got != c.want {
+			t.Errorf("%q: Got %q, Want %q", c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestRevisionJSON(t *testing.T) {
+	data, err := json.Marshal(&keyValue{Key: []byte("k"), ModRevision: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"key":"aw==","mod_revision":"12"}`; string(data) != want {
+		t.Errorf("Got %s, Want %s", data, want)
+	}
+	for _, in := range []string{`{"mod_revision":"12"}`, `{"mod_revision":12}`} {
+		kv := &keyValue{}
+		if err = json.Unmarshal([]byte(in), kv); err != nil {
+			t.Errorf("%s: Got %v, Want nil", in, err)
+		}
+		if want := (&keyValue{ModRevision: 12}); !reflect.DeepEqual(kv, want) {
+			t.Errorf("%s: Got %+v, Want %+v", in, kv, want)
+		}
+	}
+	if err = json.Unmarshal([]byte(`{"mod_revision":"x"}`), &keyValue{}); err == nil {
+		t.Errorf("Got nil, Want error")
+	}
+}
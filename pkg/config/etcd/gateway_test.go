@@ -0,0 +1,144 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/mixer/pkg/config/store"
+)
+
+// exchange is a request to the gateway and its responses, as the etcd 3.2 gateway encodes them:
+// 64 bit integers are strings, bytes are base64 and watches stream one response per line.
+type exchange struct {
+	Path     string            `json:"path"`
+	Request  interface{}       `json:"request"`
+	Response []json.RawMessage `json:"response"`
+}
+
+// newGateway serves the exchanges in testdata/gateway.json. Requests which do not
+// match an exchange fail. Streams are kept open until the client goes away.
+func newGateway(t *testing.T) *httptest.Server {
+	data, err := ioutil.ReadFile("testdata/gateway.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exchanges []*exchange
+	if err = json.Unmarshal(data, &exchanges); err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, ex := range exchanges {
+			if ex.Path != r.URL.Path || !reflect.DeepEqual(ex.Request, req) {
+				continue
+			}
+			for _, resp := range ex.Response {
+				_, _ = w.Write(append(resp, '\n'))
+				w.(http.Flusher).Flush()
+			}
+			if r.URL.Path == defaultAPIPath+"/watch" {
+				<-r.Context().Done()
+			}
+			return
+		}
+		t.Errorf("Unexpected request to %s: %v", r.URL.Path, req)
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}))
+}
+
+func TestStoreGateway(t *testing.T) {
+	srv := newGateway(t)
+	defer srv.Close()
+	u, err := url.Parse("etcd://" + srv.Listener.Addr().String() + "/testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewStore(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := b.(*Store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() store.BackendEvent {
+		select {
+		case ev := <-wch:
+			return ev
+		case <-time.After(waitForTimeout):
+			t.Fatal("no event")
+		}
+		return store.BackendEvent{}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Init(ctx, []string{"Handler"}) }()
+	k := store.Key{Kind: "Handler", Namespace: "ns", Name: "existing"}
+	want := store.BackendEvent{Type: store.Update, Key: k, Value: &store.BackEndResource{
+		Metadata: store.ResourceMeta{Name: "existing", Namespace: "ns", Labels: map[string]string{"app": "mixer"}, Revision: "2"},
+		Spec:     map[string]interface{}{"adapter": "noop"},
+	}}
+	if ev := next(); !reflect.DeepEqual(ev, want) {
+		t.Errorf("Got %+v, Want %+v", ev, want)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	rev, err := s.Put(k, &store.BackEndResource{
+		Metadata: store.ResourceMeta{Revision: "2"},
+		Spec:     map[string]interface{}{"adapter": "noop2"},
+	})
+	if err != nil || rev != "4" {
+		t.Errorf("Got %s/%v, Want revision 4", rev, err)
+	}
+	if err = s.Delete(k, "2"); err != store.ErrConflict {
+		t.Errorf("Got %v, Want ErrConflict", err)
+	}
+	if err = s.Delete(k, "4"); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+
+	// the changes are watched.
+	want = store.BackendEvent{Type: store.Update, Key: k, Value: &store.BackEndResource{
+		Metadata: store.ResourceMeta{Name: "existing", Namespace: "ns", Revision: "4"},
+		Spec:     map[string]interface{}{"adapter": "noop2"},
+	}}
+	if ev := next(); !reflect.DeepEqual(ev, want) {
+		t.Errorf("Got %+v, Want %+v", ev, want)
+	}
+	if ev := next(); ev.Type != store.Delete || ev.Key != k {
+		t.Errorf("Got %+v, Want delete of %v", ev, k)
+	}
+	if _, err = s.Get(k); err != store.ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+)
+
+// standin is an in-process server of the subset of the JSON gateway API used by the client.
+type standin struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	revision  int64
+	compacted int64
+	data      map[string]*keyValue
+	history   []*historyEvent
+	// changed is closed and replaced on every change.
+	changed chan struct{}
+	// dropped is closed and replaced to disconnect the watches.
+	dropped chan struct{}
+}
+
+type historyEvent struct {
+	revision int64
+	ev       *event
+}
+
+func newStandin() *standin {
+	s := &standin{
+		revision: 1,
+		data:     map[string]*keyValue{},
+		changed:  make(chan struct{}),
+		dropped:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(defaultAPIPath+"/kv/range", s.handleRange)
+	mux.HandleFunc(defaultAPIPath+"/kv/txn", s.handleTxn)
+	mux.HandleFunc(defaultAPIPath+"/watch", s.handleWatch)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func inRange(key []byte, start []byte, end []byte) bool {
+	return string(key) >= string(start) && string(key) < string(end)
+}
+
+func (s *standin) handleRange(w http.ResponseWriter, r *http.Request) {
+	req := &rangeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	resp := &rangeResponse{Header: responseHeader{Revision: revision(s.revision)}}
+	for _, kv := range s.data {
+		if inRange(kv.Key, req.Key, req.RangeEnd) {
+			resp.Kvs = append(resp.Kvs, kv)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(resp.Kvs, func(i, j int) bool { return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key) })
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *standin) handleTxn(w http.ResponseWriter, r *http.Request) {
+	req := &txnRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &txnResponse{Succeeded: true}
+	for _, c := range req.Compare {
+		var mod revision
+		if kv, ok := s.data[string(c.Key)]; ok {
+			mod = kv.ModRevision
+		}
+		if mod != c.ModRevision {
+			resp.Succeeded = false
+		}
+	}
+	if resp.Succeeded {
+		for _, op := range req.Success {
+			rop := &responseOp{}
+			switch {
+			case op.RequestPut != nil:
+				s.putLocked(op.RequestPut.Key, op.RequestPut.Value)
+			case op.RequestDeleteRange != nil:
+				rop.ResponseDeleteRange = &struct {
+					Deleted revision `json:"deleted,omitempty"`
+				}{}
+				if s.deleteLocked(op.RequestDeleteRange.Key) {
+					rop.ResponseDeleteRange.Deleted = 1
+				}
+			}
+			resp.Responses = append(resp.Responses, rop)
+		}
+	}
+	resp.Header.Revision = revision(s.revision)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *standin) put(key string, value string) {
+	s.mu.Lock()
+	s.putLocked([]byte(key), []byte(value))
+	s.mu.Unlock()
+}
+
+func (s *standin) putLocked(key []byte, value []byte) {
+	s.revision++
+	kv := &keyValue{Key: key, Value: value, ModRevision: revision(s.revision)}
+	s.data[string(key)] = kv
+	s.recordLocked(&event{Kv: kv})
+}
+
+func (s *standin) deleteLocked(key []byte) bool {
+	if _, ok := s.data[string(key)]; !ok {
+		return false
+	}
+	s.revision++
+	delete(s.data, string(key))
+	s.recordLocked(&event{Type: deleteEvent, Kv: &keyValue{Key: key, ModRevision: revision(s.revision)}})
+	return true
+}
+
+func (s *standin) recordLocked(ev *event) {
+	s.history = append(s.history, &historyEvent{revision: s.revision, ev: ev})
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *standin) handleWatch(w http.ResponseWriter, r *http.Request) {
+	req := &watchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.CreateRequest == nil {
+		http.Error(w, "bad watch request", http.StatusBadRequest)
+		return
+	}
+	cr := req.CreateRequest
+	enc := json.NewEncoder(w)
+	flusher := w.(http.Flusher)
+	send := func(resp *watchResponse) {
+		_ = enc.Encode(&watchStreamResponse{Result: resp})
+		flusher.Flush()
+	}
+
+	s.mu.Lock()
+	if compacted := s.compacted; cr.StartRevision > 0 && int64(cr.StartRevision) <= compacted {
+		s.mu.Unlock()
+		send(&watchResponse{Canceled: true, CompactRevision: revision(compacted)})
+		return
+	}
+	send(&watchResponse{Header: responseHeader{Revision: revision(s.revision)}, Created: true})
+	next := int64(cr.StartRevision)
+	if next == 0 {
+		next = s.revision + 1
+	}
+	dropped := s.dropped
+	for {
+		resp := &watchResponse{Header: responseHeader{Revision: revision(s.revision)}}
+		for _, h := range s.history {
+			if h.revision >= next && inRange(h.ev.Kv.Key, cr.Key, cr.RangeEnd) {
+				resp.Events = append(resp.Events, h.ev)
+			}
+		}
+		next = s.revision + 1
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(resp.Events) > 0 {
+			send(resp)
+		}
+		select {
+		case <-changed:
+		case <-dropped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		s.mu.Lock()
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcd provides a store.Store2Backend on a key-value service which
+// serves the etcd v3 API through its JSON gateway.
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/mixer/pkg/config/store"
+)
+
+const (
+	// defaultAPIPath is the path of the API on the members, as served by the etcd 3.2 gateway.
+	// It can be customized through "api" query parameter in the config URL, like
+	// etcd://localhost:2379/?api=/v3beta for the gateway of later releases.
+	defaultAPIPath = "/v3alpha"
+
+	// defaultPrefix is the prefix of the keys when the config URL has no path.
+	defaultPrefix = "/istio/config"
+
+	// requestTimeout is the timeout of requests other than watch.
+	requestTimeout = 10 * time.Second
+)
+
+// The interval to wait before a failed watch is restarted. This is not const
+// to allow changing the value for unittests.
+var retryInterval = time.Second
+
+// Store offers store.Store2Backend interface through a key-value service.
+// Resources are stored as JSON under <prefix>/<kind>/<namespace>/<name>, and
+// the modification revision of the key is the revision of the resource.
+type Store struct {
+	client *client
+	prefix string
+
+	mu    sync.RWMutex
+	kinds map[string]bool
+	data  map[store.Key]*store.BackEndResource
+	// revision is the revision of the store reflected in data.
+	revision int64
+
+	watchMutex sync.RWMutex
+	watchCtx   context.Context
+	watchCh    chan store.BackendEvent
+}
+
+var _ store.Store2Backend = &Store{}
+
+// value is the stored form of a resource.
+type value struct {
+	Metadata struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec map[string]interface{} `json:"spec"`
+}
+
+// root returns the prefix of all keys of the store.
+func (s *Store) root() []byte {
+	return []byte(s.prefix + "/")
+}
+
+func (s *Store) keyOf(key store.Key) []byte {
+	return []byte(strings.Join([]string{s.prefix, key.Kind, key.Namespace, key.Name}, "/"))
+}
+
+// parseKey returns the resource key of the stored key.
+func (s *Store) parseKey(k []byte) (store.Key, bool) {
+	parts := strings.Split(strings.TrimPrefix(string(k), string(s.root())), "/")
+	if len(parts) != 3 {
+		return store.Key{}, false
+	}
+	return store.Key{Kind: parts[0], Namespace: parts[1], Name: parts[2]}, true
+}
+
+// toResource decodes the key-value into a resource. It returns false if the
+// key-value is not a resource of the known kinds.
+func (s *Store) toResource(kv *keyValue) (store.Key, *store.BackEndResource, bool) {
+	key, ok := s.parseKey(kv.Key)
+	if !ok || !s.kinds[key.Kind] {
+		return key, nil, false
+	}
+	v := &value{}
+	if err := json.Unmarshal(kv.Value, v); err != nil {
+		glog.Errorf("Failed to decode %s: %v", kv.Key, err)
+		return key, nil, false
+	}
+	return key, &store.BackEndResource{
+		Metadata: store.ResourceMeta{
+			Name:        key.Name,
+			Namespace:   key.Namespace,
+			Labels:      v.Metadata.Labels,
+			Annotations: v.Metadata.Annotations,
+			Revision:    strconv.FormatInt(int64(kv.ModRevision), 10),
+		},
+		Spec: v.Spec,
+	}, true
+}
+
+// Init implements store.Store2Backend interface.
+func (s *Store) Init(ctx context.Context, kinds []string) error {
+	s.kinds = make(map[string]bool, len(kinds))
+	for _, k := range kinds {
+		s.kinds[k] = true
+	}
+	s.data = map[store.Key]*store.BackEndResource{}
+	if err := s.reload(ctx); err != nil {
+		return err
+	}
+	go s.watch(ctx)
+	return nil
+}
+
+// reload lists all the resources and replaces the cache with them. Differences
+// from the previous content are dispatched as events.
+func (s *Store) reload(ctx context.Context) error {
+	lctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	kvs, rev, err := s.client.list(lctx, s.root())
+	cancel()
+	if err != nil {
+		return err
+	}
+	data := make(map[store.Key]*store.BackEndResource, len(kvs))
+	for _, kv := range kvs {
+		if key, res, ok := s.toResource(kv); ok {
+			data[key] = res
+		}
+	}
+
+	s.mu.Lock()
+	old := s.data
+	s.data = data
+	s.revision = rev
+	s.mu.Unlock()
+
+	for key, res := range data {
+		if o, ok := old[key]; !ok || o.Metadata.Revision != res.Metadata.Revision {
+			s.dispatch(store.BackendEvent{Type: store.Update, Key: key, Value: res})
+		}
+	}
+	for key := range old {
+		if _, ok := data[key]; !ok {
+			s.dispatch(store.BackendEvent{Type: store.Delete, Key: key})
+		}
+	}
+	return nil
+}
+
+// watch keeps watching the changes after the last known revision. Failed watches
+// are resumed from there. If the revision is compacted, everything is reloaded.
+func (s *Store) watch(ctx context.Context) {
+	for {
+		s.mu.RLock()
+		rev := s.revision
+		s.mu.RUnlock()
+		err := s.client.watch(ctx, s.root(), rev+1, s.apply)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errCompacted {
+			glog.Warningf("Revision %d of %s is compacted, reloading", rev, s.prefix)
+			if err = s.reload(ctx); err == nil {
+				continue
+			}
+		}
+		glog.Warningf("Watching %s failed, resuming from revision %d in %v: %v", s.prefix, rev+1, retryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// apply applies the watched events to the cache and dispatches them.
+func (s *Store) apply(resp *watchResponse) {
+	for _, ev := range resp.Events {
+		if ev.Kv == nil {
+			continue
+		}
+		if bev, ok := s.update(ev); ok {
+			s.dispatch(bev)
+		}
+	}
+}
+
+// update applies the event to the cache, and returns the event to dispatch if
+// it changes a resource of the known kinds.
+func (s *Store) update(ev *event) (store.BackendEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rev := int64(ev.Kv.ModRevision); rev > s.revision {
+		s.revision = rev
+	}
+	if ev.Type == deleteEvent {
+		key, ok := s.parseKey(ev.Kv.Key)
+		if _, exists := s.data[key]; !ok || !exists {
+			return store.BackendEvent{}, false
+		}
+		delete(s.data, key)
+		return store.BackendEvent{Type: store.Delete, Key: key}, true
+	}
+	key, res, ok := s.toResource(ev.Kv)
+	if !ok {
+		return store.BackendEvent{}, false
+	}
+	s.data[key] = res
+	return store.BackendEvent{Type: store.Update, Key: key, Value: res}, true
+}
+
+// Watch implements store.Store2Backend interface.
+func (s *Store) Watch(ctx context.Context) (<-chan store.BackendEvent, error) {
+	ch := make(chan store.BackendEvent)
+	s.watchMutex.Lock()
+	s.watchCtx = ctx
+	s.watchCh = ch
+	s.watchMutex.Unlock()
+	return ch, nil
+}
+
+func (s *Store) dispatch(ev store.BackendEvent) {
+	s.watchMutex.RLock()
+	defer s.watchMutex.RUnlock()
+	if s.watchCtx == nil {
+		return
+	}
+	select {
+	case <-s.watchCtx.Done():
+	case s.watchCh <- ev:
+	}
+}
+
+// Get implements store.Store2Backend interface.
+func (s *Store) Get(key store.Key) (*store.BackEndResource, error) {
+	s.mu.RLock()
+	r, ok := s.data[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return r, nil
+}
+
+// List implements store.Store2Backend interface.
+func (s *Store) List() map[store.Key]*store.BackEndResource {
+	s.mu.RLock()
+	result := make(map[store.Key]*store.BackEndResource, len(s.data))
+	for k, v := range s.data {
+		result[k] = v
+	}
+	s.mu.RUnlock()
+	return result
+}
+
+// Put implements store.Store2Backend interface.
+func (s *Store) Put(key store.Key, resource *store.BackEndResource) (string, error) {
+	if !s.kinds[key.Kind] {
+		return "", fmt.Errorf("unrecognized kind %s", key.Kind)
+	}
+	modRevision := int64(-1)
+	if r := resource.Metadata.Revision; r != "" {
+		var err error
+		if modRevision, err = strconv.ParseInt(r, 10, 64); err != nil {
+			return "", store.ErrConflict
+		}
+	}
+	v := &value{Spec: resource.Spec}
+	v.Metadata.Labels = resource.Metadata.Labels
+	v.Metadata.Annotations = resource.Metadata.Annotations
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	rev, ok, err := s.client.put(ctx, s.keyOf(key), data, modRevision)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", store.ErrConflict
+	}
+	return strconv.FormatInt(rev, 10), nil
+}
+
+// Delete implements store.Store2Backend interface.
+func (s *Store) Delete(key store.Key, revision string) error {
+	modRevision := int64(-1)
+	if revision != "" {
+		var err error
+		if modRevision, err = strconv.ParseInt(revision, 10, 64); err != nil {
+			return store.ErrConflict
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	deleted, ok, err := s.client.delete(ctx, s.keyOf(key), modRevision)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return store.ErrConflict
+	}
+	if !deleted {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// NewStore creates a new Store instance. The config URL is like
+// etcd://host:2379/istio/config?endpoints=host2:2379,host3:2379
+// where the path is the prefix of the keys, and "endpoints" lists the other members
+// to fail over to. The etcds scheme connects through HTTPS.
+func NewStore(u *url.URL) (store.Store2Backend, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in the config URL %s", u)
+	}
+	scheme := "http"
+	if u.Scheme == "etcds" {
+		scheme = "https"
+	}
+	apiPath := defaultAPIPath
+	if p := u.Query().Get("api"); p != "" {
+		apiPath = "/" + strings.Trim(p, "/")
+	}
+	hosts := []string{u.Host}
+	if e := u.Query().Get("endpoints"); e != "" {
+		hosts = append(hosts, strings.Split(e, ",")...)
+	}
+	endpoints := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		endpoints = append(endpoints, scheme+"://"+h+apiPath)
+	}
+	prefix := strings.TrimSuffix(u.Path, "/")
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &Store{
+		client: &client{endpoints: endpoints, http: &http.Client{}},
+		prefix: prefix,
+	}, nil
+}
+
+// Register registers this module as a Store2Backend.
+// Do not use 'init()' for automatic registration; linker will drop
+// the whole module because it looks unused.
+func Register(builders map[string]store.Store2Builder) {
+	builders["etcd"] = NewStore
+	builders["etcds"] = NewStore
+}
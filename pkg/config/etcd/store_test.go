@@ -0,0 +1,295 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/mixer/pkg/config/store"
+)
+
+// The timeout for "waitFor" function, waiting for the expected event to come.
+const waitForTimeout = time.Second
+
+func waitFor(wch <-chan store.BackendEvent, ct store.ChangeType, key store.Key) error {
+	timeout := time.After(waitForTimeout)
+	for {
+		select {
+		case ev := <-wch:
+			if ev.Key == key && ev.Type == ct {
+				return nil
+			}
+		case <-timeout:
+			return context.DeadlineExceeded
+		}
+	}
+}
+
+func newTestStore(t *testing.T, srv *standin) *Store {
+	u, err := url.Parse("etcd://" + srv.Listener.Addr().String() + "/testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*Store)
+}
+
+func TestStore(t *testing.T) {
+	srv := newStandin()
+	defer srv.Close()
+	srv.put("/testing/Handler/ns/existing", `{"metadata":{"labels":{"app":"mixer"}},"spec":{"adapter":"noop"}}`)
+	srv.put("/testing/Unknown/ns/unknown", `{"spec":{}}`)
+	srv.put("/other/Handler/ns/other", `{"spec":{}}`)
+
+	s := newTestStore(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler", "Action"}); err != nil {
+		t.Fatal(err)
+	}
+	existing := store.Key{Kind: "Handler", Namespace: "ns", Name: "existing"}
+	want := map[store.Key]*store.BackEndResource{
+		existing: {
+			Metadata: store.ResourceMeta{
+				Name:      "existing",
+				Namespace: "ns",
+				Labels:    map[string]string{"app": "mixer"},
+				Revision:  "2",
+			},
+			Spec: map[string]interface{}{"adapter": "noop"},
+		},
+	}
+	if lst := s.List(); !reflect.DeepEqual(lst, want) {
+		t.Errorf("Got %+v, Want %+v", lst, want)
+	}
+
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := store.Key{Kind: "Handler", Namespace: "ns", Name: "default"}
+	if _, err = s.Get(k); err != store.ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+	h := map[string]interface{}{"name": "default", "adapter": "noop"}
+	rev, err := s.Put(k, &store.BackEndResource{Spec: h})
+	if err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	if err = waitFor(wch, store.Update, k); err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	r, err := s.Get(k)
+	if err != nil || r.Metadata.Revision != rev || !reflect.DeepEqual(r.Spec, h) {
+		t.Errorf("Got %+v/%v, Want %v at revision %s", r, err, h, rev)
+	}
+
+	h2 := map[string]interface{}{"name": "default", "adapter": "noop2"}
+	rev2, err := s.Put(k, &store.BackEndResource{Metadata: store.ResourceMeta{Revision: rev}, Spec: h2})
+	if err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if _, err = s.Put(k, &store.BackEndResource{Metadata: store.ResourceMeta{Revision: rev}, Spec: h}); err != store.ErrConflict {
+		t.Errorf("Got %v, Want ErrConflict", err)
+	}
+	if _, err = s.Put(store.Key{Kind: "Unknown", Namespace: "ns", Name: "default"}, &store.BackEndResource{}); err == nil {
+		t.Errorf("Got nil, Want error for unknown kind")
+	}
+	if err = waitFor(wch, store.Update, k); err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	if r, err = s.Get(k); err != nil || !reflect.DeepEqual(r.Spec, h2) {
+		t.Errorf("Got %+v/%v, Want %v", r, err, h2)
+	}
+
+	if err = s.Delete(k, rev); err != store.ErrConflict {
+		t.Errorf("Got %v, Want ErrConflict", err)
+	}
+	if err = s.Delete(k, rev2); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if err = waitFor(wch, store.Delete, k); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if _, err = s.Get(k); err != store.ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+	if err = s.Delete(k, ""); err != store.ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+}
+
+func TestStoreWatchResume(t *testing.T) {
+	ri := retryInterval
+	retryInterval = time.Millisecond
+	defer func() { retryInterval = ri }()
+
+	srv := newStandin()
+	defer srv.Close()
+	s := newTestStore(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1 := store.Key{Kind: "Handler", Namespace: "ns", Name: "h1"}
+	srv.put("/testing/Handler/ns/h1", `{"spec":{"adapter":"noop"}}`)
+	if err = waitFor(wch, store.Update, k1); err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+
+	// changes while the watch is disconnected are received after it is resumed.
+	srv.mu.Lock()
+	close(srv.dropped)
+	srv.dropped = make(chan struct{})
+	srv.putLocked([]byte("/testing/Handler/ns/h2"), []byte(`{"spec":{"adapter":"noop"}}`))
+	srv.deleteLocked([]byte("/testing/Handler/ns/h1"))
+	srv.mu.Unlock()
+	if err = waitFor(wch, store.Update, store.Key{Kind: "Handler", Namespace: "ns", Name: "h2"}); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if err = waitFor(wch, store.Delete, k1); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+}
+
+func TestStoreWatchCompacted(t *testing.T) {
+	ri := retryInterval
+	retryInterval = time.Millisecond
+	defer func() { retryInterval = ri }()
+
+	srv := newStandin()
+	defer srv.Close()
+	srv.put("/testing/Handler/ns/h1", `{"spec":{"adapter":"noop"}}`)
+	srv.put("/testing/Handler/ns/h2", `{"spec":{"adapter":"noop"}}`)
+	s := newTestStore(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the history of changes while the watch is disconnected is lost; they are found by reloading.
+	srv.mu.Lock()
+	close(srv.dropped)
+	srv.dropped = make(chan struct{})
+	srv.putLocked([]byte("/testing/Handler/ns/h1"), []byte(`{"spec":{"adapter":"noop2"}}`))
+	srv.deleteLocked([]byte("/testing/Handler/ns/h2"))
+	srv.compacted = srv.revision
+	srv.history = nil
+	srv.mu.Unlock()
+
+	k1 := store.Key{Kind: "Handler", Namespace: "ns", Name: "h1"}
+	if err = waitFor(wch, store.Update, k1); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if err = waitFor(wch, store.Delete, store.Key{Kind: "Handler", Namespace: "ns", Name: "h2"}); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if r, err := s.Get(k1); err != nil || r.Spec["adapter"] != "noop2" {
+		t.Errorf("Got %+v/%v, Want noop2", r, err)
+	}
+
+	// the watch continues after the reload.
+	srv.put("/testing/Handler/ns/h3", `{"spec":{"adapter":"noop"}}`)
+	if err = waitFor(wch, store.Update, store.Key{Kind: "Handler", Namespace: "ns", Name: "h3"}); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+}
+
+func TestStoreFailover(t *testing.T) {
+	srv := newStandin()
+	defer srv.Close()
+	down := newStandin()
+	down.Close()
+	u, err := url.Parse("etcd://" + down.Listener.Addr().String() + "/testing?endpoints=" + srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewStore(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = b.Init(ctx, []string{"Handler"}); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+}
+
+func TestStoreInitFailure(t *testing.T) {
+	srv := newStandin()
+	srv.Close()
+	s := newTestStore(t, srv)
+	if err := s.Init(context.Background(), []string{"Handler"}); err == nil {
+		t.Errorf("Got nil, Want error")
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	for _, c := range []struct {
+		u         string
+		endpoints []string
+		prefix    string
+		ok        bool
+	}{
+		{"etcd://localhost:2379", []string{"http://localhost:2379/v3alpha"}, defaultPrefix, true},
+		{"etcd://localhost:2379/mixer/", []string{"http://localhost:2379/v3alpha"}, "/mixer", true},
+		{"etcds://a:2379/mixer?endpoints=b:2379,c:2379&api=v3beta", []string{
+			"https://a:2379/v3beta", "https://b:2379/v3beta", "https://c:2379/v3beta"}, "/mixer", true},
+		{"etcd:///mixer", nil, "", false},
+	} {
+		u, err := url.Parse(c.u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := NewStore(u)
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("%s: Got %v, Want ok=%t", c.u, err, c.ok)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		s := b.(*Store)
+		if !reflect.DeepEqual(s.client.endpoints, c.endpoints) || s.prefix != c.prefix {
+			t.Errorf("%s: Got %v %s, Want %v %s", c.u, s.client.endpoints, s.prefix, c.endpoints, c.prefix)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := store.NewRegistry2(Register)
+	for _, u := range []string{"etcd://localhost:2379/mixer", "etcds://localhost:2379/mixer"} {
+		if _, err := r.NewStore2(u); err != nil {
+			t.Errorf("%s: Got %v, Want nil", u, err)
+		}
+	}
+}
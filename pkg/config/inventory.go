@@ -16,6 +16,7 @@ package config
 
 import (
 	"istio.io/mixer/pkg/config/crd"
+	"istio.io/mixer/pkg/config/etcd"
 	"istio.io/mixer/pkg/config/store"
 )
 
@@ -28,5 +29,6 @@ func StoreInventory() []store.RegisterFunc {
 func Store2Inventory() []store.RegisterFunc2 {
 	return []store.RegisterFunc2{
 		crd.Register,
+		etcd.Register,
 	}
 }
@@ -0,0 +1,704 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migrate translates the legacy config of a KeyValueStore into v1alpha2 resources.
+//
+// The legacy config is laid out as /scopes/{scope}/adapters, /scopes/{scope}/descriptors
+// and /scopes/{scope}/subjects/{subject}/rules. Adapters are translated into handlers,
+// aspects into instances of the matching templates, and aspect rules into rules which
+// carry over the selectors.
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"istio.io/mixer/pkg/config/store"
+)
+
+const (
+	apiVersion = "config.istio.io/v1alpha2"
+
+	global         = "global"
+	defaultAdapter = "default"
+
+	rulesKind             = "rule"
+	attributeManifestKind = "attributemanifest"
+
+	// memQuotaImpl is the adapter whose quota limits are translated into its handler.
+	memQuotaImpl = "memquota"
+	// listCheckerImpl is the adapter whose blacklist flag is translated into its handler.
+	listCheckerImpl = "listchecker"
+
+	// defaultMonitoredResourceType is the monitored resource type of metrics and logs,
+	// which the legacy aspects do not have.
+	defaultMonitoredResourceType = `"UNSPECIFIED"`
+	// defaultSeverity and defaultTimestamp are the expressions of access logs.
+	defaultSeverity  = `"Default"`
+	defaultTimestamp = "request.time"
+)
+
+// Legacy aspect kinds.
+const (
+	quotasKind          = "quotas"
+	metricsKind         = "metrics"
+	accessLogsKind      = "access-logs"
+	applicationLogsKind = "application-logs"
+	listsKind           = "lists"
+	denialsKind         = "denials"
+)
+
+// aspectTemplates maps the legacy aspect kinds to the templates of their instances.
+var aspectTemplates = map[string]string{
+	quotasKind:          "quota",
+	metricsKind:         "metric",
+	accessLogsKind:      "logentry",
+	applicationLogsKind: "logentry",
+	listsKind:           "listentry",
+	denialsKind:         "checknothing",
+}
+
+// descriptorSections are the descriptors which are not used by v1alpha2 templates.
+var descriptorSections = []string{"metrics", "logs", "quotas", "monitoredResources", "monitored_resources", "principals"}
+
+// nameReplacer matches the characters which are not allowed in resource names.
+var nameReplacer = regexp.MustCompile("[^a-z0-9-]+")
+
+// Options configures a migration.
+type Options struct {
+	// Namespace is the namespace of the translated resources.
+	Namespace string
+	// IdentityAttribute is the attribute which the legacy subjects were matched against.
+	IdentityAttribute string
+}
+
+// Resource is a v1alpha2 resource translated from the legacy config.
+type Resource struct {
+	Key  store.Key
+	Spec map[string]interface{}
+}
+
+// Result is the outcome of a migration.
+type Result struct {
+	// Resources are the translated resources: attribute manifests, handlers, instances and rules.
+	Resources []*Resource
+	// Issues describe the legacy constructs which could not be translated.
+	Issues []string
+}
+
+// YAML returns the resources as yaml documents.
+func (r *Result) YAML() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, res := range r.Resources {
+		data, err := yaml.Marshal(map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       res.Key.Kind,
+			"metadata": map[string]interface{}{
+				"name":      res.Key.Name,
+				"namespace": res.Key.Namespace,
+			},
+			"spec": res.Spec,
+		})
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+type legacyAdapter struct {
+	Name   string                 `json:"name"`
+	Kind   string                 `json:"kind"`
+	Impl   string                 `json:"impl"`
+	Params map[string]interface{} `json:"params"`
+}
+
+type legacyManifest struct {
+	Name       string                 `json:"name"`
+	Revision   interface{}            `json:"revision"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type legacyAspect struct {
+	Kind    string                 `json:"kind"`
+	Adapter string                 `json:"adapter"`
+	Inputs  map[string]interface{} `json:"inputs"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+type legacyRule struct {
+	Selector string          `json:"selector"`
+	Aspects  []*legacyAspect `json:"aspects"`
+	Rules    []*legacyRule   `json:"rules"`
+}
+
+type legacyQuota struct {
+	DescriptorName string            `json:"descriptor_name"`
+	Labels         map[string]string `json:"labels"`
+	MaxAmount      int64             `json:"max_amount"`
+	Expiration     interface{}       `json:"expiration"`
+}
+
+type legacyMetric struct {
+	DescriptorName string            `json:"descriptor_name"`
+	Value          string            `json:"value"`
+	Labels         map[string]string `json:"labels"`
+}
+
+type legacyLog struct {
+	DescriptorName      string            `json:"descriptor_name"`
+	Severity            string            `json:"severity"`
+	Timestamp           string            `json:"timestamp"`
+	TimeFormat          string            `json:"time_format"`
+	Labels              map[string]string `json:"labels"`
+	TemplateExpressions map[string]string `json:"template_expressions"`
+}
+
+type legacyAccessLogs struct {
+	LogName string     `json:"log_name"`
+	Log     *legacyLog `json:"log"`
+}
+
+type legacyApplicationLogs struct {
+	LogName string       `json:"log_name"`
+	Logs    []*legacyLog `json:"logs"`
+}
+
+type legacyList struct {
+	Blacklist       bool   `json:"blacklist"`
+	CheckExpression string `json:"check_expression"`
+}
+
+type adapterKey struct {
+	kind string
+	name string
+}
+
+type migrator struct {
+	opts Options
+
+	adapters map[adapterKey]*legacyAdapter
+
+	// resources of each category, in the order they are translated.
+	manifests []*Resource
+	handlers  []*Resource
+	instances []*Resource
+	rules     []*Resource
+	byKey     map[store.Key]*Resource
+
+	// handlerAdapters are the adapters which the handlers are translated from.
+	handlerAdapters map[store.Key]*legacyAdapter
+
+	issues []string
+}
+
+// Migrate reads the legacy config of kv and translates it into v1alpha2 resources.
+// The constructs which can not be translated are reported in the Issues of the result.
+func Migrate(kv store.KeyValueStore, opts Options) (*Result, error) {
+	keys, _, err := kv.List("/", true)
+	if err != nil {
+		return nil, err
+	}
+	docs := make(map[string]map[string]interface{}, len(keys))
+	for _, key := range keys {
+		val, _, found := kv.Get(key)
+		if !found {
+			continue
+		}
+		doc := map[string]interface{}{}
+		if err = yaml.Unmarshal([]byte(val), &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", key, err)
+		}
+		docs[key] = doc
+	}
+	sort.Strings(keys)
+
+	m := &migrator{
+		opts:     opts,
+		adapters: map[adapterKey]*legacyAdapter{},
+		byKey:    map[store.Key]*Resource{},
+
+		handlerAdapters: map[store.Key]*legacyAdapter{},
+	}
+	// adapters are referred to by the rules, so that they are read first.
+	for _, key := range keys {
+		if doc, ok := docs[key]; ok && lastSegment(key) == "adapters" {
+			if err = m.readAdapters(key, doc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, key := range keys {
+		doc, ok := docs[key]
+		if !ok {
+			continue
+		}
+		switch lastSegment(key) {
+		case "adapters":
+		case "descriptors":
+			err = m.migrateDescriptors(key, doc)
+		case "rules":
+			err = m.migrateRules(key, doc)
+		case "handlers", "instances":
+			m.reportSections(key, doc, lastSegment(key))
+		case "action_rules":
+			m.reportSections(key, doc, "action_rules", "actionRules")
+		default:
+			m.reportf("%s: unknown key is not translated", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Result{Issues: m.issues}
+	for _, rs := range [][]*Resource{m.manifests, m.handlers, m.instances, m.rules} {
+		res.Resources = append(res.Resources, rs...)
+	}
+	return res, nil
+}
+
+func (m *migrator) reportf(format string, args ...interface{}) {
+	m.issues = append(m.issues, fmt.Sprintf(format, args...))
+}
+
+// reportSections reports the non-empty sections of the document as not translated.
+func (m *migrator) reportSections(key string, doc map[string]interface{}, sections ...string) {
+	for _, s := range sections {
+		if !isEmpty(doc[s]) {
+			m.reportf("%s: %s is not translated", key, s)
+		}
+	}
+}
+
+func (m *migrator) readAdapters(key string, doc map[string]interface{}) error {
+	var adapters []*legacyAdapter
+	if err := section(doc, "adapters", &adapters); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", key, err)
+	}
+	for _, a := range adapters {
+		m.adapters[adapterKey{kind: a.Kind, name: a.Name}] = a
+	}
+	return nil
+}
+
+// migrateDescriptors translates attribute manifests. The other descriptors are
+// reported, since v1alpha2 templates define their own types.
+func (m *migrator) migrateDescriptors(key string, doc map[string]interface{}) error {
+	var manifests []*legacyManifest
+	if err := section(doc, "manifests", &manifests); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", key, err)
+	}
+	for _, mf := range manifests {
+		spec := map[string]interface{}{
+			"name":       mf.Name,
+			"attributes": mf.Attributes,
+		}
+		if mf.Revision != nil {
+			spec["revision"] = fmt.Sprint(mf.Revision)
+		}
+		m.manifests = m.add(m.manifests, key, attributeManifestKind, resourceName(mf.Name), spec)
+	}
+	m.reportSections(key, doc, descriptorSections...)
+	return nil
+}
+
+// migrateRules translates the aspect rules of /scopes/{scope}/subjects/{subject}/rules.
+func (m *migrator) migrateRules(key string, doc map[string]interface{}) error {
+	comps := strings.Split(key, "/")
+	if len(comps) != 6 || comps[1] != "scopes" || comps[3] != "subjects" {
+		m.reportf("%s: unknown key is not translated", key)
+		return nil
+	}
+	scope, subject := comps[2], comps[4]
+	var rules []*legacyRule
+	if err := section(doc, "rules", &rules); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", key, err)
+	}
+	match := ""
+	prefix := resourceName(scope)
+	if subject != global {
+		match = fmt.Sprintf(`%s == "%s" || match(%s, "*.%s")`,
+			m.opts.IdentityAttribute, subject, m.opts.IdentityAttribute, subject)
+		if subject != scope {
+			prefix += "-" + resourceName(subject)
+		}
+		if len(rules) > 0 {
+			m.reportf("%s: aspects of subject %s no longer override the aspects of the same kind in less specific subjects",
+				key, subject)
+		}
+	}
+	for i, r := range rules {
+		m.migrateRule(key, fmt.Sprintf("%s-%d", prefix, i), match, r)
+	}
+	return nil
+}
+
+// migrateRule translates an aspect rule and its nested rules, which are
+// selected by the conjunction of their selectors.
+func (m *migrator) migrateRule(key string, name string, match string, r *legacyRule) {
+	match = and(match, r.Selector)
+	var actions []interface{}
+	for i, a := range r.Aspects {
+		path := fmt.Sprintf("%s: aspect %d (%s) of rule %s", key, i, a.Kind, name)
+		if action := m.migrateAspect(key, path, fmt.Sprintf("%s-%d", name, i), a); action != nil {
+			actions = append(actions, action)
+		}
+	}
+	if len(actions) > 0 {
+		spec := map[string]interface{}{"actions": actions}
+		if match != "" {
+			spec["match"] = match
+		}
+		m.rules = m.add(m.rules, key, rulesKind, name, spec)
+	}
+	for i, nested := range r.Rules {
+		m.migrateRule(key, fmt.Sprintf("%s-%d", name, i), match, nested)
+	}
+}
+
+// migrateAspect translates the adapter of the aspect into a handler, and its params
+// into instances. Instances which are not named after a descriptor are named after
+// the aspect, and so are the instances of descriptors which are already translated
+// with a different spec. It returns the action of the rule, or nil if it is not translated.
+func (m *migrator) migrateAspect(key string, path string, name string, a *legacyAspect) map[string]interface{} {
+	tmpl, ok := aspectTemplates[a.Kind]
+	if !ok {
+		m.reportf("%s is not translated: no template replaces the aspect kind", path)
+		return nil
+	}
+	adapterName := a.Adapter
+	if adapterName == "" {
+		adapterName = defaultAdapter
+	}
+	adptr, ok := m.adapters[adapterKey{kind: a.Kind, name: adapterName}]
+	if !ok {
+		m.reportf("%s is not translated: adapter %s of kind %s is not found", path, adapterName, a.Kind)
+		return nil
+	}
+	if len(a.Inputs) > 0 {
+		m.reportf("%s: inputs are not translated", path)
+	}
+	handler := m.handler(key, adptr)
+
+	var instances []interface{}
+	var err error
+	switch a.Kind {
+	case quotasKind:
+		instances, err = m.migrateQuotas(key, path, tmpl, name, handler, adptr.Impl, a.Params)
+	case metricsKind:
+		instances, err = m.migrateMetrics(key, tmpl, name, a.Params)
+	case accessLogsKind:
+		instances, err = m.migrateAccessLogs(key, path, tmpl, name, a.Params)
+	case applicationLogsKind:
+		instances, err = m.migrateApplicationLogs(key, path, tmpl, name, a.Params)
+	case listsKind:
+		instances, err = m.migrateList(key, path, tmpl, name, handler, adptr.Impl, a.Params)
+	case denialsKind:
+		// denials have no params, the handler decides the status.
+		instances = []interface{}{m.instance(key, tmpl, name, name, map[string]interface{}{})}
+	}
+	if err != nil {
+		m.reportf("%s is not translated: %v", path, err)
+		return nil
+	}
+	if len(instances) == 0 {
+		return nil
+	}
+	return map[string]interface{}{
+		"handler":   handler.Key.Name + "." + handler.Key.Kind,
+		"instances": instances,
+	}
+}
+
+// instance adds the instance of the template, and returns its name as referred to by actions.
+// An instance of another aspect with the same name and a different spec, such as a metric
+// of the same descriptor with other labels in another scope or subject, is kept and the
+// instance is named after the aspect as well.
+func (m *migrator) instance(key string, tmpl string, aspect string, name string, spec map[string]interface{}) string {
+	if existing, ok := m.byKey[m.key(tmpl, name)]; ok && name != aspect && !reflect.DeepEqual(existing.Spec, spec) {
+		name += "-" + aspect
+	}
+	m.instances = m.add(m.instances, key, tmpl, name, spec)
+	return name + "." + tmpl
+}
+
+// migrateQuotas translates the quotas into quota instances, and their limits into the handler.
+func (m *migrator) migrateQuotas(key string, path string, tmpl string, aspect string, handler *Resource, impl string,
+	params map[string]interface{}) ([]interface{}, error) {
+	var quotas []*legacyQuota
+	if err := section(params, "quotas", &quotas); err != nil {
+		return nil, err
+	}
+	var instances []interface{}
+	for _, q := range quotas {
+		spec := map[string]interface{}{}
+		if len(q.Labels) > 0 {
+			spec["dimensions"] = q.Labels
+		}
+		name := m.instance(key, tmpl, aspect, resourceName(q.DescriptorName), spec)
+		instances = append(instances, name)
+		m.migrateQuotaLimit(path, handler, impl, name+"."+m.opts.Namespace, q)
+	}
+	return instances, nil
+}
+
+// migrateMetrics translates the metrics into metric instances. The labels become dimensions.
+func (m *migrator) migrateMetrics(key string, tmpl string, aspect string, params map[string]interface{}) ([]interface{}, error) {
+	var metrics []*legacyMetric
+	if err := section(params, "metrics", &metrics); err != nil {
+		return nil, err
+	}
+	var instances []interface{}
+	for _, mt := range metrics {
+		spec := map[string]interface{}{
+			"value":                 mt.Value,
+			"monitoredResourceType": defaultMonitoredResourceType,
+		}
+		if len(mt.Labels) > 0 {
+			spec["dimensions"] = mt.Labels
+		}
+		instances = append(instances, m.instance(key, tmpl, aspect, resourceName(mt.DescriptorName), spec))
+	}
+	return instances, nil
+}
+
+// migrateAccessLogs translates the access log into a logentry instance named after the log.
+func (m *migrator) migrateAccessLogs(key string, path string, tmpl string, aspect string,
+	params map[string]interface{}) ([]interface{}, error) {
+	logs := &legacyAccessLogs{}
+	if err := decodeParams(params, logs); err != nil {
+		return nil, err
+	}
+	if logs.Log == nil {
+		return nil, nil
+	}
+	name := aspect
+	if logs.LogName != "" {
+		name = resourceName(logs.LogName)
+	}
+	return []interface{}{m.instance(key, tmpl, aspect, name, m.logEntry(path, logs.Log))}, nil
+}
+
+// migrateApplicationLogs translates the logs into logentry instances named after their descriptors.
+func (m *migrator) migrateApplicationLogs(key string, path string, tmpl string, aspect string,
+	params map[string]interface{}) ([]interface{}, error) {
+	logs := &legacyApplicationLogs{}
+	if err := decodeParams(params, logs); err != nil {
+		return nil, err
+	}
+	if logs.LogName != "" && len(logs.Logs) > 0 {
+		m.reportf("%s: log_name %s is not translated, the logs are named after their instances", path, logs.LogName)
+	}
+	var instances []interface{}
+	for _, l := range logs.Logs {
+		instances = append(instances, m.instance(key, tmpl, aspect, resourceName(l.DescriptorName), m.logEntry(path, l)))
+	}
+	return instances, nil
+}
+
+// logEntry returns the spec of the logentry instance of the log. The labels and
+// template expressions become variables.
+func (m *migrator) logEntry(path string, l *legacyLog) map[string]interface{} {
+	variables := make(map[string]interface{}, len(l.Labels)+len(l.TemplateExpressions))
+	for k, v := range l.Labels {
+		variables[k] = v
+	}
+	for k, v := range l.TemplateExpressions {
+		if existing, ok := variables[k]; ok && existing != v {
+			m.reportf("%s: template expression %s of log %s is not translated, it conflicts with the label of the same name",
+				path, k, l.DescriptorName)
+			continue
+		}
+		variables[k] = v
+	}
+	if l.TimeFormat != "" {
+		m.reportf("%s: time_format of log %s is not translated", path, l.DescriptorName)
+	}
+	spec := map[string]interface{}{
+		"severity":              l.Severity,
+		"timestamp":             l.Timestamp,
+		"monitoredResourceType": defaultMonitoredResourceType,
+	}
+	if l.Severity == "" {
+		spec["severity"] = defaultSeverity
+	}
+	if l.Timestamp == "" {
+		spec["timestamp"] = defaultTimestamp
+	}
+	if len(variables) > 0 {
+		spec["variables"] = variables
+	}
+	return spec
+}
+
+// migrateList translates the check expression into a listentry instance, and the
+// blacklist flag into a listchecker handler. The flag of other adapters is reported.
+func (m *migrator) migrateList(key string, path string, tmpl string, name string, handler *Resource, impl string,
+	params map[string]interface{}) ([]interface{}, error) {
+	l := &legacyList{}
+	if err := decodeParams(params, l); err != nil {
+		return nil, err
+	}
+	if impl != listCheckerImpl {
+		if l.Blacklist {
+			m.reportf("%s: blacklist is not translated into handler %s", path, handler.Key.Name)
+		}
+	} else if existing, ok := handler.Spec["blacklist"]; ok && existing != l.Blacklist {
+		m.reportf("%s: blacklist %t conflicts with the blacklist of handler %s, only the first one is kept",
+			path, l.Blacklist, handler.Key.Name)
+	} else {
+		handler.Spec["blacklist"] = l.Blacklist
+	}
+	return []interface{}{m.instance(key, tmpl, name, name, map[string]interface{}{"value": l.CheckExpression})}, nil
+}
+
+// migrateQuotaLimit moves the limit of the legacy quota into the quotas of a memquota
+// handler. The limits of other adapters are reported.
+func (m *migrator) migrateQuotaLimit(path string, handler *Resource, impl string, name string, q *legacyQuota) {
+	if q.MaxAmount == 0 && q.Expiration == nil {
+		return
+	}
+	if impl != memQuotaImpl {
+		m.reportf("%s: max_amount and expiration of quota %s are not translated into handler %s",
+			path, q.DescriptorName, handler.Key.Name)
+		return
+	}
+	quotas, _ := handler.Spec["quotas"].([]interface{})
+	for _, existing := range quotas {
+		if e, ok := existing.(map[string]interface{}); ok && e["name"] == name {
+			return
+		}
+	}
+	limit := map[string]interface{}{"name": name, "maxAmount": q.MaxAmount}
+	if q.Expiration != nil {
+		limit["validDuration"] = q.Expiration
+	}
+	handler.Spec["quotas"] = append(quotas, limit)
+}
+
+// handler returns the handler translated from the adapter. Its spec is the params of the
+// adapter, which memquota handlers extend with the limits of the quotas.
+func (m *migrator) handler(key string, a *legacyAdapter) *Resource {
+	k := m.key(a.Impl, resourceName(a.Name))
+	if r, ok := m.byKey[k]; ok {
+		if existing := m.handlerAdapters[k]; existing != a && !reflect.DeepEqual(existing.Params, a.Params) {
+			m.reportf("%s: adapters %s of kinds %s and %s are translated into the same handler %s, only the params of kind %s are kept",
+				key, a.Name, existing.Kind, a.Kind, k, existing.Kind)
+		}
+		return r
+	}
+	r := &Resource{Key: k, Spec: copySpec(a.Params)}
+	m.byKey[k] = r
+	m.handlerAdapters[k] = a
+	m.handlers = append(m.handlers, r)
+	return r
+}
+
+func (m *migrator) key(kind string, name string) store.Key {
+	return store.Key{Kind: kind, Namespace: m.opts.Namespace, Name: name}
+}
+
+// add appends the resource to rs unless it is already translated. A resource
+// with the same key and a different spec is reported.
+func (m *migrator) add(rs []*Resource, key string, kind string, name string, spec map[string]interface{}) []*Resource {
+	k := m.key(kind, name)
+	if existing, ok := m.byKey[k]; ok {
+		if !reflect.DeepEqual(existing.Spec, spec) {
+			m.reportf("%s: %s is already translated with a different spec, only the first one is kept", key, k)
+		}
+		return rs
+	}
+	r := &Resource{Key: k, Spec: spec}
+	m.byKey[k] = r
+	return append(rs, r)
+}
+
+// section decodes the named section of the document into out.
+func section(doc map[string]interface{}, name string, out interface{}) error {
+	v, ok := doc[name]
+	if !ok || v == nil {
+		return nil
+	}
+	if err := decode(v, out); err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
+
+// decodeParams decodes the params of an aspect into out.
+func decodeParams(params map[string]interface{}, out interface{}) error {
+	if err := decode(params, out); err != nil {
+		return fmt.Errorf("invalid params: %v", err)
+	}
+	return nil
+}
+
+// decode converts v, as parsed from yaml, into out.
+func decode(v interface{}, out interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// and returns the conjunction of the selectors.
+func and(a string, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return "(" + a + ") && (" + b + ")"
+}
+
+// resourceName turns the legacy name into a valid resource name.
+func resourceName(name string) string {
+	return strings.Trim(nameReplacer.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func copySpec(params map[string]interface{}) map[string]interface{} {
+	spec := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		spec[k] = v
+	}
+	return spec
+}
+
+func isEmpty(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case []interface{}:
+		return len(t) == 0
+	case map[string]interface{}:
+		return len(t) == 0
+	}
+	return false
+}
+
+func lastSegment(key string) string {
+	return key[strings.LastIndex(key, "/")+1:]
+}
@@ -0,0 +1,608 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrate
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+
+	"istio.io/mixer/pkg/config/store"
+)
+
+const adapters = `
+subject: namespace:ns
+adapters:
+- name: default
+  kind: quotas
+  impl: memquota
+  params:
+    minDeduplicationDuration: 1s
+- name: default
+  kind: attributes
+  impl: kubernetes
+`
+
+const descriptors = `
+subject: namespace:ns
+manifests:
+- name: istio-proxy
+  revision: "1"
+  attributes:
+    source.name:
+      valueType: STRING
+metrics:
+- name: request_count
+  kind: COUNTER
+`
+
+const globalRules = `
+subject: namespace:ns
+rules:
+- selector:
+  aspects:
+  - kind: attributes
+    params:
+      input_expressions:
+        sourceUID: source.uid | ""
+- selector: source.name == "a"
+  aspects:
+  - kind: quotas
+    params:
+      quotas:
+      - descriptor_name: RequestCount
+        max_amount: 5000
+        expiration: 1s
+        labels:
+          source: source.name
+  rules:
+  - selector: request.size > 10
+    aspects:
+    - kind: quotas
+      adapter: other
+      params:
+        quotas:
+        - descriptor_name: RequestSize
+`
+
+const subjectRules = `
+rules:
+- aspects:
+  - kind: quotas
+    inputs:
+      a: b
+    params:
+      quotas:
+      - descriptor_name: RequestCount
+        max_amount: 5000
+        expiration: 1s
+        labels:
+          source: source.name
+`
+
+func newStore(t *testing.T, data map[string]string) (store.KeyValueStore, func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := store.NewRegistry().NewStore("fs://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range data {
+		if _, err = kv.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kv, func() {
+		kv.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	kv, cleanup := newStore(t, map[string]string{
+		"/scopes/global/adapters":                                 adapters,
+		"/scopes/global/descriptors":                              descriptors,
+		"/scopes/global/subjects/global/rules":                    globalRules,
+		"/scopes/global/subjects/svc1.ns.svc.cluster.local/rules": subjectRules,
+		"/scopes/global/subjects/global/action_rules":             "action_rules:\n- match: \"true\"\n",
+	})
+	defer cleanup()
+
+	res, err := Migrate(kv, Options{Namespace: "istio-system", IdentityAttribute: "destination.service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[store.Key]map[string]interface{}{}
+	var keys []store.Key
+	for _, r := range res.Resources {
+		keys = append(keys, r.Key)
+		got[r.Key] = r.Spec
+	}
+	k := func(kind, name string) store.Key { return store.Key{Kind: kind, Namespace: "istio-system", Name: name} }
+	wantKeys := []store.Key{
+		k("attributemanifest", "istio-proxy"),
+		k("memquota", "default"),
+		k("quota", "requestcount"),
+		k("rule", "global-1"),
+		k("rule", "global-svc1-ns-svc-cluster-local-0"),
+	}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("Got %v, Want %v", keys, wantKeys)
+	}
+
+	want := map[store.Key]string{
+		k("attributemanifest", "istio-proxy"): `
+name: istio-proxy
+revision: "1"
+attributes:
+  source.name:
+    valueType: STRING`,
+		k("memquota", "default"): `
+minDeduplicationDuration: 1s
+quotas:
+- name: requestcount.quota.istio-system
+  maxAmount: 5000
+  validDuration: 1s`,
+		k("quota", "requestcount"): `
+dimensions:
+  source: source.name`,
+		k("rule", "global-1"): `
+match: source.name == "a"
+actions:
+- handler: default.memquota
+  instances:
+  - requestcount.quota`,
+		k("rule", "global-svc1-ns-svc-cluster-local-0"): `
+match: destination.service == "svc1.ns.svc.cluster.local" || match(destination.service, "*.svc1.ns.svc.cluster.local")
+actions:
+- handler: default.memquota
+  instances:
+  - requestcount.quota`,
+	}
+	for key, spec := range want {
+		w := map[string]interface{}{}
+		if err = yaml.Unmarshal([]byte(spec), &w); err != nil {
+			t.Fatal(err)
+		}
+		// compare through json, which turns numbers into float64.
+		g := map[string]interface{}{}
+		data, _ := yaml.Marshal(got[key])
+		if err = yaml.Unmarshal(data, &g); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("%s: Got %v, Want %v", key, g, w)
+		}
+	}
+
+	wantIssues := []string{
+		"/scopes/global/descriptors: metrics is not translated",
+		"/scopes/global/subjects/global/action_rules: action_rules is not translated",
+		"aspect 0 (attributes) of rule global-0 is not translated: no template replaces the aspect kind",
+		"aspect 0 (quotas) of rule global-1-0 is not translated: adapter other of kind quotas is not found",
+		"aspects of subject svc1.ns.svc.cluster.local no longer override",
+		"aspect 0 (quotas) of rule global-svc1-ns-svc-cluster-local-0: inputs are not translated",
+	}
+	if len(res.Issues) != len(wantIssues) {
+		t.Errorf("Got %d issues %v, Want %d", len(res.Issues), res.Issues, len(wantIssues))
+	}
+	for _, w := range wantIssues {
+		found := false
+		for _, issue := range res.Issues {
+			found = found || strings.Contains(issue, w)
+		}
+		if !found {
+			t.Errorf("Issue %q is not found in %v", w, res.Issues)
+		}
+	}
+
+	data, err := res.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs := strings.Count(string(data), "---\n"); docs != len(wantKeys) {
+		t.Errorf("Got %d documents, Want %d:\n%s", docs, len(wantKeys), data)
+	}
+	if !strings.Contains(string(data), "apiVersion: config.istio.io/v1alpha2\nkind: quota\n") {
+		t.Errorf("Got %s, Want the quota resource", data)
+	}
+}
+
+func TestMigrateAspects(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		adapters string
+		aspects  string
+		want     map[string]string
+		issues   []string
+	}{
+		{
+			name: "metrics",
+			adapters: `
+- name: default
+  kind: metrics
+  impl: prometheus`,
+			aspects: `
+- kind: metrics
+  params:
+    metrics:
+    - descriptor_name: request_count
+      value: "1"
+      labels:
+        source: source.name | "unknown"
+    - descriptor_name: request_duration
+      value: response.duration`,
+			want: map[string]string{
+				"prometheus/default": `{}`,
+				"metric/request-count": `
+value: "1"
+dimensions:
+  source: source.name | "unknown"
+monitoredResourceType: '"UNSPECIFIED"'`,
+				"metric/request-duration": `
+value: response.duration
+monitoredResourceType: '"UNSPECIFIED"'`,
+				"rule/global-0": `
+actions:
+- handler: default.prometheus
+  instances:
+  - request-count.metric
+  - request-duration.metric`,
+			},
+		},
+		{
+			name: "instances of the same descriptor",
+			adapters: `
+- name: default
+  kind: metrics
+  impl: prometheus
+- name: default
+  kind: quotas
+  impl: memquota`,
+			aspects: `
+- kind: metrics
+  params:
+    metrics:
+    - descriptor_name: request_count
+      value: "1"
+- kind: metrics
+  params:
+    metrics:
+    - descriptor_name: request_count
+      value: "1"
+- kind: metrics
+  params:
+    metrics:
+    - descriptor_name: request_count
+      value: "2"
+- kind: quotas
+  params:
+    quotas:
+    - descriptor_name: request_count
+      max_amount: 10
+- kind: quotas
+  params:
+    quotas:
+    - descriptor_name: request_count
+      max_amount: 20
+      labels:
+        source: source.name`,
+			want: map[string]string{
+				"prometheus/default": `{}`,
+				"memquota/default": `
+quotas:
+- name: request-count.quota.ns
+  maxAmount: 10
+- name: request-count-global-0-4.quota.ns
+  maxAmount: 20`,
+				"metric/request-count": `
+value: "1"
+monitoredResourceType: '"UNSPECIFIED"'`,
+				"metric/request-count-global-0-2": `
+value: "2"
+monitoredResourceType: '"UNSPECIFIED"'`,
+				"quota/request-count": `{}`,
+				"quota/request-count-global-0-4": `
+dimensions:
+  source: source.name`,
+				"rule/global-0": `
+actions:
+- handler: default.prometheus
+  instances:
+  - request-count.metric
+- handler: default.prometheus
+  instances:
+  - request-count.metric
+- handler: default.prometheus
+  instances:
+  - request-count-global-0-2.metric
+- handler: default.memquota
+  instances:
+  - request-count.quota
+- handler: default.memquota
+  instances:
+  - request-count-global-0-4.quota`,
+			},
+		},
+		{
+			name: "access logs",
+			adapters: `
+- name: default
+  kind: access-logs
+  impl: stdio
+  params:
+    outputAsJson: true`,
+			aspects: `
+- kind: access-logs
+  params:
+    log_name: access_log
+    log:
+      descriptor_name: accesslog.common
+      labels:
+        sourceIp: source.ip
+      template_expressions:
+        method: request.method
+        sourceIp: source.ip`,
+			want: map[string]string{
+				"stdio/default": `outputAsJson: true`,
+				"logentry/access-log": `
+severity: '"Default"'
+timestamp: request.time
+monitoredResourceType: '"UNSPECIFIED"'
+variables:
+  sourceIp: source.ip
+  method: request.method`,
+				"rule/global-0": `
+actions:
+- handler: default.stdio
+  instances:
+  - access-log.logentry`,
+			},
+		},
+		{
+			name: "application logs",
+			adapters: `
+- name: default
+  kind: application-logs
+  impl: stdio`,
+			aspects: `
+- kind: application-logs
+  params:
+    log_name: mixer_log
+    logs:
+    - descriptor_name: app_log
+      severity: '"Error"'
+      timestamp: request.time
+      time_format: Jan 2, 2006
+      labels:
+        method: request.method
+      template_expressions:
+        method: request.path`,
+			want: map[string]string{
+				"stdio/default": `{}`,
+				"logentry/app-log": `
+severity: '"Error"'
+timestamp: request.time
+monitoredResourceType: '"UNSPECIFIED"'
+variables:
+  method: request.method`,
+				"rule/global-0": `
+actions:
+- handler: default.stdio
+  instances:
+  - app-log.logentry`,
+			},
+			issues: []string{
+				"log_name mixer_log is not translated",
+				"template expression method of log app_log is not translated",
+				"time_format of log app_log is not translated",
+			},
+		},
+		{
+			name: "lists",
+			adapters: `
+- name: default
+  kind: lists
+  impl: listchecker
+  params:
+    overrides: ["v1"]
+- name: ips
+  kind: lists
+  impl: ipListChecker`,
+			aspects: `
+- kind: lists
+  params:
+    blacklist: true
+    check_expression: source.labels["version"]
+- kind: lists
+  params:
+    blacklist: false
+    check_expression: source.name
+- kind: lists
+  adapter: ips
+  params:
+    blacklist: true
+    check_expression: source.ip`,
+			want: map[string]string{
+				"listchecker/default": `
+overrides: ["v1"]
+blacklist: true`,
+				"ipListChecker/ips":    `{}`,
+				"listentry/global-0-0": `value: source.labels["version"]`,
+				"listentry/global-0-1": `value: source.name`,
+				"listentry/global-0-2": `value: source.ip`,
+				"rule/global-0": `
+actions:
+- handler: default.listchecker
+  instances:
+  - global-0-0.listentry
+- handler: default.listchecker
+  instances:
+  - global-0-1.listentry
+- handler: ips.ipListChecker
+  instances:
+  - global-0-2.listentry`,
+			},
+			issues: []string{
+				"aspect 1 (lists) of rule global-0: blacklist false conflicts with the blacklist of handler default",
+				"aspect 2 (lists) of rule global-0: blacklist is not translated into handler ips",
+			},
+		},
+		{
+			name: "denials",
+			adapters: `
+- name: default
+  kind: denials
+  impl: denier
+  params:
+    status:
+      code: 7`,
+			aspects: `
+- kind: denials`,
+			want: map[string]string{
+				"denier/default": `
+status:
+  code: 7`,
+				"checknothing/global-0-0": `{}`,
+				"rule/global-0": `
+actions:
+- handler: default.denier
+  instances:
+  - global-0-0.checknothing`,
+			},
+		},
+		{
+			name: "invalid params",
+			adapters: `
+- name: default
+  kind: lists
+  impl: listchecker`,
+			aspects: `
+- kind: lists
+  params:
+    blacklist: abc`,
+			want: map[string]string{
+				"listchecker/default": `{}`,
+			},
+			issues: []string{"aspect 0 (lists) of rule global-0 is not translated: invalid params"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			kv, cleanup := newStore(t, map[string]string{
+				"/scopes/global/adapters":              "adapters:" + tt.adapters,
+				"/scopes/global/subjects/global/rules": "rules:\n- aspects:" + strings.Replace(tt.aspects, "\n", "\n  ", -1),
+			})
+			defer cleanup()
+
+			res, err := Migrate(kv, Options{Namespace: "ns"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]interface{}{}
+			for _, r := range res.Resources {
+				data, _ := yaml.Marshal(r.Spec)
+				g := map[string]interface{}{}
+				if err = yaml.Unmarshal(data, &g); err != nil {
+					t.Fatal(err)
+				}
+				got[r.Key.Kind+"/"+r.Key.Name] = g
+			}
+			want := map[string]interface{}{}
+			for k, spec := range tt.want {
+				w := map[string]interface{}{}
+				if err = yaml.Unmarshal([]byte(spec), &w); err != nil {
+					t.Fatal(err)
+				}
+				want[k] = w
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Got %v, Want %v", got, want)
+			}
+
+			if len(res.Issues) != len(tt.issues) {
+				t.Errorf("Got %d issues %v, Want %d", len(res.Issues), res.Issues, len(tt.issues))
+			}
+			for _, w := range tt.issues {
+				found := false
+				for _, issue := range res.Issues {
+					found = found || strings.Contains(issue, w)
+				}
+				if !found {
+					t.Errorf("Issue %q is not found in %v", w, res.Issues)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateErrors(t *testing.T) {
+	for _, tt := range []struct {
+		key  string
+		data string
+	}{
+		{"/scopes/global/subjects/global/rules", "rules: ["},
+		{"/scopes/global/subjects/global/rules", "rules: 1"},
+		{"/scopes/global/adapters", "adapters: {}"},
+		{"/scopes/global/descriptors", "manifests: abc"},
+	} {
+		t.Run(tt.data, func(t *testing.T) {
+			kv, cleanup := newStore(t, map[string]string{tt.key: tt.data})
+			defer cleanup()
+			if _, err := Migrate(kv, Options{}); err == nil || !strings.Contains(err.Error(), tt.key) {
+				t.Errorf("Got %v, Want the error of %s", err, tt.key)
+			}
+		})
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"default", "default"},
+		{"RequestCount", "requestcount"},
+		{"request_count", "request-count"},
+		{"svc1.ns.svc.cluster.local", "svc1-ns-svc-cluster-local"},
+		{"/a//b/", "a-b"},
+	} {
+		if got := resourceName(tt.name); got != tt.want {
+			t.Errorf("resourceName(%s): Got %s, Want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAnd(t *testing.T) {
+	for _, tt := range []struct {
+		a    string
+		b    string
+		want string
+	}{
+		{"", "", ""},
+		{"a", "", "a"},
+		{"", "b", "b"},
+		{"a || b", "c", "(a || b) && (c)"},
+	} {
+		if got := and(tt.a, tt.b); got != tt.want {
+			t.Errorf("and(%s, %s): Got %s, Want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
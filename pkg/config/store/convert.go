@@ -55,6 +55,19 @@ func cloneMessage(kind string, kinds map[string]proto.Message) (proto.Message, e
 	return proto.Clone(msg), nil
 }
 
+// toUnstructured converts a proto spec into its unstructured form.
+func toUnstructured(spec proto.Message) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, spec); err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 // convert converts unstructured spec into the target proto.
 func convert(key Key, spec map[string]interface{}, target proto.Message) error {
 	jsonData, err := json.Marshal(warnDeprecationAndFix(key, spec))
@@ -18,24 +18,84 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 )
 
-const defaultDuration = time.Second / 2
+const (
+	// defaultDuration is the interval to check the files when filesystem notifications are not available.
+	defaultDuration = time.Second / 2
+
+	// defaultResyncDuration is the interval to check the files when filesystem notifications are used.
+	defaultResyncDuration = time.Minute
+
+	// defaultDebounceDuration is the time to wait for further notifications before the files are checked.
+	defaultDebounceDuration = time.Second / 10
+
+	// modTimeGranularity is the coarsest file modification timestamp granularity expected.
+	modTimeGranularity = time.Second
+)
+
+// fsWatcher notifies changes of the files in the directories it watches.
+type fsWatcher interface {
+	// add starts watching the directory. Adding a watched directory is a no-op.
+	add(dir string) error
+
+	// events returns the channel which is signaled on changes.
+	events() <-chan struct{}
+
+	close() error
+}
+
+// newFsWatcher creates the fsWatcher of the platform.
+var newFsWatcher func() (fsWatcher, error)
+
+// readFile reads the content of a config file; replaced in tests.
+var readFile = ioutil.ReadFile
+
+// cachedFile is the parsed content of a file, reused while the file is unchanged.
+type cachedFile struct {
+	// target is the file the path resolves to.
+	target    string
+	modTime   time.Time
+	size      int64
+	readAt    time.Time
+	resources []*resource
+}
+
+// apiVersion is the API version of resources written by fsStore2.
+const apiVersion = "config.istio.io/v1alpha2"
+
+// listKind is the kind of documents which define the resources in their items.
+const listKind = "List"
 
 var supportedExtensions = map[string]bool{
 	".yaml": true,
 	".yml":  true,
+	".json": true,
+}
+
+// isJSON returns true if the file is a single json document.
+func isJSON(path string) bool {
+	return filepath.Ext(path) == ".json"
 }
 
+// variablePattern matches ${NAME} and ${NAME:-default} references in config files.
+var variablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
 // resource is almost identical to crd/resource.go. This is defined here
 // separately because:
 // - no dependencies on actual k8s libraries
@@ -46,6 +106,10 @@ type resource struct {
 	Metadata   ResourceMeta
 	Spec       map[string]interface{}
 	sha        [sha1.Size]byte
+	path       string
+	// generated is true if the resource is not defined verbatim by its own yaml
+	// document, in which case it can not be rewritten by Put or Delete.
+	generated bool
 }
 
 func (r *resource) Key() Key {
@@ -59,13 +123,127 @@ type fsStore2 struct {
 	kinds         map[string]bool
 	checkDuration time.Duration
 	shas          map[Key][sha1.Size]byte
+
+	// updateMu serializes reading the files and writing them.
+	updateMu sync.Mutex
+	// paths is the file that contains each resource.
+	paths map[Key]string
+	// files is the content of the files in the last check.
+	files map[string]*cachedFile
+
+	// watcher is nil when filesystem notifications are not available.
+	watcher          fsWatcher
+	unwatched        map[string]bool
+	resyncDuration   time.Duration
+	debounceDuration time.Duration
+
+	// lookupEnv returns the values of the variables referenced by the files.
+	lookupEnv func(string) (string, bool)
 }
 
 var _ Store2Backend = &fsStore2{}
 
-// parseFile parses the data and returns as a slice of resources. "path" is only used
-// for error reporting.
-func parseFile(path string, data []byte) []*resource {
+// parseFile parses the data and returns as a slice of resources. Json files
+// contain a single document, yaml files may contain several separated by "---".
+// Variables referenced by the documents are substituted with the values of lookupEnv.
+func parseFile(path string, data []byte, lookupEnv func(string) (string, bool)) []*resource {
+	chunks := [][]byte{data}
+	if !isJSON(path) {
+		chunks = splitChunks(data)
+	}
+	resources := make([]*resource, 0, len(chunks))
+	for i, chunk := range chunks {
+		rs, err := parseDocument(path, chunk, lookupEnv)
+		if err != nil {
+			glog.Errorf("Error processing %s[%d]: %v", path, i, err)
+		}
+		resources = append(resources, rs...)
+	}
+	return resources
+}
+
+// parseDocument substitutes the variables of the chunk and parses it.
+func parseDocument(path string, chunk []byte, lookupEnv func(string) (string, bool)) ([]*resource, error) {
+	expanded, err := expandVariables(chunk, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := parseChunk(expanded)
+	generated := isJSON(path) || !bytes.Equal(expanded, chunk)
+	for _, r := range resources {
+		r.path = path
+		r.generated = r.generated || generated
+	}
+	return resources, err
+}
+
+// expandVariables replaces ${NAME} with the value of the variable NAME, and
+// ${NAME:-default} with the value, or default if NAME is not set. It is an
+// error to reference a variable which is not set and has no default.
+//
+// The variables are substituted in the string values of the parsed document,
+// so references in comments are ignored and the values need no yaml quoting.
+// The chunk is returned unchanged if it references no variables, otherwise the
+// expanded document is returned as json.
+func expandVariables(chunk []byte, lookupEnv func(string) (string, bool)) ([]byte, error) {
+	if !variablePattern.Match(chunk) {
+		return chunk, nil
+	}
+	data, err := yaml.YAMLToJSON(chunk)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err = d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	var missing []string
+	expanded := false
+	expand := func(s string) string {
+		return variablePattern.ReplaceAllStringFunc(s, func(ref string) string {
+			m := variablePattern.FindStringSubmatch(ref)
+			expanded = true
+			if v, ok := lookupEnv(m[1]); ok {
+				return v
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			missing = append(missing, m[1])
+			return ref
+		})
+	}
+	doc = expandValues(doc, expand)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("variables are not set: %s", strings.Join(missing, ", "))
+	}
+	if !expanded {
+		return chunk, nil
+	}
+	return json.Marshal(doc)
+}
+
+// expandValues applies expand to the string values of the decoded json value v.
+func expandValues(v interface{}, expand func(string) string) interface{} {
+	switch t := v.(type) {
+	case string:
+		return expand(t)
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = expandValues(e, expand)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = expandValues(e, expand)
+		}
+	}
+	return v
+}
+
+// splitChunks splits the data into the yaml documents it contains.
+func splitChunks(data []byte) [][]byte {
 	if bytes.HasPrefix(data, []byte("---\n")) {
 		data = data[4:]
 	}
@@ -78,23 +256,50 @@ func parseFile(path string, data []byte) []*resource {
 	if len(data) == 0 {
 		return nil
 	}
-	chunks := bytes.Split(data, []byte("\n---\n"))
-	resources := make([]*resource, 0, len(chunks))
-	for i, chunk := range chunks {
-		r, err := parseChunk(chunk)
+	return bytes.Split(data, []byte("\n---\n"))
+}
+
+// parseChunk parses a document which defines a resource, or a List of resources in its items.
+// The resources of the valid items of a List are returned along with the errors of the others.
+func parseChunk(chunk []byte) ([]*resource, error) {
+	r, err := parseResource(chunk)
+	if r == nil || err != nil {
+		return nil, err
+	}
+	if r.Kind != listKind {
+		return []*resource{r}, nil
+	}
+	l := &struct {
+		Items []json.RawMessage
+	}{}
+	if err = yaml.Unmarshal(chunk, l); err != nil {
+		return nil, err
+	}
+	resources := make([]*resource, 0, len(l.Items))
+	var errs []string
+	for i, item := range l.Items {
+		if r, err = parseResource(item); err == nil && r != nil && r.Kind == listKind {
+			err = errors.New("lists can not be nested")
+		}
 		if err != nil {
-			glog.Errorf("Error processing %s[%d]: %v", path, i, err)
+			errs = append(errs, fmt.Sprintf("items[%d]: %v", i, err))
 			continue
 		}
 		if r == nil {
 			continue
 		}
+		r.generated = true
 		resources = append(resources, r)
 	}
-	return resources
+	if len(errs) > 0 {
+		return resources, errors.New(strings.Join(errs, "; "))
+	}
+	return resources, nil
 }
 
-func parseChunk(chunk []byte) (*resource, error) {
+// parseResource parses a document which defines a resource. A List is returned
+// without its items.
+func parseResource(chunk []byte) (*resource, error) {
 	r := &resource{}
 	if err := yaml.Unmarshal(chunk, r); err != nil {
 		return nil, err
@@ -105,6 +310,9 @@ func parseChunk(chunk []byte) (*resource, error) {
 		// There are just comments
 		return nil, nil
 	}
+	if r.Kind == listKind {
+		return r, nil
+	}
 	if r.Kind == "" || r.Metadata.Namespace == "" || r.Metadata.Name == "" {
 		return nil, fmt.Errorf("key elements are empty. Extracted as %s from\n <<%s>>", r.Key(), string(chunk))
 	}
@@ -121,35 +329,122 @@ func empty(r *resource) bool {
 
 func (s *fsStore2) readFiles() map[Key]*resource {
 	result := map[Key]*resource{}
+	files := make(map[string]*cachedFile, len(s.files))
+	now := time.Now()
+
+	add := func(path string, f *cachedFile) {
+		files[path] = f
+		for _, r := range f.resources {
+			k := r.Key()
+			if !s.kinds[k.Kind] {
+				continue
+			}
+			result[k] = r
+		}
+	}
 
 	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return err
+			if path == s.root {
+				return err
+			}
+			// Keep the previously read files below the unreadable path, one
+			// unreadable entry should not remove the rest of the config.
+			glog.Warningf("Failed to read %s: %v", path, err)
+			prefix := path + string(filepath.Separator)
+			for p, f := range s.files {
+				if p == path || strings.HasPrefix(p, prefix) {
+					add(p, f)
+				}
+			}
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		if !supportedExtensions[filepath.Ext(path)] || (info.Mode()&os.ModeType) != 0 {
+		if info.IsDir() {
+			return s.visitDir(path)
+		}
+		if !supportedExtensions[filepath.Ext(path)] {
 			return nil
 		}
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			glog.Warningf("Failed to read %s: %v", path, err)
-			return err
+		target := path
+		if info.Mode()&os.ModeSymlink != 0 {
+			// ConfigMap volumes link each file to its current version through the ..data symlink.
+			if target, err = filepath.EvalSymlinks(path); err == nil {
+				info, err = os.Stat(target)
+			}
+			if err != nil {
+				glog.Warningf("Failed to resolve %s: %v", path, err)
+				return nil
+			}
 		}
-		for _, r := range parseFile(path, data) {
-			k := r.Key()
-			if !s.kinds[k.Kind] {
-				continue
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f := s.files[path]
+		if !f.unchanged(target, info) {
+			data, err := readFile(path)
+			if err != nil {
+				// Keep the previously read content, the file is read again on the next change.
+				glog.Warningf("Failed to read %s: %v", path, err)
+				if f != nil {
+					add(path, f)
+				}
+				return nil
+			}
+			f = &cachedFile{
+				target:    target,
+				modTime:   info.ModTime(),
+				size:      info.Size(),
+				readAt:    now,
+				resources: parseFile(path, data, s.lookupEnv),
 			}
-			result[r.Key()] = r
 		}
+		add(path, f)
 		return nil
 	})
 	if err != nil {
 		glog.Errorf("failure during filepath.Walk: %v", err)
 	}
+	s.files = files
 	return result
 }
 
+// visitDir watches the directory for changes. Versioned directories of
+// ConfigMap volumes are skipped, their files are read through the symlinks.
+func (s *fsStore2) visitDir(path string) error {
+	if path != s.root && strings.HasPrefix(filepath.Base(path), "..") {
+		return filepath.SkipDir
+	}
+	if s.watcher == nil || s.unwatched[path] {
+		return nil
+	}
+	if err := s.watcher.add(path); err != nil {
+		glog.Warningf("Unable to watch %s, its changes are detected every %v: %v", path, s.resyncDuration, err)
+		s.unwatched[path] = true
+	}
+	return nil
+}
+
+// unchanged returns true if the file has not changed since it was read. Files
+// modified around the time they were read are always read again, since they
+// may have changed within the timestamp granularity of the filesystem.
+func (f *cachedFile) unchanged(target string, info os.FileInfo) bool {
+	return f != nil &&
+		f.target == target &&
+		f.size == info.Size() &&
+		f.modTime.Equal(info.ModTime()) &&
+		f.modTime.Before(f.readAt.Add(-modTimeGranularity))
+}
+
 func (s *fsStore2) checkAndUpdate() {
+	s.updateMu.Lock()
+	s.checkAndUpdateLocked()
+	s.updateMu.Unlock()
+}
+
+func (s *fsStore2) checkAndUpdateLocked() {
 	newData := s.readFiles()
 	updated := []Key{}
 	removed := map[Key]bool{}
@@ -157,6 +452,7 @@ func (s *fsStore2) checkAndUpdate() {
 		removed[k] = true
 	}
 	for k, r := range newData {
+		s.paths[k] = r.path
 		oldSha, ok := s.shas[k]
 		s.shas[k] = r.sha
 		if !ok {
@@ -172,11 +468,169 @@ func (s *fsStore2) checkAndUpdate() {
 		return
 	}
 	for _, k := range updated {
-		s.Put(k, &BackEndResource{Metadata: newData[k].Metadata, Spec: newData[k].Spec})
+		r := newData[k]
+		meta := r.Metadata
+		meta.Revision = hex.EncodeToString(r.sha[:])
+		s.set(k, &BackEndResource{Metadata: meta, Spec: r.Spec})
 	}
 	for k := range removed {
-		s.Delete(k)
+		delete(s.shas, k)
+		delete(s.paths, k)
+		s.remove(k)
+	}
+}
+
+// Put implements Store2Backend interface. The resource is written in place
+// of its current definition, or to a new file under the root.
+func (s *fsStore2) Put(key Key, resource *BackEndResource) (string, error) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	if err := s.checkRevision(key, resource.Metadata.Revision); err != nil {
+		return "", err
+	}
+	meta := map[string]interface{}{
+		"name":      key.Name,
+		"namespace": key.Namespace,
 	}
+	if len(resource.Metadata.Labels) > 0 {
+		meta["labels"] = resource.Metadata.Labels
+	}
+	if len(resource.Metadata.Annotations) > 0 {
+		meta["annotations"] = resource.Metadata.Annotations
+	}
+	chunk, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       key.Kind,
+		"metadata":   meta,
+		"spec":       resource.Spec,
+	})
+	if err != nil {
+		return "", err
+	}
+	chunk = bytes.TrimSuffix(chunk, []byte("\n"))
+	path, ok := s.paths[key]
+	if !ok {
+		path = filepath.Join(s.root, key.String()+".yaml")
+	}
+	if err = replaceChunk(path, key, chunk, s.lookupEnv); err != nil {
+		return "", err
+	}
+	s.checkAndUpdateLocked()
+	cur, err := s.memstore.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("%s is not found after writing %s", key, path)
+	}
+	return cur.Metadata.Revision, nil
+}
+
+// Delete implements Store2Backend interface. The resource is removed from the file
+// that defines it, the file is removed when no other resources remain.
+func (s *fsStore2) Delete(key Key, revision string) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	if err := s.checkRevision(key, revision); err != nil {
+		return err
+	}
+	path, ok := s.paths[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := replaceChunk(path, key, nil, s.lookupEnv); err != nil {
+		return err
+	}
+	s.checkAndUpdateLocked()
+	return nil
+}
+
+// checkRevision returns ErrConflict if the revision is set and is not
+// the current revision of the resource.
+func (s *fsStore2) checkRevision(key Key, revision string) error {
+	if revision == "" {
+		return nil
+	}
+	cur, err := s.memstore.Get(key)
+	if err != nil || cur.Metadata.Revision != revision {
+		return ErrConflict
+	}
+	return nil
+}
+
+// replaceChunk replaces the document of the key in the file with the chunk, or
+// appends the chunk if the file does not define the key. A nil chunk removes the document.
+// The file is replaced atomically, so that readers never observe a partial write.
+// Resources defined by json files, Lists or documents referencing variables can not be replaced.
+func replaceChunk(path string, key Key, chunk []byte, lookupEnv func(string) (string, bool)) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	chunks := splitChunks(data)
+	result := make([][]byte, 0, len(chunks)+1)
+	found := false
+	for _, c := range chunks {
+		if r := findResource(path, c, key, lookupEnv); r != nil {
+			if r.generated {
+				return fmt.Errorf("%s is generated from %s and can not be modified", key, path)
+			}
+			found = true
+			if chunk != nil {
+				result = append(result, chunk)
+			}
+			continue
+		}
+		result = append(result, c)
+	}
+	if !found && chunk != nil {
+		result = append(result, chunk)
+	}
+	if len(result) == 0 {
+		return os.Remove(path)
+	}
+	data = append(bytes.Join(result, []byte("\n---\n")), '\n')
+	return writeFileAtomic(path, data)
+}
+
+// findResource returns the resource of the key defined by the chunk, or nil if it is not defined.
+func findResource(path string, chunk []byte, key Key, lookupEnv func(string) (string, bool)) *resource {
+	resources, _ := parseDocument(path, chunk, lookupEnv)
+	for _, r := range resources {
+		if r.Key() == key {
+			return r
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory
+// and renames it to the path.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// the temporary file does not have a supported extension, so it is never read as config.
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
 }
 
 // NewFsStore2 creates a new Store2Backend backed by the filesystem.
@@ -188,26 +642,65 @@ func NewFsStore2(root string) Store2Backend {
 		kinds:         map[string]bool{},
 		checkDuration: defaultDuration,
 		shas:          map[Key][sha1.Size]byte{},
+		paths:         map[Key]string{},
+		files:         map[string]*cachedFile{},
+		unwatched:     map[string]bool{},
+
+		resyncDuration:   defaultResyncDuration,
+		debounceDuration: defaultDebounceDuration,
+		lookupEnv:        os.LookupEnv,
 	}
 }
 
-// Init implements Store2Backend interface.
+// Init implements Store2Backend interface. The files are checked when filesystem
+// notifications report changes, and periodically in case notifications are missed.
+// Without notifications, the files are checked every checkDuration.
 func (s *fsStore2) Init(ctx context.Context, kinds []string) error {
 	for _, k := range kinds {
 		s.kinds[k] = true
 	}
+	w, err := newFsWatcher()
+	if err == nil {
+		if err = w.add(s.root); err != nil {
+			_ = w.close()
+		}
+	}
+	if err != nil {
+		glog.Warningf("Unable to watch %s for changes, checking every %v: %v", s.root, s.checkDuration, err)
+	} else {
+		s.watcher = w
+	}
 	s.checkAndUpdate()
-	go func() {
-		tick := time.NewTicker(s.checkDuration)
-		for {
-			select {
-			case <-ctx.Done():
-				tick.Stop()
-				return
-			case <-tick.C:
-				s.checkAndUpdate()
+	go s.run(ctx)
+	return nil
+}
+
+func (s *fsStore2) run(ctx context.Context) {
+	interval := s.checkDuration
+	var events <-chan struct{}
+	if s.watcher != nil {
+		interval = s.resyncDuration
+		events = s.watcher.events()
+		defer func() { _ = s.watcher.close() }()
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	// debounce is set while notifications are being collected.
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+			if debounce == nil {
+				debounce = time.After(s.debounceDuration)
 			}
+		case <-debounce:
+			debounce = nil
+			s.checkAndUpdate()
+		case <-tick.C:
+			s.checkAndUpdate()
 		}
-	}()
-	return nil
+	}
 }
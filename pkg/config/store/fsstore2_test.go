@@ -16,11 +16,13 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,6 +35,7 @@ func getTempFSStore2() (*fsStore2, string) {
 	fsroot, _ := ioutil.TempDir("/tmp/", "fsStore2-")
 	s := NewFsStore2(fsroot).(*fsStore2)
 	s.checkDuration = testingCheckDuration
+	s.debounceDuration = time.Millisecond
 	return s, fsroot
 }
 
@@ -120,6 +123,274 @@ func TestFSStore2(t *testing.T) {
 	}
 }
 
+func TestFSStore2PutDelete(t *testing.T) {
+	s, fsroot := getTempFSStore2()
+	defer cleanupRootIfOK(t, fsroot)
+	const ns = "istio-mixer-testing"
+	k1 := Key{Kind: "Handler", Namespace: ns, Name: "h1"}
+	k2 := Key{Kind: "Handler", Namespace: ns, Name: "h2"}
+	path := filepath.Join(fsroot, "handlers.yaml")
+	data := fmt.Sprintf(`kind: Handler
+apiVersion: config.istio.io/v1alpha2
+metadata:
+  namespace: %s
+  name: h1
+spec:
+  adapter: noop
+---
+kind: Handler
+apiVersion: config.istio.io/v1alpha2
+metadata:
+  namespace: %s
+  name: h2
+spec:
+  adapter: noop
+`, ns, ns)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	r1, err := s.Get(k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.Metadata.Revision == "" {
+		t.Errorf("Got empty revision")
+	}
+
+	// the resource is updated in place.
+	spec := map[string]interface{}{"adapter": "noop2"}
+	rev, err := s.Put(k1, &BackEndResource{Metadata: ResourceMeta{Revision: r1.Metadata.Revision}, Spec: spec})
+	if err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	got, err := s.Get(k1)
+	if err != nil || got.Metadata.Revision != rev || !reflect.DeepEqual(got.Spec, spec) {
+		t.Errorf("Got %+v/%v, Want %v at revision %s", got, err, spec, rev)
+	}
+	if lst := parseFile(path, mustRead(t, path), os.LookupEnv); len(lst) != 2 {
+		t.Errorf("Got %d resources in %s, Want 2", len(lst), path)
+	}
+	if _, err = s.Put(k1, &BackEndResource{Metadata: ResourceMeta{Revision: r1.Metadata.Revision}, Spec: spec}); err != ErrConflict {
+		t.Errorf("Got %v, Want %v", err, ErrConflict)
+	}
+
+	// new resources are written to their own file.
+	k3 := Key{Kind: "Handler", Namespace: ns, Name: "h3"}
+	if _, err = s.Put(k3, &BackEndResource{Spec: spec}); err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	if lst := parseFile(path, mustRead(t, filepath.Join(fsroot, k3.String()+".yaml")), os.LookupEnv); len(lst) != 1 || lst[0].Key() != k3 {
+		t.Errorf("Got %v, Want %s", lst, k3)
+	}
+
+	if err = s.Delete(k1, r1.Metadata.Revision); err != ErrConflict {
+		t.Errorf("Got %v, Want %v", err, ErrConflict)
+	}
+	if err = s.Delete(k1, rev); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if _, err = s.Get(k1); err != ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+	if _, err = s.Get(k2); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if err = s.Delete(k2, ""); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Got %v, Want %s to be removed", err, path)
+	}
+	if err = s.Delete(k2, ""); err != ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+	if lst := s.List(); len(lst) != 1 {
+		t.Errorf("Got %v, Want only %s", lst, k3)
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// waitForEvent waits for the event, or fails the test after a second.
+func waitForEvent(t *testing.T, wch <-chan BackendEvent, ct ChangeType, key Key) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-wch:
+			if ev.Key == key && ev.Type == ct {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Did not get %v event for %s", ct, key)
+		}
+	}
+}
+
+func TestFSStore2Notify(t *testing.T) {
+	s, fsroot := getTempFSStore2()
+	defer cleanupRootIfOK(t, fsroot)
+	// changes are detected only through notifications.
+	s.checkDuration = time.Hour
+	s.resyncDuration = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.watcher == nil {
+		t.Skip("filesystem notifications are not supported")
+	}
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key{Kind: "Handler", Namespace: "ns", Name: "default"}
+	if err = write(fsroot, k, map[string]interface{}{"adapter": "noop"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, wch, Update, k)
+
+	// subdirectories created after Init are watched too.
+	if err = write(fsroot, k, map[string]interface{}{"adapter": "noop2"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, wch, Update, k)
+	if r, err := s.Get(k); err != nil || r.Spec["adapter"] != "noop2" {
+		t.Errorf("Got %+v/%v, Want noop2", r, err)
+	}
+	if err = os.RemoveAll(filepath.Join(fsroot, k.Kind)); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, wch, Delete, k)
+}
+
+func TestFSStore2PollingFallback(t *testing.T) {
+	nfw := newFsWatcher
+	newFsWatcher = func() (fsWatcher, error) { return nil, errors.New("not supported") }
+	defer func() { newFsWatcher = nfw }()
+
+	s, fsroot := getTempFSStore2()
+	defer cleanupRootIfOK(t, fsroot)
+	s.resyncDuration = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key{Kind: "Handler", Namespace: "ns", Name: "default"}
+	if err = write(fsroot, k, map[string]interface{}{"adapter": "noop"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, wch, Update, k)
+}
+
+func TestFSStore2ConfigMap(t *testing.T) {
+	s, fsroot := getTempFSStore2()
+	defer cleanupRootIfOK(t, fsroot)
+	const tmpl = `kind: Handler
+apiVersion: config.istio.io/v1alpha2
+metadata:
+  namespace: ns
+  name: default
+spec:
+  adapter: %s
+`
+	k := Key{Kind: "Handler", Namespace: "ns", Name: "default"}
+
+	// version writes the files of a ConfigMap volume and makes it current,
+	// the same way as the kubelet does.
+	version := func(v string, adapter string) {
+		dir := filepath.Join(fsroot, "..2017_10_18_"+v)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "handler.yaml"), []byte(fmt.Sprintf(tmpl, adapter)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(fsroot, "..data_tmp")
+		if err := os.Symlink(filepath.Base(dir), tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(fsroot, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version("v1", "noop")
+	if err := os.Symlink(filepath.Join("..data", "handler.yaml"), filepath.Join(fsroot, "handler.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.Get(k); err != nil || r.Spec["adapter"] != "noop" {
+		t.Fatalf("Got %+v/%v, Want noop", r, err)
+	}
+	wch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version("v2", "noop2")
+	if err = os.RemoveAll(filepath.Join(fsroot, "..2017_10_18_v1")); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, wch, Update, k)
+	if r, err := s.Get(k); err != nil || r.Spec["adapter"] != "noop2" {
+		t.Errorf("Got %+v/%v, Want noop2", r, err)
+	}
+	if lst := s.List(); len(lst) != 1 {
+		t.Errorf("Got %v, Want only %s", lst, k)
+	}
+}
+
+func TestCachedFileUnchanged(t *testing.T) {
+	fsroot, _ := ioutil.TempDir("/tmp/", "fsStore2-")
+	defer cleanupRootIfOK(t, fsroot)
+	path := filepath.Join(fsroot, "a.yaml")
+	if err := ioutil.WriteFile(path, []byte("kind: Handler"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settled := info.ModTime().Add(2 * modTimeGranularity)
+	for _, c := range []struct {
+		title string
+		f     *cachedFile
+		want  bool
+	}{
+		{"not read", nil, false},
+		{"unchanged", &cachedFile{target: path, modTime: info.ModTime(), size: info.Size(), readAt: settled}, true},
+		{"recently modified", &cachedFile{target: path, modTime: info.ModTime(), size: info.Size(), readAt: info.ModTime()}, false},
+		{"size", &cachedFile{target: path, modTime: info.ModTime(), size: info.Size() + 1, readAt: settled}, false},
+		{"modified", &cachedFile{target: path, modTime: info.ModTime().Add(-time.Hour), size: info.Size(), readAt: settled}, false},
+		{"target", &cachedFile{target: path + ".old", modTime: info.ModTime(), size: info.Size(), readAt: settled}, false},
+	} {
+		if got := c.f.unchanged(path, info); got != c.want {
+			t.Errorf("%s: Got %t, Want %t", c.title, got, c.want)
+		}
+	}
+}
+
 func TestFSStore2WrongKind(t *testing.T) {
 	s, fsroot := getTempFSStore2()
 	defer cleanupRootIfOK(t, fsroot)
@@ -249,7 +520,7 @@ spec:
 		},
 	} {
 		t.Run(c.title, func(tt *testing.T) {
-			resources := parseFile(c.title, []byte(c.data))
+			resources := parseFile(c.title, []byte(c.data), os.LookupEnv)
 			if len(resources) != c.resourceCount {
 				tt.Errorf("Got %d, Want %d", len(resources), c.resourceCount)
 			}
@@ -260,19 +531,41 @@ spec:
 func TestFsStore2_ParseChunk(t *testing.T) {
 	for _, c := range []struct {
 		title string
-		isNil bool
+		count int
 		data  string
 	}{
 		{
 			"whitespace only",
-			true,
+			0,
 			"      \n",
 		},
 		{
 			"whitespace with comments",
-			true,
+			0,
 			"   \n#This is a comments\n",
 		},
+		{
+			"empty list",
+			0,
+			"kind: List\nitems: []\n",
+		},
+		{
+			"list",
+			2,
+			`
+kind: List
+apiVersion: v1
+items:
+- kind: Foo
+  metadata:
+    namespace: ns
+    name: foo
+- kind: Bar
+  metadata:
+    namespace: ns
+    name: bar
+`,
+		},
 	} {
 		t.Run(c.title, func(t *testing.T) {
 			r, err := parseChunk([]byte(c.data))
@@ -280,13 +573,193 @@ func TestFsStore2_ParseChunk(t *testing.T) {
 				t.Fatalf("unexpected error: %v", err)
 			}
 
-			if (r == nil) != c.isNil {
-				t.Fatalf("want Got %v, Want %t", r, c.isNil)
+			if len(r) != c.count {
+				t.Fatalf("Got %v, Want %d resources", r, c.count)
+			}
+		})
+	}
+}
+
+func TestFSStore2_ParseList(t *testing.T) {
+	const list = `
+kind: List
+items:
+- kind: Foo
+  metadata:
+    namespace: ns
+    name: foo
+  spec:
+    a: b
+- kind: Foo
+  metadata:
+    name: nonamespace
+- kind: Foo
+  metadata:
+    namespace: ns
+    name: bar
+`
+	resources, err := parseChunk([]byte(list))
+	if err == nil {
+		t.Errorf("Got nil, Want the error of items[1]")
+	}
+	if len(resources) != 2 || resources[0].Metadata.Name != "foo" || resources[1].Metadata.Name != "bar" {
+		t.Fatalf("Got %v, Want foo and bar", resources)
+	}
+	if resources[0].sha == resources[1].sha {
+		t.Errorf("Got the same sha for different items")
+	}
+	if !resources[0].generated || resources[0].Spec["a"] != "b" {
+		t.Errorf("Got %+v, Want the generated foo", resources[0])
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	env := map[string]string{
+		"NS":     "staging",
+		"EMPTY":  "",
+		"SCALAR": "a: b # \"c\" 'd'\n- e",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	for _, c := range []struct {
+		data string
+		want string
+		err  bool
+	}{
+		{"namespace: ${NS}", `{"namespace":"staging"}`, false},
+		{"namespace: ${NS:-default}", `{"namespace":"staging"}`, false},
+		{"address: ${ADDR:-localhost:9091}", `{"address":"localhost:9091"}`, false},
+		{"address: ${ADDR:-}", `{"address":""}`, false},
+		{"namespace: ${EMPTY:-default}", `{"namespace":""}`, false},
+		{"a: ${NS}-${NS}", `{"a":"staging-staging"}`, false},
+		{"a: [\"${NS}\", {b: \"x${NS}\"}, 1]", `{"a":["staging",{"b":"xstaging"},1]}`, false},
+		{"a: ${NS}\nb: 12345678901234567890", `{"a":"staging","b":12345678901234567890}`, false},
+		{"a: $NS ${ NS} $", "a: $NS ${ NS} $", false},
+		{"address: ${ADDR}", "", true},
+		// references in comments are not substituted.
+		{"a: b # ${ADDR}", "a: b # ${ADDR}", false},
+		{"# a: ${ADDR}\na: ${NS}", `{"a":"staging"}`, false},
+		// values are substituted as scalars, whatever they contain.
+		{"a: ${SCALAR}", `{"a":"a: b # \"c\" 'd'\n- e"}`, false},
+		{"a: '${SCALAR}'", `{"a":"a: b # \"c\" 'd'\n- e"}`, false},
+	} {
+		t.Run(c.data, func(t *testing.T) {
+			got, err := expandVariables([]byte(c.data), lookupEnv)
+			if (err != nil) != c.err {
+				t.Fatalf("Got %v, Want error %t", err, c.err)
+			}
+			if !c.err && string(got) != c.want {
+				t.Errorf("Got %s, Want %s", got, c.want)
 			}
 		})
 	}
 }
 
+func TestFSStore2Bundles(t *testing.T) {
+	s, fsroot := getTempFSStore2()
+	defer cleanupRootIfOK(t, fsroot)
+	s.lookupEnv = func(name string) (string, bool) {
+		if name == "NS" {
+			return "staging", true
+		}
+		return "", false
+	}
+	files := map[string]string{
+		"h1.json": `{"kind": "Handler", "apiVersion": "config.istio.io/v1alpha2",
+"metadata": {"namespace": "ns", "name": "h1"}, "spec": {"adapter": "noop"}}`,
+		"list.yaml": `
+kind: List
+items:
+- kind: Handler
+  metadata:
+    namespace: ns
+    name: h2
+  spec:
+    adapter: noop
+- kind: Handler
+  metadata:
+    namespace: ns
+    name: h3
+`,
+		"templated.yaml": `
+kind: Handler
+metadata:
+  namespace: ${NS}
+  name: h4
+spec:
+  address: ${ADDRESS:-localhost:9091}
+---
+kind: Handler
+metadata:
+  namespace: ns
+  name: h5
+spec:
+  address: ${ADDRESS}
+---
+kind: Handler
+metadata:
+  namespace: ns
+  name: h6
+`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(fsroot, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[Key]map[string]interface{}{
+		{Kind: "Handler", Namespace: "ns", Name: "h1"}:      {"adapter": "noop"},
+		{Kind: "Handler", Namespace: "ns", Name: "h2"}:      {"adapter": "noop"},
+		{Kind: "Handler", Namespace: "ns", Name: "h3"}:      nil,
+		{Kind: "Handler", Namespace: "staging", Name: "h4"}: {"address": "localhost:9091"},
+		{Kind: "Handler", Namespace: "ns", Name: "h6"}:      nil,
+	}
+	got := s.List()
+	if len(got) != len(want) {
+		t.Errorf("Got %v, Want %d resources", got, len(want))
+	}
+	for k, spec := range want {
+		r, ok := got[k]
+		if !ok {
+			t.Errorf("%s is not found", k)
+			continue
+		}
+		if len(spec) > 0 && !reflect.DeepEqual(r.Spec, spec) {
+			t.Errorf("%s: Got %v, Want %v", k, r.Spec, spec)
+		}
+	}
+
+	// generated resources can not be modified.
+	for k := range want {
+		if k.Name == "h6" {
+			continue
+		}
+		if _, err := s.Put(k, &BackEndResource{Spec: map[string]interface{}{"adapter": "other"}}); err == nil {
+			t.Errorf("Put %s: Got nil, Want error", k)
+		}
+		if err := s.Delete(k, ""); err == nil {
+			t.Errorf("Delete %s: Got nil, Want error", k)
+		}
+	}
+	h6 := Key{Kind: "Handler", Namespace: "ns", Name: "h6"}
+	if err := s.Delete(h6, ""); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if lst := parseFile("templated.yaml", mustRead(t, filepath.Join(fsroot, "templated.yaml")), s.lookupEnv); len(lst) != 1 {
+		t.Errorf("Got %v, Want h4 to remain", lst)
+	}
+	if len(s.List()) != len(want)-1 {
+		t.Errorf("Got %v, Want h6 to be deleted", s.List())
+	}
+}
+
 func TestFSStore2MissingRoot(t *testing.T) {
 	s, fsroot := getTempFSStore2()
 	if err := os.RemoveAll(fsroot); err != nil {
@@ -380,3 +853,70 @@ spec:
 		})
 	}
 }
+
+func TestFSStore2ReadFailure(t *testing.T) {
+	s, fsroot := getTempFSStore2()
+	defer cleanupRootIfOK(t, fsroot)
+	const ns = "ns"
+	k1 := Key{Kind: "Handler", Namespace: ns, Name: "h1"}
+	k2 := Key{Kind: "Handler", Namespace: ns, Name: "h2"}
+	k3 := Key{Kind: "Handler", Namespace: ns, Name: "h3"}
+	for _, k := range []Key{k1, k2, k3} {
+		if err := write(fsroot, k, map[string]interface{}{"adapter": "noop"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	failing := map[string]bool{filepath.Join(fsroot, "Handler", ns, "h3.yaml"): true}
+	setFailing := func(name string, fail bool) {
+		mu.Lock()
+		failing[filepath.Join(fsroot, "Handler", ns, name)] = fail
+		mu.Unlock()
+	}
+	rf := readFile
+	readFile = func(path string) ([]byte, error) {
+		mu.Lock()
+		fail := failing[path]
+		mu.Unlock()
+		if fail {
+			return nil, errors.New("permission denied")
+		}
+		return rf(path)
+	}
+	defer func() { readFile = rf }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	// The unreadable file is skipped, the other files are still loaded.
+	if _, err := s.Get(k3); err != ErrNotFound {
+		t.Errorf("Got %v, want ErrNotFound for the unreadable file", err)
+	}
+	if _, err := s.Get(k1); err != nil {
+		t.Errorf("Failed to get %s: %v", k1, err)
+	}
+
+	// An unreadable update keeps the previously read content.
+	setFailing("h1.yaml", true)
+	if err := write(fsroot, k1, map[string]interface{}{"adapter": "updated"}); err != nil {
+		t.Fatal(err)
+	}
+	s.checkAndUpdate()
+	want := map[string]interface{}{"adapter": "noop"}
+	if r, err := s.Get(k1); err != nil || !reflect.DeepEqual(r.Spec, want) {
+		t.Errorf("Got %v, %v, want %v", r, err, want)
+	}
+	if len(s.List()) != 2 {
+		t.Errorf("Got %d resources, want 2", len(s.List()))
+	}
+
+	// The file is read again once readable.
+	setFailing("h1.yaml", false)
+	s.checkAndUpdate()
+	want = map[string]interface{}{"adapter": "updated"}
+	if r, err := s.Get(k1); err != nil || !reflect.DeepEqual(r.Spec, want) {
+		t.Errorf("Got %v, %v, want %v", r, err, want)
+	}
+}
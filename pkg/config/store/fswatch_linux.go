@@ -0,0 +1,170 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+// inotifyMask is the set of inotify events which may change the config.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotifyReadTimeout bounds how long the reader blocks, in milliseconds, before checking if the watcher is closed.
+const inotifyReadTimeout = 200
+
+// inotifyWatcher is the fsWatcher using linux inotify.
+type inotifyWatcher struct {
+	fd   int
+	epfd int
+
+	mu    sync.Mutex
+	wds   map[int]string
+	paths map[string]int
+
+	ch   chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func init() {
+	newFsWatcher = newInotifyWatcher
+}
+
+func newInotifyWatcher() (fsWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		_ = syscall.Close(epfd)
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd:    fd,
+		epfd:  epfd,
+		wds:   map[int]string{},
+		paths: map[string]int{},
+		ch:    make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.readEvents()
+	return w, nil
+}
+
+// add implements fsWatcher interface.
+func (w *inotifyWatcher) add(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.paths[dir]; ok {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.wds[wd] = dir
+	w.paths[dir] = wd
+	return nil
+}
+
+// events implements fsWatcher interface.
+func (w *inotifyWatcher) events() <-chan struct{} {
+	return w.ch
+}
+
+// close implements fsWatcher interface.
+func (w *inotifyWatcher) close() error {
+	close(w.done)
+	w.wg.Wait()
+	_ = syscall.Close(w.epfd)
+	return syscall.Close(w.fd)
+}
+
+func (w *inotifyWatcher) readEvents() {
+	defer w.wg.Done()
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		if !w.readable() {
+			continue
+		}
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			glog.Errorf("Failed to read filesystem notifications: %v", err)
+			return
+		}
+		if w.handle(buf[:n]) {
+			w.notify()
+		}
+	}
+}
+
+// readable waits until the inotify file descriptor has events to read, or
+// the read timeout elapses.
+func (w *inotifyWatcher) readable() bool {
+	var events [1]syscall.EpollEvent
+	n, err := syscall.EpollWait(w.epfd, events[:], inotifyReadTimeout)
+	return err == nil && n > 0
+}
+
+// handle processes the events in buf, and returns true if any of them may change the config.
+func (w *inotifyWatcher) handle(buf []byte) bool {
+	changed := false
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		offset += syscall.SizeofInotifyEvent + int(ev.Len)
+		if ev.Mask&syscall.IN_IGNORED != 0 {
+			// the watched directory is removed; allow it to be watched again when it is recreated.
+			w.mu.Lock()
+			delete(w.paths, w.wds[int(ev.Wd)])
+			delete(w.wds, int(ev.Wd))
+			w.mu.Unlock()
+		}
+		if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			glog.Warning("Filesystem notification queue overflowed")
+		}
+		changed = true
+	}
+	return changed
+}
+
+// notify signals a change without blocking; pending signals are coalesced.
+func (w *inotifyWatcher) notify() {
+	select {
+	case w.ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// layeredScheme is the URL scheme of the layered store. The layers are the
+// "layer" query parameters, from the lowest to the highest precedence, like
+// layered://?layer=fs:///etc/mixer/defaults&layer=k8s://
+// Layer URLs with a query need to be escaped.
+const layeredScheme = "layered"
+
+// layered is the Store2Backend which overlays multiple backends. A resource in
+// a layer hides the resources of the same key in the lower layers. Changes are
+// written to the top layer, so deleting a resource there reveals the lower one.
+type layered struct {
+	// layers are ordered from the lowest to the highest precedence.
+	layers []Store2Backend
+
+	// mu serializes the reconciliation of the events from the layers.
+	mu sync.Mutex
+
+	watchMutex sync.RWMutex
+	watchCtx   context.Context
+	watchCh    chan BackendEvent
+	// cancelWatch stops forwarding the events of the layers to watchCh.
+	cancelWatch context.CancelFunc
+}
+
+var _ Store2Backend = &layered{}
+
+func (r *Registry2) newLayered(u *url.URL) (Store2Backend, error) {
+	urls := u.Query()["layer"]
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no layers in the config URL %s", u)
+	}
+	l := &layered{layers: make([]Store2Backend, 0, len(urls))}
+	for _, lu := range urls {
+		b, err := r.newBackend(lu)
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer of %s: %v", u, err)
+		}
+		l.layers = append(l.layers, b)
+	}
+	return l, nil
+}
+
+func (l *layered) top() Store2Backend {
+	return l.layers[len(l.layers)-1]
+}
+
+// Init implements Store2Backend interface.
+func (l *layered) Init(ctx context.Context, kinds []string) error {
+	for _, b := range l.layers {
+		if err := b.Init(ctx, kinds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch implements Store2Backend interface. The disconnect of any layer is
+// reported as the disconnect of the layered store.
+func (l *layered) Watch(ctx context.Context) (<-chan BackendEvent, error) {
+	wctx, cancel := context.WithCancel(ctx)
+	chs := make([]<-chan BackendEvent, len(l.layers))
+	for i, b := range l.layers {
+		ch, err := b.Watch(wctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		chs[i] = ch
+	}
+	ch := make(chan BackendEvent)
+	l.watchMutex.Lock()
+	if l.cancelWatch != nil {
+		// the layers are watched again after a disconnect.
+		l.cancelWatch()
+	}
+	l.watchCtx = wctx
+	l.watchCh = ch
+	l.cancelWatch = cancel
+	l.watchMutex.Unlock()
+	for i, lch := range chs {
+		go l.forward(wctx, i, lch)
+	}
+	return ch, nil
+}
+
+// disconnect closes the channel of the watch started with ctx, unless the
+// layers are already watched again.
+func (l *layered) disconnect(ctx context.Context) {
+	l.watchMutex.Lock()
+	defer l.watchMutex.Unlock()
+	if l.watchCtx != ctx {
+		return
+	}
+	l.cancelWatch()
+	close(l.watchCh)
+	l.watchCtx = nil
+	l.watchCh = nil
+	l.cancelWatch = nil
+}
+
+// forward reconciles the events of the i-th layer with the other layers.
+func (l *layered) forward(ctx context.Context, i int, ch <-chan BackendEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				glog.Warningf("Layer %d of the layered store was disconnected", i)
+				l.disconnect(ctx)
+				return
+			}
+			l.mu.Lock()
+			if ev, ok = l.reconcile(i, ev); ok {
+				l.dispatch(ev)
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// reconcile returns the event of the layered store for the event of the i-th layer.
+// Changes hidden by a higher layer are dropped, and deletes reveal the resource of
+// the highest lower layer if any.
+func (l *layered) reconcile(i int, ev BackendEvent) (BackendEvent, bool) {
+	if _, j := l.find(ev.Key, len(l.layers)-1, i+1); j >= 0 {
+		return ev, false
+	}
+	if ev.Type == Delete {
+		if res, j := l.find(ev.Key, i-1, 0); j >= 0 {
+			return BackendEvent{Type: Update, Key: ev.Key, Value: res}, true
+		}
+	}
+	return ev, true
+}
+
+// find returns the resource of the highest layer from the layers from..to (descending),
+// and the index of the layer. The index is -1 if no layer has the resource.
+func (l *layered) find(key Key, from int, to int) (*BackEndResource, int) {
+	for i := from; i >= to; i-- {
+		if res, err := l.layers[i].Get(key); err == nil {
+			return res, i
+		}
+	}
+	return nil, -1
+}
+
+func (l *layered) dispatch(ev BackendEvent) {
+	l.watchMutex.RLock()
+	defer l.watchMutex.RUnlock()
+	if l.watchCtx == nil {
+		return
+	}
+	select {
+	case <-l.watchCtx.Done():
+	case l.watchCh <- ev:
+	}
+}
+
+// Get implements Store2Backend interface.
+func (l *layered) Get(key Key) (*BackEndResource, error) {
+	if res, i := l.find(key, len(l.layers)-1, 0); i >= 0 {
+		return res, nil
+	}
+	return nil, ErrNotFound
+}
+
+// List implements Store2Backend interface.
+func (l *layered) List() map[Key]*BackEndResource {
+	result := map[Key]*BackEndResource{}
+	for _, b := range l.layers {
+		for k, v := range b.List() {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// Put implements Store2Backend interface. The resource is written to the top layer.
+// A resource of a lower layer is overridden if the revision is the revision of the lower one.
+func (l *layered) Put(key Key, resource *BackEndResource) (string, error) {
+	top := l.top()
+	if rev := resource.Metadata.Revision; rev != "" {
+		if _, err := top.Get(key); err == ErrNotFound {
+			cur, err := l.Get(key)
+			if err != nil || cur.Metadata.Revision != rev {
+				return "", ErrConflict
+			}
+			override := *resource
+			override.Metadata.Revision = ""
+			resource = &override
+		}
+	}
+	return top.Put(key, resource)
+}
+
+// Delete implements Store2Backend interface. Only resources of the top layer can be deleted.
+func (l *layered) Delete(key Key, revision string) error {
+	return l.top().Delete(key, revision)
+}
+
+// SetStatus implements StatusWriter interface. The status is written to the layer
+// of the resource, and is dropped if that layer does not support status.
+func (l *layered) SetStatus(key Key, status map[string]interface{}) error {
+	supported := false
+	for _, b := range l.layers {
+		if _, ok := b.(StatusWriter); ok {
+			supported = true
+		}
+	}
+	if !supported {
+		return ErrStatusNotSupported
+	}
+	_, i := l.find(key, len(l.layers)-1, 0)
+	if i < 0 {
+		return ErrNotFound
+	}
+	sw, ok := l.layers[i].(StatusWriter)
+	if !ok {
+		return nil
+	}
+	return sw.SetStatus(key, status)
+}
@@ -0,0 +1,245 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestLayered(t *testing.T) (*layered, MemstoreWriter, MemstoreWriter) {
+	lower := "memstore://" + t.Name() + "/lower"
+	upper := "memstore://" + t.Name() + "/upper"
+	u := layeredScheme + "://?layer=" + url.QueryEscape(lower) + "&layer=" + url.QueryEscape(upper)
+	b, err := NewRegistry2().newBackend(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*layered), GetMemstoreWriter(lower), GetMemstoreWriter(upper)
+}
+
+func nextEvent(t *testing.T, ch <-chan BackendEvent) BackendEvent {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("Did not get an event")
+	}
+	return BackendEvent{}
+}
+
+func spec(adapter string) map[string]interface{} {
+	return map[string]interface{}{"adapter": adapter}
+}
+
+func TestLayered(t *testing.T) {
+	l, lower, upper := newTestLayered(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := l.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := l.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key{Kind: "Handler", Namespace: "ns", Name: "default"}
+
+	// defaults in the lower layer.
+	_, _ = lower.Put(k, &BackEndResource{Spec: spec("default")})
+	if ev := nextEvent(t, ch); ev.Type != Update || !reflect.DeepEqual(ev.Value.Spec, spec("default")) {
+		t.Errorf("Got %+v, Want update to default", ev)
+	}
+
+	// overridden by the upper layer.
+	_, _ = upper.Put(k, &BackEndResource{Spec: spec("override")})
+	if ev := nextEvent(t, ch); ev.Type != Update || !reflect.DeepEqual(ev.Value.Spec, spec("override")) {
+		t.Errorf("Got %+v, Want update to override", ev)
+	}
+	if r, err := l.Get(k); err != nil || !reflect.DeepEqual(r.Spec, spec("override")) {
+		t.Errorf("Got %+v/%v, Want override", r, err)
+	}
+
+	// changes of the lower layer are hidden while overridden.
+	_, _ = lower.Put(k, &BackEndResource{Spec: spec("default2")})
+	k2 := Key{Kind: "Handler", Namespace: "ns", Name: "other"}
+	_, _ = lower.Put(k2, &BackEndResource{Spec: spec("other")})
+	if ev := nextEvent(t, ch); ev.Key != k2 {
+		t.Errorf("Got %+v, Want the event of %s", ev, k2)
+	}
+
+	want := map[Key]map[string]interface{}{k: spec("override"), k2: spec("other")}
+	lst := l.List()
+	if len(lst) != len(want) {
+		t.Errorf("Got %v, Want %v", lst, want)
+	}
+	for key, r := range lst {
+		if !reflect.DeepEqual(r.Spec, want[key]) {
+			t.Errorf("%s: Got %v, Want %v", key, r.Spec, want[key])
+		}
+	}
+
+	// deleting the override reveals the lower one.
+	_ = upper.Delete(k, "")
+	if ev := nextEvent(t, ch); ev.Type != Update || !reflect.DeepEqual(ev.Value.Spec, spec("default2")) {
+		t.Errorf("Got %+v, Want update to default2", ev)
+	}
+	_ = lower.Delete(k, "")
+	if ev := nextEvent(t, ch); ev.Type != Delete || ev.Key != k {
+		t.Errorf("Got %+v, Want delete of %s", ev, k)
+	}
+	if _, err = l.Get(k); err != ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+}
+
+func TestLayeredDisconnect(t *testing.T) {
+	l, lower, upper := newTestLayered(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := l.Init(ctx, []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := l.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the disconnect of a layer closes the channel.
+	disconnectMemstore(lower.(*memstore))
+	select {
+	case ev, ok := <-ch:
+		if ok {
+			t.Fatalf("Got %+v, Want the channel closed", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The channel is not closed")
+	}
+
+	// the layers are watched again.
+	if ch, err = l.Watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	k := Key{Kind: "Handler", Namespace: "ns", Name: "default"}
+	_, _ = lower.Put(k, &BackEndResource{Spec: spec("default")})
+	if ev := nextEvent(t, ch); ev.Key != k {
+		t.Errorf("Got %+v, Want the event of %s", ev, k)
+	}
+	_, _ = upper.Put(k, &BackEndResource{Spec: spec("override")})
+	if ev := nextEvent(t, ch); !reflect.DeepEqual(ev.Value.Spec, spec("override")) {
+		t.Errorf("Got %+v, Want update to override", ev)
+	}
+}
+
+func TestLayeredPutDelete(t *testing.T) {
+	l, lower, upper := newTestLayered(t)
+	if err := l.Init(context.Background(), []string{"Handler"}); err != nil {
+		t.Fatal(err)
+	}
+	k := Key{Kind: "Handler", Namespace: "ns", Name: "default"}
+	_, _ = lower.Put(k, &BackEndResource{Spec: spec("default")})
+	_, _ = lower.Put(k, &BackEndResource{Spec: spec("default")})
+	cur, err := l.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resources of the lower layer can not be deleted.
+	if err = l.Delete(k, ""); err != ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+	if _, err = l.Put(k, &BackEndResource{Metadata: ResourceMeta{Revision: "1"}, Spec: spec("override")}); err != ErrConflict {
+		t.Errorf("Got %v, Want ErrConflict", err)
+	}
+	// the lower one is overridden at its revision.
+	if _, err = l.Put(k, &BackEndResource{Metadata: cur.Metadata, Spec: spec("override")}); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if r, err := upper.(*memstore).Get(k); err != nil || !reflect.DeepEqual(r.Spec, spec("override")) {
+		t.Errorf("Got %+v/%v, Want override in the upper layer", r, err)
+	}
+	if r, err := lower.(*memstore).Get(k); err != nil || !reflect.DeepEqual(r.Spec, spec("default")) {
+		t.Errorf("Got %+v/%v, Want default in the lower layer", r, err)
+	}
+	if err = l.Delete(k, ""); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if r, err := l.Get(k); err != nil || !reflect.DeepEqual(r.Spec, spec("default")) {
+		t.Errorf("Got %+v/%v, Want default", r, err)
+	}
+}
+
+func TestLayeredStatus(t *testing.T) {
+	r := NewRegistry2(registerTestStore)
+	k := Key{Kind: "Handler", Namespace: "ns", Name: "default"}
+	b, err := r.newBackend("layered://?layer=memstore://" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.(StatusWriter).SetStatus(k, nil); err != ErrStatusNotSupported {
+		t.Errorf("Got %v, Want ErrStatusNotSupported", err)
+	}
+
+	b, err = r.newBackend("layered://?layer=memstore://" + t.Name() + "&layer=test://" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := b.(*layered)
+	ts := l.layers[1].(*testStore)
+	lower := l.layers[0].(*memstore)
+	if err = l.SetStatus(k, nil); err != ErrNotFound {
+		t.Errorf("Got %v, Want ErrNotFound", err)
+	}
+	// status of resources in layers without status support is dropped.
+	_, _ = lower.Put(k, &BackEndResource{})
+	if err = l.SetStatus(k, map[string]interface{}{"state": "Accepted"}); err != nil || len(ts.status) != 0 {
+		t.Errorf("Got %v %v, Want no status written", err, ts.status)
+	}
+	_, _ = ts.Put(k, &BackEndResource{})
+	if err = l.SetStatus(k, map[string]interface{}{"state": "Accepted"}); err != nil || len(ts.status) != 1 {
+		t.Errorf("Got %v %v, Want the status written", err, ts.status)
+	}
+}
+
+func TestLayeredURL(t *testing.T) {
+	r := NewRegistry2(registerTestStore)
+	for _, c := range []struct {
+		u      string
+		layers int
+	}{
+		{"layered://?layer=fs:///defaults&layer=memstore://a", 2},
+		{"layered://?layer=" + url.QueryEscape("layered://?layer=fs:///a&layer=fs:///b") + "&layer=test://", 2},
+		{"layered://", 0},
+		{"layered://?layer=unknown://", 0},
+	} {
+		s, err := r.NewStore2(c.u)
+		if c.layers == 0 {
+			if err == nil {
+				t.Errorf("%s: Got nil, Want error", c.u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Got %v, Want nil", c.u, err)
+			continue
+		}
+		if n := len(s.(*store2).backend.(*layered).layers); n != c.layers {
+			t.Errorf("%s: Got %d layers, Want %d", c.u, n, c.layers)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package store
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"sync"
 )
 
@@ -32,6 +33,9 @@ type memstore struct {
 	mu   sync.RWMutex
 	data map[Key]*BackEndResource
 
+	// revision is the last revision assigned by Put.
+	revision int64
+
 	watchMutex sync.RWMutex
 	watchCtx   context.Context
 	watchCh    chan BackendEvent
@@ -82,9 +86,57 @@ func (m *memstore) List() map[Key]*BackEndResource {
 	return copied
 }
 
-// Put implements MemstoreWriter interface.
-func (m *memstore) Put(key Key, resource *BackEndResource) {
+// Put implements Store2Backend and MemstoreWriter interfaces.
+// The revision check and the write happen under the same lock.
+func (m *memstore) Put(key Key, resource *BackEndResource) (string, error) {
+	m.mu.Lock()
+	if rev := resource.Metadata.Revision; rev != "" {
+		if cur, ok := m.data[key]; !ok || cur.Metadata.Revision != rev {
+			m.mu.Unlock()
+			return "", ErrConflict
+		}
+	}
+	m.revision++
+	res := &BackEndResource{Metadata: resource.Metadata, Spec: resource.Spec}
+	res.Metadata.Revision = strconv.FormatInt(m.revision, 10)
+	m.setLocked(key, res)
+	m.mu.Unlock()
+
+	m.notify(BackendEvent{Type: Update, Key: key, Value: res})
+	return res.Metadata.Revision, nil
+}
+
+// Delete implements Store2Backend and MemstoreWriter interfaces.
+// The revision check and the removal happen under the same lock.
+func (m *memstore) Delete(key Key, revision string) error {
+	m.mu.Lock()
+	cur, ok := m.data[key]
+	switch {
+	case !ok && revision == "":
+		m.mu.Unlock()
+		return ErrNotFound
+	case revision != "" && (!ok || cur.Metadata.Revision != revision):
+		m.mu.Unlock()
+		return ErrConflict
+	}
+	delete(m.data, key)
+	m.mu.Unlock()
+
+	m.notify(BackendEvent{Type: Delete, Key: key})
+	return nil
+}
+
+// set stores the resource and notifies the watcher.
+func (m *memstore) set(key Key, resource *BackEndResource) {
 	m.mu.Lock()
+	m.setLocked(key, resource)
+	m.mu.Unlock()
+
+	m.notify(BackendEvent{Type: Update, Key: key, Value: resource})
+}
+
+// setLocked stores the resource. m.mu must be held.
+func (m *memstore) setLocked(key Key, resource *BackEndResource) {
 	if resource.Metadata.Name == "" {
 		resource.Metadata.Name = key.Name
 	}
@@ -92,29 +144,24 @@ func (m *memstore) Put(key Key, resource *BackEndResource) {
 		resource.Metadata.Namespace = key.Namespace
 	}
 	m.data[key] = resource
-	m.mu.Unlock()
-
-	m.watchMutex.RLock()
-	if m.watchCh != nil {
-		select {
-		case <-m.watchCtx.Done():
-		case m.watchCh <- BackendEvent{Type: Update, Key: key, Value: resource}:
-		}
-	}
-	m.watchMutex.RUnlock()
 }
 
-// Delete implements MemstoreWriter interface.
-func (m *memstore) Delete(key Key) {
+// remove removes the resource and notifies the watcher.
+func (m *memstore) remove(key Key) {
 	m.mu.Lock()
 	delete(m.data, key)
 	m.mu.Unlock()
 
+	m.notify(BackendEvent{Type: Delete, Key: key})
+}
+
+// notify sends the event to the watcher.
+func (m *memstore) notify(ev BackendEvent) {
 	m.watchMutex.RLock()
 	if m.watchCh != nil {
 		select {
 		case <-m.watchCtx.Done():
-		case m.watchCh <- BackendEvent{Type: Delete, Key: key}:
+		case m.watchCh <- ev:
 		}
 	}
 	m.watchMutex.RUnlock()
@@ -123,8 +170,8 @@ func (m *memstore) Delete(key Key) {
 // MemstoreWriter is the interface to make changes on the memstore backend. This
 // will be used by tests to set up the on-memory data in the store.
 type MemstoreWriter interface {
-	Put(key Key, resource *BackEndResource)
-	Delete(key Key)
+	Put(key Key, resource *BackEndResource) (string, error)
+	Delete(key Key, revision string) error
 }
 
 // GetMemstoreWriter returns the MemstoreWriter used for the config store URL, or nil
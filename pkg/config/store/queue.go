@@ -65,7 +65,10 @@ loop:
 		select {
 		case <-q.ctx.Done():
 			break loop
-		case ev := <-q.chin:
+		case ev, ok := <-q.chin:
+			if !ok {
+				break loop
+			}
 			converted, err := q.convertValue(ev)
 			if err != nil {
 				glog.Errorf("Failed to convert %s an event: %v", ev.Key, err)
@@ -76,7 +79,12 @@ loop:
 				select {
 				case <-q.ctx.Done():
 					break loop
-				case ev := <-q.chin:
+				case ev, ok := <-q.chin:
+					if !ok {
+						// deliver the pending events before closing the output.
+						q.flush(evs)
+						break loop
+					}
 					converted, err = q.convertValue(ev)
 					if err != nil {
 						glog.Errorf("Failed to convert %s an event: %v", ev.Key, err)
@@ -91,3 +99,14 @@ loop:
 	}
 	close(q.chout)
 }
+
+// flush delivers the events unless ctx is done.
+func (q *eventQueue) flush(evs []Event) {
+	for _, ev := range evs {
+		select {
+		case <-q.ctx.Done():
+			return
+		case q.chout <- ev:
+		}
+	}
+}
@@ -155,3 +155,22 @@ func TestQueueCancelSync(t *testing.T) {
 		t.Errorf("Got %+v, Want empty", ev)
 	}
 }
+
+func TestQueueClosedInput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chin := make(chan BackendEvent)
+	q := newQueue(ctx, chin, map[string]proto.Message{"Handler": &cfg.Handler{}})
+	chin <- BackendEvent{
+		Type:  Update,
+		Key:   Key{Kind: "Handler", Namespace: "ns", Name: "h1"},
+		Value: &BackEndResource{},
+	}
+	close(chin)
+	if ev := <-q.chout; ev.Name != "h1" {
+		t.Errorf("Got %+v, Want h1", ev)
+	}
+	if ev, ok := <-q.chout; ok {
+		t.Errorf("Got %+v, Want the output closed", ev)
+	}
+}
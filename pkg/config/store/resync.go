@@ -0,0 +1,182 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The interval to wait before a failed watch is restarted after a disconnect.
+// This is not const to allow changing the value for unittests.
+var resyncRetryInterval = time.Second
+
+const (
+	outcomeLabel    = "outcome"
+	changeTypeLabel = "change_type"
+)
+
+var (
+	resyncCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "config",
+			Name:      "store_resync_count",
+			Help:      "Total number of attempts to resume the watch of the config store after a disconnect, by outcome.",
+		}, []string{outcomeLabel})
+
+	resyncEventCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "config",
+			Name:      "store_resync_event_count",
+			Help:      "Total number of events synthesized by resyncs of the config store.",
+		}, []string{changeTypeLabel})
+)
+
+func init() {
+	prometheus.MustRegister(resyncCounter)
+	prometheus.MustRegister(resyncEventCounter)
+}
+
+// resumingWatch forwards the events of a backend. When the backend reports a
+// disconnect by closing its channel, the watch is restarted and the resources
+// are listed again. Differences from the last known state are forwarded as events,
+// so that the changes missed while disconnected are not lost.
+type resumingWatch struct {
+	backend Store2Backend
+	chout   chan BackendEvent
+
+	// known is the state of the backend as of the forwarded events.
+	known map[Key]*BackEndResource
+}
+
+// resumeWatch starts watching the backend, and returns the channel of the events
+// which is resumed after disconnects. The channel is closed when ctx is done.
+func resumeWatch(ctx context.Context, b Store2Backend) (<-chan BackendEvent, error) {
+	ch, err := b.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w := &resumingWatch{
+		backend: b,
+		chout:   make(chan BackendEvent),
+		known:   b.List(),
+	}
+	go w.run(ctx, ch)
+	return w.chout, nil
+}
+
+func (w *resumingWatch) run(ctx context.Context, ch <-chan BackendEvent) {
+	defer close(w.chout)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				if ch = w.resume(ctx); ch == nil {
+					return
+				}
+				continue
+			}
+			w.track(ev)
+			if !w.send(ctx, ev) {
+				return
+			}
+		}
+	}
+}
+
+// resume restarts the watch of the backend until it succeeds, and forwards the
+// differences of the listed resources from the known state. It returns nil if ctx
+// is done before the watch is resumed.
+func (w *resumingWatch) resume(ctx context.Context) <-chan BackendEvent {
+	glog.Warningf("The watch of the config store was disconnected, resyncing")
+	for {
+		ch, err := w.backend.Watch(ctx)
+		if err == nil {
+			resyncCounter.With(prometheus.Labels{outcomeLabel: "resumed"}).Inc()
+			for _, ev := range w.resync() {
+				if !w.send(ctx, ev) {
+					return nil
+				}
+			}
+			return ch
+		}
+		resyncCounter.With(prometheus.Labels{outcomeLabel: "failed"}).Inc()
+		glog.Warningf("Failed to resume the watch of the config store, retrying in %v: %v", resyncRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(resyncRetryInterval):
+		}
+	}
+}
+
+// resync lists the resources of the backend and returns the events which
+// turn the known state into the listed one.
+func (w *resumingWatch) resync() []BackendEvent {
+	data := w.backend.List()
+	var evs []BackendEvent
+	for k, r := range data {
+		if old, ok := w.known[k]; !ok || !sameBackEndResource(old, r) {
+			evs = append(evs, BackendEvent{Type: Update, Key: k, Value: r})
+		}
+	}
+	updated := len(evs)
+	for k := range w.known {
+		if _, ok := data[k]; !ok {
+			evs = append(evs, BackendEvent{Type: Delete, Key: k})
+		}
+	}
+	w.known = data
+	resyncEventCounter.With(prometheus.Labels{changeTypeLabel: "update"}).Add(float64(updated))
+	resyncEventCounter.With(prometheus.Labels{changeTypeLabel: "delete"}).Add(float64(len(evs) - updated))
+	glog.Infof("Resynced the config store: %d updated, %d deleted", updated, len(evs)-updated)
+	return evs
+}
+
+// track applies the event to the known state.
+func (w *resumingWatch) track(ev BackendEvent) {
+	switch {
+	case ev.Type == Delete:
+		delete(w.known, ev.Key)
+	case ev.Value != nil:
+		w.known[ev.Key] = ev.Value
+	}
+}
+
+func (w *resumingWatch) send(ctx context.Context, ev BackendEvent) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case w.chout <- ev:
+		return true
+	}
+}
+
+// sameBackEndResource returns true if the resources are the same. Revisions are
+// compared when both are known, otherwise the whole resources are compared.
+func sameBackEndResource(a *BackEndResource, b *BackEndResource) bool {
+	if a.Metadata.Revision != "" && b.Metadata.Revision != "" {
+		return a.Metadata.Revision == b.Metadata.Revision
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	cfg "istio.io/mixer/pkg/config/proto"
+)
+
+// disconnectingStore is a memstore whose watch can be disconnected.
+type disconnectingStore struct {
+	memstore
+
+	mu       sync.Mutex
+	watchErr error
+}
+
+func (d *disconnectingStore) Watch(ctx context.Context) (<-chan BackendEvent, error) {
+	d.mu.Lock()
+	err := d.watchErr
+	d.watchErr = nil
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return d.memstore.Watch(ctx)
+}
+
+// disconnect closes the watch channel. The next watch fails with err if it is not nil.
+func (d *disconnectingStore) disconnect(err error) {
+	d.mu.Lock()
+	d.watchErr = err
+	d.mu.Unlock()
+	disconnectMemstore(&d.memstore)
+}
+
+func disconnectMemstore(m *memstore) {
+	m.watchMutex.Lock()
+	close(m.watchCh)
+	m.watchCtx = nil
+	m.watchCh = nil
+	m.watchMutex.Unlock()
+}
+
+// setSilently changes the memstore without notifying the watcher, like a change missed while disconnected.
+func setSilently(m *memstore, key Key, res *BackEndResource) {
+	m.mu.Lock()
+	if res == nil {
+		delete(m.data, key)
+	} else {
+		m.data[key] = res
+	}
+	m.mu.Unlock()
+}
+
+func counterValue(t *testing.T, c *prometheus.CounterVec, label string, value string) float64 {
+	m := &dto.Metric{}
+	if err := c.With(prometheus.Labels{label: value}).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func nextStoreEvent(t *testing.T, ch <-chan Event) Event {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("Did not get an event")
+	}
+	return Event{}
+}
+
+func TestStore2Resync(t *testing.T) {
+	resyncRetryInterval = time.Millisecond
+	d := &disconnectingStore{memstore: memstore{data: map[Key]*BackEndResource{}}}
+	s := &store2{backend: d}
+	if err := s.Init(context.Background(), map[string]proto.Message{"Handler": &cfg.Handler{}}); err != nil {
+		t.Fatal(err)
+	}
+	k := func(name string) Key { return Key{Kind: "Handler", Namespace: "ns", Name: name} }
+	for _, name := range []string{"unchanged", "changed", "deleted"} {
+		setSilently(&d.memstore, k(name), &BackEndResource{Metadata: ResourceMeta{Revision: "1"}, Spec: spec(name)})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Put(k("watched"), &BackEndResource{Spec: spec("watched")}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextStoreEvent(t, ch); ev.Key != k("watched") || ev.Type != Update {
+		t.Fatalf("Got %+v, Want the update of watched", ev)
+	}
+
+	resumed := counterValue(t, resyncCounter, outcomeLabel, "resumed")
+	failed := counterValue(t, resyncCounter, outcomeLabel, "failed")
+	updates := counterValue(t, resyncEventCounter, changeTypeLabel, "update")
+	deletes := counterValue(t, resyncEventCounter, changeTypeLabel, "delete")
+
+	// changes missed while disconnected.
+	setSilently(&d.memstore, k("changed"), &BackEndResource{Metadata: ResourceMeta{Revision: "2"}, Spec: spec("new")})
+	setSilently(&d.memstore, k("deleted"), nil)
+	setSilently(&d.memstore, k("added"), &BackEndResource{Metadata: ResourceMeta{Revision: "3"}, Spec: spec("added")})
+	d.disconnect(errors.New("unavailable"))
+
+	got := map[Key]ChangeType{}
+	for i := 0; i < 3; i++ {
+		ev := nextStoreEvent(t, ch)
+		got[ev.Key] = ev.Type
+		if ev.Key == k("changed") && ev.Value.Spec.(*cfg.Handler).Adapter != "new" {
+			t.Errorf("Got %+v, Want the new spec", ev.Value)
+		}
+	}
+	want := map[Key]ChangeType{k("changed"): Update, k("deleted"): Delete, k("added"): Update}
+	for key, ct := range want {
+		if got[key] != ct {
+			t.Errorf("Got %v, Want %v of %s", got, ct, key)
+		}
+	}
+
+	// the watch is resumed.
+	if _, err = d.Put(k("resumed"), &BackEndResource{Spec: spec("resumed")}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextStoreEvent(t, ch); ev.Key != k("resumed") {
+		t.Errorf("Got %+v, Want the update of resumed", ev)
+	}
+
+	for _, c := range []struct {
+		counter *prometheus.CounterVec
+		label   string
+		value   string
+		want    float64
+	}{
+		{resyncCounter, outcomeLabel, "resumed", resumed + 1},
+		{resyncCounter, outcomeLabel, "failed", failed + 1},
+		{resyncEventCounter, changeTypeLabel, "update", updates + 2},
+		{resyncEventCounter, changeTypeLabel, "delete", deletes + 1},
+	} {
+		if got := counterValue(t, c.counter, c.label, c.value); got != c.want {
+			t.Errorf("%s: Got %v, Want %v", c.value, got, c.want)
+		}
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestSameBackEndResource(t *testing.T) {
+	for _, c := range []struct {
+		a    *BackEndResource
+		b    *BackEndResource
+		want bool
+	}{
+		{&BackEndResource{Metadata: ResourceMeta{Revision: "1"}, Spec: spec("a")}, &BackEndResource{Metadata: ResourceMeta{Revision: "1"}, Spec: spec("b")}, true},
+		{&BackEndResource{Metadata: ResourceMeta{Revision: "1"}, Spec: spec("a")}, &BackEndResource{Metadata: ResourceMeta{Revision: "2"}, Spec: spec("a")}, false},
+		{&BackEndResource{Spec: spec("a")}, &BackEndResource{Spec: spec("a")}, true},
+		{&BackEndResource{Spec: spec("a")}, &BackEndResource{Spec: spec("b")}, false},
+	} {
+		if got := sameBackEndResource(c.a, c.b); got != c.want {
+			t.Errorf("%+v %+v: Got %t, Want %t", c.a, c.b, got, c.want)
+		}
+	}
+}
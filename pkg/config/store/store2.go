@@ -31,6 +31,17 @@ var ErrNotFound = errors.New("not found")
 // ErrWatchAlreadyExists is the error to report that the watching channel already exists.
 var ErrWatchAlreadyExists = errors.New("watch already exists")
 
+// ErrConflict is the error to be returned when a change is made against a revision
+// that is not the current revision of the resource.
+var ErrConflict = errors.New("revision conflict")
+
+// ErrRevisionNotSupported is the error to report that the storage can not check
+// the revision of a deletion atomically.
+var ErrRevisionNotSupported = errors.New("revision-checked delete not supported")
+
+// ErrStatusNotSupported is the error to report that the storage does not record resource status.
+var ErrStatusNotSupported = errors.New("status not supported")
+
 // Key represents the key to identify a resource in the store.
 type Key struct {
 	Kind      string
@@ -85,7 +96,9 @@ type Event struct {
 
 // Validator defines the interface to validate a new change.
 type Validator interface {
-	Validate(t ChangeType, key Key, spec proto.Message) bool
+	// Validate returns nil if the change is valid, or an error which describes the problems.
+	// The value of a Delete event is nil.
+	Validate(ev *Event) error
 }
 
 // Store2Backend defines the typeless storage backend for mixer.
@@ -93,7 +106,9 @@ type Validator interface {
 type Store2Backend interface {
 	Init(ctx context.Context, kinds []string) error
 
-	// Watch creates a channel to receive the events.
+	// Watch creates a channel to receive the events. The backend closes the channel
+	// to report a disconnect after which events may have been missed. Watch is then
+	// called again, and the resources are listed to recover the missed changes.
 	Watch(ctx context.Context) (<-chan BackendEvent, error)
 
 	// Get returns a resource's spec to the key.
@@ -101,6 +116,24 @@ type Store2Backend interface {
 
 	// List returns the whole mapping from key to resource specs in the store.
 	List() map[Key]*BackEndResource
+
+	// Put creates or updates a resource and returns its new revision.
+	// If resource.Metadata.Revision is set, the resource is updated only if
+	// its current revision matches, otherwise ErrConflict is returned.
+	Put(key Key, resource *BackEndResource) (string, error)
+
+	// Delete removes a resource.
+	// If revision is set, the resource is removed only if its current
+	// revision matches, otherwise ErrConflict is returned. Backends that can
+	// not check the revision atomically return ErrRevisionNotSupported instead.
+	Delete(key Key, revision string) error
+}
+
+// StatusWriter records the status of a resource as computed by its consumer.
+// Store2Backend implementations may optionally implement it.
+type StatusWriter interface {
+	// SetStatus replaces the status of the resource to the key.
+	SetStatus(key Key, status map[string]interface{}) error
 }
 
 // Store2 defines the access to the storage for mixer.
@@ -110,6 +143,8 @@ type Store2 interface {
 
 	// Watch creates a channel to receive the events. A store can conduct a single
 	// watch channel at the same time. Multiple calls lead to an error.
+	// The watch is resumed when the backend is disconnected, and the changes
+	// made in the meantime are delivered as events.
 	Watch(ctx context.Context) (<-chan Event, error)
 
 	// Get returns a resource's spec to the key.
@@ -117,6 +152,17 @@ type Store2 interface {
 
 	// List returns the whole mapping from key to resource specs in the store.
 	List() map[Key]*Resource
+
+	// Put creates or updates a resource and returns its new revision.
+	// If resource.Metadata.Revision is set, the resource is updated only if
+	// its current revision matches, otherwise ErrConflict is returned.
+	Put(key Key, resource *Resource) (string, error)
+
+	// Delete removes a resource.
+	// If revision is set, the resource is removed only if its current
+	// revision matches, otherwise ErrConflict is returned. Backends that can
+	// not check the revision atomically return ErrRevisionNotSupported instead.
+	Delete(key Key, revision string) error
 }
 
 // store2 is the implementation of Store2 interface.
@@ -150,7 +196,7 @@ func (s *store2) Watch(ctx context.Context) (<-chan Event, error) {
 	if s.queue != nil {
 		return nil, ErrWatchAlreadyExists
 	}
-	ch, err := s.backend.Watch(ctx)
+	ch, err := resumeWatch(ctx, s.backend)
 	if err != nil {
 		return nil, err
 	}
@@ -197,6 +243,33 @@ func (s *store2) List() map[Key]*Resource {
 	return result
 }
 
+// Put implements Store2 interface.
+func (s *store2) Put(key Key, resource *Resource) (string, error) {
+	if _, ok := s.kinds[key.Kind]; !ok {
+		return "", fmt.Errorf("unrecognized kind %s", key.Kind)
+	}
+	spec, err := toUnstructured(resource.Spec)
+	if err != nil {
+		return "", err
+	}
+	return s.backend.Put(key, &BackEndResource{Metadata: resource.Metadata, Spec: spec})
+}
+
+// Delete implements Store2 interface.
+func (s *store2) Delete(key Key, revision string) error {
+	return s.backend.Delete(key, revision)
+}
+
+// SetStatus implements StatusWriter interface.
+// It returns ErrStatusNotSupported if the backend does not record status.
+func (s *store2) SetStatus(key Key, status map[string]interface{}) error {
+	sw, ok := s.backend.(StatusWriter)
+	if !ok {
+		return ErrStatusNotSupported
+	}
+	return sw.SetStatus(key, status)
+}
+
 // Store2Builder is the type of function to build a Store2Backend.
 type Store2Builder func(u *url.URL) (Store2Backend, error)
 
@@ -220,6 +293,15 @@ func NewRegistry2(inventory ...RegisterFunc2) *Registry2 {
 
 // NewStore2 creates a new Store2 instance with the specified backend.
 func (r *Registry2) NewStore2(configURL string) (Store2, error) {
+	b, err := r.newBackend(configURL)
+	if err != nil {
+		return nil, err
+	}
+	return &store2{backend: b}, nil
+}
+
+// newBackend creates the Store2Backend for the config URL.
+func (r *Registry2) newBackend(configURL string) (Store2Backend, error) {
 	u, err := url.Parse(configURL)
 
 	if err != nil {
@@ -232,6 +314,8 @@ func (r *Registry2) NewStore2(configURL string) (Store2, error) {
 		b = NewFsStore2(u.Path)
 	case memstoreScheme:
 		b = createMemstore(u)
+	case layeredScheme:
+		return r.newLayered(u)
 	default:
 		if builder, ok := r.builders[u.Scheme]; ok {
 			b, err = builder(u)
@@ -241,7 +325,7 @@ func (r *Registry2) NewStore2(configURL string) (Store2, error) {
 		}
 	}
 	if b != nil {
-		return &store2{backend: b}, nil
+		return b, nil
 	}
 	return nil, fmt.Errorf("unknown config URL %s %v", configURL, u)
 }
@@ -31,6 +31,15 @@ type testStore struct {
 	memstore
 	initErr  error
 	watchErr error
+	status   map[Key]map[string]interface{}
+}
+
+func (t *testStore) SetStatus(key Key, status map[string]interface{}) error {
+	if t.status == nil {
+		t.status = map[Key]map[string]interface{}{}
+	}
+	t.status[key] = status
+	return nil
 }
 
 func (t *testStore) Init(ctx context.Context, kinds []string) error {
@@ -102,6 +111,7 @@ func TestStore2(t *testing.T) {
 			Metadata: ResourceMeta{
 				Name:      k.Name,
 				Namespace: k.Namespace,
+				Revision:  "2",
 			},
 			Spec: want,
 		},
@@ -170,6 +180,92 @@ func TestStore2Fail(t *testing.T) {
 	}
 }
 
+func TestStore2Status(t *testing.T) {
+	r := NewRegistry2(registerTestStore)
+	k := Key{Kind: "Handler", Name: "name", Namespace: "ns"}
+	status := map[string]interface{}{"state": "Accepted"}
+
+	s, err := r.NewStore2("memstore://" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.(StatusWriter).SetStatus(k, status); err != ErrStatusNotSupported {
+		t.Errorf("Got %v, Want %v", err, ErrStatusNotSupported)
+	}
+
+	s, err = r.NewStore2("test://" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.(StatusWriter).SetStatus(k, status); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	ts := s.(*store2).backend.(*testStore)
+	if !reflect.DeepEqual(ts.status[k], status) {
+		t.Errorf("Got %v, Want %v", ts.status[k], status)
+	}
+}
+
+func TestStore2PutDelete(t *testing.T) {
+	r := NewRegistry2(registerTestStore)
+	s, err := r.NewStore2("memstore://" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Init(context.Background(), map[string]proto.Message{"Handler": &cfg.Handler{}}); err != nil {
+		t.Fatal(err)
+	}
+	k := Key{Kind: "Handler", Name: "name", Namespace: "ns"}
+	h := &cfg.Handler{Name: "default", Adapter: "noop"}
+	if _, err = s.Put(Key{Kind: "Unknown", Name: "name", Namespace: "ns"}, &Resource{Spec: h}); err == nil {
+		t.Errorf("Got nil, Want error for unknown kind")
+	}
+	if _, err = s.Put(k, &Resource{Metadata: ResourceMeta{Revision: "1"}, Spec: h}); err != ErrConflict {
+		t.Errorf("Got %v, Want %v", err, ErrConflict)
+	}
+	rev, err := s.Put(k, &Resource{Spec: h})
+	if err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	got := &cfg.Handler{}
+	if err = s.Get(k, got); err != nil || !reflect.DeepEqual(got, h) {
+		t.Errorf("Got %v/%v, Want %v", got, err, h)
+	}
+
+	h2 := &cfg.Handler{Name: "default", Adapter: "noop2"}
+	rev2, err := s.Put(k, &Resource{Metadata: ResourceMeta{Revision: rev}, Spec: h2})
+	if err != nil {
+		t.Fatalf("Got %v, Want nil", err)
+	}
+	if rev2 == rev {
+		t.Errorf("Got the same revision %s after update", rev2)
+	}
+	// updates against a stale revision are rejected.
+	if _, err = s.Put(k, &Resource{Metadata: ResourceMeta{Revision: rev}, Spec: h}); err != ErrConflict {
+		t.Errorf("Got %v, Want %v", err, ErrConflict)
+	}
+	if err = s.Get(k, got); err != nil || !reflect.DeepEqual(got, h2) {
+		t.Errorf("Got %v/%v, Want %v", got, err, h2)
+	}
+
+	// deletes against a stale revision are rejected.
+	if err = s.Delete(k, rev); err != ErrConflict {
+		t.Errorf("Got %v, Want %v", err, ErrConflict)
+	}
+	if err = s.Delete(k, rev2); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if err = s.Get(k, got); err != ErrNotFound {
+		t.Errorf("Got %v, Want %v", err, ErrNotFound)
+	}
+	if err = s.Delete(k, rev2); err != ErrConflict {
+		t.Errorf("Got %v, Want %v", err, ErrConflict)
+	}
+	if err = s.Delete(k, ""); err != ErrNotFound {
+		t.Errorf("Got %v, Want %v", err, ErrNotFound)
+	}
+}
+
 func TestRegistry2(t *testing.T) {
 	r := NewRegistry2(registerTestStore)
 	for _, c := range []struct {
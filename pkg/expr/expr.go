@@ -444,6 +444,68 @@ func extractEQMatches(ex *Expression, eqMap map[string]interface{}) {
 	}
 }
 
+// ExtractPrefixMatches extracts prefix sub expressions from the match expression.
+// It returns a list of <attribute name, prefix> such that
+// if the attribute does not start with the prefix, the expression will evaluate to false.
+// Like equality matches, only sub expressions joined by top level ANDs are considered.
+// For example
+// match(request.path, "/api/*")  -- Used to index rules by request path.
+// request.path == "/healthz"     -- The whole value is treated as a prefix.
+func ExtractPrefixMatches(src string) (map[string]string, error) {
+	ex, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	prefixMap := make(map[string]string)
+	extractPrefixMatches(ex, prefixMap)
+	return prefixMap, nil
+}
+
+func recordIfPrefix(fn *Function, prefixMap map[string]string) {
+	if len(fn.Args) != 2 {
+		return
+	}
+
+	switch fn.Name {
+	case "match":
+		// match(x, "y*")
+		if fn.Args[0].Var == nil || fn.Args[1].Const == nil {
+			return
+		}
+		pattern, ok := fn.Args[1].Const.Value.(string)
+		if !ok || !strings.HasSuffix(pattern, "*") {
+			return
+		}
+		prefixMap[fn.Args[0].Var.Name] = pattern[:len(pattern)-1]
+	case "EQ":
+		eqMap := make(map[string]interface{})
+		recordIfEQ(fn, eqMap)
+		for k, v := range eqMap {
+			if str, ok := v.(string); ok {
+				prefixMap[k] = str
+			}
+		}
+	}
+}
+
+// extractPrefixMatches traverses down "LANDS" and records prefix matches of variables and constants.
+func extractPrefixMatches(ex *Expression, prefixMap map[string]string) {
+	if ex.Fn == nil {
+		return
+	}
+
+	recordIfPrefix(ex.Fn, prefixMap)
+
+	// only recurse on AND function.
+	if ex.Fn.Name != "LAND" {
+		return
+	}
+
+	for _, arg := range ex.Fn.Args {
+		extractPrefixMatches(arg, prefixMap)
+	}
+}
+
 // DefaultCacheSize is the default size for the expression cache.
 const DefaultCacheSize = 1024
 
@@ -147,6 +147,62 @@ func TestExtractMatches(t *testing.T) {
 	}
 }
 
+func TestExtractPrefixMatches(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		src  string
+		m    map[string]string
+	}{
+		{
+			desc: "no ANDS",
+			src:  `match(request.path, "/a*") || b`,
+			m:    map[string]string{},
+		},
+		{
+			desc: "single prefix match",
+			src:  `match(request.path, "/api/*")`,
+			m: map[string]string{
+				"request.path": "/api/",
+			},
+		},
+		{
+			desc: "suffix match is not a prefix",
+			src:  `match(request.path, "*.html")`,
+			m:    map[string]string{},
+		},
+		{
+			desc: "exact match without wildcard is not a prefix",
+			src:  `match(request.path, "/api")`,
+			m:    map[string]string{},
+		},
+		{
+			desc: "string equality is a prefix",
+			src:  `request.path == "/healthz" && a.b == 3.14`,
+			m: map[string]string{
+				"request.path": "/healthz",
+			},
+		},
+		{
+			desc: "only top level ANDS",
+			src:  `destination.service == "a.b" && match(request.path, "/api/*") && (match(c, "x*") || d)`,
+			m: map[string]string{
+				"destination.service": "a.b",
+				"request.path":        "/api/",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			m, err := ExtractPrefixMatches(tc.src)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(m, tc.m) {
+				t.Fatalf("got %v, want %v", m, tc.m)
+			}
+		})
+	}
+}
+
 func TestNewConstant(t *testing.T) {
 	tests := []struct {
 		v        string
@@ -0,0 +1,257 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed lets all calls through.
+	breakerClosed breakerState = iota
+	// breakerOpen short-circuits all calls.
+	breakerOpen
+	// breakerHalfOpen lets a single probe call through.
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerConfig configures the circuit breakers of handlers.
+type BreakerConfig struct {
+	// Disabled turns off circuit breaking; all calls are dispatched to handlers.
+	Disabled bool
+
+	// Window is the period over which the error rate is computed.
+	Window time.Duration
+
+	// MinRequests is the minimum number of calls in a window before the circuit can open.
+	MinRequests int
+
+	// ErrorRatio is the ratio of failed calls in a window that opens the circuit.
+	ErrorRatio float64
+
+	// CoolDown is the time the circuit stays open before a probe call is let through.
+	CoolDown time.Duration
+}
+
+// DefaultBreakerConfig returns the default circuit breaker settings.
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		Window:      10 * time.Second,
+		MinRequests: 20,
+		ErrorRatio:  0.5,
+		CoolDown:    30 * time.Second,
+	}
+}
+
+// circuitBreaker tracks the error rate of a handler.
+// Calls to a handler with a high error rate are short-circuited for a cool-down period.
+// After the cool-down period a single probe call is let through.
+// The circuit closes if the probe succeeds, otherwise it opens again.
+type circuitBreaker struct {
+	name string
+	cfg  BreakerConfig
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+	// removed breakers no longer report their state.
+	removed bool
+}
+
+// allow returns true if a call should be dispatched to the handler.
+// A call that is allowed must be followed by a call to record.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cfg.CoolDown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record records the outcome of a call that was allowed.
+func (b *circuitBreaker) record(now time.Time, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if success {
+			glog.Infof("Circuit for handler %s closed after a successful probe", b.name)
+			b.reset(now)
+			b.setState(breakerClosed)
+		} else {
+			b.open(now)
+		}
+		return
+	}
+
+	if b.state == breakerOpen {
+		// a call that was allowed before the circuit opened.
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.cfg.Window {
+		b.reset(now)
+	}
+	b.requests++
+	if !success {
+		b.failures++
+	}
+	if b.requests >= b.cfg.MinRequests && float64(b.failures) >= b.cfg.ErrorRatio*float64(b.requests) {
+		glog.Warningf("Circuit for handler %s opened: %d of %d calls failed", b.name, b.failures, b.requests)
+		b.open(now)
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.openedAt = now
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) reset(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	if !b.removed {
+		breakerStateGauge.WithLabelValues(b.name).Set(float64(s))
+	}
+}
+
+// breakerStatus is the externally visible state of a circuitBreaker.
+type breakerStatus struct {
+	Handler  string    `json:"handler"`
+	State    string    `json:"state"`
+	Requests int       `json:"requests"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"openedAt,omitempty"`
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStatus{
+		Handler:  b.name,
+		State:    b.state.String(),
+		Requests: b.requests,
+		Failures: b.failures,
+		OpenedAt: b.openedAt,
+	}
+}
+
+// breakerTable holds circuit breakers keyed by handler name.
+type breakerTable struct {
+	cfg BreakerConfig
+
+	mu       sync.RWMutex
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerTable(cfg BreakerConfig) *breakerTable {
+	return &breakerTable{cfg: cfg, breakers: make(map[string]*circuitBreaker)}
+}
+
+// get returns the circuit breaker of the handler, creating it if needed.
+// It returns nil if circuit breaking is disabled.
+func (t *breakerTable) get(handler string) *circuitBreaker {
+	if t.cfg.Disabled {
+		return nil
+	}
+	t.mu.RLock()
+	b := t.breakers[handler]
+	t.mu.RUnlock()
+	if b != nil {
+		return b
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b = t.breakers[handler]; b == nil {
+		b = &circuitBreaker{name: handler, cfg: t.cfg, windowStart: time.Now()}
+		t.breakers[handler] = b
+	}
+	return b
+}
+
+// remove discards the circuit breakers of handlers that were removed or rebuilt,
+// so that a rebuilt handler starts with a closed circuit.
+// Calls in flight to the old handlers still record their outcome to the discarded breakers.
+func (t *breakerTable) remove(handlers []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, h := range handlers {
+		b := t.breakers[h]
+		if b == nil {
+			continue
+		}
+		b.mu.Lock()
+		b.removed = true
+		b.mu.Unlock()
+		delete(t.breakers, h)
+		breakerStateGauge.DeleteLabelValues(h)
+	}
+}
+
+// status returns the state of all circuit breakers sorted by handler name.
+func (t *breakerTable) status() []breakerStatus {
+	t.mu.RLock()
+	out := make([]breakerStatus, 0, len(t.breakers))
+	for _, b := range t.breakers {
+		out = append(out, b.status())
+	}
+	t.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Handler < out[j].Handler })
+	return out
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/mixer/pkg/pool"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	cfg := BreakerConfig{Window: 10 * time.Second, MinRequests: 4, ErrorRatio: 0.5, CoolDown: 30 * time.Second}
+	b := &circuitBreaker{name: "h1", cfg: cfg, windowStart: now}
+
+	call := func(success bool) bool {
+		if !b.allow(now) {
+			return false
+		}
+		b.record(now, success)
+		return true
+	}
+	assertState := func(want breakerState) {
+		if b.state != want {
+			t.Fatalf("got state %v, want %v", b.state, want)
+		}
+	}
+
+	// not enough requests to open.
+	for i := 0; i < 3; i++ {
+		call(false)
+	}
+	assertState(breakerClosed)
+
+	// a new window resets counts.
+	now = now.Add(11 * time.Second)
+	call(true)
+	call(true)
+	call(false)
+	assertState(breakerClosed)
+	call(false)
+	assertState(breakerOpen)
+
+	// calls are short-circuited during cool-down.
+	now = now.Add(10 * time.Second)
+	if call(true) {
+		t.Fatalf("call allowed while circuit is open")
+	}
+
+	// a single probe is allowed after cool-down.
+	now = now.Add(21 * time.Second)
+	if !b.allow(now) {
+		t.Fatalf("probe not allowed after cool-down")
+	}
+	assertState(breakerHalfOpen)
+	if b.allow(now) {
+		t.Fatalf("second probe allowed while half-open")
+	}
+
+	// failed probe opens the circuit again.
+	b.record(now, false)
+	assertState(breakerOpen)
+
+	// successful probe closes the circuit.
+	now = now.Add(31 * time.Second)
+	if !call(true) {
+		t.Fatalf("probe not allowed after cool-down")
+	}
+	assertState(breakerClosed)
+	if b.requests != 0 || b.failures != 0 {
+		t.Fatalf("got %d/%d, want counts reset", b.failures, b.requests)
+	}
+}
+
+func TestBreakerTable_remove(t *testing.T) {
+	bt := newBreakerTable(DefaultBreakerConfig())
+	old := bt.get("h1")
+	old.open(time.Now())
+	other := bt.get("h2")
+	other.open(time.Now())
+
+	bt.remove([]string{"h1", "unknown"})
+
+	// the gauge series of the removed handler is deleted.
+	if breakerStateGauge.DeleteLabelValues("h1") {
+		t.Fatalf("got gauge series of h1, want it deleted")
+	}
+	// in-flight calls to the old handler do not bring the series back.
+	old.record(time.Now(), false)
+	old.setState(breakerClosed)
+	if breakerStateGauge.DeleteLabelValues("h1") {
+		t.Fatalf("got gauge series of h1 recreated by the removed breaker")
+	}
+
+	// a rebuilt handler with the same name starts with a closed circuit.
+	if b := bt.get("h1"); b == old || b.status().State != breakerClosed.String() {
+		t.Fatalf("got %v, want a new closed breaker", b.status())
+	}
+	if b := bt.get("h2"); b != other || b.status().State != breakerOpen.String() {
+		t.Fatalf("got %v, want the open breaker of h2", b.status())
+	}
+}
+
+func TestDispatcher_CircuitBreaker(t *testing.T) {
+	gp := pool.NewGoroutinePool(1, true)
+	defer gp.Close()
+
+	fp := &fakeProc{err: errors.New("adapter failure")}
+	rt := newFakeResolver("metric1", nil, false, fp)
+	m := newDispatcher(nil, rt, gp, BreakerConfig{Window: time.Minute, MinRequests: 2, ErrorRatio: 0.5, CoolDown: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if err := m.Report(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "adapter failure") {
+			t.Fatalf("got %v, want adapter failure", err)
+		}
+	}
+	called := fp.called
+
+	// circuits are open now
+	err := m.Report(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "circuit open") {
+		t.Fatalf("got %v, want circuit open", err)
+	}
+	if fp.called != called {
+		t.Fatalf("got %d calls, want %d", fp.called, called)
+	}
+
+	// fail open handlers succeed while the circuit is open.
+	for _, a := range rt.ra {
+		a.failOpen = true
+	}
+	if err = m.Report(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fp.called != called {
+		t.Fatalf("got %d calls, want %d", fp.called, called)
+	}
+
+	// state is available on the debug endpoint.
+	dh := DebugHandler(m)
+	w := httptest.NewRecorder()
+	dh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DebugPath+"handlers", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var st []breakerStatus
+	if err = json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatalf("unable to unmarshal %s: %v", w.Body.String(), err)
+	}
+	if len(st) != len(rt.ra) {
+		t.Fatalf("got %v, want %d handlers", st, len(rt.ra))
+	}
+	for _, s := range st {
+		if s.State != breakerOpen.String() {
+			t.Errorf("handler %s: got state %s, want %s", s.Handler, s.State, breakerOpen)
+		}
+	}
+}
+
+func TestDispatcher_CircuitBreakerDisabled(t *testing.T) {
+	gp := pool.NewGoroutinePool(1, true)
+	defer gp.Close()
+
+	fp := &fakeProc{err: errors.New("adapter failure")}
+	rt := newFakeResolver("metric1", nil, false, fp)
+	m := newDispatcher(nil, rt, gp, BreakerConfig{Disabled: true, Window: time.Minute, MinRequests: 2, ErrorRatio: 0.5, CoolDown: time.Minute})
+
+	for i := 0; i < 4; i++ {
+		if err := m.Report(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "adapter failure") {
+			t.Fatalf("got %v, want adapter failure", err)
+		}
+	}
+	if st := m.breakers.status(); len(st) != 0 {
+		t.Fatalf("got %v, want no breakers", st)
+	}
+}
+
+func TestDebugHandler_NotDispatcher(t *testing.T) {
+	if dh := DebugHandler(nil); dh != nil {
+		t.Fatalf("got %v, want nil", dh)
+	}
+}
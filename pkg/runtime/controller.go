@@ -15,11 +15,16 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/golang/glog"
 
 	adptTmpl "istio.io/api/mixer/v1/template"
@@ -42,6 +47,7 @@ type Controller struct {
 	templateInfo           map[string]template.Info // maps template name to Info.
 	eval                   expr.Evaluator           // Used to infer types. Used by resolver and dispatcher.
 	identityAttribute      string                   // used by resolver
+	namespaceExpression    string                   // used by resolver
 	defaultConfigNamespace string                   // used by resolver
 
 	// configState is the current (potentially inconsistent) view of config.
@@ -69,10 +75,50 @@ type Controller struct {
 	// It is reset on every config change.
 	changedKinds map[string]bool
 
+	// changedKeys is updated by applyEvents to hold the fully qualified
+	// names of resources that have changed in the current batch of changes.
+	// It is nil when the change set is unknown.
+	changedKeys map[string]bool
+
+	// status collects the status of resources while a snapshot is built.
+	status *configStatus
+
+	// snapshotStatus holds the *SnapshotStatus of the last published snapshot.
+	snapshotStatus atomic.Value
+
+	// statusUpdater writes resource status to the config store in the background.
+	// It is nil if the store does not support status.
+	statusUpdater *statusUpdater
+
+	// targets bounds the cardinality of the target label of resolve metrics.
+	// It is shared by all resolvers.
+	targets *labelLimiter
+
+	// drainer closes handlers that are no longer used by the current resolver.
+	drainer *drainer
+
+	// history retains the config state of the last published snapshots.
+	history *snapshotHistory
+
+	// pinned is the snapshot the resolver is pinned to by Rollback.
+	// It is nil if the resolver follows the config store.
+	pinned *configSnapshot
+
+	// storeState is the config state of the store while the resolver is pinned.
+	// configState holds the config state of the pinned snapshot in the meantime.
+	storeState map[store.Key]*store.Resource
+
+	// mu serializes config changes with Rollback and Unpin.
+	mu sync.Mutex
+
 	// df is the cached version of descriptorFinder.
 	// It is recreated when attributes change.
 	df expr.AttributeDescriptorFinder
 
+	// dryRun is set when the controller only checks the config state, as done by Validator.
+	// Rules of a dry run are not monitored.
+	dryRun bool
+
 	// Fields below are used for testing an debugging.
 
 	// createHandlerFactory for testing.
@@ -93,6 +139,11 @@ type ResolverChangeListener interface {
 	ChangeResolver(rt Resolver)
 }
 
+// HandlerRetireListener is notified of handlers that are removed or rebuilt due to config change.
+type HandlerRetireListener interface {
+	RetireHandlers(handlers []string)
+}
+
 // VocabularyChangeListener is notified when attribute vocabulary changes.
 type VocabularyChangeListener interface {
 	ChangeVocabulary(finder expr.AttributeDescriptorFinder)
@@ -102,6 +153,11 @@ type VocabularyChangeListener interface {
 type factoryCreatorFunc func(templateInfo map[string]template.Info, expr expr.TypeChecker,
 	df expr.AttributeDescriptorFinder, builderInfo map[string]*adapter.Info) HandlerFactory
 
+// instanceTypeInferrer is implemented by handler factories that infer instance types.
+type instanceTypeInferrer interface {
+	inferType(instance *cpb.Instance) (proto.Message, error)
+}
+
 // applyEventsFn is used for testing
 type applyEventsFn func(events []*store.Event)
 
@@ -110,6 +166,9 @@ type applyEventsFn func(events []*store.Event)
 // The previous handler table enables handler cleanup and reuse.
 // This code is single threaded, it only runs on a config change control loop.
 func (c *Controller) publishSnapShot() {
+	// status of every resource is recorded while the snapshot is built.
+	c.status = newConfigStatus(c.configState)
+
 	// current view of attributes
 	// attribute manifests are used by type inference during handler creation.
 	attributes := c.processAttributeManifests()
@@ -141,17 +200,41 @@ func (c *Controller) publishSnapShot() {
 	// ht (handlerTable) keeps track of handler-instance association.
 	ruleConfig := c.processRules(handlerConfig, instanceConfig, ht)
 
+	// handlers are rebuilt when the inferred types of their instances change.
+	if ti, ok := hb.(instanceTypeInferrer); ok {
+		ht.instanceType = ti.inferType
+	}
+
 	// Initialize handlers that are used in the configuration.
 	// Some handlers may not initialize due to errors.
-	ht.Initialize(c.table)
+	// Only handlers that refer to changed handler or instance config are rebuilt.
+	// A change in attribute manifests may change the inferred type of any instance,
+	// therefore all handlers are compared in that case.
+	changed := c.changedKeys
+	if c.changedKinds[AttributeManifestKind] {
+		changed = nil
+	}
+	ht.Initialize(c.table, changed)
+	handlerBuildCounter.WithLabelValues(rebuiltStr).Add(float64(ht.rebuilt))
+	handlerBuildCounter.WithLabelValues(reusedStr).Add(float64(ht.reused))
+	for name, he := range ht.table {
+		if he.HandlerCreateError == nil {
+			continue
+		}
+		if k, ok := keyFromFQN(name); ok {
+			c.status.handlerFailed(k, "%v", he.HandlerCreateError)
+		}
+	}
 
 	// Combine rules with the handler table.
 	// Actions referring to handlers in error are logged and purged.
-	resolvedRules, nrules := generateResolvedRules(ruleConfig, ht.table)
+	resolvedRules, nrules := generateResolvedRules(ruleConfig, ht.table, c.status)
 
 	// Create new resolver and cleanup the old resolver.
 	c.nextResolverID++
-	resolver := newResolver(c.eval, c.identityAttribute, c.defaultConfigNamespace, resolvedRules, c.nextResolverID)
+	scopes := newScopeResolver(c.eval, c.identityAttribute, c.namespaceExpression)
+	resolver := newResolver(c.eval, scopes, c.defaultConfigNamespace, resolvedRules, c.nextResolverID)
+	resolver.targets = c.targets
 	c.dispatcher.ChangeResolver(resolver)
 
 	// copy old for deletion.
@@ -159,24 +242,55 @@ func (c *Controller) publishSnapShot() {
 	oldResolver := c.resolver
 	oldNrules := c.nrules
 
+	// removed and rebuilt handlers do not inherit the state of the old ones.
+	if rl, ok := c.dispatcher.(HandlerRetireListener); ok {
+		rl.RetireHandlers(retiredHandlers(oldTable))
+	}
+
 	// set new
 	c.table = ht.table
 	c.resolver = resolver
 	c.nrules = nrules
 
-	glog.Infof("Published snapshot[%d] with %d rules, %d handlers, previously %d rules", resolver.id, nrules, len(c.table), oldNrules)
+	glog.Infof("Published snapshot[%d] with %d rules, %d handlers (%d rebuilt, %d reused), previously %d rules",
+		resolver.id, nrules, len(c.table), ht.rebuilt, ht.reused, oldNrules)
 
-	// synchronous call to cleanup.
-	err := cleanupResolver(oldResolver, oldTable, maxCleanupDuration)
-	if err != nil {
-		glog.Warningf("Unable to perform cleanup: %v", err)
+	rollbackOf := 0
+	if c.pinned != nil {
+		rollbackOf = c.pinned.id
+	}
+	c.history.add(resolver.id, rollbackOf, c.configState)
+
+	c.snapshotStatus.Store(c.status.snapshot(resolver.id))
+	// the status of a pinned snapshot does not describe the resources in the store.
+	if c.pinned == nil {
+		c.writeStatus(c.status)
 	}
+
+	// retired handlers are closed once the old resolver and their in-flight calls are done.
+	if c.drainer == nil {
+		c.drainer = newDrainer(DefaultHandlerDrainTimeout)
+	}
+	c.drainer.retire(oldTable, oldResolver)
 }
 
-// maxCleanupDuration is the maximum amount of time cleanup operation will wait
-// before resolver ref count does to 0. It will return after this duration without
-// calling Close() on handlers.
-var maxCleanupDuration = 10 * time.Second
+// retiredHandlers returns the names of handlers of the table that were removed or rebuilt.
+func retiredHandlers(table map[string]*HandlerEntry) []string {
+	var names []string
+	for name, he := range table {
+		if he.closeOnCleanup {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Status returns the status of config resources in the last published snapshot.
+// It returns nil if no snapshot has been published.
+func (c *Controller) Status() *SnapshotStatus {
+	ss, _ := c.snapshotStatus.Load().(*SnapshotStatus)
+	return ss
+}
 
 var watchFlushDuration = time.Second
 
@@ -212,21 +326,102 @@ func watchChanges(wch <-chan store.Event, applyEvents applyEventsFn) {
 }
 
 // applyEvents applies given events to config state and then publishes a snapshot.
+// While the resolver is pinned, events are applied to the config state of the store
+// and no snapshot is published.
 func (c *Controller) applyEvents(events []*store.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	configState := c.configState
+	if c.pinned != nil {
+		configState = c.storeState
+	}
 	ck := make(map[string]bool)
+	keys := make(map[string]bool, len(events))
 	for _, ev := range events {
 		ck[ev.Kind] = true
+		keys[ev.Key.String()] = true
 		switch ev.Type {
 		case store.Update:
-			c.configState[ev.Key] = ev.Value
+			configState[ev.Key] = ev.Value
 		case store.Delete:
-			delete(c.configState, ev.Key)
+			delete(configState, ev.Key)
 		}
 	}
+	if c.pinned != nil {
+		glog.Infof("Resolver is pinned to snapshot[%d], %d config changes are not published", c.pinned.id, len(events))
+		return
+	}
 	c.changedKinds = ck
+	c.changedKeys = keys
 	c.publishSnapShot()
 }
 
+// Rollback publishes a snapshot of the config state of a retained snapshot, and pins the
+// resolver to it while the config store is repaired. Config changes are not published until Unpin.
+func (c *Controller) Rollback(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.history.get(id)
+	if s == nil {
+		return fmt.Errorf("snapshot %d is not retained", id)
+	}
+	if c.pinned == nil {
+		c.storeState = c.configState
+	}
+	c.pinned = s
+	c.configState = copyConfigState(s.configState)
+	glog.Infof("Rolling back to snapshot[%d]", id)
+	c.republish()
+	return nil
+}
+
+// Unpin publishes a snapshot of the config state of the store, and resumes publishing config changes.
+func (c *Controller) Unpin() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pinned == nil {
+		return errors.New("resolver is not pinned")
+	}
+	glog.Infof("Unpinning snapshot[%d]", c.pinned.id)
+	c.configState = c.storeState
+	c.storeState = nil
+	c.pinned = nil
+	c.republish()
+	return nil
+}
+
+// republish publishes a snapshot after the config state was replaced as a whole.
+func (c *Controller) republish() {
+	// attributes are reloaded and every handler is compared with the current table.
+	c.changedKinds = map[string]bool{AttributeManifestKind: true}
+	c.changedKeys = nil
+	c.publishSnapShot()
+}
+
+// History returns the retained snapshots.
+func (c *Controller) History() *SnapshotHistory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := &SnapshotHistory{Snapshots: c.history.list()}
+	if c.pinned != nil {
+		h.Pinned = c.pinned.id
+	}
+	return h
+}
+
+// Diff returns the difference of the config state of two retained snapshots.
+func (c *Controller) Diff(from int, to int) (*SnapshotDiff, error) {
+	fs := c.history.get(from)
+	if fs == nil {
+		return nil, fmt.Errorf("snapshot %d is not retained", from)
+	}
+	ts := c.history.get(to)
+	if ts == nil {
+		return nil, fmt.Errorf("snapshot %d is not retained", to)
+	}
+	return diffSnapshots(fs, ts), nil
+}
+
 // validInstanceConfigs returns instanceConfigs from the configState that
 // point to valid templates.
 func (c *Controller) validInstanceConfigs() map[string]*cpb.Instance {
@@ -321,6 +516,7 @@ func convertToRuntimeRules(ruleConfig rulesMapByNamespace) (rulesListByNamespace
 		for _, rule := range nsmap {
 			rulesArr = append(rulesArr, rule)
 		}
+		sort.Sort(byPriority(rulesArr))
 		rules[ns] = rulesArr
 		nrules += len(rulesArr)
 	}
@@ -329,6 +525,10 @@ func convertToRuntimeRules(ruleConfig rulesMapByNamespace) (rulesListByNamespace
 
 const (
 	istioProtocol = "istio-protocol"
+	istioPriority = "istio-priority"
+	istioTerminal = "istio-terminal"
+	istioShadow   = "istio-shadow"
+	istioFailOpen = "istio-fail-open"
 )
 
 // buildRule builds runtime representation of rule based on match condition.
@@ -350,6 +550,11 @@ func buildRule(k store.Key, r *cpb.Rule, rt ResourceType) (*Rule, error) {
 	if ContextProtocolTCP == m[ContextProtocolAttributeName] {
 		rule.rtype.protocol = protocolTCP
 	}
+	rule.eqMatches = m
+
+	if rule.prefixMatches, err = expr.ExtractPrefixMatches(r.Match); err != nil {
+		return nil, err
+	}
 
 	return rule, nil
 }
@@ -363,6 +568,53 @@ func resourceType(labels map[string]string) ResourceType {
 	return rt
 }
 
+// ruleOrder maps labels to rule priority and terminal flag.
+func ruleOrder(labels map[string]string) (priority int, terminal bool, err error) {
+	if p, ok := labels[istioPriority]; ok {
+		if priority, err = strconv.Atoi(p); err != nil {
+			return 0, false, fmt.Errorf("invalid %s label '%s': %v", istioPriority, p, err)
+		}
+	}
+	if t, ok := labels[istioTerminal]; ok {
+		if terminal, err = strconv.ParseBool(t); err != nil {
+			return 0, false, fmt.Errorf("invalid %s label '%s': %v", istioTerminal, t, err)
+		}
+	}
+	return priority, terminal, nil
+}
+
+// ruleShadow maps labels to the rule shadow flag.
+func ruleShadow(labels map[string]string) (shadow bool, err error) {
+	if s, ok := labels[istioShadow]; ok {
+		if shadow, err = strconv.ParseBool(s); err != nil {
+			return false, fmt.Errorf("invalid %s label '%s': %v", istioShadow, s, err)
+		}
+	}
+	return shadow, nil
+}
+
+// handlerFailOpen returns true if the handler is labelled to fail open: [istio-fail-open: true]
+// Calls to fail open handlers succeed while their circuit breaker is open.
+func (c *Controller) handlerFailOpen(handler string) bool {
+	k, ok := keyFromFQN(handler)
+	if !ok {
+		return false
+	}
+	res := c.configState[k]
+	if res == nil {
+		return false
+	}
+	v, ok := res.Metadata.Labels[istioFailOpen]
+	if !ok {
+		return false
+	}
+	failOpen, err := strconv.ParseBool(v)
+	if err != nil {
+		glog.Warningf("Handler %s: invalid %s label '%s': %v", handler, istioFailOpen, v, err)
+	}
+	return failOpen
+}
+
 // processRules builds the current consistent view of the rules keyed by Namespace and then Name.
 // ht (handlerTable) keeps track of handler-instance association.
 func (c *Controller) processRules(handlerConfig map[string]*cpb.Handler,
@@ -381,7 +633,16 @@ func (c *Controller) processRules(handlerConfig map[string]*cpb.Handler,
 		cfg := obj.Spec
 		rulec := cfg.(*cpb.Rule)
 
-		acts := c.processActions(rulec.Actions, handlerConfig, instanceConfig, ht, k.Namespace)
+		// handler splits are specified using annotations: [istio-handler-split: "a.prometheus=95,b.prometheus=5"]
+		splits, err := parseHandlerSplits(obj.Metadata.Annotations, k.Namespace)
+		if err != nil {
+			glog.Warningf("Unable to process rule %s: %v", k, err)
+			c.status.reject(k, "%v", err)
+			continue
+		}
+		ruleActs := expandSplitActions(canonicalizeHandlerNames(rulec.Actions, k.Namespace), splits)
+
+		acts := c.processActions(k, ruleActs, handlerConfig, instanceConfig, ht)
 
 		ruleActions := make(map[adptTmpl.TemplateVariety][]*Action)
 		for vr, amap := range acts {
@@ -394,8 +655,32 @@ func (c *Controller) processRules(handlerConfig map[string]*cpb.Handler,
 		rule, err := buildRule(k, rulec, rt)
 		if err != nil {
 			glog.Warningf("Unable to process match condition: %v", err)
+			c.status.reject(k, "invalid match condition '%s': %v", rulec.Match, err)
+			continue
+		}
+		// priority and terminal are specified using labels: [istio-priority: 10, istio-terminal: true]
+		if rule.priority, rule.terminal, err = ruleOrder(obj.Metadata.Labels); err != nil {
+			glog.Warningf("Unable to process rule %s: %v", k, err)
+			c.status.reject(k, "%v", err)
+			continue
+		}
+		// shadow rules are specified using labels: [istio-shadow: true]
+		if rule.shadow, err = ruleShadow(obj.Metadata.Labels); err != nil {
+			glog.Warningf("Unable to process rule %s: %v", k, err)
+			c.status.reject(k, "%v", err)
 			continue
 		}
+		for _, vact := range ruleActions {
+			for _, act := range vact {
+				act.ruleName = rule.name
+				act.shadow = rule.shadow
+			}
+		}
+		rule.splits = splits
+		if !c.dryRun {
+			rule.monitor()
+		}
+		tagSplitActions(ruleActions, splits)
 		rule.actions = ruleActions
 		rn := ruleConfig[k.Namespace]
 		if rn == nil {
@@ -408,8 +693,6 @@ func (c *Controller) processRules(handlerConfig map[string]*cpb.Handler,
 	return ruleConfig
 }
 
-var cleanupSleepTime = 500 * time.Millisecond
-
 // isFQN returns true if the name is fully qualified.
 // every resource name is defined by Key.String()
 // shortname.kind.namespace
@@ -439,26 +722,29 @@ func canonicalizeInstanceNames(instances []string, namespace string) []string {
 
 // processActions prunes actions that lack referential integrity and associate instances with
 // handlers that are later used to create new handlers.
-func (c *Controller) processActions(acts []*cpb.Action, handlerConfig map[string]*cpb.Handler,
-	instanceConfig map[string]*cpb.Instance, ht *handlerTable, namespace string) map[adptTmpl.TemplateVariety]map[string]*Action {
+// Pruned actions are recorded as warnings of the rule.
+func (c *Controller) processActions(rule store.Key, acts []*cpb.Action, handlerConfig map[string]*cpb.Handler,
+	instanceConfig map[string]*cpb.Instance, ht *handlerTable) map[adptTmpl.TemplateVariety]map[string]*Action {
 
 	actions := make(map[adptTmpl.TemplateVariety]map[string]*Action)
 
-	for _, ic := range canonicalizeHandlerNames(acts, namespace) {
+	for _, ic := range canonicalizeHandlerNames(acts, rule.Namespace) {
 		var hc *cpb.Handler
 		if hc = handlerConfig[ic.Handler]; hc == nil {
 			if glog.V(3) {
 				glog.Warningf("ConfigWarning unknown handler: %s", ic.Handler)
 			}
+			c.status.warn(rule, "unknown handler %s", ic.Handler)
 			continue
 		}
 
-		for _, instName := range canonicalizeInstanceNames(ic.Instances, namespace) {
+		for _, instName := range canonicalizeInstanceNames(ic.Instances, rule.Namespace) {
 			inst := instanceConfig[instName]
 			if inst == nil {
 				if glog.V(3) {
 					glog.Warningf("ConfigWarning unknown instance: %s", instName)
 				}
+				c.status.warn(rule, "unknown instance %s", instName)
 				continue
 			}
 
@@ -481,6 +767,7 @@ func (c *Controller) processActions(acts []*cpb.Action, handlerConfig map[string
 					processor:   &ti,
 					handlerName: ic.Handler,
 					adapterName: hc.Adapter,
+					failOpen:    c.handlerFailOpen(ic.Handler),
 				}
 				vAction[templateHandlerKey] = act
 			}
@@ -492,11 +779,14 @@ func (c *Controller) processActions(acts []*cpb.Action, handlerConfig map[string
 
 // generateResolvedRules sets handler references in rulesConfig.
 // It reject actions from rulesConfig whose handler could not be initialized.
-func generateResolvedRules(ruleConfig rulesMapByNamespace, handlerTable map[string]*HandlerEntry) (rulesListByNamespace, int) {
+// Rejections are recorded in status.
+func generateResolvedRules(ruleConfig rulesMapByNamespace, handlerTable map[string]*HandlerEntry,
+	status *configStatus) (rulesListByNamespace, int) {
 	// map by namespace
 	for ns, nsmap := range ruleConfig {
 		// map by rule name
 		for rn, rule := range nsmap {
+			rk, _ := keyFromFQN(rule.name)
 			// map by template variety
 			for vr, vact := range rule.actions {
 				newvact := vact[:0]
@@ -508,9 +798,11 @@ func generateResolvedRules(ruleConfig rulesMapByNamespace, handlerTable map[stri
 					}
 					if he.Handler == nil {
 						glog.Warningf("Filtering action from rule %s/%s. Handler %s could not be initialized due to %s.", ns, rn, act.handlerName, he.HandlerCreateError)
+						status.warn(rk, "handler %s could not be initialized", act.handlerName)
 						continue
 					}
 					act.handler = he.Handler
+					act.entry = he
 					newvact = append(newvact, act)
 				}
 				if len(newvact) > 0 {
@@ -519,8 +811,15 @@ func generateResolvedRules(ruleConfig rulesMapByNamespace, handlerTable map[stri
 					delete(rule.actions, vr)
 				}
 			}
+			// split alternatives are chosen only among the handlers that can be dispatched.
+			var dropped []string
+			rule.splits, dropped = resolveSplits(rule.splits, rule.actions)
+			for _, h := range dropped {
+				status.warn(rk, "split handler %s can not be dispatched, its traffic goes to the other alternatives", h)
+			}
 			if len(rule.actions) == 0 {
 				glog.Warningf("Purging rule %v with no actions", rn)
+				status.reject(rk, "rule has no actions that can be dispatched")
 				delete(nsmap, rn)
 			}
 		}
@@ -529,37 +828,3 @@ func generateResolvedRules(ruleConfig rulesMapByNamespace, handlerTable map[stri
 	// create rules that are in the format that resolver needs.
 	return convertToRuntimeRules(ruleConfig)
 }
-
-// cleanupResolver cleans up handler table in the resolver
-// after the resolver is no longer in use.
-func cleanupResolver(r *resolver, table map[string]*HandlerEntry, timeout time.Duration) error {
-	start := time.Now()
-	for {
-		rc := atomic.LoadInt32(&r.refCount)
-		if rc > 0 {
-			if time.Since(start) > timeout {
-				return fmt.Errorf("unable to cleanup resolver in %v time. %d requests remain", timeout, rc)
-			}
-			if glog.V(2) {
-				glog.Infof("Waiting for resolver %d to finish %d remaining requests", r.id, rc)
-			}
-			time.Sleep(cleanupSleepTime)
-			continue
-		}
-		if glog.V(2) {
-			glog.Infof("cleanupResolver[%d] handler table has %d entries", r.id, len(table))
-		}
-		for _, he := range table {
-			if he.closeOnCleanup && he.Handler != nil {
-				msg := fmt.Sprintf("closing %s/%v", he.Name, he.Handler)
-				err := he.Handler.Close()
-				if err != nil {
-					glog.Warningf("Error "+msg+": %s", err)
-				} else {
-					glog.Info(msg)
-				}
-			}
-		}
-		return nil
-	}
-}
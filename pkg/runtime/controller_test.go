@@ -19,6 +19,7 @@ import (
 	"flag"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -122,20 +123,33 @@ func checkRulesInvariants(t *testing.T, rules rulesListByNamespace) {
 func TestController_buildrule(t *testing.T) {
 	key := store.Key{Kind: "kind1", Namespace: "ns1", Name: "name1"}
 	for _, tc := range []struct {
-		desc  string
-		match string
-		want  protocol
-		err   error
+		desc   string
+		match  string
+		want   protocol
+		eq     map[string]interface{}
+		prefix map[string]string
+		err    error
 	}{
 		{
-			desc:  "http service",
-			match: `request.headers["x-id"] == "tcp"`,
-			want:  protocolHTTP,
+			desc:   "http service",
+			match:  `request.headers["x-id"] == "tcp"`,
+			want:   protocolHTTP,
+			eq:     map[string]interface{}{},
+			prefix: map[string]string{},
+		},
+		{
+			desc:   "tcp service",
+			match:  ContextProtocolAttributeName + "== \"tcp\"",
+			want:   protocolTCP,
+			eq:     map[string]interface{}{ContextProtocolAttributeName: ContextProtocolTCP},
+			prefix: map[string]string{ContextProtocolAttributeName: ContextProtocolTCP},
 		},
 		{
-			desc:  "tcp service",
-			match: ContextProtocolAttributeName + "== \"tcp\"",
-			want:  protocolTCP,
+			desc:   "indexable service",
+			match:  `destination.service == "a.ns1.svc" && match(request.path, "/api/*")`,
+			want:   protocolHTTP,
+			eq:     map[string]interface{}{DefaultIdentityAttribute: "a.ns1.svc"},
+			prefix: map[string]string{DefaultIdentityAttribute: "a.ns1.svc", RequestPathAttributeName: "/api/"},
 		},
 		{
 			desc:  "bad expression",
@@ -150,9 +164,11 @@ func TestController_buildrule(t *testing.T) {
 			rt := defaultResourcetype()
 			rt.protocol = tc.want
 			want := &Rule{
-				name:  key.String(),
-				match: rinput.Match,
-				rtype: rt,
+				name:          key.String(),
+				match:         rinput.Match,
+				rtype:         rt,
+				eqMatches:     tc.eq,
+				prefixMatches: tc.prefix,
 			}
 
 			r, err := buildRule(key, rinput, defaultResourcetype())
@@ -170,10 +186,64 @@ func TestController_buildrule(t *testing.T) {
 	}
 }
 
-func TestController_workflow(t *testing.T) {
-	mcd := maxCleanupDuration
-	defer func() { maxCleanupDuration = mcd }()
+func TestController_ruleOrder(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		labels   map[string]string
+		priority int
+		terminal bool
+		err      string
+	}{
+		{desc: "no labels"},
+		{desc: "priority", labels: map[string]string{istioPriority: "10"}, priority: 10},
+		{desc: "negative priority", labels: map[string]string{istioPriority: "-1"}, priority: -1},
+		{desc: "terminal", labels: map[string]string{istioPriority: "5", istioTerminal: "true"}, priority: 5, terminal: true},
+		{desc: "bad priority", labels: map[string]string{istioPriority: "high"}, err: "invalid istio-priority label"},
+		{desc: "bad terminal", labels: map[string]string{istioTerminal: "yes"}, err: "invalid istio-terminal label"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			priority, terminal, err := ruleOrder(tc.labels)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if priority != tc.priority || terminal != tc.terminal {
+				t.Fatalf("got (%d, %t), want (%d, %t)", priority, terminal, tc.priority, tc.terminal)
+			}
+		})
+	}
+}
 
+func TestController_ruleShadow(t *testing.T) {
+	for _, tc := range []struct {
+		labels map[string]string
+		shadow bool
+		err    string
+	}{
+		{},
+		{labels: map[string]string{istioShadow: "true"}, shadow: true},
+		{labels: map[string]string{istioShadow: "false"}},
+		{labels: map[string]string{istioShadow: "maybe"}, err: "invalid istio-shadow label"},
+	} {
+		shadow, err := ruleShadow(tc.labels)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%v: got error %v, want %s", tc.labels, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || shadow != tc.shadow {
+			t.Fatalf("%v: got (%t, %v), want %t", tc.labels, shadow, err, tc.shadow)
+		}
+	}
+}
+
+func TestController_workflow(t *testing.T) {
 	adapterInfo := map[string]*adapter.Info{
 		"AA": {
 			Name: "AA",
@@ -310,65 +380,147 @@ func TestController_workflow(t *testing.T) {
 	checkRulesInvariants(t, c.resolver.rules)
 }
 
-func Test_cleanupResolver(t *testing.T) {
-	cr := cleanupSleepTime
-	cleanupSleepTime = 50 * time.Millisecond
-	r := &resolver{}
-	r.refCount = 2
+// fhtbuilder builds a new handler per call and infers instance types from a map.
+type fhtbuilder struct {
+	built    map[string]int
+	handlers map[string]*fhandler
+	types    map[string]proto.Message
+	errs     map[string]error
+}
 
-	// force a timeout by not reducing refcount.
-	err := cleanupResolver(r, nil, 2*cleanupSleepTime)
-	if err == nil {
-		t.Fatalf("resolver did not error")
+func (f *fhtbuilder) Build(h *cpb.Handler, inst []*cpb.Instance, env adapter.Env) (adapter.Handler, error) {
+	f.built[h.Name]++
+	if err := f.errs[h.Name]; err != nil {
+		return nil, err
 	}
+	fh := &fhandler{name: h.Name}
+	f.handlers[h.Name] = fh
+	return fh, nil
+}
 
-	table := map[string]*HandlerEntry{
-		"h1": {
-			Handler:        &fhandler{name: "h1"},
-			closeOnCleanup: true,
-		},
-		"h2": {
-			Handler:        &fhandler{name: "h2"},
-			closeOnCleanup: false,
-		},
-		"h3": {
-			Handler:        &fhandler{name: "h3", closeError: errors.New("unable to close")},
-			closeOnCleanup: true,
-		},
-	}
+func (f *fhtbuilder) inferType(inst *cpb.Instance) (proto.Message, error) {
+	return f.types[inst.Name], nil
+}
 
-	done := make(chan bool)
-	go func() {
-		if err := cleanupResolver(r, table, 5*cleanupSleepTime); err != nil {
-			done <- false
-		} else {
-			done <- true
+func TestController_incrementalRebuild(t *testing.T) {
+	ns := DefaultConfigNamespace
+	rule := func(match string) *cpb.Rule {
+		return &cpb.Rule{
+			Match: match,
+			Actions: []*cpb.Action{
+				{Handler: "a1.AA." + ns, Instances: []string{"m1.metric." + ns}},
+				{Handler: "a2.AA." + ns, Instances: []string{"m2.metric." + ns}},
+			},
 		}
-	}()
-
-	r.decRefCount()
-	r.decRefCount()
-	ok := false
-
-	tc := time.NewTimer(4 * cleanupSleepTime).C
-	select {
-	case ok = <-done:
-	case <-tc:
-		t.Fatalf("did not cleanup in time.")
 	}
-
-	if !ok {
-		t.Fatalf("cleanup did not finish")
+	configState := map[store.Key]*store.Resource{
+		{RulesKind, ns, "r1"}: {Spec: rule("target.service == \"abc\"")},
+		{"metric", ns, "m1"}:  {Spec: &wrappers.StringValue{Value: "metric1_config"}},
+		{"metric", ns, "m2"}:  {Spec: &wrappers.StringValue{Value: "metric2_config"}},
+		{"AA", ns, "a1"}:      {Spec: &wrappers.StringValue{Value: "a1_config"}},
+		{"AA", ns, "a2"}:      {Spec: &wrappers.StringValue{Value: "a2_config"}},
+	}
+	fb := &fhtbuilder{
+		built:    make(map[string]int),
+		handlers: make(map[string]*fhandler),
+		types: map[string]proto.Message{
+			"m1.metric." + ns: &wrappers.StringValue{Value: "STRING"},
+			"m2.metric." + ns: &wrappers.StringValue{Value: "STRING"},
+		},
+	}
+	c := &Controller{
+		adapterInfo:            map[string]*adapter.Info{"AA": {Name: "AA"}},
+		templateInfo:           map[string]template.Info{"metric": {Name: "metric"}},
+		configState:            configState,
+		dispatcher:             &fakedispatcher{},
+		resolver:               &resolver{},
+		identityAttribute:      DefaultIdentityAttribute,
+		defaultConfigNamespace: ns,
+		createHandlerFactory: func(templateInfo map[string]template.Info, expr expr.TypeChecker,
+			df expr.AttributeDescriptorFinder, builderInfo map[string]*adapter.Info) HandlerFactory {
+			return fb
+		},
 	}
+	a1 := "a1.AA." + ns
+	a2 := "a2.AA." + ns
 
-	for _, he := range table {
-		hh := he.Handler.(*fhandler)
-		if hh.closed != he.closeOnCleanup {
-			t.Fatalf("closing got %t, want %t", hh.closed, he.closeOnCleanup)
-		}
+	c.publishSnapShot()
+	if fb.built[a1] != 1 || fb.built[a2] != 1 {
+		t.Fatalf("initial builds: got %v, want 1 each", fb.built)
 	}
 
-	cleanupSleepTime = cr
+	for _, tc := range []struct {
+		desc   string
+		events []*store.Event
+		setup  func()
+		want   map[string]int
+	}{
+		{
+			desc: "rule edit",
+			events: []*store.Event{
+				{Key: store.Key{RulesKind, ns, "r1"}, Value: &store.Resource{Spec: rule("target.service == \"bcd\"")}},
+			},
+			want: map[string]int{a1: 1, a2: 1},
+		},
+		{
+			desc: "instance edit",
+			events: []*store.Event{
+				{Key: store.Key{"metric", ns, "m2"}, Value: &store.Resource{Spec: &wrappers.StringValue{Value: "metric2_new"}}},
+			},
+			want: map[string]int{a1: 1, a2: 2},
+		},
+		{
+			desc: "handler edit",
+			events: []*store.Event{
+				{Key: store.Key{"AA", ns, "a1"}, Value: &store.Resource{Spec: &wrappers.StringValue{Value: "a1_new"}}},
+			},
+			want: map[string]int{a1: 2, a2: 2},
+		},
+		{
+			desc: "identical instance update",
+			events: []*store.Event{
+				{Key: store.Key{"metric", ns, "m1"}, Value: &store.Resource{Spec: &wrappers.StringValue{Value: "metric1_config"}}},
+			},
+			want: map[string]int{a1: 2, a2: 2},
+		},
+		{
+			desc: "manifest edit without type change",
+			events: []*store.Event{
+				{Key: store.Key{AttributeManifestKind, ns, "attrs"}, Type: store.Delete},
+			},
+			want: map[string]int{a1: 2, a2: 2},
+		},
+		{
+			desc: "manifest edit with type change",
+			events: []*store.Event{
+				{Key: store.Key{AttributeManifestKind, ns, "attrs"}, Type: store.Delete},
+			},
+			setup: func() {
+				fb.types["m1.metric."+ns] = &wrappers.StringValue{Value: "INT64"}
+			},
+			want: map[string]int{a1: 3, a2: 2},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.setup != nil {
+				tc.setup()
+			}
+			old := map[string]*fhandler{a1: fb.handlers[a1], a2: fb.handlers[a2]}
+			c.applyEvents(tc.events)
+			if !reflect.DeepEqual(fb.built, tc.want) {
+				t.Fatalf("builds: got %v, want %v", fb.built, tc.want)
+			}
+			for name, h := range old {
+				rebuilt := fb.handlers[name] != h
+				if h.closed != rebuilt {
+					t.Fatalf("%s: closed %t, rebuilt %t", name, h.closed, rebuilt)
+				}
+				if c.table[name].Handler != fb.handlers[name] {
+					t.Fatalf("%s: table does not hold the latest handler", name)
+				}
+			}
+		})
+	}
 }
 
 // nolint: unparam
@@ -496,7 +648,7 @@ func TestController_Resolve2(t *testing.T) {
 		}, 1},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
-			_, n := generateResolvedRules(rc(), tc.ht)
+			_, n := generateResolvedRules(rc(), tc.ht, nil)
 			if n != tc.numRules {
 				t.Fatalf("nrules got: %d, want %d", n, tc.numRules)
 			}
@@ -683,5 +835,15 @@ func TestController_KindMap(t *testing.T) {
 	}
 }
 
+func TestController_retiredHandlers(t *testing.T) {
+	got := retiredHandlers(map[string]*HandlerEntry{
+		"removed": {closeOnCleanup: true},
+		"reused":  {},
+	})
+	if len(got) != 1 || got[0] != "removed" {
+		t.Fatalf("got %v, want [removed]", got)
+	}
+}
+
 var _ = flag.Lookup("v").Value.Set("99")
 var _ = flag.Lookup("logtostderr").Value.Set("true")
@@ -0,0 +1,164 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// DebugPath is the root of runtime debug endpoints.
+const DebugPath = "/debug/"
+
+// AdminPath is the root of runtime admin endpoints.
+const AdminPath = "/admin/"
+
+// DebugHandler returns an http.Handler that serves read-only runtime debug information under DebugPath.
+//
+//	/debug/handlers -- circuit breaker state of handlers.
+//	/debug/config   -- status of config resources in the last published snapshot.
+//	/debug/retired  -- retired handlers that are not closed yet.
+//
+// It returns nil if the dispatcher was not created by New.
+func DebugHandler(d Dispatcher) http.Handler {
+	m, ok := d.(*dispatcher)
+	if !ok {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(DebugPath+"handlers", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, m.breakers.status())
+	})
+	mux.HandleFunc(DebugPath+"config", func(w http.ResponseWriter, req *http.Request) {
+		if m.controller == nil {
+			http.Error(w, "config controller is not running", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, m.controller.Status())
+	})
+	mux.HandleFunc(DebugPath+"retired", func(w http.ResponseWriter, req *http.Request) {
+		if m.controller == nil || m.controller.drainer == nil {
+			http.Error(w, "config controller is not running", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, m.controller.drainer.status())
+	})
+	return mux
+}
+
+// AdminHandler returns an http.Handler that serves the runtime admin actions under AdminPath.
+// The actions change the running config, and snapshot diffs include the params of handlers
+// and instances, so the handler must not be served with the debug information to everyone
+// that can reach the monitoring port.
+//
+//	/admin/snapshots -- retained config snapshots.
+//	/admin/snapshots/diff?from=<id>&to=<id> -- config differences between two snapshots.
+//	    to defaults to the last snapshot.
+//	/admin/snapshots/rollback?id=<id> -- POST to pin the resolver to the config of a snapshot.
+//	/admin/snapshots/unpin -- POST to resume publishing the config of the store.
+//
+// It returns nil if the dispatcher was not created by New.
+func AdminHandler(d Dispatcher) http.Handler {
+	m, ok := d.(*dispatcher)
+	if !ok {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPath+"snapshots", func(w http.ResponseWriter, req *http.Request) {
+		if m.controller == nil {
+			http.Error(w, "config controller is not running", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, m.controller.History())
+	})
+	mux.HandleFunc(AdminPath+"snapshots/diff", func(w http.ResponseWriter, req *http.Request) {
+		if m.controller == nil {
+			http.Error(w, "config controller is not running", http.StatusServiceUnavailable)
+			return
+		}
+		from, err := strconv.Atoi(req.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, "invalid from snapshot: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to := 0
+		if t := req.URL.Query().Get("to"); t != "" {
+			if to, err = strconv.Atoi(t); err != nil {
+				http.Error(w, "invalid to snapshot: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if snapshots := m.controller.History().Snapshots; len(snapshots) > 0 {
+			to = snapshots[len(snapshots)-1].ID
+		}
+		d, err := m.controller.Diff(from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, d)
+	})
+	mux.HandleFunc(AdminPath+"snapshots/rollback", func(w http.ResponseWriter, req *http.Request) {
+		if !adminRequest(w, req, m) {
+			return
+		}
+		id, err := strconv.Atoi(req.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid snapshot: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = m.controller.Rollback(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, m.controller.History())
+	})
+	mux.HandleFunc(AdminPath+"snapshots/unpin", func(w http.ResponseWriter, req *http.Request) {
+		if !adminRequest(w, req, m) {
+			return
+		}
+		if err := m.controller.Unpin(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, m.controller.History())
+	})
+	return mux
+}
+
+// adminRequest returns true if the request can change the controller state.
+// Otherwise it writes the error.
+func adminRequest(w http.ResponseWriter, req *http.Request, m *dispatcher) bool {
+	if req.Method != http.MethodPost {
+		http.Error(w, "admin actions must be posted", http.StatusMethodNotAllowed)
+		return false
+	}
+	if m.controller == nil {
+		http.Error(w, "config controller is not running", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as indented json.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
@@ -19,7 +19,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -57,6 +59,11 @@ type Dispatcher interface {
 	// Quota dispatches to the set of adapters associated with the Quota API method
 	Quota(ctx context.Context, requestBag attribute.Bag,
 		qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error)
+
+	// ReleaseQuota returns qma.Amount of previously allocated quota to the
+	// adapters associated with the Quota API method.
+	ReleaseQuota(ctx context.Context, requestBag attribute.Bag,
+		qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error)
 }
 
 // Resolver represents the current snapshot of the configuration database
@@ -89,6 +96,18 @@ type Action struct {
 	handlerName string
 	// Name of adapter that created the handler. Informational.
 	adapterName string
+	// Name of the rule that produced this action. Informational.
+	ruleName string
+	// shadow actions are dispatched, but their results are only recorded.
+	// They do not affect the outcome of the request.
+	shadow bool
+	// split is set if the action is one of several alternatives of a handler split.
+	split *splitChoice
+	// failOpen actions succeed when the circuit breaker of the handler is open.
+	// Otherwise they fail.
+	failOpen bool
+	// entry tracks in-flight calls so that a retired handler is closed after they complete.
+	entry *HandlerEntry
 	// handler to call.
 	// instanceConfigs to dispatch to the handler.
 	// instanceConfigs must belong to the same template.
@@ -99,10 +118,12 @@ type Action struct {
 type genDispatchFn func(call *Action) []dispatchFn
 
 // newDispatcher creates a new dispatcher.
-func newDispatcher(mapper expr.Evaluator, rt Resolver, gp *pool.GoroutinePool) *dispatcher {
+// breakers configures the circuit breakers of handlers.
+func newDispatcher(mapper expr.Evaluator, rt Resolver, gp *pool.GoroutinePool, breakers BreakerConfig) *dispatcher {
 	m := &dispatcher{
-		mapper: mapper,
-		gp:     gp,
+		mapper:   mapper,
+		gp:       gp,
+		breakers: newBreakerTable(breakers),
 	}
 	m.ChangeResolver(rt)
 	return m
@@ -120,6 +141,13 @@ type dispatcher struct {
 
 	resolverLock sync.RWMutex
 	resolver     Resolver
+
+	// breakers track handler health and short-circuit calls to failing handlers.
+	breakers *breakerTable
+
+	// controller publishes resolvers to the dispatcher.
+	// It is used for debugging and may be nil.
+	controller *Controller
 }
 
 // ChangeResolver installs a new resolver.
@@ -131,6 +159,11 @@ func (m *dispatcher) ChangeResolver(rt Resolver) {
 	m.resolverLock.Unlock()
 }
 
+// RetireHandlers discards the circuit breakers of handlers that were removed or rebuilt.
+func (m *dispatcher) RetireHandlers(handlers []string) {
+	m.breakers.remove(handlers)
+}
+
 // Resolve resolves configuration to a list of actions.
 func (m *dispatcher) Resolve(bag attribute.Bag, variety adptTmpl.TemplateVariety) (Actions, error) {
 	m.resolverLock.RLock()
@@ -228,44 +261,65 @@ func (m *dispatcher) Check(ctx context.Context, requestBag attribute.Bag) (*adap
 
 // Quota dispatches to the set of adapters associated with the Quota API method
 // Config validation ensures that things are consistent.
-// Quota calls are dispatched to at most one handler.
+// The request is routed to the quota instance whose name matches qma.Quota.
+// Quota calls are enforced by at most one handler, shadow quota actions are
+// dispatched in addition to it.
+// Returns an error if quota rules apply to the request but none of them
+// refer to the requested quota, or if a short name refers to several quotas.
 // Dispatcher#Quota.
 func (m *dispatcher) Quota(ctx context.Context, requestBag attribute.Bag,
 	qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
-	dispatched := false
-	qres, err := m.dispatch(ctx, requestBag, adptTmpl.TEMPLATE_VARIETY_QUOTA,
-		func(call *Action) []dispatchFn {
-			for _, inst := range call.instanceConfig {
-				// if inst.Name != qma.Quota {
-				//	continue
-				// }
-				// TODO Re-enable inst.Name check
-				// proxy - mixer quota protocol dictates that quota name is passed in as a parameter.
-				// As of 0.2, there is no mechanism to distribute configuration from Mixer to Mixer client(Proxy).
-				// When such a mechanism is created, re-enable the inst.Name filter.
-				// Until then Proxy always calls with exactly 1 quota request named
-				// "RequestCount" which is intended for rate limit.
-				if dispatched { // ensures only one call is dispatched.
-					glog.Warningf("Multiple dispatch: not dispatching %s to handler %s", inst.Name, call.handlerName)
-					return nil
-				}
-				dispatched = true
-				return []dispatchFn{ // nolint: megacheck
-					func(ctx context.Context) *result {
-						resp, err := call.processor.ProcessQuota(ctx, inst.Name,
-							inst.Params.(proto.Message), requestBag, m.mapper, call.handler,
-							adapter.QuotaArgs{
-								DeduplicationID: qma.DeduplicationID,
-								QuotaAmount:     qma.Amount,
-								BestEffort:      qma.BestEffort,
-							})
-						return &result{err, &resp, call}
-					},
-				}
-			}
-			return nil
-		},
-	)
+	return m.quota(ctx, requestBag, qma, adapter.QuotaArgs{
+		DeduplicationID: qma.DeduplicationID,
+		QuotaAmount:     qma.Amount,
+		BestEffort:      qma.BestEffort,
+	})
+}
+
+// ReleaseQuota returns previously allocated quota to the handler that allocated it.
+// Release is dispatched to adapters as a quota request with a negative amount, see adapter.QuotaArgs.
+// Releases are always best effort, the result contains the amount actually released.
+// qma.DeduplicationID must be distinct from the one used to allocate the quota.
+// Dispatcher#ReleaseQuota.
+func (m *dispatcher) ReleaseQuota(ctx context.Context, requestBag attribute.Bag,
+	qma *aspect.QuotaMethodArgs) (*adapter.QuotaResult, error) {
+	if qma.Amount <= 0 {
+		return nil, fmt.Errorf("quota '%s' release amount must be positive, got %d", qma.Quota, qma.Amount)
+	}
+	return m.quota(ctx, requestBag, qma, adapter.QuotaArgs{
+		DeduplicationID: qma.DeduplicationID,
+		QuotaAmount:     -qma.Amount,
+		BestEffort:      true,
+	})
+}
+
+// quota dispatches args to the quota instance requested by qma.
+func (m *dispatcher) quota(ctx context.Context, requestBag attribute.Bag,
+	qma *aspect.QuotaMethodArgs, args adapter.QuotaArgs) (*adapter.QuotaResult, error) {
+	calls, err := m.Resolve(requestBag, adptTmpl.TEMPLATE_VARIETY_QUOTA)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+
+	// This *must* run after all the processing is done, see dispatch.
+	defer calls.Done()
+
+	qs, err := selectQuota(calls.Get(), qma.Quota)
+	if err != nil {
+		glog.Warning(err)
+		return nil, err
+	}
+	ra := make([]*runArg, 0, len(qs))
+	for _, q := range qs {
+		call, inst := q.call, q.inst
+		ra = append(ra, &runArg{call, func(ctx context.Context) *result {
+			resp, err := call.processor.ProcessQuota(ctx, inst.Name,
+				inst.Params.(proto.Message), requestBag, m.mapper, call.handler, args)
+			return &result{err, &resp, call}
+		}})
+	}
+	qres, err := m.run(ctx, ra)
 	res, _ := qres.(*adapter.QuotaResult)
 	if glog.V(3) {
 		glog.Infof("Quota %v", res)
@@ -273,6 +327,121 @@ func (m *dispatcher) Quota(ctx context.Context, requestBag attribute.Bag,
 	return res, err
 }
 
+// quotaInstance is a quota instance of a resolved action.
+type quotaInstance struct {
+	call *Action
+	inst *cpb.Instance
+}
+
+// selectQuota returns the quota instances to dispatch the requested quota to, or nil
+// if no quota actions apply to the request. An instance is requested by its fully
+// qualified name, or by its short name if no instance with a different name shares it.
+// Instances with the same short name may be defined both in the default config
+// namespace and in the namespace of the request, which must then be told apart.
+// At most one enforced instance is returned. Matching instances of shadow actions are
+// returned in addition to it, their results are recorded but never enforced.
+func selectQuota(calls []*Action, quota string) ([]*quotaInstance, error) {
+	var enforced, shadows []*quotaInstance
+	nenforced := 0
+	for _, call := range calls {
+		if !call.shadow {
+			nenforced++
+		}
+		for _, inst := range call.instanceConfig {
+			q := &quotaInstance{call, inst}
+			if call.shadow {
+				shadows = append(shadows, q)
+			} else {
+				enforced = append(enforced, q)
+			}
+		}
+	}
+
+	candidates, err := matchQuota(enforced, quota)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 && nenforced > 0 {
+		return nil, fmt.Errorf("requested quota '%s' does not match any of the %d applicable quota actions", quota, nenforced)
+	}
+	var selected []*quotaInstance
+	if len(candidates) > 0 {
+		// ensures only one call is enforced.
+		for _, q := range candidates[1:] {
+			glog.Warningf("Multiple dispatch: not dispatching %s to handler %s", q.inst.Name, q.call.handlerName)
+		}
+		selected = append(selected, candidates[0])
+	}
+
+	// a shadow action must not fail the request, so ambiguous shadow instances are only logged.
+	shadowCandidates, err := matchQuota(shadows, quota)
+	if err != nil {
+		glog.Warningf("Not dispatching shadow quota actions: %v", err)
+		return selected, nil
+	}
+	dispatched := make(map[*Action]bool, len(shadowCandidates))
+	for _, q := range shadowCandidates {
+		if dispatched[q.call] {
+			glog.Warningf("Multiple dispatch: not dispatching %s to handler %s", q.inst.Name, q.call.handlerName)
+			continue
+		}
+		dispatched[q.call] = true
+		selected = append(selected, q)
+	}
+	return selected, nil
+}
+
+// matchQuota returns the quota instances that match the requested quota.
+// Exact matches take precedence over short name matches.
+func matchQuota(qs []*quotaInstance, quota string) ([]*quotaInstance, error) {
+	var exact, short []*quotaInstance
+	for _, q := range qs {
+		switch {
+		case q.inst.Name == quota:
+			exact = append(exact, q)
+		case quotaNameMatches(q.inst.Name, quota):
+			short = append(short, q)
+		}
+	}
+	if len(exact) > 0 {
+		return exact, nil
+	}
+	if names := instanceNames(short); len(names) > 1 {
+		return nil, fmt.Errorf("requested quota '%s' is ambiguous, use one of the fully qualified names %v", quota, names)
+	}
+	return short, nil
+}
+
+// instanceNames returns the sorted distinct names of the quota instances.
+func instanceNames(qs []*quotaInstance) []string {
+	seen := make(map[string]bool, len(qs))
+	names := make([]string, 0, len(qs))
+	for _, q := range qs {
+		if !seen[q.inst.Name] {
+			seen[q.inst.Name] = true
+			names = append(names, q.inst.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quotaNameMatches returns true if instName is the quota requested by the client.
+// Instances use fully qualified names of form shortname.kind.namespace.
+// Clients may request a quota by its fully qualified name or by its short name.
+// Short names are compared without regard to case, so that a request for
+// "RequestCount" is served by the "requestcount" instance.
+func quotaNameMatches(instName string, quota string) bool {
+	if instName == quota {
+		return true
+	}
+	shortName := instName
+	if idx := strings.Index(instName, "."); idx >= 0 {
+		shortName = instName[:idx]
+	}
+	return strings.EqualFold(shortName, quota)
+}
+
 // Preprocess runs the first phase of adapter processing before any other adapters are run.
 // Attribute producing adapters are run in this phase.
 func (m *dispatcher) Preprocess(ctx context.Context, requestBag attribute.Bag, responseBag *attribute.MutableBag) error {
@@ -281,6 +450,7 @@ func (m *dispatcher) Preprocess(ctx context.Context, requestBag attribute.Bag, r
 }
 
 // combineResults combines results
+// Results of shadow actions are recorded, but not combined.
 func combineResults(results []*result) (adapter.Result, error) {
 	var res adapter.Result
 	var err *multierror.Error
@@ -288,6 +458,10 @@ func combineResults(results []*result) (adapter.Result, error) {
 	code := rpc.OK
 
 	for _, rs := range results {
+		if rs.callinfo != nil && rs.callinfo.shadow {
+			recordShadowResult(rs)
+			continue
+		}
 		if rs.err != nil {
 			err = multierror.Append(err, rs.err)
 		}
@@ -322,6 +496,29 @@ func combineResults(results []*result) (adapter.Result, error) {
 	return res, err.ErrorOrNil()
 }
 
+// recordShadowResult records the outcome that a shadow action would have had.
+func recordShadowResult(rs *result) {
+	st := status.OK
+	if rs.err != nil {
+		st = status.WithError(rs.err)
+	} else if rs.res != nil {
+		st = rs.res.GetStatus()
+	}
+
+	shadowCounter.With(prometheus.Labels{
+		ruleStr:      rs.callinfo.ruleName,
+		handlerName:  rs.callinfo.handlerName,
+		responseCode: rpc.Code_name[st.Code],
+	}).Inc()
+
+	if !status.IsOK(st) {
+		glog.Infof("Shadow rule %s: handler %s would have returned %s", rs.callinfo.ruleName,
+			rs.callinfo.handlerName, status.String(st))
+	} else if glog.V(3) {
+		glog.Infof("Shadow rule %s: handler %s would have returned OK", rs.callinfo.ruleName, rs.callinfo.handlerName)
+	}
+}
+
 // dispatchFn is the abstraction used by runAsync to dispatch to adapters.
 type dispatchFn func(context.Context) *result
 
@@ -358,12 +555,14 @@ func (m *dispatcher) run(ctx context.Context, runArgs []*runArg) (adapter.Result
 }
 
 // safeDispatch ensures that an adapter panic does not bring down Mixer.
-func safeDispatch(ctx context.Context, do dispatchFn, op string) (res *result) {
+// The result of a panicking call is attributed to callinfo.
+func safeDispatch(ctx context.Context, callinfo *Action, do dispatchFn, op string) (res *result) {
 	defer func() {
 		if r := recover(); r != nil {
 			glog.Errorf("Dispatch %s panic: %v", op, r)
 			res = &result{
-				err: fmt.Errorf("dispatch %s panic: %v", op, r),
+				err:      fmt.Errorf("dispatch %s panic: %v", op, r),
+				callinfo: callinfo,
 			}
 		}
 	}()
@@ -371,6 +570,17 @@ func safeDispatch(ctx context.Context, do dispatchFn, op string) (res *result) {
 	return
 }
 
+// openCircuitResult is the result of a call that was short-circuited by the circuit breaker.
+func openCircuitResult(callinfo *Action) *result {
+	if callinfo.failOpen {
+		return &result{callinfo: callinfo}
+	}
+	return &result{
+		err:      fmt.Errorf("handler %s is unavailable: circuit open", callinfo.handlerName),
+		callinfo: callinfo,
+	}
+}
+
 // runAsync runs the dispatchFn using a scheduler. It also adds a new span and records prometheus metrics.
 func (m *dispatcher) runAsync(ctx context.Context, callinfo *Action, results chan *result, do dispatchFn) {
 	if glog.V(4) {
@@ -387,7 +597,23 @@ func (m *dispatcher) runAsync(ctx context.Context, callinfo *Action, results cha
 			glog.Infof("runAsync %s -> %v", op, *callinfo)
 		}
 
-		out := safeDispatch(ctx, do, op)
+		var out *result
+		cb := m.breakers.get(callinfo.handlerName)
+		if !callinfo.acquire() {
+			out = retiredResult(callinfo)
+			span.SetTag("retired", true)
+		} else if cb == nil || cb.allow(start) {
+			out = safeDispatch(ctx, callinfo, do, op)
+			callinfo.release()
+			if cb != nil {
+				cb.record(time.Now(), out.err == nil)
+			}
+		} else {
+			callinfo.release()
+			out = openCircuitResult(callinfo)
+			breakerRejectCounter.WithLabelValues(callinfo.handlerName).Inc()
+			span.SetTag("circuit", breakerOpen.String())
+		}
 		st := status.OK
 		if out.err != nil {
 			st = status.WithError(out.err)
@@ -407,15 +633,24 @@ func (m *dispatcher) runAsync(ctx context.Context, callinfo *Action, results cha
 			tracelog.Bool(errorStr, out.err != nil),
 		)
 
+		if callinfo.shadow {
+			span.SetTag(shadowStr, true)
+		}
+
 		dispatchLbls := prometheus.Labels{
 			meshFunction: callinfo.processor.Name,
 			handlerName:  callinfo.handlerName,
 			adapterName:  callinfo.adapterName,
+			ruleStr:      callinfo.ruleName,
 			responseCode: rpc.Code_name[st.Code],
 			errorStr:     strconv.FormatBool(out.err != nil),
 		}
 		dispatchCounter.With(dispatchLbls).Inc()
 		dispatchDuration.With(dispatchLbls).Observe(duration.Seconds())
+		for _, inst := range callinfo.instanceConfig {
+			instanceDispatchCounter.WithLabelValues(callinfo.ruleName, inst.Name, callinfo.handlerName,
+				dispatchLbls[errorStr]).Inc()
+		}
 
 		results <- out
 		span.Finish()
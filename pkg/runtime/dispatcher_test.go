@@ -22,12 +22,16 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	google_rpc "github.com/googleapis/googleapis/google/rpc"
 
 	adptTmpl "istio.io/api/mixer/v1/template"
+	"istio.io/mixer/adapter/memquota"
+	"istio.io/mixer/adapter/memquota/config"
 	"istio.io/mixer/pkg/adapter"
+	"istio.io/mixer/pkg/adapter/test"
 	"istio.io/mixer/pkg/aspect"
 	"istio.io/mixer/pkg/attribute"
 	cpb "istio.io/mixer/pkg/config/proto"
@@ -35,37 +39,51 @@ import (
 	"istio.io/mixer/pkg/pool"
 	"istio.io/mixer/pkg/status"
 	"istio.io/mixer/pkg/template"
+	"istio.io/mixer/template/quota"
 )
 
 func TestDispatcher_safeDispatch(t *testing.T) {
-	//safeDispatch(ctx context.Context, do dispatchFn, op string) (res *result) {
-
 	ctx := context.Background()
 	panicerror := errors.New("panicerror")
 
 	for _, tc := range []struct {
-		desc  string
-		panic bool
-	}{} {
+		desc   string
+		panic  bool
+		shadow bool
+	}{
+		{"no panic", false, false},
+		{"panic", true, false},
+		{"shadow panic", true, true},
+	} {
 		t.Run(tc.desc, func(t *testing.T) {
-			want := &result{}
-			if tc.panic {
-				want.err = panicerror
-			}
-
-			res := safeDispatch(ctx, func(context context.Context) *result {
+			callinfo := &Action{handlerName: "h1", ruleName: "r1", shadow: tc.shadow}
+			res := safeDispatch(ctx, callinfo, func(context context.Context) *result {
 				if tc.panic {
 					panic(panicerror)
 				}
-				return &result{}
+				return &result{callinfo: callinfo}
 			}, tc.desc)
 
-			if res == want {
+			if res.callinfo != callinfo {
+				t.Fatalf("got callinfo %v, want %v", res.callinfo, callinfo)
+			}
+			if !tc.panic {
+				if res.err != nil {
+					t.Fatalf("unexpected error: %v", res.err)
+				}
 				return
 			}
+			if res.err == nil || !strings.Contains(res.err.Error(), panicerror.Error()) {
+				t.Fatalf("got %v\nwant %v", res.err, panicerror)
+			}
 
-			if !strings.Contains(res.err.Error(), want.err.Error()) {
-				t.Fatalf("got %v\nwant %v", res.err, want.err)
+			// a panicking shadow handler must not fail the request.
+			_, err := combineResults([]*result{res})
+			if tc.shadow && err != nil {
+				t.Fatalf("shadow panic failed the request: %v", err)
+			}
+			if !tc.shadow && err == nil {
+				t.Fatalf("got nil, want error %v", panicerror)
 			}
 		})
 	}
@@ -94,7 +112,7 @@ func TestReport(t *testing.T) {
 				resolveErr = s.callErr
 			}
 			rt := newFakeResolver(s.tn, resolveErr, false, fp)
-			m := newDispatcher(nil, rt, gp)
+			m := newDispatcher(nil, rt, gp, DefaultBreakerConfig())
 
 			err := m.Report(context.Background(), nil)
 			checkError(t, s.callErr, err)
@@ -136,7 +154,7 @@ func TestCheck(t *testing.T) {
 				resolveErr = s.callErr
 			}
 			rt := newFakeResolver(s.tn, resolveErr, false, fp)
-			m := newDispatcher(nil, rt, gp)
+			m := newDispatcher(nil, rt, gp, DefaultBreakerConfig())
 
 			cr, err := m.Check(context.Background(), nil)
 
@@ -162,6 +180,63 @@ func TestCheck(t *testing.T) {
 	gp.Close()
 }
 
+func TestCombineResults_Shadow(t *testing.T) {
+	enforced := &Action{handlerName: "h1", ruleName: "r1"}
+	shadow := &Action{handlerName: "h2", ruleName: "r2", shadow: true}
+	denied := func() *adapter.CheckResult {
+		return &adapter.CheckResult{Status: status.WithPermissionDenied("bad user"), ValidUseCount: 1}
+	}
+	ok := func() *adapter.CheckResult {
+		return &adapter.CheckResult{Status: status.OK, ValidUseCount: 100}
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		results []*result
+		code    google_rpc.Code
+		err     bool
+		nilRes  bool
+	}{
+		{
+			desc:    "shadow deny is ignored",
+			results: []*result{{res: ok(), callinfo: enforced}, {res: denied(), callinfo: shadow}},
+			code:    google_rpc.OK,
+		},
+		{
+			desc:    "shadow error is ignored",
+			results: []*result{{res: ok(), callinfo: enforced}, {err: errors.New("shadow failure"), callinfo: shadow}},
+			code:    google_rpc.OK,
+		},
+		{
+			desc:    "enforced deny is returned",
+			results: []*result{{res: denied(), callinfo: enforced}, {res: ok(), callinfo: shadow}},
+			code:    google_rpc.PERMISSION_DENIED,
+		},
+		{
+			desc:    "only shadow results",
+			results: []*result{{res: denied(), callinfo: shadow}},
+			nilRes:  true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			res, err := combineResults(tc.results)
+			if (err != nil) != tc.err {
+				t.Fatalf("got error %v, want error %t", err, tc.err)
+			}
+			if tc.nilRes {
+				if res != nil {
+					t.Fatalf("got %v, want nil result", res)
+				}
+				return
+			}
+			cr := res.(*adapter.CheckResult)
+			if google_rpc.Code(cr.Status.Code) != tc.code {
+				t.Fatalf("got %v, want %v", cr.Status, tc.code)
+			}
+		})
+	}
+}
+
 func TestQuota(t *testing.T) {
 	gp := pool.NewGoroutinePool(1, true)
 	tname := "metric1"
@@ -174,12 +249,15 @@ func TestQuota(t *testing.T) {
 		ncalled     int
 		cr          adapter.QuotaResult
 		emptyResult bool
+		quota       string
 	}{{tn: tname, ncalled: 1},
 		{tn: tname, ncalled: 1, cr: adapter.QuotaResult{Amount: 200}},
 		{tn: tname, ncalled: 1, cr: adapter.QuotaResult{Amount: 200, Status: status.WithPermissionDenied("bad user")}},
 		{tn: tname, callErr: err1},
 		{tn: tname, callErr: err1, resolveErr: true},
 		{tn: tname, ncalled: 0, cr: adapter.QuotaResult{Amount: 200}, emptyResult: true},
+		{tn: tname, ncalled: 1, cr: adapter.QuotaResult{Amount: 200}, quota: "I1X"},
+		{tn: tname, callErr: errors.New("requested quota 'unknown' does not match"), quota: "unknown"},
 	} {
 		t.Run(fmt.Sprintf("%#v", s), func(t *testing.T) {
 			fp := &fakeProc{
@@ -191,11 +269,15 @@ func TestQuota(t *testing.T) {
 				resolveErr = s.callErr
 			}
 			rt := newFakeResolver(s.tn, resolveErr, s.emptyResult, fp)
-			m := newDispatcher(nil, rt, gp)
+			m := newDispatcher(nil, rt, gp, DefaultBreakerConfig())
 
+			quota := "i1"
+			if s.quota != "" {
+				quota = s.quota
+			}
 			cr, err := m.Quota(context.Background(), nil,
 				&aspect.QuotaMethodArgs{
-					Quota: "i1",
+					Quota: quota,
 				})
 
 			checkError(t, s.callErr, err)
@@ -221,6 +303,248 @@ func TestQuota(t *testing.T) {
 	gp.Close()
 }
 
+func TestReleaseQuota(t *testing.T) {
+	gp := pool.NewGoroutinePool(1, true)
+	tname := "metric1"
+
+	for _, s := range []struct {
+		desc    string
+		amount  int64
+		callErr error
+		ncalled int
+	}{
+		{desc: "release", amount: 10, ncalled: 1},
+		{desc: "zero", amount: 0, callErr: errors.New("release amount must be positive")},
+		{desc: "negative", amount: -10, callErr: errors.New("release amount must be positive")},
+	} {
+		t.Run(s.desc, func(t *testing.T) {
+			fp := &fakeProc{
+				quotaResult: adapter.QuotaResult{Amount: s.amount},
+			}
+			rt := newFakeResolver(tname, nil, false, fp)
+			m := newDispatcher(nil, rt, gp, DefaultBreakerConfig())
+
+			qr, err := m.ReleaseQuota(context.Background(), nil,
+				&aspect.QuotaMethodArgs{
+					Quota:           "i1",
+					Amount:          s.amount,
+					DeduplicationID: "release-1",
+				})
+
+			checkError(t, s.callErr, err)
+			if fp.called != s.ncalled {
+				t.Fatalf("got %v, want %v", fp.called, s.ncalled)
+			}
+			if s.callErr != nil {
+				return
+			}
+
+			want := adapter.QuotaArgs{
+				DeduplicationID: "release-1",
+				QuotaAmount:     -s.amount,
+				BestEffort:      true,
+			}
+			if !reflect.DeepEqual(fp.quotaArgs, want) {
+				t.Fatalf("got %v, want %v", fp.quotaArgs, want)
+			}
+			if qr == nil || qr.Amount != s.amount {
+				t.Fatalf("got %v, want released amount %d", qr, s.amount)
+			}
+		})
+	}
+	gp.Close()
+}
+
+// TestReleaseQuota_Memquota dispatches allocations and releases to the memquota
+// adapter, which returns quota for requests with a negative amount.
+func TestReleaseQuota_Memquota(t *testing.T) {
+	info := memquota.GetInfo()
+	b := info.NewBuilder()
+	b.SetAdapterConfig(&config.Params{
+		MinDeduplicationDuration: time.Hour,
+		Quotas:                   []config.Params_Quota{{Name: "i1", MaxAmount: 10}},
+	})
+	h, err := b.Build(context.Background(), test.NewEnv(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = h.Close() }()
+
+	processQuota := func(ctx context.Context, quotaName string, _ proto.Message, _ attribute.Bag,
+		_ expr.Evaluator, handler adapter.Handler, args adapter.QuotaArgs) (adapter.QuotaResult, error) {
+		return handler.(quota.Handler).HandleQuota(ctx, &quota.Instance{Name: quotaName}, args)
+	}
+	rt := &fakeResolver{
+		ra: []*Action{{
+			processor:      &template.Info{Name: "quota", ProcessQuota: processQuota},
+			handler:        h,
+			handlerName:    "handler",
+			adapterName:    info.Name,
+			instanceConfig: []*cpb.Instance{{Name: "i1", Template: "quota", Params: &google_rpc.Status{}}},
+		}},
+	}
+	gp := pool.NewGoroutinePool(1, true)
+	defer gp.Close()
+	m := newDispatcher(nil, rt, gp, DefaultBreakerConfig())
+
+	for _, s := range []struct {
+		desc    string
+		release bool
+		amount  int64
+		want    int64
+	}{
+		{"allocate", false, 10, 10},
+		{"exhausted", false, 1, 0},
+		{"release", true, 4, 4},
+		{"allocate released", false, 4, 4},
+		{"release more than allocated", true, 20, 10},
+		{"allocate all", false, 10, 10},
+	} {
+		qma := &aspect.QuotaMethodArgs{Quota: "i1", Amount: s.amount, DeduplicationID: s.desc}
+		var qr *adapter.QuotaResult
+		if s.release {
+			qr, err = m.ReleaseQuota(context.Background(), nil, qma)
+		} else {
+			qr, err = m.Quota(context.Background(), nil, qma)
+		}
+		if err != nil {
+			t.Fatalf("%s: got %v, want success", s.desc, err)
+		}
+		if qr == nil || qr.Amount != s.want {
+			t.Fatalf("%s: got %v, want amount %d", s.desc, qr, s.want)
+		}
+	}
+}
+
+func TestQuota_Shadow(t *testing.T) {
+	gp := pool.NewGoroutinePool(1, true)
+	defer gp.Close()
+	tname := "quota1"
+
+	action := func(handler string, shadow bool, fp *fakeProc) *Action {
+		return &Action{
+			processor:   newTemplate(tname, fp),
+			handlerName: handler,
+			adapterName: handler + "Impl",
+			ruleName:    handler + "-rule",
+			shadow:      shadow,
+			instanceConfig: []*cpb.Instance{
+				{"requestcount.quota.istio-system", tname, &google_rpc.Status{}},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		shadowErr error
+	}{
+		{"shadow grants", nil},
+		{"shadow fails", errors.New("shadow failure")},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			shadowProc := &fakeProc{err: tc.shadowErr, quotaResult: adapter.QuotaResult{Amount: 100}}
+			enforcedProc := &fakeProc{quotaResult: adapter.QuotaResult{Amount: 5}}
+			// the shadow action is resolved first, it must not take the place of the enforced one.
+			rt := &fakeResolver{ra: []*Action{
+				action("shadow", true, shadowProc),
+				action("enforced", false, enforcedProc),
+			}}
+			m := newDispatcher(nil, rt, gp, DefaultBreakerConfig())
+
+			qr, err := m.Quota(context.Background(), nil, &aspect.QuotaMethodArgs{Quota: "requestcount", Amount: 100})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if shadowProc.called != 1 || enforcedProc.called != 1 {
+				t.Fatalf("got %d shadow and %d enforced calls, want 1 and 1", shadowProc.called, enforcedProc.called)
+			}
+			if qr == nil || qr.Amount != 5 {
+				t.Fatalf("got %v, want the result of the enforced quota", qr)
+			}
+		})
+	}
+}
+
+func TestQuotaNameMatches(t *testing.T) {
+	for _, tc := range []struct {
+		inst  string
+		quota string
+		want  bool
+	}{
+		{"requestcount.quota.istio-system", "requestcount.quota.istio-system", true},
+		{"requestcount.quota.istio-system", "requestcount", true},
+		{"requestcount.quota.istio-system", "RequestCount", true},
+		{"requestcount.quota.istio-system", "requestcount.quota.default", false},
+		{"requestcount.quota.istio-system", "request", false},
+		{"i1", "i1", true},
+		{"i1B", "i1", false},
+	} {
+		t.Run(tc.inst+"/"+tc.quota, func(t *testing.T) {
+			if got := quotaNameMatches(tc.inst, tc.quota); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSelectQuota(t *testing.T) {
+	action := func(handler string, shadow bool, names ...string) *Action {
+		a := &Action{handlerName: handler, shadow: shadow}
+		for _, n := range names {
+			a.instanceConfig = append(a.instanceConfig, &cpb.Instance{Name: n})
+		}
+		return a
+	}
+	mesh := action("mesh", false, "requestcount.quota.istio-system")
+	local := action("local", false, "requestcount.quota.myns", "other.quota.myns")
+	shadow := action("shadow", true, "requestcount.quota.istio-system", "requestcount.quota.istio-system")
+	shadowLocal := action("shadowLocal", true, "requestcount.quota.myns")
+	both := []*Action{mesh, local}
+
+	for _, tc := range []struct {
+		desc  string
+		calls []*Action
+		quota string
+		want  []string
+		err   string
+	}{
+		{"no actions", nil, "requestcount", nil, ""},
+		{"fully qualified", both, "requestcount.quota.myns", []string{"local/requestcount.quota.myns"}, ""},
+		{"unique short name", both, "other", []string{"local/other.quota.myns"}, ""},
+		{"short name in one namespace", []*Action{mesh}, "RequestCount",
+			[]string{"mesh/requestcount.quota.istio-system"}, ""},
+		{"ambiguous short name", both, "requestcount", nil, "is ambiguous"},
+		{"no match", both, "unknown", nil, "does not match any of the 2 applicable quota actions"},
+		{"shadow in addition", []*Action{shadow, mesh}, "requestcount",
+			[]string{"mesh/requestcount.quota.istio-system", "shadow/requestcount.quota.istio-system"}, ""},
+		{"shadow only", []*Action{shadow}, "requestcount", []string{"shadow/requestcount.quota.istio-system"}, ""},
+		{"shadow does not count as applicable", []*Action{shadow, mesh}, "unknown",
+			nil, "does not match any of the 1 applicable quota actions"},
+		{"ambiguous shadow is not dispatched", []*Action{shadow, shadowLocal, mesh}, "requestcount",
+			[]string{"mesh/requestcount.quota.istio-system"}, ""},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			qs, err := selectQuota(tc.calls, tc.quota)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got %v, want error %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, q := range qs {
+				got = append(got, q.call.handlerName+"/"+q.inst.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestPreprocess(t *testing.T) {
 	m := dispatcher{}
 
@@ -353,6 +677,7 @@ type fakeProc struct {
 	err         error
 	checkResult adapter.CheckResult
 	quotaResult adapter.QuotaResult
+	quotaArgs   adapter.QuotaArgs
 }
 
 func (f *fakeProc) ProcessReport(_ context.Context, _ map[string]proto.Message,
@@ -367,8 +692,9 @@ func (f *fakeProc) ProcessCheck(_ context.Context, _ string, _ proto.Message, _
 }
 
 func (f *fakeProc) ProcessQuota(_ context.Context, _ string, _ proto.Message, _ attribute.Bag,
-	_ expr.Evaluator, _ adapter.Handler, _ adapter.QuotaArgs) (adapter.QuotaResult, error) {
+	_ expr.Evaluator, _ adapter.Handler, args adapter.QuotaArgs) (adapter.QuotaResult, error) {
 	f.called++
+	f.quotaArgs = args
 	return f.quotaResult, f.err
 }
 
@@ -0,0 +1,228 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultHandlerDrainTimeout is the default amount of time retired handlers
+// are given to complete in-flight calls before they are closed.
+const DefaultHandlerDrainTimeout = 10 * time.Second
+
+// drainPollInterval is the interval at which in-flight calls of retired handlers are checked.
+var drainPollInterval = 50 * time.Millisecond
+
+// acquire registers an in-flight call to the handler of the action.
+// It returns false if the handler has been retired, the call must not be dispatched.
+// A successful acquire must be followed by release.
+func (a *Action) acquire() bool {
+	he := a.entry
+	if he == nil {
+		return true
+	}
+	// in-flight count is incremented before the retired check, so that drainer
+	// either sees the call or the call sees the retired handler.
+	atomic.AddInt32(&he.inFlight, 1)
+	if atomic.LoadInt32(&he.retired) != 0 {
+		atomic.AddInt32(&he.inFlight, -1)
+		return false
+	}
+	return true
+}
+
+// release unregisters an in-flight call.
+func (a *Action) release() {
+	if a.entry != nil {
+		atomic.AddInt32(&a.entry.inFlight, -1)
+	}
+}
+
+// retiredResult is the result of an action whose handler has been retired.
+func retiredResult(callinfo *Action) *result {
+	if callinfo.failOpen {
+		return &result{callinfo: callinfo}
+	}
+	return &result{
+		err:      fmt.Errorf("handler %s is unavailable: handler retired", callinfo.handlerName),
+		callinfo: callinfo,
+	}
+}
+
+// drainer closes retired handlers once the requests of the old resolver and
+// their in-flight calls complete.
+// Handlers that do not drain within the timeout are closed anyway,
+// abandoning the calls that remain in flight.
+type drainer struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	draining map[*HandlerEntry]*retiredHandler
+}
+
+// retiredHandler is a handler that is draining.
+type retiredHandler struct {
+	entry     *HandlerEntry
+	resolver  *resolver
+	retiredAt time.Time
+
+	// forced is set when the handler is closed with calls in flight.
+	forced bool
+}
+
+// retiredStatus is the externally visible state of a retired handler that is not closed yet.
+type retiredStatus struct {
+	Handler   string    `json:"handler"`
+	Resolver  int       `json:"resolver"`
+	RetiredAt time.Time `json:"retiredAt"`
+	// ResolverRefs is the number of requests still using the old resolver.
+	ResolverRefs int32 `json:"resolverRefs"`
+	InFlight     int32 `json:"inFlight"`
+	Forced       bool  `json:"forced"`
+}
+
+func newDrainer(timeout time.Duration) *drainer {
+	return &drainer{
+		timeout:  timeout,
+		draining: make(map[*HandlerEntry]*retiredHandler),
+	}
+}
+
+// retire closes handlers of the table that are marked closeOnCleanup once they are no longer used.
+// Requests that resolved actions with the old resolver r may still dispatch to the handlers,
+// so the handlers keep accepting calls until the reference count of r drops to 0.
+// Handlers are then drained of in-flight calls and closed.
+// If r is no longer in use, idle handlers are closed immediately, the others are drained in the background.
+func (d *drainer) retire(table map[string]*HandlerEntry, r *resolver) {
+	now := time.Now()
+	var rhs []*retiredHandler
+	for _, he := range table {
+		if !he.closeOnCleanup || he.Handler == nil {
+			continue
+		}
+		rhs = append(rhs, &retiredHandler{entry: he, resolver: r, retiredAt: now})
+	}
+	if len(rhs) == 0 {
+		return
+	}
+
+	if atomic.LoadInt32(&r.refCount) == 0 {
+		var busy []*retiredHandler
+		for _, rh := range rhs {
+			atomic.StoreInt32(&rh.entry.retired, 1)
+			if atomic.LoadInt32(&rh.entry.inFlight) == 0 {
+				d.close(rh)
+				continue
+			}
+			busy = append(busy, rh)
+		}
+		rhs = busy
+		if len(rhs) == 0 {
+			return
+		}
+	}
+
+	d.mu.Lock()
+	for _, rh := range rhs {
+		if glog.V(2) {
+			glog.Infof("Draining handler %s of resolver %d", rh.entry.Name, r.id)
+		}
+		d.draining[rh.entry] = rh
+	}
+	d.mu.Unlock()
+	go d.drain(r, rhs, now.Add(d.timeout))
+}
+
+// drain waits for the requests of resolver r to complete, then stops dispatch to the handlers,
+// waits for their in-flight calls to complete and closes them.
+// Handlers are closed anyway once the deadline passes.
+func (d *drainer) drain(r *resolver, rhs []*retiredHandler, deadline time.Time) {
+	for {
+		rc := atomic.LoadInt32(&r.refCount)
+		if rc <= 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			glog.Warningf("Resolver %d is still used by %d requests after %v, retiring its handlers", r.id, rc, d.timeout)
+			break
+		}
+		if glog.V(2) {
+			glog.Infof("Waiting for resolver %d to finish %d remaining requests", r.id, rc)
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	for _, rh := range rhs {
+		atomic.StoreInt32(&rh.entry.retired, 1)
+	}
+	for _, rh := range rhs {
+		he := rh.entry
+		for {
+			n := atomic.LoadInt32(&he.inFlight)
+			if n == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				glog.Warningf("Handler %s did not drain in %v, closing it with %d calls in flight", he.Name, d.timeout, n)
+				handlerLeakCounter.WithLabelValues(he.Name).Inc()
+				d.mu.Lock()
+				rh.forced = true
+				d.mu.Unlock()
+				break
+			}
+			time.Sleep(drainPollInterval)
+		}
+		d.close(rh)
+
+		d.mu.Lock()
+		delete(d.draining, he)
+		d.mu.Unlock()
+	}
+}
+
+func (d *drainer) close(rh *retiredHandler) {
+	he := rh.entry
+	msg := fmt.Sprintf("closing %s/%v of resolver %d", he.Name, he.Handler, rh.resolver.id)
+	if err := he.Handler.Close(); err != nil {
+		glog.Warningf("Error "+msg+": %s", err)
+	} else {
+		glog.Info(msg)
+	}
+}
+
+// status returns retired handlers that are not closed yet, sorted by handler name.
+func (d *drainer) status() []retiredStatus {
+	d.mu.Lock()
+	out := make([]retiredStatus, 0, len(d.draining))
+	for he, rh := range d.draining {
+		out = append(out, retiredStatus{
+			Handler:      he.Name,
+			Resolver:     rh.resolver.id,
+			RetiredAt:    rh.retiredAt,
+			ResolverRefs: atomic.LoadInt32(&rh.resolver.refCount),
+			InFlight:     atomic.LoadInt32(&he.inFlight),
+			Forced:       rh.forced,
+		})
+	}
+	d.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Handler < out[j].Handler })
+	return out
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/mixer/pkg/pool"
+)
+
+// chandler signals Close on a channel.
+type chandler struct {
+	closed chan struct{}
+}
+
+func (c *chandler) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func newCHandler() *chandler {
+	return &chandler{closed: make(chan struct{})}
+}
+
+func isClosed(h *chandler) bool {
+	select {
+	case <-h.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDrainer_Idle(t *testing.T) {
+	table := map[string]*HandlerEntry{
+		"h1": {
+			Name:           "h1",
+			Handler:        &fhandler{name: "h1"},
+			closeOnCleanup: true,
+		},
+		"h2": {
+			Name:           "h2",
+			Handler:        &fhandler{name: "h2"},
+			closeOnCleanup: false,
+		},
+		"h3": {
+			Name:           "h3",
+			Handler:        &fhandler{name: "h3", closeError: errors.New("unable to close")},
+			closeOnCleanup: true,
+		},
+		"h4": {
+			Name:               "h4",
+			HandlerCreateError: errors.New("unable to create"),
+			closeOnCleanup:     true,
+		},
+	}
+
+	d := newDrainer(time.Minute)
+	d.retire(table, &resolver{id: 1})
+
+	// handlers without in-flight calls are closed synchronously.
+	for _, he := range table {
+		if he.Handler == nil {
+			continue
+		}
+		hh := he.Handler.(*fhandler)
+		if hh.closed != he.closeOnCleanup {
+			t.Fatalf("%s: closing got %t, want %t", he.Name, hh.closed, he.closeOnCleanup)
+		}
+	}
+	if st := d.status(); len(st) != 0 {
+		t.Fatalf("got %v, want no retired handlers", st)
+	}
+}
+
+func TestDrainer_InFlight(t *testing.T) {
+	dpi := drainPollInterval
+	drainPollInterval = time.Millisecond
+	defer func() { drainPollInterval = dpi }()
+
+	h := newCHandler()
+	he := &HandlerEntry{Name: "h1", Handler: h, closeOnCleanup: true}
+	act := &Action{handlerName: "h1", entry: he}
+	if !act.acquire() {
+		t.Fatalf("call to an active handler was not allowed")
+	}
+
+	d := newDrainer(time.Minute)
+	d.retire(map[string]*HandlerEntry{"h1": he}, &resolver{id: 3})
+
+	if isClosed(h) {
+		t.Fatalf("handler was closed with a call in flight")
+	}
+	if act.acquire() {
+		t.Fatalf("call to a retired handler was allowed")
+	}
+
+	// retired handlers are available on the debug endpoint.
+	gp := pool.NewGoroutinePool(1, true)
+	defer gp.Close()
+	m := newDispatcher(nil, nil, gp, DefaultBreakerConfig())
+	m.controller = &Controller{drainer: d}
+	w := httptest.NewRecorder()
+	DebugHandler(m).ServeHTTP(w, httptest.NewRequest(http.MethodGet, DebugPath+"retired", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var st []retiredStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatalf("unable to unmarshal %s: %v", w.Body.String(), err)
+	}
+	if len(st) != 1 || st[0].Handler != "h1" || st[0].Resolver != 3 || st[0].InFlight != 1 || st[0].Forced {
+		t.Fatalf("got %+v, want h1 of resolver 3 with 1 call in flight", st)
+	}
+
+	act.release()
+	select {
+	case <-h.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("handler was not closed after the call completed")
+	}
+	waitForDrained(t, d)
+}
+
+func TestDrainer_Timeout(t *testing.T) {
+	dpi := drainPollInterval
+	drainPollInterval = time.Millisecond
+	defer func() { drainPollInterval = dpi }()
+
+	h := newCHandler()
+	he := &HandlerEntry{Name: "h1", Handler: h, closeOnCleanup: true}
+	act := &Action{handlerName: "h1", entry: he}
+	act.acquire()
+
+	d := newDrainer(10 * time.Millisecond)
+	d.retire(map[string]*HandlerEntry{"h1": he}, &resolver{id: 1})
+
+	select {
+	case <-h.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("handler was not closed after the drain timeout")
+	}
+	waitForDrained(t, d)
+}
+
+func TestDrainer_ResolverInUse(t *testing.T) {
+	dpi := drainPollInterval
+	drainPollInterval = time.Millisecond
+	defer func() { drainPollInterval = dpi }()
+
+	h1 := newCHandler()
+	h2 := newCHandler()
+	table := map[string]*HandlerEntry{
+		"h1": {Name: "h1", Handler: h1, closeOnCleanup: true},
+		"h2": {Name: "h2", Handler: h2, closeOnCleanup: false},
+	}
+	r := &resolver{id: 2}
+	r.incRefCount()
+	r.incRefCount()
+
+	d := newDrainer(time.Minute)
+	d.retire(table, r)
+
+	// requests of the old resolver may still dispatch to its handlers.
+	act := &Action{handlerName: "h1", entry: table["h1"]}
+	if !act.acquire() {
+		t.Fatalf("call of a request of the old resolver was not allowed")
+	}
+	act.release()
+	if isClosed(h1) {
+		t.Fatalf("handler was closed while the old resolver is in use")
+	}
+	st := d.status()
+	if len(st) != 1 || st[0].Handler != "h1" || st[0].Resolver != 2 || st[0].ResolverRefs != 2 {
+		t.Fatalf("got %+v, want h1 of resolver 2 with 2 requests", st)
+	}
+
+	r.decRefCount()
+	r.decRefCount()
+	select {
+	case <-h1.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("handler was not closed after the old resolver was released")
+	}
+	waitForDrained(t, d)
+	if act.acquire() {
+		t.Fatalf("call to a retired handler was allowed")
+	}
+	if isClosed(h2) {
+		t.Fatalf("handler in use was closed")
+	}
+}
+
+func TestDrainer_ResolverTimeout(t *testing.T) {
+	dpi := drainPollInterval
+	drainPollInterval = time.Millisecond
+	defer func() { drainPollInterval = dpi }()
+
+	h := newCHandler()
+	r := &resolver{id: 1}
+	// force a timeout by not reducing refcount.
+	r.incRefCount()
+
+	d := newDrainer(10 * time.Millisecond)
+	d.retire(map[string]*HandlerEntry{"h1": {Name: "h1", Handler: h, closeOnCleanup: true}}, r)
+
+	select {
+	case <-h.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("handler was not closed after the drain timeout")
+	}
+	waitForDrained(t, d)
+}
+
+func waitForDrained(t *testing.T, d *drainer) {
+	deadline := time.Now().Add(time.Second)
+	for len(d.status()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v, want no retired handlers", d.status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcher_RetiredHandler(t *testing.T) {
+	gp := pool.NewGoroutinePool(1, true)
+	defer gp.Close()
+
+	fp := &fakeProc{}
+	rt := newFakeResolver("metric1", nil, false, fp)
+	m := newDispatcher(nil, rt, gp, DefaultBreakerConfig())
+	for _, a := range rt.ra {
+		a.entry = &HandlerEntry{Name: a.handlerName, retired: 1}
+	}
+
+	err := m.Report(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "handler retired") {
+		t.Fatalf("got %v, want handler retired", err)
+	}
+	if fp.called != 0 {
+		t.Fatalf("got %d calls, want 0", fp.called)
+	}
+
+	// fail open handlers succeed once retired.
+	for _, a := range rt.ra {
+		a.failOpen = true
+	}
+	if err = m.Report(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -98,28 +98,9 @@ func (h *handlerFactory) Build(handler *pb.Handler, instances []*pb.Instance, en
 		return nil, err
 	}
 
-	// HandlerBuilder should always be present for a valid configuration (reference integrity should already be checked).
-	info, _ := h.builderInfoFinder(handler.Adapter)
-
-	bldr := info.NewBuilder()
-
-	if bldr == nil {
-		msg := fmt.Sprintf("nil HandlerBuilder instantiated for adapter '%s' in handler config '%s'", handler.Adapter, handler.Name)
-		glog.Warning(msg)
-		return nil, errors.New(msg)
-	}
-
-	// validate if the builder supports all the necessary interfaces
-	for _, tmplName := range info.SupportedTemplates {
-		// ti should be there for a valid configuration.
-		ti, _ := h.tmplRepo.GetTemplateInfo(tmplName)
-		if supports := ti.BuilderSupportsTemplate(bldr); !supports {
-			// adapter's builder is bad since it does not support the necessary interface
-			msg := fmt.Sprintf("adapter is invalid because it does not implement interface '%s'. "+
-				"Therefore, it cannot support template '%s'", ti.BldrInterfaceName, tmplName)
-			glog.Error(msg)
-			return nil, fmt.Errorf(msg)
-		}
+	info, bldr, err := h.newBuilder(handler)
+	if err != nil {
+		return nil, err
 	}
 
 	var hndlr adapter.Handler
@@ -145,20 +126,81 @@ func (h *handlerFactory) Build(handler *pb.Handler, instances []*pb.Instance, en
 	return hndlr, err
 }
 
+// Validate runs the checks of Build up to the validation of the adapter config by the
+// HandlerBuilder, without instantiating the Handler.
+func (h *handlerFactory) Validate(handler *pb.Handler, instances []*pb.Instance) error {
+	infrdTypsByTmpl, err := h.inferTypesGrpdByTmpl(instances)
+	if err != nil {
+		return err
+	}
+
+	_, bldr, err := h.newBuilder(handler)
+	if err != nil {
+		return err
+	}
+
+	if err = h.configure(bldr, infrdTypsByTmpl, handler.Params); err != nil {
+		return fmt.Errorf("cannot configure adapter '%s' in handler config '%s': %v", handler.Adapter, handler.Name, err)
+	}
+	return nil
+}
+
+// newBuilder instantiates the HandlerBuilder of the handler and verifies that it supports
+// the templates of the adapter.
+func (h *handlerFactory) newBuilder(handler *pb.Handler) (*adapter.Info, adapter.HandlerBuilder, error) {
+	// HandlerBuilder should always be present for a valid configuration (reference integrity should already be checked).
+	info, _ := h.builderInfoFinder(handler.Adapter)
+
+	bldr := info.NewBuilder()
+
+	if bldr == nil {
+		msg := fmt.Sprintf("nil HandlerBuilder instantiated for adapter '%s' in handler config '%s'", handler.Adapter, handler.Name)
+		glog.Warning(msg)
+		return nil, nil, errors.New(msg)
+	}
+
+	// validate if the builder supports all the necessary interfaces
+	for _, tmplName := range info.SupportedTemplates {
+		// ti should be there for a valid configuration.
+		ti, _ := h.tmplRepo.GetTemplateInfo(tmplName)
+		if supports := ti.BuilderSupportsTemplate(bldr); !supports {
+			// adapter's builder is bad since it does not support the necessary interface
+			msg := fmt.Sprintf("adapter is invalid because it does not implement interface '%s'. "+
+				"Therefore, it cannot support template '%s'", ti.BldrInterfaceName, tmplName)
+			glog.Error(msg)
+			return nil, nil, fmt.Errorf(msg)
+		}
+	}
+	return info, bldr, nil
+}
+
 func (h *handlerFactory) build(bldr adapter.HandlerBuilder, infrdTypesByTmpl map[string]typeMap,
 	adapterCnfg interface{}, env adapter.Env) (hndlr adapter.Handler, err error) {
-	var ti template.Info
-	var typs typeMap
+	if err = h.configure(bldr, infrdTypesByTmpl, adapterCnfg); err != nil {
+		return nil, err
+	}
 
 	// calls into handler can panic. If that happens, we will log and return error with nil handler
 	defer func() {
 		if r := recover(); r != nil {
-			msg := fmt.Sprintf("handler panicked with '%v' when trying to configure the associated adapter."+
-				" Please remove the handler or fix the configuration. %v\nti=%v\ntype=%v", r, adapterCnfg, ti, typs)
-			glog.Error(msg)
 			hndlr = nil
-			err = errors.New(msg)
-			return
+			err = handlerPanicError(r, adapterCnfg, template.Info{}, nil)
+		}
+	}()
+
+	return bldr.Build(context.Background(), env)
+}
+
+// configure sets the inferred types and the adapter config on the builder, and validates them.
+func (h *handlerFactory) configure(bldr adapter.HandlerBuilder, infrdTypesByTmpl map[string]typeMap,
+	adapterCnfg interface{}) (err error) {
+	var ti template.Info
+	var typs typeMap
+
+	// calls into handler can panic. If that happens, we will log and return error.
+	defer func() {
+		if r := recover(); r != nil {
+			err = handlerPanicError(r, adapterCnfg, ti, typs)
 		}
 	}()
 
@@ -173,12 +215,17 @@ func (h *handlerFactory) build(bldr adapter.HandlerBuilder, infrdTypesByTmpl map
 	if ce := bldr.Validate(); ce != nil {
 		msg := fmt.Sprintf("handler validation failed: %s", ce.Error())
 		glog.Error(msg)
-		hndlr = nil
-		err = errors.New(msg)
-		return
+		return errors.New(msg)
 	}
+	return nil
+}
 
-	return bldr.Build(context.Background(), env)
+// handlerPanicError logs and returns the error of a handler that panicked.
+func handlerPanicError(r interface{}, adapterCnfg interface{}, ti template.Info, typs typeMap) error {
+	msg := fmt.Sprintf("handler panicked with '%v' when trying to configure the associated adapter."+
+		" Please remove the handler or fix the configuration. %v\nti=%v\ntype=%v", r, adapterCnfg, ti, typs)
+	glog.Error(msg)
+	return errors.New(msg)
 }
 
 func (h *handlerFactory) inferTypesGrpdByTmpl(instances []*pb.Instance) (map[string]typeMap, error) {
@@ -41,8 +41,20 @@ type handlerTable struct {
 
 	// table that maintains handler state
 	table map[string]*HandlerEntry
+
+	// instanceType optionally returns the inferred type of an instance.
+	// If set, the inferred types are part of the handler sha so that
+	// handlers are rebuilt when the types of their instances change.
+	instanceType instanceTypeFn
+
+	// rebuilt and reused count handlers created and carried over by Initialize.
+	rebuilt int
+	reused  int
 }
 
+// instanceTypeFn returns the inferred type of an instance.
+type instanceTypeFn func(*cpb.Instance) (proto.Message, error)
+
 // buildHandlerFn creates a handler given the handler config and the config of
 // all instances associated with it.
 type buildHandlerFn func(*cpb.Handler, []*cpb.Instance) (adapter.Handler, error)
@@ -67,6 +79,12 @@ type HandlerEntry struct {
 	// closeOnCleanup is set to indicate that the handler should be closed during cleanup.
 	// If handler configuration changes or if a handler is removed, this flag is set.
 	closeOnCleanup bool
+
+	// inFlight is the number of calls currently dispatched to the handler.
+	inFlight int32
+
+	// retired is set when the handler no longer accepts calls.
+	retired int32
 }
 
 func newHandlerTable(instanceConfig map[string]*cpb.Instance, handlerConfig map[string]*cpb.Handler,
@@ -97,9 +115,13 @@ func (t *handlerTable) Associate(handleName string, instanceName string) {
 // initialized all adapters.
 // If handler config and associated instance config does not change,
 // connections from the old handler table are re-used.
+// changed holds the fully qualified names of handlers and instances that changed
+// since the old handler table was built. Entries that do not refer to a changed
+// key are carried over without recomputing their sha.
+// If changed is nil, every entry is compared with the old table by sha.
 // This method does not return an error, it records errors in the handlerEntry.
-func (t *handlerTable) Initialize(oldTable map[string]*HandlerEntry) {
-	t.computeSha()
+func (t *handlerTable) Initialize(oldTable map[string]*HandlerEntry, changed map[string]bool) {
+	t.computeSha(oldTable, changed)
 	// run diff with the old handlerTable
 	for oh, ohe := range oldTable {
 		he := t.table[oh]
@@ -128,14 +150,33 @@ func (t *handlerTable) Initialize(oldTable map[string]*HandlerEntry) {
 	for _, he := range t.table {
 		// this was already initialized.
 		if he.Handler != nil {
+			t.reused++
 			continue
 		}
 		// create a new handler
 		// handler error is marked inside the entry.
 		t.initHandler(he)
+		t.rebuilt++
 	}
 }
 
+// unchanged returns true if the entry and the old entry refer to the same
+// set of instances and none of them, nor the handler, is in changed.
+func unchanged(he *HandlerEntry, ohe *HandlerEntry, changed map[string]bool) bool {
+	if changed == nil || ohe == nil || ohe.Handler == nil {
+		return false
+	}
+	if changed[he.Name] || len(he.Instances) != len(ohe.Instances) {
+		return false
+	}
+	for iname := range he.Instances {
+		if !ohe.Instances[iname] || changed[iname] {
+			return false
+		}
+	}
+	return true
+}
+
 // initialize handler, mark the handler as bad
 func (t *handlerTable) initHandler(he *HandlerEntry) {
 	hc := t.handlerConfig[he.Name]
@@ -170,10 +211,15 @@ func encode(w io.Writer, v interface{}) {
 	}
 }
 
-// computeSha for individual handler entries
-func (t *handlerTable) computeSha() {
+// computeSha for individual handler entries.
+// Entries that are unchanged since the old table inherit the old sha.
+func (t *handlerTable) computeSha(oldTable map[string]*HandlerEntry, changed map[string]bool) {
 	buf := new(bytes.Buffer)
 	for _, nh := range t.table {
+		if ohe := oldTable[nh.Name]; unchanged(nh, ohe, changed) {
+			nh.sha = ohe.sha
+			continue
+		}
 		h := t.handlerConfig[nh.Name]
 		encode(buf, h.Adapter)
 		encode(buf, h.Params)
@@ -189,8 +235,23 @@ func (t *handlerTable) computeSha() {
 			inst := t.instanceConfig[iname]
 			encode(buf, inst.Template)
 			encode(buf, inst.Params)
+			if t.instanceType != nil {
+				t.encodeType(buf, inst)
+			}
 		}
 		nh.sha = sha1.Sum(buf.Bytes())
 		buf.Reset()
 	}
 }
+
+// encodeType encodes the inferred type of an instance.
+// A type inference error is encoded instead of the type so that
+// the handler is rebuilt and the error is reported by the handler factory.
+func (t *handlerTable) encodeType(w io.Writer, inst *cpb.Instance) {
+	typ, err := t.instanceType(inst)
+	if err != nil {
+		encode(w, err.Error())
+		return
+	}
+	encode(w, typ)
+}
@@ -319,3 +319,62 @@ func TestBuild_Valid(t *testing.T) {
 		})
 	}
 }
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		tmplRepo     fakeTmplRepo
+		hndlrBuilder adapter.HandlerBuilder
+		wantError    string
+	}{
+		{
+			name:         "Valid",
+			tmplRepo:     fakeTmplRepo{typeResult: &wrappers.Int32Value{Value: 1}},
+			hndlrBuilder: &fakeHndlrBldr{bldPanic: "handlers are not built"},
+		},
+		{
+			name:         "ErrorBuilderValidate",
+			tmplRepo:     fakeTmplRepo{},
+			hndlrBuilder: &fakeHndlrBldr{validateErr: "Adapter's builder says I don't like the config"},
+			wantError:    "cannot configure adapter 'a1' in handler config 'h1': handler validation failed",
+		},
+		{
+			name:         "ErrorTypeInferError",
+			tmplRepo:     fakeTmplRepo{infrErr: fmt.Errorf("FOOBAR ERROR")},
+			hndlrBuilder: &fakeHndlrBldr{},
+			wantError:    "cannot infer type information from params in instance 'inst1': FOOBAR ERROR",
+		},
+		{
+			name:         "PanicConfigure",
+			tmplRepo:     fakeTmplRepo{cnfgrPanic: "FOOBAR PANIC"},
+			hndlrBuilder: &fakeHndlrBldr{},
+			wantError:    "handler panicked with 'FOOBAR PANIC'",
+		},
+		{
+			name:         "BuilderNotImplInterface",
+			tmplRepo:     fakeTmplRepo{bldrDoesNotImplTemplate: true},
+			hndlrBuilder: &fakeHndlrBldr{},
+			wantError:    "cannot support template 'fakeTmpl'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bldrInfoFinder := func(name string) (*adapter.Info, bool) {
+				return &adapter.Info{NewBuilder: func() adapter.HandlerBuilder { return tt.hndlrBuilder }, SupportedTemplates: []string{"fakeTmpl"}}, true
+			}
+
+			hf := NewHandlerFactory(tt.tmplRepo, nil, nil, bldrInfoFinder).(*handlerFactory)
+			err := hf.Validate(&pb.Handler{Name: "h1", Adapter: "a1", Params: &empty.Empty{}},
+				[]*pb.Instance{{"inst1", "tpml1", &empty.Empty{}}})
+			if tt.wantError == "" {
+				if err != nil {
+					t.Errorf("got error %v\nwant <nil>", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("got error %v\nwant %v", err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/glog"
+
+	"istio.io/mixer/pkg/config/store"
+)
+
+// DefaultSnapshotHistory is the default number of published snapshots retained by the controller.
+const DefaultSnapshotHistory = 10
+
+// configSnapshot is the config state of a published snapshot.
+type configSnapshot struct {
+	id          int
+	published   time.Time
+	rollbackOf  int
+	configState map[store.Key]*store.Resource
+}
+
+// snapshotHistory retains the config state of the last published snapshots.
+// All methods are safe to call on a nil snapshotHistory, which retains nothing.
+type snapshotHistory struct {
+	mu        sync.RWMutex
+	max       int
+	snapshots []*configSnapshot // ordered by id.
+}
+
+// SnapshotInfo describes a retained snapshot.
+type SnapshotInfo struct {
+	ID        int       `json:"id"`
+	Published time.Time `json:"published"`
+	Resources int       `json:"resources"`
+	// RollbackOf is the ID of the snapshot whose config state was published again.
+	RollbackOf int `json:"rollbackOf,omitempty"`
+}
+
+// SnapshotHistory lists the retained snapshots.
+type SnapshotHistory struct {
+	// Pinned is the ID of the snapshot the resolver is pinned to, 0 if it follows the store.
+	Pinned    int             `json:"pinned,omitempty"`
+	Snapshots []*SnapshotInfo `json:"snapshots"`
+}
+
+// newSnapshotHistory returns a history which retains max snapshots.
+// It returns nil if max is not positive.
+func newSnapshotHistory(max int) *snapshotHistory {
+	if max <= 0 {
+		return nil
+	}
+	return &snapshotHistory{max: max}
+}
+
+// add retains a copy of the config state of a published snapshot, and drops the oldest one if needed.
+func (h *snapshotHistory) add(id int, rollbackOf int, configState map[store.Key]*store.Resource) {
+	if h == nil {
+		return
+	}
+	s := &configSnapshot{
+		id:          id,
+		published:   time.Now(),
+		rollbackOf:  rollbackOf,
+		configState: copyConfigState(configState),
+	}
+	h.mu.Lock()
+	h.snapshots = append(h.snapshots, s)
+	if len(h.snapshots) > h.max {
+		h.snapshots = h.snapshots[len(h.snapshots)-h.max:]
+	}
+	h.mu.Unlock()
+}
+
+// get returns the snapshot of the id, or nil if it is not retained.
+func (h *snapshotHistory) get(id int) *configSnapshot {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, s := range h.snapshots {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// list describes the retained snapshots.
+func (h *snapshotHistory) list() []*SnapshotInfo {
+	result := []*SnapshotInfo{}
+	if h == nil {
+		return result
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, s := range h.snapshots {
+		result = append(result, &SnapshotInfo{
+			ID:         s.id,
+			Published:  s.published,
+			Resources:  len(s.configState),
+			RollbackOf: s.rollbackOf,
+		})
+	}
+	return result
+}
+
+// copyConfigState returns a shallow copy of the config state.
+// Resources are replaced, not modified, by config changes.
+func copyConfigState(configState map[store.Key]*store.Resource) map[store.Key]*store.Resource {
+	result := make(map[store.Key]*store.Resource, len(configState))
+	for k, r := range configState {
+		result[k] = r
+	}
+	return result
+}
+
+// SnapshotDiff is the difference of the config state of two snapshots.
+type SnapshotDiff struct {
+	From    int             `json:"from"`
+	To      int             `json:"to"`
+	Added   []*ResourceDiff `json:"added"`
+	Removed []*ResourceDiff `json:"removed"`
+	Changed []*ResourceDiff `json:"changed"`
+}
+
+// ResourceDiff is a resource that differs between two snapshots.
+type ResourceDiff struct {
+	Kind      string          `json:"kind"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Before    *ResourceRecord `json:"before,omitempty"`
+	After     *ResourceRecord `json:"after,omitempty"`
+}
+
+// ResourceRecord is the labels, annotations and spec of a resource in a diff.
+type ResourceRecord struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Spec        json.RawMessage   `json:"spec,omitempty"`
+}
+
+// diffSnapshots returns the difference of the config state of the snapshots from and to.
+func diffSnapshots(from *configSnapshot, to *configSnapshot) *SnapshotDiff {
+	d := &SnapshotDiff{
+		From:    from.id,
+		To:      to.id,
+		Added:   []*ResourceDiff{},
+		Removed: []*ResourceDiff{},
+		Changed: []*ResourceDiff{},
+	}
+	for k, before := range from.configState {
+		after, ok := to.configState[k]
+		switch {
+		case !ok:
+			d.Removed = append(d.Removed, &ResourceDiff{Kind: k.Kind, Namespace: k.Namespace, Name: k.Name,
+				Before: newResourceRecord(k, before)})
+		case !sameResource(before, after):
+			d.Changed = append(d.Changed, &ResourceDiff{Kind: k.Kind, Namespace: k.Namespace, Name: k.Name,
+				Before: newResourceRecord(k, before), After: newResourceRecord(k, after)})
+		}
+	}
+	for k, after := range to.configState {
+		if _, ok := from.configState[k]; !ok {
+			d.Added = append(d.Added, &ResourceDiff{Kind: k.Kind, Namespace: k.Namespace, Name: k.Name,
+				After: newResourceRecord(k, after)})
+		}
+	}
+	for _, l := range [][]*ResourceDiff{d.Added, d.Removed, d.Changed} {
+		sortResourceDiffs(l)
+	}
+	return d
+}
+
+// sameResource returns true if the resources have the same labels, annotations and spec.
+// The revision is ignored.
+func sameResource(a *store.Resource, b *store.Resource) bool {
+	if a == b {
+		return true
+	}
+	return reflect.DeepEqual(a.Metadata.Labels, b.Metadata.Labels) &&
+		reflect.DeepEqual(a.Metadata.Annotations, b.Metadata.Annotations) &&
+		proto.Equal(a.Spec, b.Spec)
+}
+
+func newResourceRecord(k store.Key, r *store.Resource) *ResourceRecord {
+	rec := &ResourceRecord{
+		Labels:      r.Metadata.Labels,
+		Annotations: r.Metadata.Annotations,
+	}
+	if r.Spec == nil {
+		return rec
+	}
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, r.Spec); err != nil {
+		glog.Warningf("Unable to marshal the spec of %s: %v", k, err)
+		rec.Spec = json.RawMessage(fmt.Sprintf("%q", r.Spec.String()))
+		return rec
+	}
+	rec.Spec = buf.Bytes()
+	return rec
+}
+
+func sortResourceDiffs(l []*ResourceDiff) {
+	sort.Slice(l, func(i, j int) bool {
+		a, b := l[i], l[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+}
@@ -0,0 +1,220 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/mixer/pkg/adapter"
+	cpb "istio.io/mixer/pkg/config/proto"
+	"istio.io/mixer/pkg/config/store"
+	"istio.io/mixer/pkg/expr"
+	"istio.io/mixer/pkg/pool"
+	"istio.io/mixer/pkg/template"
+)
+
+func TestSnapshotHistory(t *testing.T) {
+	var h *snapshotHistory
+	if h = newSnapshotHistory(0); h != nil {
+		t.Fatalf("got %v, want nil", h)
+	}
+	h.add(1, 0, nil)
+	if s := h.get(1); s != nil || len(h.list()) != 0 {
+		t.Fatalf("got %v %v, want nothing retained", s, h.list())
+	}
+
+	h = newSnapshotHistory(2)
+	k := store.Key{Kind: "AA", Namespace: "ns", Name: "a1"}
+	state := map[store.Key]*store.Resource{k: {Spec: &wrappers.StringValue{Value: "1"}}}
+	h.add(1, 0, state)
+	state[k] = &store.Resource{Spec: &wrappers.StringValue{Value: "2"}}
+	h.add(2, 0, state)
+	h.add(3, 1, state)
+
+	if h.get(1) != nil {
+		t.Errorf("snapshot 1 is retained, want it dropped")
+	}
+	if s := h.get(2); s == nil || s.configState[k].Spec.(*wrappers.StringValue).Value != "2" {
+		t.Errorf("got %v, want snapshot 2", s)
+	}
+	l := h.list()
+	if len(l) != 2 || l[0].ID != 2 || l[1].ID != 3 || l[1].RollbackOf != 1 || l[1].Resources != 1 {
+		t.Errorf("got %v, want snapshots 2 and 3", l)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	ns := DefaultConfigNamespace
+	same := &store.Resource{Spec: &wrappers.StringValue{Value: "same"}}
+	from := &configSnapshot{id: 1, configState: map[store.Key]*store.Resource{
+		{"AA", ns, "same"}:    same,
+		{"AA", ns, "revised"}: {Metadata: store.ResourceMeta{Revision: "1"}, Spec: &wrappers.StringValue{Value: "v"}},
+		{"AA", ns, "changed"}: {Spec: &wrappers.StringValue{Value: "before"}},
+		{"AA", ns, "labeled"}: {Spec: &wrappers.StringValue{Value: "v"}},
+		{"AA", ns, "removed"}: {Spec: &wrappers.StringValue{Value: "v"}},
+	}}
+	to := &configSnapshot{id: 2, configState: map[store.Key]*store.Resource{
+		{"AA", ns, "same"}:    same,
+		{"AA", ns, "revised"}: {Metadata: store.ResourceMeta{Revision: "2"}, Spec: &wrappers.StringValue{Value: "v"}},
+		{"AA", ns, "changed"}: {Spec: &wrappers.StringValue{Value: "after"}},
+		{"AA", ns, "labeled"}: {Metadata: store.ResourceMeta{Labels: map[string]string{"a": "b"}}, Spec: &wrappers.StringValue{Value: "v"}},
+		{"AA", ns, "added"}:   {Spec: &wrappers.StringValue{Value: "v"}},
+	}}
+	d := diffSnapshots(from, to)
+	names := func(l []*ResourceDiff) []string {
+		result := []string{}
+		for _, rd := range l {
+			result = append(result, rd.Name)
+		}
+		return result
+	}
+	if d.From != 1 || d.To != 2 {
+		t.Errorf("got %d..%d, want 1..2", d.From, d.To)
+	}
+	if got := names(d.Added); !reflect.DeepEqual(got, []string{"added"}) {
+		t.Errorf("added: got %v", got)
+	}
+	if got := names(d.Removed); !reflect.DeepEqual(got, []string{"removed"}) {
+		t.Errorf("removed: got %v", got)
+	}
+	if got := names(d.Changed); !reflect.DeepEqual(got, []string{"changed", "labeled"}) {
+		t.Errorf("changed: got %v", got)
+	}
+	if c := d.Changed[0]; !strings.Contains(string(c.Before.Spec), "before") || !strings.Contains(string(c.After.Spec), "after") {
+		t.Errorf("got %s..%s, want the specs", c.Before.Spec, c.After.Spec)
+	}
+	if _, err := json.Marshal(d); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestController_Rollback(t *testing.T) {
+	ns := DefaultConfigNamespace
+	a1 := store.Key{Kind: "AA", Namespace: ns, Name: "a1"}
+	configState := map[store.Key]*store.Resource{
+		{RulesKind, ns, "r1"}: {Spec: &cpb.Rule{
+			Actions: []*cpb.Action{{Handler: "a1.AA", Instances: []string{"m1.metric"}}},
+		}},
+		{"metric", ns, "m1"}: {Spec: &wrappers.StringValue{Value: "metric1_config"}},
+		a1:                   {Spec: &wrappers.StringValue{Value: "good"}},
+	}
+	fb := &fhtbuilder{
+		built:    make(map[string]int),
+		handlers: make(map[string]*fhandler),
+	}
+	c := &Controller{
+		adapterInfo:            map[string]*adapter.Info{"AA": {Name: "AA"}},
+		templateInfo:           map[string]template.Info{"metric": {Name: "metric"}},
+		configState:            configState,
+		dispatcher:             &fakedispatcher{},
+		resolver:               &resolver{},
+		identityAttribute:      DefaultIdentityAttribute,
+		defaultConfigNamespace: ns,
+		history:                newSnapshotHistory(DefaultSnapshotHistory),
+		createHandlerFactory: func(templateInfo map[string]template.Info, expr expr.TypeChecker,
+			df expr.AttributeDescriptorFinder, builderInfo map[string]*adapter.Info) HandlerFactory {
+			return fb
+		},
+	}
+	c.publishSnapShot()
+	good := c.resolver.id
+	c.applyEvents([]*store.Event{{Key: a1, Value: &store.Resource{Spec: &wrappers.StringValue{Value: "bad"}}}})
+	bad := c.resolver.id
+
+	if err := c.Rollback(bad + 1); err == nil {
+		t.Errorf("rollback to an unknown snapshot: got nil, want error")
+	}
+	if err := c.Rollback(good); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if c.resolver.id != bad+1 || c.configState[a1].Spec.(*wrappers.StringValue).Value != "good" {
+		t.Fatalf("got snapshot %d with %v, want %d with the good handler", c.resolver.id, c.configState[a1], bad+1)
+	}
+	h := c.History()
+	if h.Pinned != good || len(h.Snapshots) != 3 || h.Snapshots[2].RollbackOf != good {
+		t.Errorf("got %+v, want pinned to %d", h, good)
+	}
+	if d, err := c.Diff(bad, c.resolver.id); err != nil || len(d.Changed) != 1 || d.Changed[0].Name != "a1" {
+		t.Errorf("got %+v %v, want a1 changed", d, err)
+	}
+
+	// changes of the store are not published while pinned.
+	c.applyEvents([]*store.Event{{Key: a1, Value: &store.Resource{Spec: &wrappers.StringValue{Value: "fixed"}}}})
+	if c.resolver.id != bad+1 || c.configState[a1].Spec.(*wrappers.StringValue).Value != "good" {
+		t.Fatalf("got snapshot %d with %v, want %d with the good handler", c.resolver.id, c.configState[a1], bad+1)
+	}
+
+	if err := c.Unpin(); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if c.resolver.id != bad+2 || c.configState[a1].Spec.(*wrappers.StringValue).Value != "fixed" {
+		t.Fatalf("got snapshot %d with %v, want %d with the fixed handler", c.resolver.id, c.configState[a1], bad+2)
+	}
+	if err := c.Unpin(); err == nil {
+		t.Errorf("unpin twice: got nil, want error")
+	}
+	if h = c.History(); h.Pinned != 0 {
+		t.Errorf("got pinned %d, want 0", h.Pinned)
+	}
+
+	// snapshots are served and changed through the admin endpoint only.
+	gp := pool.NewGoroutinePool(1, true)
+	defer gp.Close()
+	d := newDispatcher(nil, nil, gp, DefaultBreakerConfig())
+	d.controller = c
+	dh := DebugHandler(d)
+	ah := AdminHandler(d)
+	for _, tc := range []struct {
+		handler http.Handler
+		method  string
+		path    string
+		want    int
+	}{
+		{ah, http.MethodGet, AdminPath + "snapshots", http.StatusOK},
+		{ah, http.MethodGet, AdminPath + "snapshots/diff?from=1", http.StatusOK},
+		{ah, http.MethodGet, AdminPath + "snapshots/diff?from=1&to=2", http.StatusOK},
+		{ah, http.MethodGet, AdminPath + "snapshots/diff?from=x", http.StatusBadRequest},
+		{ah, http.MethodGet, AdminPath + "snapshots/diff?from=1&to=100", http.StatusNotFound},
+		// the debug information does not include the snapshots, which hold handler params.
+		{dh, http.MethodGet, DebugPath + "snapshots", http.StatusNotFound},
+		{dh, http.MethodGet, DebugPath + "snapshots/diff?from=1", http.StatusNotFound},
+		{dh, http.MethodPost, DebugPath + "snapshots/rollback?id=1", http.StatusNotFound},
+		{dh, http.MethodPost, DebugPath + "snapshots/unpin", http.StatusNotFound},
+		{ah, http.MethodGet, AdminPath + "snapshots/rollback?id=1", http.StatusMethodNotAllowed},
+		{ah, http.MethodPost, AdminPath + "snapshots/rollback?id=100", http.StatusNotFound},
+		{ah, http.MethodPost, AdminPath + "snapshots/unpin", http.StatusConflict},
+		{ah, http.MethodPost, AdminPath + "snapshots/rollback?id=1", http.StatusOK},
+		{ah, http.MethodPost, AdminPath + "snapshots/unpin", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		tc.handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.want {
+			t.Errorf("%s %s: got status %d, want %d: %s", tc.method, tc.path, w.Code, tc.want, w.Body.String())
+		}
+	}
+}
+
+func TestAdminHandler_NotDispatcher(t *testing.T) {
+	if ah := AdminHandler(nil); ah != nil {
+		t.Fatalf("got %v, want nil", ah)
+	}
+}
@@ -16,6 +16,7 @@ package runtime
 
 import (
 	"context"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/glog"
@@ -34,14 +35,27 @@ import (
 // New creates a new runtime Dispatcher
 // Create a new controller and a dispatcher.
 // Returns a ready to use dispatcher.
+// namespaceExpression derives the configuration namespace from request attributes.
+// If it is empty, the namespace is derived from the identityAttribute.
+// handlerDrainTimeout is the time retired handlers are given to complete in-flight calls.
+// maxTargetLabelValues bounds the number of distinct target label values of resolve metrics,
+// 0 does not bound them.
+// snapshotHistory is the number of published snapshots retained for diffs and rollbacks.
+// breakers configures the circuit breakers of handlers.
 func New(eval expr.Evaluator, gp *pool.GoroutinePool, handlerPool *pool.GoroutinePool,
-	identityAttribute string, defaultConfigNamespace string,
-	s store.Store2, adapterInfo map[string]*adapter.Info,
+	identityAttribute string, namespaceExpression string, defaultConfigNamespace string,
+	handlerDrainTimeout time.Duration, maxTargetLabelValues int, snapshotHistory int,
+	breakers BreakerConfig, s store.Store2, adapterInfo map[string]*adapter.Info,
 	templateInfo map[string]template.Info) (Dispatcher, error) {
+	if err := validateNamespaceExpression(namespaceExpression); err != nil {
+		return nil, err
+	}
 	// controller will set Resolver before the dispatcher is used.
-	d := newDispatcher(eval, nil, gp)
-	err := startController(s, adapterInfo, templateInfo, eval, d,
-		identityAttribute, defaultConfigNamespace, handlerPool)
+	d := newDispatcher(eval, nil, gp, breakers)
+	c, err := startController(s, adapterInfo, templateInfo, eval, d,
+		identityAttribute, namespaceExpression, defaultConfigNamespace, handlerDrainTimeout,
+		maxTargetLabelValues, snapshotHistory, handlerPool)
+	d.controller = c
 
 	return d, err
 }
@@ -85,14 +99,17 @@ func kindMap(adapterInfo map[string]*adapter.Info,
 }
 
 // startController creates a controller from the given params.
+// The controller writes resource status to s if s implements store.StatusWriter.
 func startController(s store.Store2, adapterInfo map[string]*adapter.Info,
 	templateInfo map[string]template.Info, eval expr.Evaluator,
 	dispatcher ResolverChangeListener,
-	identityAttribute string, defaultConfigNamespace string, handlerPool *pool.GoroutinePool) error {
+	identityAttribute string, namespaceExpression string, defaultConfigNamespace string,
+	handlerDrainTimeout time.Duration, maxTargetLabelValues int, snapshotHistory int,
+	handlerPool *pool.GoroutinePool) (*Controller, error) {
 
 	data, watchChan, err := startWatch(s, adapterInfo, templateInfo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	c := &Controller{
@@ -103,14 +120,22 @@ func startController(s store.Store2, adapterInfo map[string]*adapter.Info,
 		dispatcher:             dispatcher,
 		resolver:               &resolver{}, // get an empty resolver
 		identityAttribute:      identityAttribute,
+		namespaceExpression:    namespaceExpression,
 		defaultConfigNamespace: defaultConfigNamespace,
 		handlerGoRoutinePool:   handlerPool,
 		table:                  make(map[string]*HandlerEntry),
 		createHandlerFactory:   newHandlerFactory,
+		drainer:                newDrainer(handlerDrainTimeout),
+		targets:                newLabelLimiter(maxTargetLabelValues),
+		history:                newSnapshotHistory(snapshotHistory),
+	}
+	if sw, ok := s.(store.StatusWriter); ok {
+		c.statusUpdater = newStatusUpdater(sw, statusWriteInterval)
+		c.statusUpdater.start()
 	}
 
 	c.publishSnapShot()
 	glog.Infof("Config controller has started with %d config elements", len(c.configState))
 	go watchChanges(watchChan, c.applyEvents)
-	return nil
+	return c, nil
 }
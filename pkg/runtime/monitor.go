@@ -15,6 +15,8 @@ package runtime
 // limitations under the License.
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -26,10 +28,18 @@ const (
 	responseMsg  = "response_message"
 	errorStr     = "error"
 	targetStr    = "target"
+	scopeStr     = "scope"
+	ruleStr      = "rule"
+	instanceStr  = "instance"
+	matchedStr   = "matched"
+	shadowStr    = "shadow"
+	outcomeStr   = "outcome"
+	rebuiltStr   = "rebuilt"
+	reusedStr    = "reused"
 )
 
 var (
-	promLabelNames  = []string{meshFunction, handlerName, adapterName, responseCode, errorStr}
+	promLabelNames  = []string{meshFunction, handlerName, adapterName, ruleStr, responseCode, errorStr}
 	buckets         = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
 	dispatchCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -48,7 +58,23 @@ var (
 			Buckets:   buckets,
 		}, promLabelNames)
 
-	resolveLabelNames = []string{targetStr, errorStr}
+	instanceDispatchCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "adapter",
+			Name:      "instance_dispatch_count",
+			Help:      "Total number of instances dispatched to adapters by rule.",
+		}, []string{ruleStr, instanceStr, handlerName, errorStr})
+
+	ruleEvalCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "config",
+			Name:      "rule_evaluation_count",
+			Help:      "Total number of rule match evaluations by outcome.",
+		}, []string{ruleStr, matchedStr})
+
+	resolveLabelNames = []string{targetStr, scopeStr, errorStr}
 	resolveCounter    = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "mixer",
@@ -66,6 +92,48 @@ var (
 			Buckets:   buckets,
 		}, resolveLabelNames)
 
+	handlerBuildCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "config",
+			Name:      "handler_build_count",
+			Help:      "Total number of handlers rebuilt or reused across config changes.",
+		}, []string{outcomeStr})
+
+	handlerLeakCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "config",
+			Name:      "handler_drain_timeout_count",
+			Help:      "Total number of retired handlers closed with calls still in flight.",
+		}, []string{handlerName})
+
+	shadowLabelNames = []string{ruleStr, handlerName, responseCode}
+	shadowCounter    = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "adapter",
+			Name:      "shadow_dispatch_count",
+			Help:      "Total number of shadow rule dispatches by the outcome they would have had.",
+		}, shadowLabelNames)
+
+	breakerLabelNames = []string{handlerName}
+	breakerStateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "mixer",
+			Subsystem: "adapter",
+			Name:      "circuit_state",
+			Help:      "State of the handler circuit breaker: 0 closed, 1 open, 2 half-open.",
+		}, breakerLabelNames)
+
+	breakerRejectCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mixer",
+			Subsystem: "adapter",
+			Name:      "circuit_rejected_count",
+			Help:      "Total number of adapter dispatches short-circuited by an open circuit breaker.",
+		}, breakerLabelNames)
+
 	countBuckets = []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 10, 15, 20}
 	resolveRules = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -89,9 +157,54 @@ var (
 func init() {
 	prometheus.MustRegister(dispatchCounter)
 	prometheus.MustRegister(dispatchDuration)
+	prometheus.MustRegister(instanceDispatchCounter)
+	prometheus.MustRegister(shadowCounter)
+	prometheus.MustRegister(breakerStateGauge)
+	prometheus.MustRegister(breakerRejectCounter)
 
 	prometheus.MustRegister(resolveCounter)
+	prometheus.MustRegister(ruleEvalCounter)
+	prometheus.MustRegister(handlerBuildCounter)
+	prometheus.MustRegister(handlerLeakCounter)
 	prometheus.MustRegister(resolveDuration)
 	prometheus.MustRegister(resolveRules)
 	prometheus.MustRegister(resolveActions)
 }
+
+// otherLabelValue replaces label values beyond the limit of a labelLimiter.
+const otherLabelValue = "other"
+
+// labelLimiter bounds the cardinality of a metric label.
+// The first max distinct values are used as is, later values are reported as otherLabelValue.
+// A nil labelLimiter or a max of 0 does not limit values.
+type labelLimiter struct {
+	max int
+
+	mu   sync.RWMutex
+	seen map[string]bool
+}
+
+func newLabelLimiter(max int) *labelLimiter {
+	return &labelLimiter{max: max, seen: make(map[string]bool)}
+}
+
+// value returns the label value to use for v.
+func (l *labelLimiter) value(v string) string {
+	if l == nil || l.max <= 0 {
+		return v
+	}
+	l.mu.RLock()
+	found := l.seen[v]
+	l.mu.RUnlock()
+	if found {
+		return v
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[v] || len(l.seen) < l.max {
+		l.seen[v] = true
+		return v
+	}
+	return otherLabelValue
+}
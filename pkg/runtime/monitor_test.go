@@ -0,0 +1,41 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"testing"
+)
+
+func TestLabelLimiter(t *testing.T) {
+	var unbounded *labelLimiter
+	for _, tc := range []struct {
+		desc string
+		l    *labelLimiter
+		in   []string
+		want []string
+	}{
+		{"nil", unbounded, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"no limit", newLabelLimiter(0), []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"limit", newLabelLimiter(2), []string{"a", "b", "c", "a", "d", "b"}, []string{"a", "b", "other", "a", "other", "b"}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			for i, v := range tc.in {
+				if got := tc.l.value(v); got != tc.want[i] {
+					t.Fatalf("value(%s): got %s, want %s", v, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
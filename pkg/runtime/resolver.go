@@ -15,10 +15,9 @@
 package runtime
 
 import (
-	"errors"
 	"fmt"
+	"sort"
 	"strconv"
-	"strings"
 	"sync/atomic"
 	"time"
 
@@ -41,11 +40,77 @@ type Rule struct {
 	name string
 	// rtype is gathered from labels.
 	rtype ResourceType
+	// eqMatches are attribute equalities required by the match condition.
+	// They are used to index the rule.
+	eqMatches map[string]interface{}
+	// prefixMatches are attribute prefixes required by the match condition.
+	// They are used to index the rule.
+	prefixMatches map[string]string
+	// priority orders rules. Rules with higher priority are applied first.
+	// priority is gathered from labels.
+	priority int
+	// terminal rules suppress matching rules with lower priority
+	// for the same template variety. Terminal shadow rules do not suppress other rules.
+	// terminal is gathered from labels.
+	terminal bool
+	// shadow rules are dispatched, but their results do not affect the outcome of the request.
+	// shadow is gathered from labels.
+	shadow bool
+	// splits divide traffic between alternative handlers.
+	// splits are gathered from annotations.
+	splits []*handlerSplit
+	// matched and unmatched count evaluations of the match condition.
+	// They are nil if the rule is not monitored.
+	matched   prometheus.Counter
+	unmatched prometheus.Counter
+}
+
+// monitor creates the counters of rule evaluations.
+func (r *Rule) monitor() {
+	r.matched = ruleEvalCounter.WithLabelValues(r.name, "true")
+	r.unmatched = ruleEvalCounter.WithLabelValues(r.name, "false")
+}
+
+// recordMatch counts an evaluation of the match condition.
+func (r *Rule) recordMatch(selected bool) {
+	c := r.unmatched
+	if selected {
+		c = r.matched
+	}
+	if c != nil {
+		c.Inc()
+	}
 }
 
 func (r Rule) String() string {
-	return fmt.Sprintf("[name:<%s>, match:<%s>, type:%s, actions: %v",
-		r.name, r.match, r.rtype, r.actions)
+	return fmt.Sprintf("[name:<%s>, match:<%s>, type:%s, priority:%d, terminal:%t, shadow:%t, actions: %v",
+		r.name, r.match, r.rtype, r.priority, r.terminal, r.shadow, r.actions)
+}
+
+// appendActions appends actions of the given variety.
+// If the rule splits traffic between handlers, only actions of the chosen handlers are appended.
+func (r *Rule) appendActions(res []*Action, variety adptTmpl.TemplateVariety, attrs attribute.Bag) []*Action {
+	if len(r.splits) == 0 {
+		return append(res, r.actions[variety]...)
+	}
+	return appendSplitActions(res, r.actions[variety], r.splits, attrs)
+}
+
+// ordered returns true if the rule needs to be ordered with respect to other rules.
+func (r *Rule) ordered() bool {
+	return r.priority != 0 || r.terminal
+}
+
+// byPriority sorts rules by descending priority, ties are broken by name.
+type byPriority []*Rule
+
+func (a byPriority) Len() int      { return len(a) }
+func (a byPriority) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPriority) Less(i, j int) bool {
+	if a[i].priority != a[j].priority {
+		return a[i].priority > a[j].priority
+	}
+	return a[i].name < a[j].name
 }
 
 // resolver is the runtime view of the configuration database.
@@ -53,10 +118,8 @@ type resolver struct {
 	// evaluator evaluates selectors
 	evaluator expr.PredicateEvaluator
 
-	// identityAttribute defines which configuration scopes apply to a request.
-	// default: target.service
-	// The value of this attribute is expected to be a hostname of form "svc.$ns.suffix"
-	identityAttribute string
+	// scopes derives the configuration scope of a request.
+	scopes *scopeResolver
 
 	// defaultConfigNamespace defines the namespace that contains configuration defaults for istio.
 	// This is distinct from the "default" namespace in K8s.
@@ -66,6 +129,18 @@ type resolver struct {
 	// rules in the configuration database keyed by $namespace.
 	rules map[string][]*Rule
 
+	// index of rules keyed by $namespace.
+	// Only candidate rules from the index are evaluated during resolution.
+	index map[string]namespaceIndex
+
+	// ordered is true if any rule uses priority or terminal.
+	// Matching rules are ordered by priority only if it is set.
+	ordered bool
+
+	// targets bounds the cardinality of the target label of resolve metrics.
+	// If nil, targets are not bounded.
+	targets *labelLimiter
+
 	// refCount tracks the number requests currently using this
 	// configuration. resolver state can be cleaned up when this count is 0.
 	refCount int32
@@ -75,17 +150,31 @@ type resolver struct {
 }
 
 // newResolver returns a Resolver.
-func newResolver(evaluator expr.PredicateEvaluator, identityAttribute string, defaultConfigNamespace string,
+func newResolver(evaluator expr.PredicateEvaluator, scopes *scopeResolver, defaultConfigNamespace string,
 	rules map[string][]*Rule, id int) *resolver {
 	return &resolver{
 		evaluator:              evaluator,
-		identityAttribute:      identityAttribute,
+		scopes:                 scopes,
 		defaultConfigNamespace: defaultConfigNamespace,
-		rules: rules,
-		id:    id,
+		rules:                  rules,
+		index:                  buildRuleIndices(rules, scopes.identityAttribute),
+		ordered:                hasOrderedRules(rules),
+		id:                     id,
 	}
 }
 
+// hasOrderedRules returns true if any rule uses priority or terminal.
+func hasOrderedRules(rules map[string][]*Rule) bool {
+	for _, nsRules := range rules {
+		for _, rule := range nsRules {
+			if rule.ordered() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 const (
 	// DefaultConfigNamespace holds istio wide configuration.
 	DefaultConfigNamespace = "istio-system"
@@ -101,16 +190,21 @@ const (
 
 	// expectedResolvedActionsCount is used to preallocate slice for actions.
 	expectedResolvedActionsCount = 10
+
+	// expectedCandidateListsCount is used to preallocate slice for candidate rule lists.
+	expectedCandidateListsCount = 6
 )
 
 // Resolve resolves the in memory configuration to a set of actions based on request attributes.
 // Resolution is performed in the following order
 // 1. Check rules from the defaultConfigNamespace -- these rules always apply
-// 2. Check rules from the target.service namespace
+// 2. Check rules from the namespace derived from the request attributes
+// Within a namespace only the candidate rules selected by the rule index are evaluated.
+// Candidates include rules that are scoped to the request's service.
 func (r *resolver) Resolve(attrs attribute.Bag, variety adptTmpl.TemplateVariety) (ra Actions, err error) {
 	nselected := 0
 	target := "unknown"
-	var ns string
+	ns := "unknown"
 
 	start := time.Now()
 	// increase refcount just before returning
@@ -124,7 +218,8 @@ func (r *resolver) Resolve(attrs attribute.Bag, variety adptTmpl.TemplateVariety
 	// monitoring info
 	defer func() {
 		lbls := prometheus.Labels{
-			targetStr: target,
+			targetStr: r.targets.value(target),
+			scopeStr:  ns,
 			errorStr:  strconv.FormatBool(err != nil),
 		}
 		resolveCounter.With(lbls).Inc()
@@ -137,20 +232,28 @@ func (r *resolver) Resolve(attrs attribute.Bag, variety adptTmpl.TemplateVariety
 		resolveActions.With(lbls).Observe(float64(raLen))
 	}()
 
-	if target, ns, err = destAndNamespace(attrs, r.identityAttribute); err != nil {
+	var sc scope
+	if sc, err = r.scopes.resolve(attrs); err != nil {
 		return nil, err
 	}
+	if sc.service != "" {
+		target = sc.service
+	}
+	ns = sc.namespace
+
+	ctxProtocol, _ := attrs.Get(ContextProtocolAttributeName)
+	key := indexKey{variety: variety, tcp: ctxProtocol == ContextProtocolTCP}
 
-	// at most this can have 2 elements.
-	rulesArr := make([][]*Rule, 0, 2)
+	// candidate rule lists from the index.
+	rulesArr := make([][]*Rule, 0, expectedCandidateListsCount)
 
 	// add default namespace if present
-	rulesArr = appendRules(rulesArr, r.rules, r.defaultConfigNamespace)
+	rulesArr = r.appendCandidates(rulesArr, r.defaultConfigNamespace, key, sc.service, attrs)
 
 	// If the destination namespace is different than the default namespace
 	// add those rules too
 	if r.defaultConfigNamespace != ns {
-		rulesArr = appendRules(rulesArr, r.rules, ns)
+		rulesArr = r.appendCandidates(rulesArr, ns, key, sc.service, attrs)
 	} else if glog.V(3) {
 		glog.Infof("Resolve: skipping duplicate namespace %s", ns)
 	}
@@ -167,44 +270,32 @@ func (r *resolver) Resolve(attrs attribute.Bag, variety adptTmpl.TemplateVariety
 	return ra, nil
 }
 
-func appendRules(rulesArr [][]*Rule, rules map[string][]*Rule, ns string) [][]*Rule {
-	if r := rules[ns]; r != nil {
-		rulesArr = append(rulesArr, r)
-	} else if glog.V(3) {
-		glog.Infof("Resolve: no namespace config for %s", ns)
-	}
-	return rulesArr
-}
-
-// destAndNamespace extracts namespace from identity attribute.
-func destAndNamespace(attrs attribute.Bag, idAttr string) (dest string, ns string, err error) {
-	attr, _ := attrs.Get(idAttr)
-	if attr == nil {
-		msg := fmt.Sprintf("%s identity not found in attributes%v", idAttr, attrs.Names())
-		glog.Warningf(msg)
-		return "", "", errors.New(msg)
-	}
-
-	var ok bool
-	if dest, ok = attr.(string); !ok {
-		msg := fmt.Sprintf("%s identity must be string: %v", idAttr, attr)
-		glog.Warningf(msg)
-		return "", "", errors.New(msg)
+// appendCandidates appends rules from namespace ns that may match the request.
+func (r *resolver) appendCandidates(rulesArr [][]*Rule, ns string, key indexKey,
+	service string, attrs attribute.Bag) [][]*Rule {
+	nsi := r.index[ns]
+	if nsi == nil {
+		if glog.V(3) {
+			glog.Infof("Resolve: no namespace config for %s", ns)
+		}
+		return rulesArr
 	}
-	splits := strings.SplitN(dest, ".", 3) // we only care about service and namespace.
-	if len(splits) > 1 {
-		ns = splits[1]
+	if ri := nsi[key]; ri != nil {
+		rulesArr = ri.appendCandidates(rulesArr, service, attrs)
 	}
-	return dest, ns, nil
+	return rulesArr
 }
 
 //filterActions filters rules based on template variety and selectors.
+// If rules are ordered, actions are returned in priority order and
+// matching terminal rules suppress matching rules with lower priority.
 func (r *resolver) filterActions(rulesArr [][]*Rule, attrs attribute.Bag,
 	variety adptTmpl.TemplateVariety) ([]*Action, int, error) {
 	res := make([]*Action, 0, expectedResolvedActionsCount)
 	var selected bool
 	nselected := 0
 	var err error
+	var matched []*Rule
 	ctxProtocol, _ := attrs.Get(ContextProtocolAttributeName)
 	tcp := ctxProtocol == ContextProtocolTCP
 
@@ -227,20 +318,56 @@ func (r *resolver) filterActions(rulesArr [][]*Rule, attrs attribute.Bag,
 				if selected, err = r.evaluator.EvalPredicate(rule.match, attrs); err != nil {
 					return nil, 0, err
 				}
+				rule.recordMatch(selected)
 				if !selected {
 					continue
 				}
+			} else {
+				rule.recordMatch(true)
 			}
 			if glog.V(3) {
 				glog.Infof("filterActions: rule %s selected %v", rule.name, rule.rtype)
 			}
+			if r.ordered {
+				matched = append(matched, rule)
+				continue
+			}
 			nselected++
-			res = append(res, act...)
+			res = rule.appendActions(res, variety, attrs)
 		}
 	}
+
+	if r.ordered {
+		res, nselected = appendOrderedActions(res, matched, variety, attrs)
+	}
 	return res, nselected, nil
 }
 
+// appendOrderedActions appends actions of the matched rules in priority order.
+// Once a terminal rule is applied, rules with lower priority are suppressed.
+// Rules with the same priority as the terminal rule are still applied.
+// Shadow rules never suppress other rules, since they do not affect the outcome of the request.
+func appendOrderedActions(res []*Action, matched []*Rule, variety adptTmpl.TemplateVariety,
+	attrs attribute.Bag) ([]*Action, int) {
+	sort.Sort(byPriority(matched))
+	var terminal *Rule
+	nselected := 0
+	for _, rule := range matched {
+		if terminal != nil && rule.priority < terminal.priority {
+			if glog.V(3) {
+				glog.Infof("filterActions: rule %s suppressed by terminal rule %s", rule.name, terminal.name)
+			}
+			continue
+		}
+		if rule.terminal && !rule.shadow && terminal == nil {
+			terminal = rule
+		}
+		nselected++
+		res = rule.appendActions(res, variety, attrs)
+	}
+	return res, nselected
+}
+
 func (r *resolver) incRefCount() {
 	atomic.AddInt32(&r.refCount, 1)
 }
@@ -0,0 +1,148 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"sort"
+
+	adptTmpl "istio.io/api/mixer/v1/template"
+	"istio.io/mixer/pkg/attribute"
+)
+
+// RequestPathAttributeName is the attribute used to index rules by path prefix.
+const RequestPathAttributeName = "request.path"
+
+// ruleIndex narrows down the set of rules that may apply to a request.
+// Rules are bucketed by the constraints hoisted out of their match condition.
+// The index only selects candidates, the full match condition
+// of every candidate is still evaluated by the resolver.
+type ruleIndex struct {
+	// byDest holds rules that require an exact identity attribute value.
+	byDest map[string][]*Rule
+
+	// byPathPrefix holds rules that require a request.path prefix.
+	byPathPrefix map[string][]*Rule
+
+	// prefixLens are the distinct prefix lengths in byPathPrefix, ascending.
+	prefixLens []int
+
+	// rest holds rules that cannot be indexed. They are always candidates.
+	rest []*Rule
+}
+
+// indexKey partitions rules of a namespace by
+// template variety and context protocol.
+type indexKey struct {
+	variety adptTmpl.TemplateVariety
+	tcp     bool
+}
+
+// namespaceIndex holds the rule indices of a single namespace.
+type namespaceIndex map[indexKey]*ruleIndex
+
+// buildRuleIndices builds indices for rules keyed by namespace.
+// It is called once per config snapshot.
+func buildRuleIndices(rules map[string][]*Rule, identityAttribute string) map[string]namespaceIndex {
+	indices := make(map[string]namespaceIndex, len(rules))
+	for ns, nsRules := range rules {
+		indices[ns] = newNamespaceIndex(nsRules, identityAttribute)
+	}
+	return indices
+}
+
+func newNamespaceIndex(rules []*Rule, identityAttribute string) namespaceIndex {
+	nsi := make(namespaceIndex)
+	for _, rule := range rules {
+		for vr, act := range rule.actions {
+			if act == nil { // filterActions ignores rules without variety specific actions.
+				continue
+			}
+			key := indexKey{variety: vr, tcp: rule.rtype.IsTCP()}
+			ri := nsi[key]
+			if ri == nil {
+				ri = &ruleIndex{
+					byDest:       make(map[string][]*Rule),
+					byPathPrefix: make(map[string][]*Rule),
+				}
+				nsi[key] = ri
+			}
+			ri.add(rule, identityAttribute)
+		}
+	}
+
+	for _, ri := range nsi {
+		for p := range ri.byPathPrefix {
+			ri.prefixLens = append(ri.prefixLens, len(p))
+		}
+		sort.Ints(ri.prefixLens)
+		ri.prefixLens = dedupInts(ri.prefixLens)
+	}
+	return nsi
+}
+
+// add places the rule in the most selective bucket available.
+func (ri *ruleIndex) add(rule *Rule, identityAttribute string) {
+	if dest, ok := rule.eqMatches[identityAttribute].(string); ok {
+		ri.byDest[dest] = append(ri.byDest[dest], rule)
+		return
+	}
+	if prefix, ok := rule.prefixMatches[RequestPathAttributeName]; ok {
+		ri.byPathPrefix[prefix] = append(ri.byPathPrefix[prefix], rule)
+		return
+	}
+	ri.rest = append(ri.rest, rule)
+}
+
+// appendCandidates appends the rule lists that may apply to the given destination
+// and request attributes.
+func (ri *ruleIndex) appendCandidates(rulesArr [][]*Rule, dest string, attrs attribute.Bag) [][]*Rule {
+	if r := ri.byDest[dest]; r != nil {
+		rulesArr = append(rulesArr, r)
+	}
+
+	if len(ri.prefixLens) > 0 {
+		if v, _ := attrs.Get(RequestPathAttributeName); v != nil {
+			if path, ok := v.(string); ok {
+				for _, l := range ri.prefixLens {
+					if l > len(path) {
+						break
+					}
+					if r := ri.byPathPrefix[path[:l]]; r != nil {
+						rulesArr = append(rulesArr, r)
+					}
+				}
+			}
+		}
+	}
+
+	if ri.rest != nil {
+		rulesArr = append(rulesArr, ri.rest)
+	}
+	return rulesArr
+}
+
+// dedupInts removes adjacent duplicates from a sorted slice.
+func dedupInts(a []int) []int {
+	if len(a) == 0 {
+		return a
+	}
+	out := a[:1]
+	for _, v := range a[1:] {
+		if v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
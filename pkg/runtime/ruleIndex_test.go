@@ -0,0 +1,164 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	adptTmpl "istio.io/api/mixer/v1/template"
+	"istio.io/mixer/pkg/attribute"
+	cpb "istio.io/mixer/pkg/config/proto"
+	"istio.io/mixer/pkg/config/store"
+	"istio.io/mixer/pkg/expr"
+)
+
+func TestRuleIndex(t *testing.T) {
+	ia := DefaultIdentityAttribute
+	ns := "myns"
+	matches := []string{
+		`destination.service == "a.myns.svc"`,
+		`destination.service == "b.myns.svc"`,
+		`"a.myns.svc" == destination.service && match(request.path, "/api/*")`,
+		`match(request.path, "/api/*")`,
+		`match(request.path, "/api/v1/*")`,
+		`request.path == "/healthz"`,
+		`match(request.path, "*.html")`,
+		`request.size == 20 || destination.service == "b.myns.svc"`,
+		``,
+		`context.protocol == "tcp"`,
+		`context.protocol == "tcp" && destination.service == "a.myns.svc"`,
+	}
+	rules := map[string][]*Rule{ns: newMatchRules(t, ns, adptTmpl.TEMPLATE_VARIETY_CHECK, matches)}
+
+	eval, err := expr.NewCEXLEvaluator(expr.DefaultCacheSize)
+	if err != nil {
+		t.Fatalf("unable to create evaluator: %v", err)
+	}
+	r := newResolver(eval, newScopeResolver(nil, ia, ""), DefaultConfigNamespace, rules, 1)
+
+	for _, tc := range []struct {
+		desc string
+		bag  map[string]interface{}
+		want []int
+	}{
+		{
+			desc: "destination a",
+			bag:  map[string]interface{}{ia: "a.myns.svc", RequestPathAttributeName: "/", "request.size": int64(1)},
+			want: []int{0, 8},
+		},
+		{
+			desc: "destination b",
+			bag:  map[string]interface{}{ia: "b.myns.svc", RequestPathAttributeName: "/", "request.size": int64(1)},
+			want: []int{1, 7, 8},
+		},
+		{
+			desc: "destination a with api path",
+			bag:  map[string]interface{}{ia: "a.myns.svc", RequestPathAttributeName: "/api/v1/books", "request.size": int64(1)},
+			want: []int{0, 2, 3, 4, 8},
+		},
+		{
+			desc: "short path",
+			bag:  map[string]interface{}{ia: "c.myns.svc", RequestPathAttributeName: "/a", "request.size": int64(1)},
+			want: []int{8},
+		},
+		{
+			desc: "exact path",
+			bag:  map[string]interface{}{ia: "c.myns.svc", RequestPathAttributeName: "/healthz", "request.size": int64(20)},
+			want: []int{5, 7, 8},
+		},
+		{
+			desc: "suffix path",
+			bag:  map[string]interface{}{ia: "c.myns.svc", RequestPathAttributeName: "/index.html", "request.size": int64(1)},
+			want: []int{6, 8},
+		},
+		{
+			desc: "tcp",
+			bag:  map[string]interface{}{ia: "a.myns.svc", ContextProtocolAttributeName: ContextProtocolTCP},
+			want: []int{9, 10},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			bag := attribute.GetFakeMutableBagForTesting(tc.bag)
+
+			// scan all rules the way the resolver did before indexing.
+			scanned, _, err := r.filterActions([][]*Rule{rules[ns]}, bag, adptTmpl.TEMPLATE_VARIETY_CHECK)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			ra, err := r.Resolve(bag, adptTmpl.TEMPLATE_VARIETY_CHECK)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer ra.Done()
+
+			got := actionIndices(ra.Get())
+			if !reflect.DeepEqual(got, actionIndices(scanned)) {
+				t.Errorf("indexed %v, scanned %v", got, actionIndices(scanned))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDedupInts(t *testing.T) {
+	for _, tc := range []struct {
+		in   []int
+		want []int
+	}{
+		{[]int{}, []int{}},
+		{[]int{1}, []int{1}},
+		{[]int{1, 1, 2, 3, 3, 3}, []int{1, 2, 3}},
+	} {
+		if got := dedupInts(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("dedupInts(%v): got %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// newMatchRules creates one rule per match expression.
+// The rule's action records the position of the match expression in its handler name.
+func newMatchRules(t testing.TB, ns string, vr adptTmpl.TemplateVariety, matches []string) []*Rule {
+	rules := make([]*Rule, 0, len(matches))
+	for i, m := range matches {
+		k := store.Key{Kind: RulesKind, Namespace: ns, Name: fmt.Sprintf("r%d", i)}
+		rule, err := buildRule(k, &cpb.Rule{Match: m}, defaultResourcetype())
+		if err != nil {
+			t.Fatalf("unable to build rule %s: %v", m, err)
+		}
+		rule.actions = map[adptTmpl.TemplateVariety][]*Action{
+			vr: {{handlerName: fmt.Sprintf("%d", i)}},
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// actionIndices returns the sorted rule positions of actions created by newMatchRules.
+func actionIndices(acts []*Action) []int {
+	idx := make([]int, 0, len(acts))
+	for _, a := range acts {
+		var i int
+		_, _ = fmt.Sscanf(a.handlerName, "%d", &i)
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	return idx
+}
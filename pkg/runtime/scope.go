@@ -0,0 +1,120 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"istio.io/mixer/pkg/attribute"
+	"istio.io/mixer/pkg/expr"
+)
+
+// Configuration applies to a request at 3 levels.
+// 1. mesh      -- rules from the defaultConfigNamespace always apply.
+// 2. namespace -- rules from the namespace derived from request attributes.
+// 3. service   -- rules within the namespace that select the request's
+//                 service using the identity attribute, for example
+//                 destination.service == "svc.ns.svc.cluster.local".
+//                 These rules are indexed by service.
+
+// scope is the configuration scope of a request.
+type scope struct {
+	// service is the value of the identity attribute.
+	service string
+
+	// namespace is the namespace whose configuration applies to the request.
+	namespace string
+}
+
+// stringEvaluator evaluates an expression to a string.
+type stringEvaluator interface {
+	EvalString(expr string, attrs attribute.Bag) (string, error)
+}
+
+// scopeResolver derives the configuration scope of a request from its attributes.
+type scopeResolver struct {
+	// identityAttribute holds the service the request is destined for.
+	// default: destination.service
+	identityAttribute string
+
+	// namespaceExpression is evaluated against the request attributes to derive the namespace.
+	// For example: destination.namespace | "default"
+	// If empty, the namespace is the second segment of the identity attribute.
+	// The identity attribute is expected to be a hostname of form "svc.$ns.suffix".
+	namespaceExpression string
+
+	// evaluator evaluates namespaceExpression.
+	evaluator stringEvaluator
+}
+
+// newScopeResolver returns a scopeResolver.
+// evaluator may be nil if namespaceExpression is empty.
+func newScopeResolver(evaluator stringEvaluator, identityAttribute string, namespaceExpression string) *scopeResolver {
+	return &scopeResolver{
+		identityAttribute:   identityAttribute,
+		namespaceExpression: namespaceExpression,
+		evaluator:           evaluator,
+	}
+}
+
+// validateNamespaceExpression ensures that the namespace expression can be parsed.
+func validateNamespaceExpression(namespaceExpression string) error {
+	if namespaceExpression == "" {
+		return nil
+	}
+	if _, err := expr.Parse(namespaceExpression); err != nil {
+		return fmt.Errorf("invalid namespace expression '%s': %v", namespaceExpression, err)
+	}
+	return nil
+}
+
+// resolve returns the scope of the request.
+// The identity attribute is required unless the namespace is derived from an expression.
+func (s *scopeResolver) resolve(attrs attribute.Bag) (sc scope, err error) {
+	attr, _ := attrs.Get(s.identityAttribute)
+	if attr == nil && s.namespaceExpression == "" {
+		msg := fmt.Sprintf("%s identity not found in attributes%v", s.identityAttribute, attrs.Names())
+		glog.Warningf(msg)
+		return sc, errors.New(msg)
+	}
+
+	if attr != nil {
+		var ok bool
+		if sc.service, ok = attr.(string); !ok {
+			msg := fmt.Sprintf("%s identity must be string: %v", s.identityAttribute, attr)
+			glog.Warningf(msg)
+			return sc, errors.New(msg)
+		}
+	}
+
+	if s.namespaceExpression != "" {
+		if sc.namespace, err = s.evaluator.EvalString(s.namespaceExpression, attrs); err != nil {
+			msg := fmt.Sprintf("unable to derive namespace using '%s': %v", s.namespaceExpression, err)
+			glog.Warningf(msg)
+			return sc, errors.New(msg)
+		}
+		return sc, nil
+	}
+
+	splits := strings.SplitN(sc.service, ".", 3) // we only care about service and namespace.
+	if len(splits) > 1 {
+		sc.namespace = splits[1]
+	}
+	return sc, nil
+}
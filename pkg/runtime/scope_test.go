@@ -0,0 +1,155 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"testing"
+
+	adptTmpl "istio.io/api/mixer/v1/template"
+	"istio.io/mixer/pkg/attribute"
+	"istio.io/mixer/pkg/expr"
+)
+
+func TestScopeResolver(t *testing.T) {
+	ia := DefaultIdentityAttribute
+	nsExpr := `destination.namespace | "default"`
+
+	eval, err := expr.NewCEXLEvaluator(expr.DefaultCacheSize)
+	if err != nil {
+		t.Fatalf("unable to create evaluator: %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		nsExpr string
+		bag    map[string]interface{}
+		want   scope
+		err    string
+	}{
+		{
+			desc: "namespace from identity",
+			bag:  map[string]interface{}{ia: "svc.myns.svc.cluster.local"},
+			want: scope{service: "svc.myns.svc.cluster.local", namespace: "myns"},
+		},
+		{
+			desc: "identity without namespace",
+			bag:  map[string]interface{}{ia: "svc"},
+			want: scope{service: "svc"},
+		},
+		{
+			desc: "missing identity",
+			bag:  map[string]interface{}{},
+			err:  "identity not found",
+		},
+		{
+			desc: "identity not a string",
+			bag:  map[string]interface{}{ia: int64(5)},
+			err:  "identity must be string",
+		},
+		{
+			desc:   "namespace from expression",
+			nsExpr: nsExpr,
+			bag:    map[string]interface{}{ia: "svc.myns", "destination.namespace": "other"},
+			want:   scope{service: "svc.myns", namespace: "other"},
+		},
+		{
+			desc:   "namespace from expression default",
+			nsExpr: nsExpr,
+			bag:    map[string]interface{}{ia: "svc.myns"},
+			want:   scope{service: "svc.myns", namespace: "default"},
+		},
+		{
+			desc:   "namespace from expression without identity",
+			nsExpr: nsExpr,
+			bag:    map[string]interface{}{"destination.namespace": "other"},
+			want:   scope{namespace: "other"},
+		},
+		{
+			desc:   "namespace expression error",
+			nsExpr: `destination.namespace`,
+			bag:    map[string]interface{}{ia: "svc.myns"},
+			err:    "unable to derive namespace",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := newScopeResolver(eval, ia, tc.nsExpr)
+			sc, err := s.resolve(attribute.GetFakeMutableBagForTesting(tc.bag))
+			assertResolverError(t, err, tc.err)
+			if err != nil {
+				return
+			}
+			if sc != tc.want {
+				t.Fatalf("got %v, want %v", sc, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateNamespaceExpression(t *testing.T) {
+	for _, tc := range []struct {
+		nsExpr string
+		err    string
+	}{
+		{``, ""},
+		{`destination.namespace | "default"`, ""},
+		{`destination.namespace |`, "invalid namespace expression"},
+	} {
+		assertResolverError(t, validateNamespaceExpression(tc.nsExpr), tc.err)
+	}
+}
+
+func TestResolver_NamespaceExpression(t *testing.T) {
+	ia := DefaultIdentityAttribute
+	rules := newRules(adptTmpl.TEMPLATE_VARIETY_CHECK, []fakeRuleCfg{
+		{DefaultConfigNamespace, 1},
+		{"default", 2},
+		{"team-a", 3},
+	})
+
+	eval, err := expr.NewCEXLEvaluator(expr.DefaultCacheSize)
+	if err != nil {
+		t.Fatalf("unable to create evaluator: %v", err)
+	}
+	scopes := newScopeResolver(eval, ia, `destination.labels["team"] | "default"`)
+	r := newResolver(fakePred(false, ""), scopes, DefaultConfigNamespace, rules, 1)
+
+	for _, tc := range []struct {
+		desc     string
+		bag      map[string]interface{}
+		nactions int
+	}{
+		{
+			desc:     "label selects namespace",
+			bag:      map[string]interface{}{"destination.labels": map[string]string{"team": "team-a"}},
+			nactions: 4,
+		},
+		{
+			desc:     "fallback namespace",
+			bag:      map[string]interface{}{ia: "svc.team-a", "destination.labels": map[string]string{}},
+			nactions: 3,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			ra, err := r.Resolve(attribute.GetFakeMutableBagForTesting(tc.bag), adptTmpl.TEMPLATE_VARIETY_CHECK)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer ra.Done()
+			if len(ra.Get()) != tc.nactions {
+				t.Fatalf("got %d actions, want %d", len(ra.Get()), tc.nactions)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	adptTmpl "istio.io/api/mixer/v1/template"
+	"istio.io/mixer/pkg/attribute"
+	cpb "istio.io/mixer/pkg/config/proto"
+)
+
+// Traffic splitting between handlers is specified using rule annotations.
+//
+//	istio-handler-split: "prometheus-old.prometheus=95,prometheus-new.prometheus=5"
+//	istio-handler-split-key: "source.user"
+//
+// An action that refers to any handler of a split is dispatched to exactly one
+// of the handlers of the split, chosen by weight.
+// If a split key is given, the choice is sticky by a hash of that attribute.
+// Multiple splits are separated by ';'.
+const (
+	istioHandlerSplit    = "istio-handler-split"
+	istioHandlerSplitKey = "istio-handler-split-key"
+)
+
+// handlerSplit divides traffic between alternative handlers.
+type handlerSplit struct {
+	// handlers are fully qualified handler names.
+	handlers []string
+
+	// bounds are cumulative weights of handlers.
+	bounds []int
+
+	// hashAttribute makes the choice sticky by the value of the attribute.
+	// If empty, or if the attribute is absent, the choice is random.
+	hashAttribute string
+}
+
+// splitChoice associates an action with an alternative of a handlerSplit.
+type splitChoice struct {
+	// split is the index of the split in Rule.splits.
+	split int
+
+	// alternative is the index of the handler in handlerSplit.handlers.
+	alternative int
+}
+
+// parseHandlerSplits parses handler splits from rule annotations.
+func parseHandlerSplits(annotations map[string]string, namespace string) ([]*handlerSplit, error) {
+	spec, ok := annotations[istioHandlerSplit]
+	if !ok {
+		return nil, nil
+	}
+	hashAttribute := strings.TrimSpace(annotations[istioHandlerSplitKey])
+
+	var splits []*handlerSplit
+	seen := make(map[string]bool)
+	for _, group := range strings.Split(spec, ";") {
+		if strings.TrimSpace(group) == "" {
+			continue
+		}
+		s := &handlerSplit{hashAttribute: hashAttribute}
+		total := 0
+		for _, alt := range strings.Split(group, ",") {
+			kv := strings.SplitN(alt, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid %s annotation '%s': want handler=weight", istioHandlerSplit, alt)
+			}
+			handler := strings.TrimSpace(kv[0])
+			weight, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid %s annotation '%s': weight must be a non-negative integer", istioHandlerSplit, alt)
+			}
+			if !isFQN(handler) {
+				handler = handler + "." + namespace
+			}
+			if seen[handler] {
+				return nil, fmt.Errorf("invalid %s annotation: handler %s is listed more than once", istioHandlerSplit, handler)
+			}
+			seen[handler] = true
+			total += weight
+			s.handlers = append(s.handlers, handler)
+			s.bounds = append(s.bounds, total)
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("invalid %s annotation '%s': weights must add up to more than 0", istioHandlerSplit, group)
+		}
+		splits = append(splits, s)
+	}
+	return splits, nil
+}
+
+// findSplit returns the split and alternative index of a handler.
+func findSplit(splits []*handlerSplit, handler string) (splitChoice, bool) {
+	for si, s := range splits {
+		for ai, h := range s.handlers {
+			if h == handler {
+				return splitChoice{split: si, alternative: ai}, true
+			}
+		}
+	}
+	return splitChoice{}, false
+}
+
+// expandSplitActions adds actions for every alternative handler of an action that refers to a split.
+// Handler names of acts must be fully qualified.
+func expandSplitActions(acts []*cpb.Action, splits []*handlerSplit) []*cpb.Action {
+	if len(splits) == 0 {
+		return acts
+	}
+
+	key := func(a *cpb.Action) string {
+		return a.Handler + "/" + strings.Join(a.Instances, ",")
+	}
+	seen := make(map[string]bool, len(acts))
+	for _, a := range acts {
+		seen[key(a)] = true
+	}
+
+	expanded := make([]*cpb.Action, 0, len(acts))
+	for _, a := range acts {
+		expanded = append(expanded, a)
+		sc, found := findSplit(splits, a.Handler)
+		if !found {
+			continue
+		}
+		for _, h := range splits[sc.split].handlers {
+			alt := &cpb.Action{
+				Handler:   h,
+				Instances: append([]string(nil), a.Instances...),
+			}
+			if seen[key(alt)] {
+				continue
+			}
+			seen[key(alt)] = true
+			expanded = append(expanded, alt)
+		}
+	}
+	return expanded
+}
+
+// tagSplitActions records which split alternative each action belongs to.
+func tagSplitActions(actions map[adptTmpl.TemplateVariety][]*Action, splits []*handlerSplit) {
+	for _, vact := range actions {
+		for _, act := range vact {
+			if sc, found := findSplit(splits, act.handlerName); found {
+				act.split = &sc
+			}
+		}
+	}
+}
+
+// resolveSplits reweights splits so that only alternatives with dispatchable actions are chosen.
+// Alternatives whose handlers were dropped from actions get no traffic, their share is divided
+// among the remaining alternatives in proportion to their weights.
+// It returns the reweighted splits and the dropped handlers that had a share of the traffic.
+func resolveSplits(splits []*handlerSplit, actions map[adptTmpl.TemplateVariety][]*Action) ([]*handlerSplit, []string) {
+	if len(splits) == 0 {
+		return splits, nil
+	}
+	present := make(map[string]bool)
+	for _, vact := range actions {
+		for _, act := range vact {
+			present[act.handlerName] = true
+		}
+	}
+
+	var dropped []string
+	resolved := make([]*handlerSplit, 0, len(splits))
+	for _, s := range splits {
+		rs := &handlerSplit{
+			handlers:      s.handlers,
+			bounds:        make([]int, 0, len(s.bounds)),
+			hashAttribute: s.hashAttribute,
+		}
+		prev, total := 0, 0
+		for i, h := range s.handlers {
+			weight := s.bounds[i] - prev
+			prev = s.bounds[i]
+			if !present[h] {
+				if weight > 0 {
+					dropped = append(dropped, h)
+				}
+				weight = 0
+			}
+			total += weight
+			rs.bounds = append(rs.bounds, total)
+		}
+		resolved = append(resolved, rs)
+	}
+	return resolved, dropped
+}
+
+// choose returns the index of the handler that should receive the request,
+// or -1 if no handler of the split has a share of the traffic.
+func (s *handlerSplit) choose(attrs attribute.Bag) int {
+	total := s.bounds[len(s.bounds)-1]
+	if total == 0 {
+		return -1
+	}
+	var n int
+	if v, found := s.stickyValue(attrs); found {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(v))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+
+	for i, b := range s.bounds {
+		if n < b {
+			return i
+		}
+	}
+	return len(s.bounds) - 1
+}
+
+func (s *handlerSplit) stickyValue(attrs attribute.Bag) (string, bool) {
+	if s.hashAttribute == "" {
+		return "", false
+	}
+	v, found := attrs.Get(s.hashAttribute)
+	if !found || v == nil {
+		return "", false
+	}
+	if str, ok := v.(string); ok {
+		return str, true
+	}
+	return fmt.Sprintf("%v", v), true
+}
+
+// appendSplitActions appends actions of a rule with splits.
+// Actions that belong to a split are appended only if their alternative is chosen.
+// The choice is made once per split.
+func appendSplitActions(res []*Action, acts []*Action, splits []*handlerSplit, attrs attribute.Bag) []*Action {
+	choices := make([]int, len(splits))
+	chosen := make([]bool, len(splits))
+
+	for _, act := range acts {
+		if act.split == nil {
+			res = append(res, act)
+			continue
+		}
+		sc := act.split
+		if !chosen[sc.split] {
+			choices[sc.split] = splits[sc.split].choose(attrs)
+			chosen[sc.split] = true
+		}
+		if choices[sc.split] == sc.alternative {
+			res = append(res, act)
+		}
+	}
+	return res
+}
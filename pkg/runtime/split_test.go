@@ -0,0 +1,285 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	adptTmpl "istio.io/api/mixer/v1/template"
+	"istio.io/mixer/pkg/attribute"
+	cpb "istio.io/mixer/pkg/config/proto"
+)
+
+func TestParseHandlerSplits(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		annotations map[string]string
+		want        []*handlerSplit
+		err         string
+	}{
+		{
+			desc: "no split",
+		},
+		{
+			desc:        "weighted",
+			annotations: map[string]string{istioHandlerSplit: "old.prometheus=95, new.prometheus.ns2=5"},
+			want: []*handlerSplit{{
+				handlers: []string{"old.prometheus.ns1", "new.prometheus.ns2"},
+				bounds:   []int{95, 100},
+			}},
+		},
+		{
+			desc: "sticky multiple splits",
+			annotations: map[string]string{
+				istioHandlerSplit:    "a.denier=1,b.denier=1;c.list=0,d.list=3",
+				istioHandlerSplitKey: "source.user",
+			},
+			want: []*handlerSplit{
+				{handlers: []string{"a.denier.ns1", "b.denier.ns1"}, bounds: []int{1, 2}, hashAttribute: "source.user"},
+				{handlers: []string{"c.list.ns1", "d.list.ns1"}, bounds: []int{0, 3}, hashAttribute: "source.user"},
+			},
+		},
+		{
+			desc:        "missing weight",
+			annotations: map[string]string{istioHandlerSplit: "a.denier"},
+			err:         "want handler=weight",
+		},
+		{
+			desc:        "bad weight",
+			annotations: map[string]string{istioHandlerSplit: "a.denier=-1,b.denier=2"},
+			err:         "non-negative integer",
+		},
+		{
+			desc:        "zero total",
+			annotations: map[string]string{istioHandlerSplit: "a.denier=0,b.denier=0"},
+			err:         "more than 0",
+		},
+		{
+			desc:        "duplicate handler",
+			annotations: map[string]string{istioHandlerSplit: "a.denier=1;a.denier.ns1=2"},
+			err:         "more than once",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := parseHandlerSplits(tc.annotations, "ns1")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpandSplitActions(t *testing.T) {
+	splits := []*handlerSplit{{
+		handlers: []string{"old.prometheus.ns1", "new.prometheus.ns1"},
+		bounds:   []int{95, 100},
+	}}
+	acts := []*cpb.Action{
+		{Handler: "old.prometheus.ns1", Instances: []string{"rc.metric.ns1"}},
+		{Handler: "new.prometheus.ns1", Instances: []string{"rc.metric.ns1"}},
+		{Handler: "deny.denier.ns1", Instances: []string{"n.checknothing.ns1"}},
+		{Handler: "old.prometheus.ns1", Instances: []string{"rs.metric.ns1"}},
+	}
+	want := []*cpb.Action{
+		{Handler: "old.prometheus.ns1", Instances: []string{"rc.metric.ns1"}},
+		{Handler: "new.prometheus.ns1", Instances: []string{"rc.metric.ns1"}},
+		{Handler: "deny.denier.ns1", Instances: []string{"n.checknothing.ns1"}},
+		{Handler: "old.prometheus.ns1", Instances: []string{"rs.metric.ns1"}},
+		{Handler: "new.prometheus.ns1", Instances: []string{"rs.metric.ns1"}},
+	}
+
+	if got := expandSplitActions(acts, splits); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	if got := expandSplitActions(acts, nil); !reflect.DeepEqual(got, acts) {
+		t.Fatalf("got %v\nwant %v", got, acts)
+	}
+}
+
+func TestHandlerSplit_choose(t *testing.T) {
+	all := &handlerSplit{handlers: []string{"a", "b"}, bounds: []int{0, 10}}
+	for i := 0; i < 100; i++ {
+		if got := all.choose(attribute.GetFakeMutableBagForTesting(nil)); got != 1 {
+			t.Fatalf("got %d, want 1", got)
+		}
+	}
+
+	weighted := &handlerSplit{handlers: []string{"a", "b"}, bounds: []int{50, 100}}
+	counts := make([]int, 2)
+	for i := 0; i < 1000; i++ {
+		counts[weighted.choose(attribute.GetFakeMutableBagForTesting(nil))]++
+	}
+	if counts[0] == 0 || counts[1] == 0 {
+		t.Fatalf("got %v, want both alternatives chosen", counts)
+	}
+
+	sticky := &handlerSplit{handlers: []string{"a", "b"}, bounds: []int{50, 100}, hashAttribute: "source.user"}
+	counts = make([]int, 2)
+	for u := 0; u < 100; u++ {
+		bag := attribute.GetFakeMutableBagForTesting(map[string]interface{}{"source.user": fmt.Sprintf("user%d", u)})
+		first := sticky.choose(bag)
+		for i := 0; i < 10; i++ {
+			if got := sticky.choose(bag); got != first {
+				t.Fatalf("user%d: got %d, want sticky %d", u, got, first)
+			}
+		}
+		counts[first]++
+	}
+	if counts[0] == 0 || counts[1] == 0 {
+		t.Fatalf("got %v, want users spread across alternatives", counts)
+	}
+}
+
+func TestResolver_Split(t *testing.T) {
+	ia := DefaultIdentityAttribute
+	vr := adptTmpl.TEMPLATE_VARIETY_REPORT
+	splits := []*handlerSplit{{
+		handlers:      []string{"old", "new"},
+		bounds:        []int{1, 2},
+		hashAttribute: "source.user",
+	}}
+	rule := &Rule{
+		name:   "r1",
+		splits: splits,
+		actions: map[adptTmpl.TemplateVariety][]*Action{
+			vr: {
+				{handlerName: "old"},
+				{handlerName: "new"},
+				{handlerName: "other"},
+			},
+		},
+	}
+	tagSplitActions(rule.actions, splits)
+	rv := newResolver(fakePred(false, ""), newScopeResolver(nil, ia, ""), DefaultConfigNamespace,
+		map[string][]*Rule{DefaultConfigNamespace: {rule}}, 1)
+
+	seen := map[string]bool{}
+	for u := 0; u < 50; u++ {
+		bag := attribute.GetFakeMutableBagForTesting(map[string]interface{}{
+			ia:            "svc.myns",
+			"source.user": fmt.Sprintf("user%d", u),
+		})
+		ra, err := rv.Resolve(bag, vr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		acts := ra.Get()
+		if len(acts) != 2 {
+			t.Fatalf("got %d actions, want 2", len(acts))
+		}
+		if acts[1].handlerName != "other" {
+			t.Fatalf("got %s, want unsplit action", acts[1].handlerName)
+		}
+		seen[acts[0].handlerName] = true
+		ra.Done()
+	}
+	if !seen["old"] || !seen["new"] {
+		t.Fatalf("got %v, want both alternatives", seen)
+	}
+}
+
+func TestResolveSplits(t *testing.T) {
+	vr := adptTmpl.TEMPLATE_VARIETY_REPORT
+	splits := []*handlerSplit{
+		{handlers: []string{"a", "b", "c"}, bounds: []int{1, 3, 6}, hashAttribute: "source.user"},
+		{handlers: []string{"d", "e"}, bounds: []int{0, 5}},
+	}
+	for _, tc := range []struct {
+		desc    string
+		present []string
+		want    [][]int
+		dropped []string
+	}{
+		{"all present", []string{"a", "b", "c", "d", "e"}, [][]int{{1, 3, 6}, {0, 5}}, nil},
+		{"middle dropped", []string{"a", "c", "d", "e"}, [][]int{{1, 1, 4}, {0, 5}}, []string{"b"}},
+		{"zero weight dropped", []string{"a", "b", "c", "e"}, [][]int{{1, 3, 6}, {0, 5}}, nil},
+		{"split dropped", []string{"a", "b", "c"}, [][]int{{1, 3, 6}, {0, 0}}, []string{"e"}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			actions := map[adptTmpl.TemplateVariety][]*Action{}
+			for _, h := range tc.present {
+				actions[vr] = append(actions[vr], &Action{handlerName: h})
+			}
+			got, dropped := resolveSplits(splits, actions)
+			for i, s := range got {
+				if !reflect.DeepEqual(s.bounds, tc.want[i]) {
+					t.Errorf("split %d: got bounds %v, want %v", i, s.bounds, tc.want[i])
+				}
+				if !reflect.DeepEqual(s.handlers, splits[i].handlers) || s.hashAttribute != splits[i].hashAttribute {
+					t.Errorf("split %d: got %v, want the alternatives of %v", i, s, splits[i])
+				}
+			}
+			if !reflect.DeepEqual(dropped, tc.dropped) {
+				t.Errorf("got dropped %v, want %v", dropped, tc.dropped)
+			}
+		})
+	}
+}
+
+func TestResolver_SplitDroppedHandler(t *testing.T) {
+	ia := DefaultIdentityAttribute
+	vr := adptTmpl.TEMPLATE_VARIETY_REPORT
+	splits := []*handlerSplit{{
+		handlers: []string{"old", "new"},
+		bounds:   []int{1, 100},
+	}}
+	rule := &Rule{
+		name:   "r1",
+		splits: splits,
+		actions: map[adptTmpl.TemplateVariety][]*Action{
+			vr: {
+				{handlerName: "old"},
+				{handlerName: "new"},
+			},
+		},
+	}
+	tagSplitActions(rule.actions, splits)
+
+	// the new handler could not be initialized, its traffic must go to the old one.
+	ht := map[string]*HandlerEntry{
+		"old": {Handler: &fhandler{}},
+		"new": {},
+	}
+	rules, n := generateResolvedRules(rulesMapByNamespace{DefaultConfigNamespace: rulesByName{"r1": rule}}, ht, nil)
+	if n != 1 {
+		t.Fatalf("got %d rules, want 1", n)
+	}
+	rv := newResolver(fakePred(false, ""), newScopeResolver(nil, ia, ""), DefaultConfigNamespace, rules, 1)
+
+	for i := 0; i < 50; i++ {
+		bag := attribute.GetFakeMutableBagForTesting(map[string]interface{}{ia: "svc.myns"})
+		ra, err := rv.Resolve(bag, vr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		acts := ra.Get()
+		if len(acts) != 1 || acts[0].handlerName != "old" {
+			t.Fatalf("got %v, want the old handler", acts)
+		}
+		ra.Done()
+	}
+}
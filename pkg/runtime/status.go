@@ -0,0 +1,278 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"istio.io/mixer/pkg/config/store"
+)
+
+// States of a config resource in a snapshot.
+const (
+	// StateAccepted indicates that the resource is part of the snapshot.
+	// An accepted resource may still carry warnings.
+	StateAccepted = "Accepted"
+
+	// StateRejected indicates that the resource failed validation.
+	StateRejected = "Rejected"
+
+	// StateHandlerInitFailed indicates that the handler could not be initialized.
+	StateHandlerInitFailed = "HandlerInitFailed"
+)
+
+// ResourceStatus is the status of a config resource in a snapshot.
+type ResourceStatus struct {
+	Kind      string   `json:"kind"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	Reasons   []string `json:"reasons,omitempty"`
+}
+
+// SnapshotStatus is the status of all config resources in a snapshot.
+type SnapshotStatus struct {
+	ID        int               `json:"id"`
+	Published time.Time         `json:"published"`
+	Resources []*ResourceStatus `json:"resources"`
+}
+
+// configStatus collects the status of resources while a snapshot is built.
+// All methods are safe to call on a nil configStatus.
+type configStatus struct {
+	resources map[store.Key]*ResourceStatus
+}
+
+// newConfigStatus returns a configStatus where every resource is accepted.
+func newConfigStatus(configState map[store.Key]*store.Resource) *configStatus {
+	s := &configStatus{resources: make(map[store.Key]*ResourceStatus, len(configState))}
+	for k := range configState {
+		s.resources[k] = &ResourceStatus{
+			Kind:      k.Kind,
+			Namespace: k.Namespace,
+			Name:      k.Name,
+			State:     StateAccepted,
+		}
+	}
+	return s
+}
+
+// reject marks the resource rejected.
+func (s *configStatus) reject(k store.Key, format string, args ...interface{}) {
+	s.set(k, StateRejected, format, args...)
+}
+
+// handlerFailed marks the handler as failed to initialize.
+func (s *configStatus) handlerFailed(k store.Key, format string, args ...interface{}) {
+	s.set(k, StateHandlerInitFailed, format, args...)
+}
+
+// warn records a reason without changing the state of the resource.
+func (s *configStatus) warn(k store.Key, format string, args ...interface{}) {
+	s.set(k, "", format, args...)
+}
+
+func (s *configStatus) set(k store.Key, state string, format string, args ...interface{}) {
+	if s == nil {
+		return
+	}
+	rs := s.resources[k]
+	if rs == nil {
+		return
+	}
+	if state != "" {
+		rs.State = state
+	}
+	rs.Reasons = append(rs.Reasons, fmt.Sprintf(format, args...))
+}
+
+// snapshot returns the externally visible status sorted by kind, namespace and name.
+func (s *configStatus) snapshot(id int) *SnapshotStatus {
+	ss := &SnapshotStatus{
+		ID:        id,
+		Published: time.Now(),
+		Resources: make([]*ResourceStatus, 0, len(s.resources)),
+	}
+	for _, rs := range s.resources {
+		ss.Resources = append(ss.Resources, rs)
+	}
+	sort.Slice(ss.Resources, func(i, j int) bool {
+		a, b := ss.Resources[i], ss.Resources[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return ss
+}
+
+// keyFromFQN returns the store key of a fully qualified resource name: name.kind.namespace
+func keyFromFQN(name string) (store.Key, bool) {
+	parts := strings.Split(name, ".")
+	if len(parts) != 3 {
+		return store.Key{}, false
+	}
+	return store.Key{Name: parts[0], Kind: parts[1], Namespace: parts[2]}, true
+}
+
+// statusWriteInterval is the minimum time between two status writes to the store.
+// It is a variable for testing.
+var statusWriteInterval = 50 * time.Millisecond
+
+// writeStatus hands the status of the snapshot to the status updater.
+// The status is written to the store in the background.
+func (c *Controller) writeStatus(s *configStatus) {
+	if c.statusUpdater != nil {
+		c.statusUpdater.update(s)
+	}
+}
+
+// statusUpdater writes the status of resources that changed since the last write to the store.
+// Writes are spaced by interval to limit the load on the store. While a status is being
+// written, only the status of the latest snapshot is kept, it supersedes the one being written.
+type statusUpdater struct {
+	w        store.StatusWriter
+	interval time.Duration
+
+	mu     sync.Mutex
+	latest *configStatus
+	// notify signals that latest is set.
+	notify chan struct{}
+
+	// written is the resource status last written to the store.
+	written map[store.Key]*ResourceStatus
+	// lastWrite is the time of the last write.
+	lastWrite time.Time
+	// disabled is set once the store reports that it does not support status.
+	disabled bool
+}
+
+func newStatusUpdater(w store.StatusWriter, interval time.Duration) *statusUpdater {
+	return &statusUpdater{
+		w:        w,
+		interval: interval,
+		notify:   make(chan struct{}, 1),
+		written:  make(map[store.Key]*ResourceStatus),
+	}
+}
+
+// start writes status in the background until the store reports that it does not support status.
+func (u *statusUpdater) start() {
+	go func() {
+		for range u.notify {
+			if !u.writePending() {
+				return
+			}
+		}
+	}()
+}
+
+// update replaces the status waiting to be written.
+func (u *statusUpdater) update(s *configStatus) {
+	u.mu.Lock()
+	u.latest = s
+	u.mu.Unlock()
+	select {
+	case u.notify <- struct{}{}:
+	default:
+		// a write is already pending.
+	}
+}
+
+// pending returns the status waiting to be written, if any.
+func (u *statusUpdater) pending() *configStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s := u.latest
+	u.latest = nil
+	return s
+}
+
+// superseded returns true if a newer status is waiting to be written.
+func (u *statusUpdater) superseded() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latest != nil
+}
+
+// writePending writes the status waiting to be written.
+// It returns false if the store does not support status.
+func (u *statusUpdater) writePending() bool {
+	if u.disabled {
+		return false
+	}
+	s := u.pending()
+	if s == nil {
+		return true
+	}
+	for k, rs := range s.resources {
+		if u.superseded() {
+			// the remaining resources are written with the newer status.
+			return true
+		}
+		if reflect.DeepEqual(u.written[k], rs) {
+			continue
+		}
+		if wait := u.interval - time.Since(u.lastWrite); wait > 0 {
+			time.Sleep(wait)
+		}
+		err := u.w.SetStatus(k, resourceStatusMap(rs))
+		u.lastWrite = time.Now()
+		if err == store.ErrStatusNotSupported {
+			glog.Infof("Config store does not support resource status")
+			u.disabled = true
+			return false
+		}
+		if err != nil {
+			glog.Warningf("Unable to write status of %s: %v", k, err)
+			// retry on the next snapshot.
+			delete(u.written, k)
+			continue
+		}
+		u.written[k] = rs
+	}
+	// resources that are no longer in the config are forgotten.
+	for k := range u.written {
+		if _, found := s.resources[k]; !found {
+			delete(u.written, k)
+		}
+	}
+	return true
+}
+
+// resourceStatusMap converts the status to the form stored with the resource.
+func resourceStatusMap(rs *ResourceStatus) map[string]interface{} {
+	m := map[string]interface{}{
+		"state": rs.State,
+	}
+	if len(rs.Reasons) > 0 {
+		reasons := make([]interface{}, 0, len(rs.Reasons))
+		for _, r := range rs.Reasons {
+			reasons = append(reasons, r)
+		}
+		m["reasons"] = reasons
+	}
+	return m
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/mixer/pkg/adapter"
+	cpb "istio.io/mixer/pkg/config/proto"
+	"istio.io/mixer/pkg/config/store"
+	"istio.io/mixer/pkg/expr"
+	"istio.io/mixer/pkg/pool"
+	"istio.io/mixer/pkg/template"
+)
+
+func TestConfigStatus(t *testing.T) {
+	k1 := store.Key{Kind: "rule", Namespace: "ns", Name: "r1"}
+	k2 := store.Key{Kind: "AA", Namespace: "ns", Name: "a1"}
+	s := newConfigStatus(map[store.Key]*store.Resource{k1: {}, k2: {}})
+
+	s.warn(k1, "unknown handler %s", "h1")
+	s.reject(k1, "bad match")
+	s.handlerFailed(k2, "%v", errors.New("connection refused"))
+	// unknown keys are ignored.
+	s.reject(store.Key{Kind: "rule", Name: "unknown"}, "ignored")
+
+	want := []*ResourceStatus{
+		{Kind: "AA", Namespace: "ns", Name: "a1", State: StateHandlerInitFailed, Reasons: []string{"connection refused"}},
+		{Kind: "rule", Namespace: "ns", Name: "r1", State: StateRejected, Reasons: []string{"unknown handler h1", "bad match"}},
+	}
+	ss := s.snapshot(7)
+	if ss.ID != 7 {
+		t.Fatalf("id: got %d, want 7", ss.ID)
+	}
+	if !reflect.DeepEqual(ss.Resources, want) {
+		t.Fatalf("got %v, want %v", ss.Resources, want)
+	}
+
+	// nil status is a no-op.
+	var ns *configStatus
+	ns.reject(k1, "ignored")
+}
+
+type fstatusWriter struct {
+	status map[store.Key]map[string]interface{}
+	writes int
+	err    error
+}
+
+func (f *fstatusWriter) SetStatus(key store.Key, status map[string]interface{}) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.writes++
+	f.status[key] = status
+	return nil
+}
+
+func TestController_Status(t *testing.T) {
+	ns := DefaultConfigNamespace
+	configState := map[store.Key]*store.Resource{
+		{RulesKind, ns, "r1"}: {Spec: &cpb.Rule{
+			Actions: []*cpb.Action{{Handler: "a1.AA", Instances: []string{"m1.metric"}}},
+		}},
+		{RulesKind, ns, "r2"}: {
+			Metadata: store.ResourceMeta{Labels: map[string]string{istioPriority: "high"}},
+			Spec:     &cpb.Rule{},
+		},
+		{RulesKind, ns, "r3"}: {Spec: &cpb.Rule{
+			Actions: []*cpb.Action{
+				{Handler: "a2.AA", Instances: []string{"m1.metric"}},
+				{Handler: "missing.AA", Instances: []string{"m1.metric"}},
+			},
+		}},
+		{"metric", ns, "m1"}: {Spec: &wrappers.StringValue{Value: "metric1_config"}},
+		{"AA", ns, "a1"}:     {Spec: &wrappers.StringValue{Value: "a1_config"}},
+		{"AA", ns, "a2"}:     {Spec: &wrappers.StringValue{Value: "a2_config"}},
+	}
+	fb := &fhtbuilder{
+		built:    make(map[string]int),
+		handlers: make(map[string]*fhandler),
+		errs:     map[string]error{"a1.AA." + ns: errors.New("connection refused")},
+	}
+	sw := &fstatusWriter{status: make(map[store.Key]map[string]interface{})}
+	c := &Controller{
+		adapterInfo:            map[string]*adapter.Info{"AA": {Name: "AA"}},
+		templateInfo:           map[string]template.Info{"metric": {Name: "metric"}},
+		configState:            configState,
+		dispatcher:             &fakedispatcher{},
+		resolver:               &resolver{},
+		identityAttribute:      DefaultIdentityAttribute,
+		defaultConfigNamespace: ns,
+		statusUpdater:          newStatusUpdater(sw, 0),
+		createHandlerFactory: func(templateInfo map[string]template.Info, expr expr.TypeChecker,
+			df expr.AttributeDescriptorFinder, builderInfo map[string]*adapter.Info) HandlerFactory {
+			return fb
+		},
+	}
+	if c.Status() != nil {
+		t.Fatalf("status before the first snapshot: got %v, want nil", c.Status())
+	}
+
+	c.publishSnapShot()
+	c.statusUpdater.writePending()
+
+	want := map[store.Key]*ResourceStatus{
+		{RulesKind, ns, "r1"}: {State: StateRejected, Reasons: []string{
+			"handler a1.AA.istio-system could not be initialized",
+			"rule has no actions that can be dispatched",
+		}},
+		{RulesKind, ns, "r2"}: {State: StateRejected, Reasons: []string{
+			`invalid istio-priority label 'high': strconv.Atoi: parsing "high": invalid syntax`,
+		}},
+		{RulesKind, ns, "r3"}: {State: StateAccepted, Reasons: []string{"unknown handler missing.AA.istio-system"}},
+		{"metric", ns, "m1"}:  {State: StateAccepted},
+		{"AA", ns, "a1"}:      {State: StateHandlerInitFailed, Reasons: []string{"connection refused"}},
+		{"AA", ns, "a2"}:      {State: StateAccepted},
+	}
+	ss := c.Status()
+	if len(ss.Resources) != len(want) {
+		t.Fatalf("got %d resources, want %d", len(ss.Resources), len(want))
+	}
+	for _, rs := range ss.Resources {
+		k := store.Key{Kind: rs.Kind, Namespace: rs.Namespace, Name: rs.Name}
+		w := want[k]
+		if rs.State != w.State || !reflect.DeepEqual(rs.Reasons, w.Reasons) {
+			t.Errorf("%s: got %s %v, want %s %v", k, rs.State, rs.Reasons, w.State, w.Reasons)
+		}
+		if !reflect.DeepEqual(sw.status[k], resourceStatusMap(rs)) {
+			t.Errorf("%s: written %v, want %v", k, sw.status[k], resourceStatusMap(rs))
+		}
+	}
+	if sw.writes != len(want) {
+		t.Fatalf("writes: got %d, want %d", sw.writes, len(want))
+	}
+
+	// only changed status is written.
+	c.applyEvents([]*store.Event{
+		{Key: store.Key{RulesKind, ns, "r2"}, Value: &store.Resource{Spec: &cpb.Rule{
+			Actions: []*cpb.Action{{Handler: "a2.AA", Instances: []string{"m1.metric"}}},
+		}}},
+	})
+	c.statusUpdater.writePending()
+	if sw.writes != len(want)+1 {
+		t.Fatalf("writes: got %d, want %d", sw.writes, len(want)+1)
+	}
+	if st := sw.status[store.Key{RulesKind, ns, "r2"}]; st["state"] != StateAccepted {
+		t.Fatalf("r2 status: got %v, want %s", st, StateAccepted)
+	}
+
+	// writing stops if the store does not support status.
+	sw.err = store.ErrStatusNotSupported
+	c.applyEvents([]*store.Event{
+		{Key: store.Key{RulesKind, ns, "r2"}, Type: store.Delete},
+		{Key: store.Key{RulesKind, ns, "r1"}, Value: &store.Resource{Spec: &cpb.Rule{
+			Actions: []*cpb.Action{{Handler: "a2.AA", Instances: []string{"m1.metric"}}},
+		}}},
+	})
+	if c.statusUpdater.writePending() {
+		t.Fatalf("status writer was not disabled")
+	}
+
+	// status is served by the debug endpoint.
+	gp := pool.NewGoroutinePool(1, true)
+	defer gp.Close()
+	d := newDispatcher(nil, nil, gp, DefaultBreakerConfig())
+	dh := DebugHandler(d)
+	w := httptest.NewRecorder()
+	dh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DebugPath+"config", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	d.controller = c
+	w = httptest.NewRecorder()
+	dh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DebugPath+"config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var got SnapshotStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unable to unmarshal %s: %v", w.Body.String(), err)
+	}
+	if got.ID != c.Status().ID || len(got.Resources) != len(want)-1 {
+		t.Fatalf("got snapshot %d with %d resources, want %d with %d", got.ID, len(got.Resources), c.Status().ID, len(want)-1)
+	}
+}
+
+func TestStatusUpdater(t *testing.T) {
+	k1 := store.Key{Kind: RulesKind, Namespace: "ns", Name: "r1"}
+	k2 := store.Key{Kind: RulesKind, Namespace: "ns", Name: "r2"}
+	configState := map[store.Key]*store.Resource{k1: {}, k2: {}}
+
+	sw := &fstatusWriter{status: make(map[store.Key]map[string]interface{})}
+	interval := 20 * time.Millisecond
+	u := newStatusUpdater(sw, interval)
+
+	// only the latest status is written.
+	s1 := newConfigStatus(configState)
+	s1.reject(k1, "first")
+	u.update(s1)
+	s2 := newConfigStatus(configState)
+	s2.reject(k1, "second")
+	u.update(s2)
+
+	start := time.Now()
+	if !u.writePending() {
+		t.Fatalf("status writer was disabled")
+	}
+	if sw.writes != 2 {
+		t.Fatalf("writes: got %d, want 2", sw.writes)
+	}
+	if st := sw.status[k1]; !reflect.DeepEqual(st["reasons"], []interface{}{"second"}) {
+		t.Fatalf("got %v, want the latest status", st)
+	}
+	// writes are spaced by the interval.
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Fatalf("2 writes took %v, want at least %v", elapsed, interval)
+	}
+
+	// nothing is pending.
+	if !u.writePending() || sw.writes != 2 {
+		t.Fatalf("writes: got %d, want 2", sw.writes)
+	}
+
+	// unchanged status is not written again.
+	u.update(newConfigStatus(configState))
+	u.writePending()
+	s3 := newConfigStatus(configState)
+	s3.reject(k1, "second")
+	u.update(s3)
+	u.writePending()
+	if sw.writes != 4 {
+		t.Fatalf("writes: got %d, want 4", sw.writes)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+
+	"istio.io/mixer/pkg/adapter"
+	cpb "istio.io/mixer/pkg/config/proto"
+	"istio.io/mixer/pkg/config/store"
+	"istio.io/mixer/pkg/expr"
+	"istio.io/mixer/pkg/template"
+)
+
+// Validator validates config changes with the checks that are applied when a snapshot is published:
+// attribute manifest lookup, instance type inference, handler validation and rule processing.
+// A change is invalid if it leaves a resource rejected that is not rejected without the change,
+// so that problems already present in the config state do not block unrelated changes.
+// Only the resources affected by a change are checked: the changed resource, the rules
+// that refer to it, and the handlers and instances of those rules.
+type Validator struct {
+	adapterInfo  map[string]*adapter.Info
+	templateInfo map[string]template.Info
+	typeChecker  expr.TypeChecker
+	kinds        map[string]proto.Message
+
+	// list returns the current config state.
+	list func() map[store.Key]*store.Resource
+}
+
+var _ store.Validator = &Validator{}
+
+// ValidationErrors is the status of the resources that a change leaves rejected.
+type ValidationErrors []*ResourceStatus
+
+// Error implements error interface.
+func (e ValidationErrors) Error() string {
+	var b bytes.Buffer
+	for i, rs := range e {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "%s %s.%s %s: %s", rs.Kind, rs.Name, rs.Namespace, rs.State, strings.Join(rs.Reasons, ", "))
+	}
+	return b.String()
+}
+
+// NewValidator creates a Validator of changes to the config state of s.
+// s must already be initialized, as done by New.
+func NewValidator(s store.Store2, typeChecker expr.TypeChecker, adapterInfo map[string]*adapter.Info,
+	templateInfo map[string]template.Info) *Validator {
+	return &Validator{
+		adapterInfo:  adapterInfo,
+		templateInfo: templateInfo,
+		typeChecker:  typeChecker,
+		kinds:        kindMap(adapterInfo, templateInfo),
+		list:         s.List,
+	}
+}
+
+// Kinds returns the config kinds known to the validator, mapped to their proto messages.
+func (v *Validator) Kinds() map[string]proto.Message {
+	return v.kinds
+}
+
+// Validate implements store.Validator interface.
+// The error is ValidationErrors if the change is invalid.
+func (v *Validator) Validate(ev *store.Event) error {
+	if _, ok := v.kinds[ev.Kind]; !ok {
+		return ValidationErrors{rejected(ev.Key, "unknown kind %s", ev.Kind)}
+	}
+	if ev.Type == store.Update && (ev.Value == nil || ev.Value.Spec == nil) {
+		return ValidationErrors{rejected(ev.Key, "missing spec")}
+	}
+
+	current := v.list()
+	affected := affectedKeys(current, ev)
+	before := restrict(current, affected)
+	after := restrict(current, affected)
+	switch ev.Type {
+	case store.Update:
+		// the spec is modified in place while rules are processed.
+		after[ev.Key] = &store.Resource{Metadata: ev.Value.Metadata, Spec: proto.Clone(ev.Value.Spec)}
+	case store.Delete:
+		delete(after, ev.Key)
+	}
+
+	beforeStatus := v.check(before)
+	afterStatus := v.check(after)
+	var errs ValidationErrors
+	for k, rs := range afterStatus.resources {
+		if !isRejected(rs) {
+			continue
+		}
+		if k != ev.Key && isRejected(beforeStatus.resources[k]) {
+			continue
+		}
+		errs = append(errs, rs)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Kind+"/"+errs[i].Namespace+"/"+errs[i].Name < errs[j].Kind+"/"+errs[j].Namespace+"/"+errs[j].Name
+	})
+	return errs
+}
+
+// affectedKeys returns the keys of the resources whose status may change with the event:
+// the changed resource, the rules that refer to it before or after the change, and
+// the handlers and instances of those rules. It returns nil if all resources are affected,
+// as attribute manifests are used by every instance.
+func affectedKeys(current map[store.Key]*store.Resource, ev *store.Event) map[store.Key]bool {
+	if ev.Kind == AttributeManifestKind {
+		return nil
+	}
+	keys := map[store.Key]bool{ev.Key: true}
+	addRule := func(k store.Key, r *store.Resource) {
+		keys[k] = true
+		for _, ref := range ruleReferences(k, r) {
+			keys[ref] = true
+		}
+	}
+	if ev.Kind == RulesKind {
+		if r, ok := current[ev.Key]; ok {
+			addRule(ev.Key, r)
+		}
+		if ev.Type == store.Update {
+			addRule(ev.Key, ev.Value)
+		}
+		return keys
+	}
+	for k, r := range current {
+		if k.Kind != RulesKind {
+			continue
+		}
+		for _, ref := range ruleReferences(k, r) {
+			if ref == ev.Key {
+				addRule(k, r)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// ruleReferences returns the keys of the handlers and instances that the rule refers to,
+// including the handlers of its handler splits.
+func ruleReferences(k store.Key, r *store.Resource) []store.Key {
+	rule, ok := r.Spec.(*cpb.Rule)
+	if !ok {
+		return nil
+	}
+	var refs []store.Key
+	add := func(name string) {
+		if !isFQN(name) {
+			name = name + "." + k.Namespace
+		}
+		if ref, ok := keyFromFQN(name); ok {
+			refs = append(refs, ref)
+		}
+	}
+	for _, act := range rule.Actions {
+		add(act.Handler)
+		for _, in := range act.Instances {
+			add(in)
+		}
+	}
+	// invalid splits reject the rule, whatever the handlers.
+	splits, _ := parseHandlerSplits(r.Metadata.Annotations, k.Namespace)
+	for _, s := range splits {
+		for _, h := range s.handlers {
+			add(h)
+		}
+	}
+	return refs
+}
+
+// restrict returns the resources of the config state with the given keys, and
+// the attribute manifests. All resources are returned if keys is nil.
+func restrict(configState map[store.Key]*store.Resource, keys map[store.Key]bool) map[store.Key]*store.Resource {
+	out := make(map[store.Key]*store.Resource, len(keys)+1)
+	for k, r := range configState {
+		if keys == nil || keys[k] || k.Kind == AttributeManifestKind {
+			out[k] = r
+		}
+	}
+	return out
+}
+
+// check returns the status of the resources of the config state, as computed by publishSnapShot.
+// Handlers are validated but not built.
+func (v *Validator) check(configState map[store.Key]*store.Resource) *configStatus {
+	c := &Controller{
+		adapterInfo:  v.adapterInfo,
+		templateInfo: v.templateInfo,
+		configState:  configState,
+		status:       newConfigStatus(configState),
+		dryRun:       true,
+	}
+	attributes := c.processAttributeManifests()
+	handlerConfig := c.validHandlerConfigs()
+	instanceConfig := c.validInstanceConfigs()
+	hf := newHandlerFactory(v.templateInfo, v.typeChecker, attributes, v.adapterInfo).(*handlerFactory)
+
+	// instances are checked whether or not a rule uses them.
+	for name, inst := range instanceConfig {
+		if _, err := hf.inferType(inst); err != nil {
+			k, _ := keyFromFQN(name)
+			c.status.reject(k, "%v", err)
+		}
+	}
+
+	ht := newHandlerTable(instanceConfig, handlerConfig, nil)
+	ruleConfig := c.processRules(handlerConfig, instanceConfig, ht)
+	for name, he := range ht.table {
+		instances := make([]*cpb.Instance, 0, len(he.Instances))
+		for in := range he.Instances {
+			instances = append(instances, instanceConfig[in])
+		}
+		if err := hf.Validate(handlerConfig[name], instances); err != nil {
+			he.HandlerCreateError = err
+			if k, ok := keyFromFQN(name); ok {
+				c.status.handlerFailed(k, "%v", err)
+			}
+			continue
+		}
+		he.Handler = validatedHandler{}
+	}
+
+	// rules are rejected if none of their actions can be dispatched.
+	generateResolvedRules(ruleConfig, ht.table, c.status)
+	return c.status
+}
+
+// validatedHandler stands for handlers that pass validation.
+type validatedHandler struct{}
+
+// Close implements adapter.Handler interface.
+func (validatedHandler) Close() error { return nil }
+
+// isRejected returns true if the resource is not part of the snapshot, or its handler fails.
+func isRejected(rs *ResourceStatus) bool {
+	return rs != nil && rs.State != StateAccepted
+}
+
+// rejected returns the status of a resource rejected for the given reason.
+func rejected(k store.Key, format string, args ...interface{}) *ResourceStatus {
+	return &ResourceStatus{
+		Kind:      k.Kind,
+		Namespace: k.Namespace,
+		Name:      k.Name,
+		State:     StateRejected,
+		Reasons:   []string{fmt.Sprintf(format, args...)},
+	}
+}
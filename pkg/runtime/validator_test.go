@@ -0,0 +1,316 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	pbd "istio.io/api/mixer/v1/config/descriptor"
+	"istio.io/mixer/pkg/adapter"
+	cpb "istio.io/mixer/pkg/config/proto"
+	"istio.io/mixer/pkg/config/store"
+	"istio.io/mixer/pkg/expr"
+	"istio.io/mixer/pkg/template"
+)
+
+// attrTypeChecker evaluates expressions that are attribute names.
+type attrTypeChecker struct{}
+
+func (attrTypeChecker) EvalType(ex string, finder expr.AttributeDescriptorFinder) (pbd.ValueType, error) {
+	a := finder.GetAttribute(ex)
+	if a == nil {
+		return pbd.VALUE_TYPE_UNSPECIFIED, fmt.Errorf("unknown attribute %s", ex)
+	}
+	return a.ValueType, nil
+}
+
+func (c attrTypeChecker) AssertType(ex string, finder expr.AttributeDescriptorFinder, expectedType pbd.ValueType) error {
+	if t, err := c.EvalType(ex, finder); err != nil {
+		return err
+	} else if t != expectedType {
+		return fmt.Errorf("expression '%s' evaluated to type %v, expected type %v", ex, t, expectedType)
+	}
+	return nil
+}
+
+// checkedBuilder rejects the adapter config "bad".
+type checkedBuilder struct {
+	cfg adapter.Config
+}
+
+func (b *checkedBuilder) SetAdapterConfig(cfg adapter.Config) { b.cfg = cfg }
+
+func (b *checkedBuilder) Validate() (ce *adapter.ConfigErrors) {
+	if b.cfg.(*wrappers.StringValue).Value == "bad" {
+		ce = ce.Append("value", errors.New("bad config"))
+	}
+	return ce
+}
+
+func (b *checkedBuilder) Build(context.Context, adapter.Env) (adapter.Handler, error) {
+	panic("handlers must not be built during validation")
+}
+
+func newTestValidator(configState map[store.Key]*store.Resource) *Validator {
+	adapterInfo := map[string]*adapter.Info{
+		"AA": {
+			Name:               "AA",
+			NewBuilder:         func() adapter.HandlerBuilder { return &checkedBuilder{} },
+			SupportedTemplates: []string{"metric"},
+			DefaultConfig:      &wrappers.StringValue{},
+		},
+	}
+	templateInfo := map[string]template.Info{
+		"metric": {
+			Name:   "metric",
+			CtrCfg: &wrappers.StringValue{},
+			InferType: func(p proto.Message, tef template.TypeEvalFn) (proto.Message, error) {
+				if _, err := tef(p.(*wrappers.StringValue).Value); err != nil {
+					return nil, err
+				}
+				return &wrappers.StringValue{}, nil
+			},
+			SetType:                 func(map[string]proto.Message, adapter.HandlerBuilder) {},
+			BuilderSupportsTemplate: func(adapter.HandlerBuilder) bool { return true },
+			HandlerSupportsTemplate: func(adapter.Handler) bool { return true },
+		},
+	}
+	return &Validator{
+		adapterInfo:  adapterInfo,
+		templateInfo: templateInfo,
+		typeChecker:  attrTypeChecker{},
+		kinds:        kindMap(adapterInfo, templateInfo),
+		list: func() map[store.Key]*store.Resource {
+			result := make(map[store.Key]*store.Resource, len(configState))
+			for k, r := range configState {
+				result[k] = &store.Resource{Metadata: r.Metadata, Spec: proto.Clone(r.Spec)}
+			}
+			return result
+		},
+	}
+}
+
+func TestValidator(t *testing.T) {
+	ns := DefaultConfigNamespace
+	manifest := store.Key{Kind: AttributeManifestKind, Namespace: ns, Name: "attrs"}
+	rule := store.Key{Kind: RulesKind, Namespace: ns, Name: "r1"}
+	metric := store.Key{Kind: "metric", Namespace: ns, Name: "m1"}
+	handler := store.Key{Kind: "AA", Namespace: ns, Name: "a1"}
+	broken := store.Key{Kind: RulesKind, Namespace: ns, Name: "broken"}
+	configState := map[store.Key]*store.Resource{
+		manifest: {Spec: &cpb.AttributeManifest{
+			Attributes: map[string]*cpb.AttributeManifest_AttributeInfo{
+				"source.name": {ValueType: pbd.STRING},
+			},
+		}},
+		rule: {Spec: &cpb.Rule{
+			Actions: []*cpb.Action{{Handler: "a1.AA", Instances: []string{"m1.metric"}}},
+		}},
+		metric:  {Spec: &wrappers.StringValue{Value: "source.name"}},
+		handler: {Spec: &wrappers.StringValue{Value: "good"}},
+		// problems of the current config state do not block other changes.
+		broken: {
+			Metadata: store.ResourceMeta{Labels: map[string]string{istioPriority: "x"}},
+			Spec: &cpb.Rule{
+				Actions: []*cpb.Action{{Handler: "a1.AA", Instances: []string{"m1.metric"}}},
+			},
+		},
+	}
+	v := newTestValidator(configState)
+
+	for _, tc := range []struct {
+		name string
+		ev   *store.Event
+		want []string
+	}{
+		{"valid handler",
+			&store.Event{Key: handler, Type: store.Update, Value: &store.Resource{Spec: &wrappers.StringValue{Value: "other"}}},
+			nil},
+		{"invalid handler",
+			&store.Event{Key: handler, Type: store.Update, Value: &store.Resource{Spec: &wrappers.StringValue{Value: "bad"}}},
+			[]string{"AA a1.istio-system HandlerInitFailed", "bad config"}},
+		{"unknown attribute",
+			&store.Event{Key: metric, Type: store.Update, Value: &store.Resource{Spec: &wrappers.StringValue{Value: "target.name"}}},
+			[]string{"metric m1.istio-system Rejected", "unknown attribute target.name"}},
+		{"attribute removed",
+			&store.Event{Key: manifest, Type: store.Delete},
+			[]string{"metric m1.istio-system Rejected", "unknown attribute source.name"}},
+		{"invalid label",
+			&store.Event{Key: store.Key{Kind: RulesKind, Namespace: ns, Name: "r2"}, Type: store.Update,
+				Value: &store.Resource{
+					Metadata: store.ResourceMeta{Labels: map[string]string{istioShadow: "x"}},
+					Spec:     &cpb.Rule{Actions: []*cpb.Action{{Handler: "a1.AA", Instances: []string{"m1.metric"}}}},
+				}},
+			[]string{"rule r2.istio-system Rejected", "invalid istio-shadow label"}},
+		{"no actions",
+			&store.Event{Key: store.Key{Kind: RulesKind, Namespace: ns, Name: "r3"}, Type: store.Update,
+				Value: &store.Resource{Spec: &cpb.Rule{Actions: []*cpb.Action{{Handler: "unknown.AA", Instances: []string{"m1.metric"}}}}}},
+			[]string{"unknown handler unknown.AA.istio-system", "rule has no actions"}},
+		{"resubmit broken rule",
+			&store.Event{Key: broken, Type: store.Update, Value: configState[broken]},
+			[]string{"rule broken.istio-system Rejected"}},
+		{"delete rule",
+			&store.Event{Key: rule, Type: store.Delete},
+			nil},
+		{"unknown kind",
+			&store.Event{Key: store.Key{Kind: "unknown", Namespace: ns, Name: "u"}, Type: store.Update,
+				Value: &store.Resource{Spec: &wrappers.StringValue{}}},
+			[]string{"unknown kind unknown"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := v.Validate(tc.ev)
+			if len(tc.want) == 0 {
+				if err != nil {
+					t.Fatalf("Got %v, Want nil", err)
+				}
+				return
+			}
+			if _, ok := err.(ValidationErrors); !ok {
+				t.Fatalf("Got %v, Want ValidationErrors", err)
+			}
+			for _, w := range tc.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("Got %v, Want it to contain %s", err, w)
+				}
+			}
+		})
+	}
+
+	// the proposed spec is not modified.
+	spec := &cpb.Rule{Actions: []*cpb.Action{{Handler: "a1", Instances: []string{"m1"}}}}
+	if err := v.Validate(&store.Event{Key: rule, Type: store.Update, Value: &store.Resource{Spec: spec}}); err != nil {
+		t.Errorf("Got %v, Want nil", err)
+	}
+	if spec.Actions[0].Handler != "a1" {
+		t.Errorf("Got %s, Want the spec unchanged", spec.Actions[0].Handler)
+	}
+}
+
+func TestAffectedKeys(t *testing.T) {
+	ns := DefaultConfigNamespace
+	key := func(kind, name string) store.Key { return store.Key{Kind: kind, Namespace: ns, Name: name} }
+	rule := func(handler string, instance string) *store.Resource {
+		return &store.Resource{Spec: &cpb.Rule{Actions: []*cpb.Action{{Handler: handler, Instances: []string{instance}}}}}
+	}
+	configState := map[store.Key]*store.Resource{
+		key(AttributeManifestKind, "attrs"): {Spec: &cpb.AttributeManifest{}},
+		key(RulesKind, "r1"):                rule("a1.AA", "m1.metric"),
+		key(RulesKind, "r2"):                rule("a2.AA", "m2.metric"),
+		key(RulesKind, "split"): {
+			Metadata: store.ResourceMeta{Annotations: map[string]string{istioHandlerSplit: "a3.AA=50,a4.AA=50"}},
+			Spec:     &cpb.Rule{Actions: []*cpb.Action{{Handler: "a3.AA", Instances: []string{"m3.metric." + ns}}}},
+		},
+		key("AA", "a1"):     {Spec: &wrappers.StringValue{}},
+		key("AA", "a2"):     {Spec: &wrappers.StringValue{}},
+		key("AA", "a3"):     {Spec: &wrappers.StringValue{}},
+		key("AA", "a4"):     {Spec: &wrappers.StringValue{}},
+		key("metric", "m1"): {Spec: &wrappers.StringValue{}},
+		key("metric", "m2"): {Spec: &wrappers.StringValue{}},
+		key("metric", "m3"): {Spec: &wrappers.StringValue{}},
+	}
+
+	for _, tc := range []struct {
+		name string
+		ev   *store.Event
+		want []store.Key
+	}{
+		{"handler",
+			&store.Event{Key: key("AA", "a1"), Type: store.Delete},
+			[]store.Key{key("AA", "a1"), key(RulesKind, "r1"), key("metric", "m1")}},
+		{"instance",
+			&store.Event{Key: key("metric", "m2"), Type: store.Delete},
+			[]store.Key{key("metric", "m2"), key(RulesKind, "r2"), key("AA", "a2")}},
+		{"split handler",
+			&store.Event{Key: key("AA", "a4"), Type: store.Delete},
+			[]store.Key{key("AA", "a4"), key(RulesKind, "split"), key("AA", "a3"), key("metric", "m3")}},
+		{"unreferenced",
+			&store.Event{Key: key("AA", "new"), Type: store.Update, Value: &store.Resource{Spec: &wrappers.StringValue{}}},
+			[]store.Key{key("AA", "new")}},
+		{"rule",
+			&store.Event{Key: key(RulesKind, "r1"), Type: store.Update, Value: rule("a2.AA", "m2.metric")},
+			[]store.Key{key(RulesKind, "r1"), key("AA", "a1"), key("metric", "m1"), key("AA", "a2"), key("metric", "m2")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := make(map[store.Key]bool, len(tc.want))
+			for _, k := range tc.want {
+				want[k] = true
+			}
+			if got := affectedKeys(configState, tc.ev); !reflect.DeepEqual(got, want) {
+				t.Errorf("Got %v, Want %v", got, want)
+			}
+		})
+	}
+
+	// attribute manifests affect all instances.
+	if got := affectedKeys(configState, &store.Event{Key: key(AttributeManifestKind, "attrs"), Type: store.Delete}); got != nil {
+		t.Errorf("Got %v, Want all resources", got)
+	}
+}
+
+// BenchmarkValidator_Validate validates a handler change in config states of growing size.
+// Only the rules of the handler are checked, so the time should grow slowly with the
+// number of unrelated rules.
+func BenchmarkValidator_Validate(b *testing.B) {
+	ns := DefaultConfigNamespace
+	for _, n := range []int{10, 100, 1000} {
+		configState := map[store.Key]*store.Resource{
+			{Kind: AttributeManifestKind, Namespace: ns, Name: "attrs"}: {Spec: &cpb.AttributeManifest{
+				Attributes: map[string]*cpb.AttributeManifest_AttributeInfo{
+					"source.name": {ValueType: pbd.STRING},
+				},
+			}},
+		}
+		for i := 0; i < n; i++ {
+			configState[store.Key{Kind: RulesKind, Namespace: ns, Name: fmt.Sprintf("r%d", i)}] = &store.Resource{Spec: &cpb.Rule{
+				Actions: []*cpb.Action{{Handler: fmt.Sprintf("a%d.AA", i), Instances: []string{fmt.Sprintf("m%d.metric", i)}}},
+			}}
+			configState[store.Key{Kind: "AA", Namespace: ns, Name: fmt.Sprintf("a%d", i)}] = &store.Resource{Spec: &wrappers.StringValue{Value: "good"}}
+			configState[store.Key{Kind: "metric", Namespace: ns, Name: fmt.Sprintf("m%d", i)}] = &store.Resource{Spec: &wrappers.StringValue{Value: "source.name"}}
+		}
+		v := newTestValidator(configState)
+		v.list = func() map[store.Key]*store.Resource { return configState }
+		ev := &store.Event{
+			Key:   store.Key{Kind: "AA", Namespace: ns, Name: "a0"},
+			Type:  store.Update,
+			Value: &store.Resource{Spec: &wrappers.StringValue{Value: "other"}},
+		}
+
+		b.Run(fmt.Sprintf("rules-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := v.Validate(ev); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	err := ValidationErrors{
+		{Kind: "rule", Namespace: "ns", Name: "r1", State: StateRejected, Reasons: []string{"a", "b"}},
+		{Kind: "AA", Namespace: "ns", Name: "a1", State: StateHandlerInitFailed, Reasons: []string{"c"}},
+	}
+	if want := "rule r1.ns Rejected: a, b; AA a1.ns HandlerInitFailed: c"; err.Error() != want {
+		t.Errorf("Got %s, Want %s", err.Error(), want)
+	}
+}
@@ -82,11 +82,19 @@ func IsOK(status rpc.Status) bool {
 // NOTE: if there is an issue marshaling the proto to a google.protobuf.Any,
 // the returned Status message will not have the `details` field populated.
 func InvalidWithDetails(msg string, pb proto.Message) rpc.Status {
-	invalid := WithInvalidArgument(msg)
+	return WithDetails(rpc.INVALID_ARGUMENT, msg, pb)
+}
+
+// WithDetails builds a google.rpc.Status proto with the provided code and
+// message and the `details` field populated with the supplied proto message.
+// NOTE: if there is an issue marshaling the proto to a google.protobuf.Any,
+// the returned Status message will not have the `details` field populated.
+func WithDetails(c rpc.Code, msg string, pb proto.Message) rpc.Status {
+	s := WithMessage(c, msg)
 	if any, err := types.MarshalAny(pb); err == nil {
-		invalid.Details = []*types.Any{any}
+		s.Details = []*types.Any{any}
 	}
-	return invalid
+	return s
 }
 
 // NewBadRequest builds a google.rpc.BadRequest proto. BadRequest proto messages
@@ -77,6 +77,11 @@ func TestStatus(t *testing.T) {
 	if s.Code != int32(rpc.INVALID_ARGUMENT) && s.Message != "Invalid" && len(s.Details) != 1 {
 		t.Errorf("Got %v, expected status with code = rpc.INVALID_ARGUMENT and populated details", s)
 	}
+
+	s = WithDetails(rpc.UNAVAILABLE, "Unavailable", NewBadRequest("test", errors.New("error")))
+	if s.Code != int32(rpc.UNAVAILABLE) || s.Message != "Unavailable" || len(s.Details) != 1 {
+		t.Errorf("Got %v, expected status with code = rpc.UNAVAILABLE and populated details", s)
+	}
 }
 
 func TestNewBadRequest(t *testing.T) {